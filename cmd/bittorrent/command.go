@@ -1,39 +1,64 @@
 package main
 
 import (
-	"bufio"
-	"crypto/rand"
-	"encoding/binary"
+	"context"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
 	"log"
 	"net"
 	"net/http"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/nullxDEADBEEF/bittorrent/internal/bencode"
+	"github.com/nullxDEADBEEF/bittorrent/internal/dht"
+	dl "github.com/nullxDEADBEEF/bittorrent/internal/download"
+	"github.com/nullxDEADBEEF/bittorrent/internal/httpserve"
+	"github.com/nullxDEADBEEF/bittorrent/internal/lsd"
+	magnetlink "github.com/nullxDEADBEEF/bittorrent/internal/manget_link"
+	"github.com/nullxDEADBEEF/bittorrent/internal/mse"
+	"github.com/nullxDEADBEEF/bittorrent/internal/peer"
+	"github.com/nullxDEADBEEF/bittorrent/internal/storage"
 	t "github.com/nullxDEADBEEF/bittorrent/internal/torrent"
+	"github.com/nullxDEADBEEF/bittorrent/internal/tracker"
+	"github.com/nullxDEADBEEF/bittorrent/internal/utp"
+	"github.com/nullxDEADBEEF/bittorrent/pkg/client"
 )
 
-const (
-	BITFIELD_ID         byte = 5
-	INTERESTED_ID       byte = 2
-	UNCHOKE_ID          byte = 1
-	REQUEST_ID          byte = 6
-	PIECE_ID            byte = 7
-	PAYLOAD_BYTES       byte = 17
-	LengthIndexStart    byte = 0
-	LengthIndexEnd      byte = 4
-	PieceIndexStart     byte = 5
-	PieceIndexEnd       byte = 9
-	OffsetIndexStart    byte = 9
-	OffsetIndexEnd      byte = 13
-	BlocksizeIndexStart byte = 13
-	BlocksizeIndexEnd   byte = 17
-	PieceDataStart      byte = 9
-)
+// port we tell trackers we are listening on
+const listenPort = 6881
+
+const handshakeTimeout = 10 * time.Second
+
+// stopped announces are sent on the way out, after the download was cancelled, so they
+// get their own deadline
+const stopAnnounceTimeout = 10 * time.Second
+
+// how long we wait for peers on the local network when trackers and the DHT have none
+const localPeersTimeout = 30 * time.Second
+
+// downloads that did not verify a piece for this long give up
+const stallTimeout = 2 * time.Minute
+
+// clientPeerID identifies us to trackers and peers for the whole session
+var clientPeerID = mustGeneratePeerID()
+
+// encryptionPolicy decides whether peer connections are encrypted, both the ones we make
+// and the ones we accept
+var encryptionPolicy = mse.PolicyPrefer
+
+// transport decides whether we connect to peers over TCP, uTP or race both
+var transport = peer.TransportRace
+
+// sequential downloads pieces in order rather than in the order peers can give them
+var sequential bool
 
 type DownloadConfig struct {
 	TorrentPath string
@@ -42,417 +67,762 @@ type DownloadConfig struct {
 	Concurrency int
 }
 
-func handleDecode(bencodedValue string) string {
+func handleDecode(bencodedValue string) (string, error) {
 	decoder := bencode.NewBencodeDecoder([]byte(bencodedValue))
 	decoded, err := decoder.Decode()
 	if err != nil {
-		fmt.Println(err)
-		return ""
+		return "", err
+	}
+	jsonOutput, err := json.Marshal(decoded)
+	if err != nil {
+		return "", err
 	}
-	jsonOutput, _ := json.Marshal(decoded)
 
-	return string(jsonOutput)
+	return string(jsonOutput), nil
 }
 
-func handleInfo(torrentPath string) {
+// parseTorrent reads a torrent file along with its info dictionary
+func parseTorrent(torrentPath string) (map[string]interface{}, map[string]interface{}, error) {
 	torrent, err := t.ParseTorrentFile(torrentPath)
 	if err != nil {
-		fmt.Println(err)
-		return
+		return nil, nil, err
 	}
 
-	encoder := t.NewTorrentEncoder()
-	torrentInfo := torrent["info"].(map[string]interface{})
-	bencodedInfo := encoder.EncodeTorrentInfo(torrentInfo)
-	infoHash := encoder.CalculateSHA1Hash(bencodedInfo)
-	pieceHashes := encoder.GetTorrentPieceHashes(torrentInfo["pieces"].([]byte))
-
-	fmt.Printf("Tracker URL: %s\nLength: %d\nInfo Hash: %s\nPiece Length: %d\nPiece Hashes:\n",
-		torrent["announce"],
-		torrentInfo["length"],
-		infoHash,
-		torrentInfo["piece length"])
-	encoder.PrintPieceHashes(pieceHashes)
+	torrentInfo, ok := torrent["info"].(map[string]interface{})
+	if !ok {
+		return nil, nil, fmt.Errorf("torrent file has no info dictionary")
+	}
+
+	return torrent, torrentInfo, nil
 }
 
-func handlePeers(torrentPath string) []string {
-	torrent, err := t.ParseTorrentFile(torrentPath)
+func handleInfo(torrentPath string) (*infoResult, error) {
+	torrent, torrentInfo, err := parseTorrent(torrentPath)
 	if err != nil {
-		fmt.Println(err)
-		return []string{}
+		return nil, err
 	}
 
 	encoder := t.NewTorrentEncoder()
-	torrentInfo := torrent["info"].(map[string]interface{})
 	bencodedInfo := encoder.EncodeTorrentInfo(torrentInfo)
-	infoHash := encoder.CalculateSHA1Hash(bencodedInfo)
 
-	peers, err := getPeers(torrent, torrentInfo, infoHash)
+	pieceLength, _ := torrentInfo["piece length"].(int)
+	r := &infoResult{
+		TrackerURL:  t.AnnounceURL(torrent),
+		Name:        t.Name(torrentInfo),
+		Length:      t.Length(torrentInfo),
+		PieceLength: pieceLength,
+		Files:       []infoFile{},
+	}
+	if t.HasV1(torrentInfo) {
+		r.InfoHash = encoder.CalculateSHA1Hash(bencodedInfo)
+		r.PieceHashes = encoder.GetTorrentPieceHashes(torrentInfo["pieces"].([]byte))
+	}
+	if t.HasV2(torrentInfo) {
+		r.InfoHashV2 = encoder.CalculateSHA256Hash(bencodedInfo)
+		for _, file := range t.FileTree(torrentInfo) {
+			r.PiecesRoots = append(r.PiecesRoots, infoRoot{
+				Path:       filepath.Join(file.Path...),
+				PiecesRoot: hex.EncodeToString(file.PiecesRoot[:]),
+			})
+		}
+	}
+
+	// files are listed with the indexes the download command takes
+	files := t.Files(torrentInfo)
+	r.multiFile = len(files) > 1 || len(files) == 1 && len(files[0].Path) > 0
+	for _, file := range files {
+		if file.Pad {
+			continue
+		}
+		path := filepath.Join(file.Path...)
+		if !r.multiFile {
+			path = r.Name
+		}
+		r.Files = append(r.Files, infoFile{Index: len(r.Files), Path: path, Length: file.Length})
+	}
+
+	return r, nil
+}
+
+// handlePeers returns the peers of a torrent, ErrNoPeers when there are none
+func handlePeers(ctx context.Context, torrentPath string) ([]tracker.Peer, error) {
+	torrent, torrentInfo, err := parseTorrent(torrentPath)
 	if err != nil {
-		fmt.Println(err)
-		return []string{}
+		return nil, err
 	}
 
-	return peers
+	infoHash := t.SwarmInfoHash(torrentInfo)
+	return getPeers(ctx, torrent, torrentInfo, infoHash)
 }
 
-func handleHandshake(torrentPath string, peerIP string) (net.Conn, string) {
-	conn, err := net.Dial("tcp", peerIP)
+func handleScrape(ctx context.Context, torrentPath string) (*scrapeResult, error) {
+	torrent, torrentInfo, err := parseTorrent(torrentPath)
 	if err != nil {
-		fmt.Println(err)
-		return nil, ""
+		return nil, err
 	}
 
-	torrent, err := t.ParseTorrentFile(torrentPath)
+	infoHash := t.SwarmInfoHash(torrentInfo)
+	infoHashBytes, err := hex.DecodeString(infoHash)
 	if err != nil {
-		fmt.Println(err)
-		return nil, ""
+		return nil, err
 	}
 
-	torrentInfo := torrent["info"].(map[string]interface{})
-	encoder := t.NewTorrentEncoder()
-	bencodedInfo := encoder.EncodeTorrentInfo(torrentInfo)
-	infoHash := encoder.CalculateSHA1Hash(bencodedInfo)
+	var infoHashArray [20]byte
+	copy(infoHashArray[:], infoHashBytes)
+
+	trackerURL, results, err := trackerListFor(torrent, infoHash).Scrape(ctx, [][20]byte{infoHashArray})
+	if err != nil {
+		return nil, err
+	}
 
-	handshake := make([]byte, 0)
-	handshake = append(handshake, byte(19))
-	handshake = append(handshake, []byte("BitTorrent protocol")...)
-	handshake = append(handshake, make([]byte, 8)...)
+	return &scrapeResult{
+		TrackerURL: trackerURL,
+		Complete:   results[0].Complete,
+		Incomplete: results[0].Incomplete,
+		Downloaded: results[0].Downloaded,
+	}, nil
+}
 
+func handleHandshake(ctx context.Context, torrentPath string, peerIP string) (*peer.Conn, error) {
+	_, torrentInfo, err := parseTorrent(torrentPath)
+	if err != nil {
+		return nil, err
+	}
+
+	infoHash := t.SwarmInfoHash(torrentInfo)
 	infoHashBytes, err := hex.DecodeString(infoHash)
 	if err != nil {
-		fmt.Println(err)
-		return nil, ""
+		return nil, err
 	}
-	handshake = append(handshake, infoHashBytes...)
+	handshake := &peer.Handshake{}
+	handshake.SetExtensions()
+	if t.HasV2(torrentInfo) {
+		handshake.SetV2()
+	}
+	copy(handshake.InfoHash[:], infoHashBytes)
+	handshake.PeerID = clientPeerID
 
-	handshake = append(handshake, generatePeerID()...)
+	// a single handshake does not need the well known port
+	socket := openUTP(":0")
+	if socket != nil {
+		defer socket.Close()
+	}
 
-	conn.Write(handshake)
+	dialer := &peer.Dialer{Encryption: encryptionPolicy, Transport: transport, UTP: socket, Timeout: handshakeTimeout}
+	conn, err := dialer.DialContext(ctx, peerIP, handshake)
+	if err != nil {
+		return nil, err
+	}
 
-	handshakeLength := 68
-	response := make([]byte, handshakeLength)
-	_, err = conn.Read(response)
+	return conn, nil
+}
+
+// tracker lists are kept per info hash so the tracker that answered last is tried first
+// on the next announce
+var (
+	trackerListsMu sync.Mutex
+	trackerLists   = make(map[string]*tracker.TrackerList)
+)
+
+func trackerListFor(torrent map[string]interface{}, infoHash string) *tracker.TrackerList {
+	trackerListsMu.Lock()
+	defer trackerListsMu.Unlock()
+
+	list, ok := trackerLists[infoHash]
+	if !ok {
+		list = tracker.NewTrackerList(t.AnnounceTiers(torrent))
+		trackerLists[infoHash] = list
+	}
+
+	return list
+}
+
+// newAnnouncer sets up the announce lifecycle of a torrent, stats reports our transfer
+// counters to the trackers
+func newAnnouncer(torrent map[string]interface{}, infoHash string, stats func() tracker.Stats) (*tracker.Announcer, error) {
+	infoHashBytes, err := hex.DecodeString(infoHash)
 	if err != nil {
-		fmt.Println(err)
-		return nil, ""
+		return nil, err
 	}
 
-	peerIDInHandshake := response[48:]
+	var infoHashArray [20]byte
+	copy(infoHashArray[:], infoHashBytes)
 
-	return conn, hex.EncodeToString(peerIDInHandshake)
+	announcer := tracker.NewAnnouncer(trackerListFor(torrent, infoHash), infoHashArray, clientPeerID, listenPort, stats)
+	if addr, ok := tracker.LocalIPv6(); ok {
+		announcer.SetIPv6(addr)
+	}
+
+	return announcer, nil
 }
 
-func getPeers(torrent map[string]interface{}, torrentInfo map[string]interface{}, infoHash string) ([]string, error) {
-	encodedInfoHash := encodeInfoHash(infoHash)
+// getPeers announces that we joined the swarm to get a list of peers, and that we left
+// once we got it
+func getPeers(ctx context.Context, torrent map[string]interface{}, torrentInfo map[string]interface{}, infoHash string) ([]tracker.Peer, error) {
+	left := int64(t.Length(torrentInfo))
+	announcer, err := newAnnouncer(torrent, infoHash, func() tracker.Stats {
+		return tracker.Stats{Left: left}
+	})
+	if err != nil {
+		return nil, err
+	}
 
-	req, err := http.NewRequest("GET", torrent["announce"].(string), nil)
+	peers, _, err := startAnnounce(ctx, torrent, torrentInfo, infoHash, announcer)
 	if err != nil {
 		return nil, err
 	}
 
-	rawQuery := fmt.Sprintf("info_hash=%s&peer_id=99999999999999999999&port=6881&uploaded=0&downloaded=0&left=%d&compact=1",
-		encodedInfoHash,
-		torrentInfo["length"])
-	req.URL.RawQuery = rawQuery
+	stopAnnouncer(announcer)
+
+	if len(peers) == 0 {
+		return nil, dl.ErrNoPeers
+	}
+	return peers, nil
+}
+
+// stopAnnouncer tells the trackers we left the swarm, whether or not we were cancelled
+func stopAnnouncer(announcer *tracker.Announcer) {
+	ctx, cancel := context.WithTimeout(context.Background(), stopAnnounceTimeout)
+	defer cancel()
+
+	if err := announcer.Stop(ctx); err != nil {
+		log.Printf("Failed to send stopped announce: %v", err)
+	}
+}
+
+// startAnnounce sends the started announce and falls back to the DHT when the trackers
+// are unreachable or do not know any peers, unless the torrent is private
+func startAnnounce(ctx context.Context, torrent map[string]interface{}, torrentInfo map[string]interface{}, infoHash string, announcer *tracker.Announcer) ([]tracker.Peer, dl.Source, error) {
+	resp, err := announcer.Start(ctx)
+	if err == nil {
+		if resp.Warning != "" {
+			log.Printf("Tracker warning: %s", resp.Warning)
+		}
+		if len(resp.Peers) > 0 {
+			return resp.Peers, dl.SourceTracker, nil
+		}
+	}
 
-	resp, err := http.Get(req.URL.String())
+	if t.IsPrivate(torrentInfo) {
+		if err != nil {
+			return nil, dl.SourceTracker, err
+		}
+		return resp.Peers, dl.SourceTracker, nil
+	}
+
+	if ctx.Err() != nil {
+		return nil, dl.SourceTracker, ctx.Err()
+	}
+	if err != nil {
+		log.Printf("Failed to announce, falling back to DHT: %v", err)
+	}
+
+	peers, dhtErr := getPeersFromDHT(ctx, torrent, infoHash)
+	if dhtErr != nil && err != nil {
+		// keep the tracker error, a tracker refusing us tells more than the DHT failing
+		return nil, dl.SourceDHT, fmt.Errorf("%w, DHT lookup failed: %w", err, dhtErr)
+	}
+	return peers, dl.SourceDHT, dhtErr
+}
+
+// getPeersFromDHT joins the DHT, bootstrapping from the torrent's nodes and the default
+// routers, and looks up peers for the info hash. The routing table is kept in the user
+// cache directory so following runs do not start from scratch. Cancelling ctx closes the
+// node, which ends the lookup
+func getPeersFromDHT(ctx context.Context, torrent map[string]interface{}, infoHash string) ([]tracker.Peer, error) {
+	infoHashBytes, err := hex.DecodeString(infoHash)
 	if err != nil {
 		return nil, err
 	}
-	defer resp.Body.Close()
 
-	body, err := io.ReadAll(resp.Body)
+	config := dht.DefaultConfig()
+	config.Addr = fmt.Sprintf(":%d", listenPort)
+	config.BootstrapNodes = append(t.DHTNodes(torrent), config.BootstrapNodes...)
+	if cacheDir, err := os.UserCacheDir(); err == nil {
+		config.StateFile = filepath.Join(cacheDir, "bittorrent", "dht.json")
+	}
+
+	server, err := dht.NewServer(config)
 	if err != nil {
+		// the port may be taken by another client, any port will do for lookups
+		config.Addr = ":0"
+		server, err = dht.NewServer(config)
+		if err != nil {
+			return nil, err
+		}
+	}
+	defer server.Close()
+	stop := context.AfterFunc(ctx, func() {
+		server.Close()
+	})
+	defer stop()
+
+	if err := server.Bootstrap(); err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
 		return nil, err
 	}
 
-	decoder := bencode.NewBencodeDecoder(body)
-	decoded, err := decoder.Decode()
+	var infoHashArray [20]byte
+	copy(infoHashArray[:], infoHashBytes)
+
+	addrs, err := server.GetPeers(infoHashArray)
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
 	if err != nil {
 		return nil, err
 	}
 
-	return parsePeers(decoded.(map[string]interface{})["peers"].([]byte)), nil
+	peers := make([]tracker.Peer, 0, len(addrs))
+	for _, addr := range addrs {
+		peers = append(peers, tracker.Peer{Addr: addr})
+	}
+
+	return peers, nil
 }
 
-func encodeInfoHash(infoHash string) string {
-	var encodedInfoHash string
+// startLocalDiscovery announces the torrent on the local network (BEP 14) and reports the
+// peers that announce it too
+func startLocalDiscovery(infoHash string, onPeer func(netip.AddrPort)) (*lsd.Service, error) {
+	infoHashBytes, err := hex.DecodeString(infoHash)
+	if err != nil {
+		return nil, err
+	}
 
-	// Convert hex string to bytes and encode each byte
-	for i := 0; i < len(infoHash); i += 2 {
-		var byteVal byte
-		// Convert each pair of hex chars to a byte
-		fmt.Sscanf(infoHash[i:i+2], "%02x", &byteVal)
-		encodedInfoHash += fmt.Sprintf("%%%02x", byteVal)
+	config := lsd.DefaultConfig()
+	config.Port = listenPort
+	service, err := lsd.NewService(config)
+	if err != nil {
+		return nil, err
 	}
-	return encodedInfoHash
+
+	var infoHashArray [20]byte
+	copy(infoHashArray[:], infoHashBytes)
+	service.Add(infoHashArray, onPeer)
+
+	return service, nil
 }
 
-func parsePeers(peersBytes []byte) []string {
-	peers := make([]string, 0)
-	ipWithPortInBytes := 6
-	for i := 0; i < len(peersBytes); i += ipWithPortInBytes {
-		ip := fmt.Sprintf("%d.%d.%d.%d", peersBytes[i], peersBytes[i+1], peersBytes[i+2], peersBytes[i+3])
-		port := binary.BigEndian.Uint16(peersBytes[i+4 : i+6])
-		peers = append(peers, fmt.Sprintf("%s:%d", ip, port))
+// openUTP opens the socket uTP connections are made from and accepted on, it returns nil
+// when only TCP is used or the socket can not be opened
+func openUTP(addr string) *utp.Socket {
+	if transport == peer.TransportTCP {
+		return nil
 	}
-	return peers
-}
 
-func generatePeerID() []byte {
-	peerID := make([]byte, 20)
-	_, err := rand.Read(peerID)
+	socket, err := utp.Listen(addr)
 	if err != nil {
-		fmt.Println(err)
+		log.Printf("uTP disabled: %v", err)
 		return nil
 	}
 
-	return peerID
+	return socket
 }
 
-/*
-peer messages consists of:
-- message length prefix (4 bytes)
-- message id (1 byte)
-- payload (variable size)
-
-// once the handshake is complete we need to exchange the following messages
-- wait for _bitfield_ message from peer to indicate which pieces it has
-  - message id for this type is 5
-  - payload ()
-
-- send _interested_ message
-  - id for this message type is 2
-  - empty payload
-
-- wait till receiving _unchoke_ message
-  - id for this message type is 1
-  - empty payload
-
-// Break the pieces into blocks of 16 kiB (16 * 1024 bytes) and send _request_ message for each block
-  - id for this message type is 6
-  - payload consists of:
-  - index: zero-based index
-  - begin: zero-based byte offset within the piece
-    0 for first block, 2^14 for second, 2 * 2^14 for third.....
-  - length: the length of the block in bytes
-    this will be 2^14 for all blocks except the last one.
-    the last one will be 2^14 bytes or lower, this will be caculated using the piece length
-
-wait till receiving _piece_ message for each block requested
-  - id for this message type is 7
-  - payload consists of:
-    index: zero-based piece index
-    begin: zero-based byte offset within the piece
-    block: the data for the piece, usually 2^14 bytes long
-
-After combining blocks into pieces, we have to check the integrity of each piece
-by comparing the hash with the piece hash found in the torrent file
-*/
-func downloadPiece(torrentPath string, pieceIndex int) []byte {
-	torrent, err := t.ParseTorrentFile(torrentPath)
+// mustGeneratePeerID is peer.NewPeerID for package initialization, a system that can not
+// produce random bytes can not run the client at all
+func mustGeneratePeerID() [20]byte {
+	peerID, err := peer.NewPeerID()
 	if err != nil {
-		log.Printf("Failed to parse torrent: %v", err)
+		panic(err)
 	}
+	return peerID
+}
 
-	encoder := t.NewTorrentEncoder()
-	torrentInfo := torrent["info"].(map[string]interface{})
-	pieceHashes := encoder.GetTorrentPieceHashes(torrentInfo["pieces"].([]byte))
-	standardPieceLength := torrentInfo["piece length"].(int)
-	fileLength := torrentInfo["length"].(int)
-
-	// ceiling division
-	numPieces := (fileLength + standardPieceLength - 1) / standardPieceLength
-
-	// calcualte piece length for this piece
-	pieceLength := standardPieceLength
-	if pieceIndex == numPieces-1 {
-		remainingLength := fileLength - (pieceIndex * standardPieceLength)
-		if remainingLength > 0 {
-			pieceLength = remainingLength
-		}
+func downloadPiece(ctx context.Context, torrentPath string, pieceIndex int) ([]byte, error) {
+	progress := newProgress()
+	d, err := runDownload(ctx, torrentPath, downloadOptions{pieces: []int{pieceIndex}, started: progress.start})
+	progress.finish()
+	if err != nil {
+		return nil, err
 	}
 
-	peers := handlePeers(torrentPath)
-	if len(peers) < 1 {
-		fmt.Println("Could not find any peers")
-		return nil
+	data, err := d.Piece(pieceIndex)
+	if err != nil {
+		return nil, err
 	}
+	if data == nil {
+		return nil, fmt.Errorf("piece index %d out of range, the torrent has %d pieces", pieceIndex, d.NumPieces())
+	}
+	return data, nil
+}
 
-	fmt.Println("STARTING HANDSHAKE")
+// download downloads a torrent to outputPath. The file of a single file torrent is
+// written at outputPath, the files of a multi-file torrent in a directory named after the
+// torrent under it. fileSelection picks the files to download, every file is downloaded
+// when it is empty
+func download(ctx context.Context, torrentPath string, outputPath string, fileSelection string) (*downloadResult, error) {
+	_, torrentInfo, err := parseTorrent(torrentPath)
+	if err != nil {
+		return nil, err
+	}
 
-	conn, _ := handleHandshake(torrentPath, peers[0])
-	defer conn.Close()
+	files := t.Files(torrentInfo)
+	var priorities []dl.Priority
+	if fileSelection != "" {
+		priorities, err = parseFileSelection(fileSelection, files)
+		if err != nil {
+			return nil, err
+		}
+	}
 
-	fmt.Println("HANDSHAKE COMPLETE")
+	store, err := newStorage(torrentInfo, outputPath, priorities)
+	if err != nil {
+		return nil, err
+	}
+	defer store.Close()
 
-	reader := bufio.NewReader(conn)
+	started := time.Now()
+	progress := newProgress()
+	_, err = runDownload(ctx, torrentPath, downloadOptions{priorities: priorities, storage: store, started: progress.start})
+	progress.finish()
+	if err != nil {
+		return nil, err
+	}
+	if err := store.Finish(); err != nil {
+		return nil, err
+	}
 
-	blockOffset := 0
-	pieceData := make([]byte, 0)
-	atLastBlock := false
+	r := &downloadResult{
+		Name:            t.Name(torrentInfo),
+		Output:          outputPath,
+		DurationSeconds: time.Since(started).Seconds(),
+		Files:           []downloadFile{},
+	}
+	multiFile := len(files) > 1 || len(files) == 1 && len(files[0].Path) > 0
+	if multiFile {
+		r.Output = filepath.Join(outputPath, r.Name)
+	}
+	index := 0
+	for i, file := range files {
+		if file.Pad {
+			continue
+		}
+		priority := dl.PriorityNormal
+		if i < len(priorities) {
+			priority = priorities[i]
+		}
+		path := r.Name
+		if multiFile {
+			path = filepath.Join(file.Path...)
+		}
+		r.Files = append(r.Files, downloadFile{Index: index, Path: path, Length: file.Length, Priority: priority.String()})
+		if priority != dl.PrioritySkip {
+			r.Length += int64(file.Length)
+		}
+		index++
+	}
+	return r, nil
+}
 
-	for {
-		lengthBuf := make([]byte, 4)
-		if _, err := io.ReadFull(reader, lengthBuf); err != nil {
-			log.Printf("Failed to read length: %v", err)
-			return nil
+// parseFileSelection turns a list of file indexes and ranges like "0,3-5" into file
+// priorities, the files listed are downloaded and the others skipped. An index or range
+// can be followed by a priority, as in "0:high,3-5:low". Indexes count the files listed
+// by the info command, pad files are left out
+func parseFileSelection(selection string, files []t.File) ([]dl.Priority, error) {
+	// indexes of the files that are not pad files
+	visible := make([]int, 0, len(files))
+	for i, file := range files {
+		if !file.Pad {
+			visible = append(visible, i)
 		}
-		messageLength := binary.BigEndian.Uint32(lengthBuf)
+	}
 
-		messageBuffer := make([]byte, messageLength)
-		if _, err := io.ReadFull(reader, messageBuffer); err != nil {
-			log.Printf("Failed to read message: %v", err)
-			return nil
+	priorities := make([]dl.Priority, len(files))
+	for _, item := range strings.Split(selection, ",") {
+		item = strings.TrimSpace(item)
+		priority := dl.PriorityNormal
+		if rangeSpec, name, ok := strings.Cut(item, ":"); ok {
+			p, err := dl.ParsePriority(name)
+			if err != nil {
+				return nil, err
+			}
+			item, priority = rangeSpec, p
 		}
 
-		messageID := messageBuffer[0]
+		first, last, isRange := strings.Cut(item, "-")
+		from, err := strconv.Atoi(first)
+		if err != nil {
+			return nil, fmt.Errorf("invalid file index %q", first)
+		}
+		to := from
+		if isRange {
+			if to, err = strconv.Atoi(last); err != nil {
+				return nil, fmt.Errorf("invalid file index %q", last)
+			}
+		}
+		if from < 0 || to >= len(visible) || from > to {
+			return nil, fmt.Errorf("file range %q out of bounds, the torrent has %d files", item, len(visible))
+		}
 
-		log.Printf("Received message with data length: %d, ID: %d", messageLength-9, messageID)
+		for i := from; i <= to; i++ {
+			priorities[visible[i]] = priority
+		}
+	}
 
-		switch messageID {
-		case BITFIELD_ID:
-			msg := []byte{0, 0, 0, 1, INTERESTED_ID}
-			if _, err := conn.Write(msg); err != nil {
-				log.Printf("Error sending INTERESTED message: %v", err)
-				return nil
-			}
-		case UNCHOKE_ID:
-			blockSize := 1 << 14
-			if blockSize > pieceLength {
-				blockSize = pieceLength
-			}
-			if err := sendBlockRequest(conn, pieceIndex, blockOffset, blockSize); err != nil {
-				log.Printf("Error sending initial block request: %v", err)
-				return nil
-			}
+	// a download with every file skipped would wait for a file to be wanted forever
+	for i, priority := range priorities {
+		if priority != dl.PrioritySkip && files[i].Length > 0 {
+			return priorities, nil
+		}
+	}
+	return nil, fmt.Errorf("file selection %q has nothing to download", selection)
+}
 
-		case PIECE_ID:
-			blockData := messageBuffer[PieceDataStart:]
-			pieceData = append(pieceData, blockData...)
+// newStorage lays out the files of a torrent under outputPath, pad files and the files
+// skipped by priorities are left out
+func newStorage(torrentInfo map[string]interface{}, outputPath string, priorities []dl.Priority) (*storage.Storage, error) {
+	files := t.Files(torrentInfo)
 
-			if len(pieceData) == pieceLength {
-				atLastBlock = true
-			}
+	dir := filepath.Join(outputPath, t.Name(torrentInfo))
+	if len(files) == 1 && len(files[0].Path) == 0 {
+		dir = filepath.Dir(outputPath)
+		files[0].Path = []string{filepath.Base(outputPath)}
+	}
 
-			blockOffset += len(blockData)
-			if blockOffset < pieceLength {
-				blockSize := 1 << 14
+	storageFiles := make([]storage.File, 0, len(files))
+	for i, file := range files {
+		storageFiles = append(storageFiles, storage.File{
+			Path:       file.Path,
+			Length:     file.Length,
+			Pad:        file.Pad,
+			Skip:       i < len(priorities) && priorities[i] == dl.PrioritySkip,
+			Executable: file.Executable,
+			Symlink:    file.Symlink,
+		})
+	}
 
-				if blockOffset+blockSize > pieceLength {
-					blockSize = pieceLength - blockOffset
-				}
+	return storage.New(dir, storageFiles)
+}
 
-				if err := sendBlockRequest(conn, pieceIndex, blockOffset, blockSize); err != nil {
-					log.Printf("Error sending next block request: %v", err)
-					return nil
-				}
-			}
-		default:
-			log.Println("Unexpected peer message")
-			continue
-		}
+// handleServe downloads torrents into dir and serves their files over HTTP while they
+// download, the files stay available once the downloads complete. The torrents share one
+// client, so one port for peers, one DHT node and one local discovery service. Cancelling
+// ctx stops the downloads and shuts the server down
+func handleServe(ctx context.Context, addr string, dir string, torrentPaths []string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen: %w", err)
+	}
 
-		if atLastBlock {
-			break
+	config := client.DefaultConfig()
+	config.DataDir = dir
+	config.ListenPort = listenPort
+	config.Encryption = encryptionPolicy
+	config.Transport = transport
+	c, err := client.NewClient(config)
+	if err != nil {
+		ln.Close()
+		return err
+	}
+	defer c.Close()
+
+	server := httpserve.NewServer()
+	for _, torrentPath := range torrentPaths {
+		torrent, err := c.AddTorrentFile(torrentPath)
+		if err != nil {
+			ln.Close()
+			return fmt.Errorf("failed to add %s: %w", torrentPath, err)
 		}
+		server.Add(torrent)
+		infoHash := torrent.InfoHash()
+		log.Printf("Serving %s at /%s/", torrent.Name(), hex.EncodeToString(infoHash[:]))
+
+		go func() {
+			<-torrent.Done()
+			if err := torrent.Err(); err != nil && ctx.Err() == nil {
+				log.Printf("Failed to download %s: %v", torrentPath, err)
+				// files of a failed download would never finish reading
+				server.Remove(infoHash)
+			}
+		}()
 	}
-
-	expectedHash := pieceHashes[pieceIndex]
-	receivedHash := encoder.CalculateSHA1Hash(pieceData)
-	if expectedHash != receivedHash {
-		log.Println("Hash from torrent", pieceHashes[pieceIndex])
-		log.Println("Hash received from fetched piece", receivedHash[pieceIndex])
-	} else {
-		log.Println("Hashes match :o!")
+	log.Printf("Serving torrents on http://%s/", ln.Addr())
+
+	httpServer := &http.Server{Handler: server}
+	stop := context.AfterFunc(ctx, func() {
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), stopAnnounceTimeout)
+		defer cancel()
+		httpServer.Shutdown(shutdownCtx)
+	})
+	defer stop()
+
+	if err := httpServer.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
 	}
+	return nil
+}
 
-	return pieceData
+// downloadOptions say what runDownload downloads
+type downloadOptions struct {
+	// pieces restricts the download to some pieces, priorities set the priorities of
+	// the files
+	pieces     []int
+	priorities []dl.Priority
+	// storage is where the pieces are written as they are verified, they are kept in
+	// memory without one
+	storage dl.Storage
+	// started is called with the download before it looks for peers
+	started func(d *dl.Download)
 }
 
-func download(torrentPath string) []byte {
-	torrent, err := t.ParseTorrentFile(torrentPath)
+// runDownload joins the swarm of a torrent and downloads the given pieces, or the files
+// of the torrent according to their priorities when pieces is empty. Peers come from the trackers (or the DHT when they have
+// none), and keep coming from regular announces and peer exchange while we download.
+// Cancelling ctx stops the download. ErrNoPeers is returned when no peer can be found or
+// every peer failed, a PieceHashError when they sent corrupt data
+func runDownload(ctx context.Context, torrentPath string, options downloadOptions) (*dl.Download, error) {
+	torrent, torrentInfo, err := parseTorrent(torrentPath)
 	if err != nil {
-		log.Printf("Failed to parse torrent: %v", err)
+		return nil, err
 	}
 
-	torrentInfo := torrent["info"].(map[string]interface{})
-	fileLength := torrentInfo["length"].(int)
-	standardPieceLength := torrentInfo["piece length"].(int)
-	numPieces := (fileLength + standardPieceLength - 1) / standardPieceLength
+	infoHash := t.SwarmInfoHash(torrentInfo)
 
-	piecesChan := make(chan struct {
-		index int
-		data  []byte
-	}, numPieces)
-
-	// WaitGroup to wait for all downloads to finish
-	var wg sync.WaitGroup
+	// uTP shares the port number with TCP, peers reach us on either
+	socket := openUTP(fmt.Sprintf(":%d", listenPort))
+	if socket != nil {
+		defer socket.Close()
+	}
 
-	maxConcurrent := 5
-	semaphore := make(chan int, maxConcurrent)
+	d, err := newDownload(torrent, options, socket)
+	if err != nil {
+		return nil, fmt.Errorf("failed to set up download: %w", err)
+	}
+	if options.started != nil {
+		options.started(d)
+	}
 
-	for i := 0; i < numPieces; i++ {
-		wg.Add(1)
-		go func(pieceIndex int) {
-			defer wg.Done()
+	fileLength := int64(t.Length(torrentInfo))
+	announcer, err := newAnnouncer(torrent, infoHash, func() tracker.Stats {
+		done := d.Downloaded()
+		return tracker.Stats{Uploaded: d.Uploaded(), Downloaded: done, Left: fileLength - done}
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to set up announcer: %w", err)
+	}
 
-			semaphore <- 1
-			defer func() { <-semaphore }()
+	// look for peers on the local network while we ask the trackers, private torrents
+	// only get their peers from trackers
+	localPeers := make(chan struct{}, 1)
+	if !t.IsPrivate(torrentInfo) {
+		service, err := startLocalDiscovery(infoHash, func(addr netip.AddrPort) {
+			d.AddPeers([]netip.AddrPort{addr}, dl.SourceLSD)
+			select {
+			case localPeers <- struct{}{}:
+			default:
+			}
+		})
+		if err != nil {
+			log.Printf("Local service discovery disabled: %v", err)
+		} else {
+			defer service.Close()
+		}
+	}
 
-			pieceData := downloadPiece(torrentPath, pieceIndex)
-			piecesChan <- struct {
-				index int
-				data  []byte
-			}{pieceIndex, pieceData}
-		}(i)
+	// peers learn our port from trackers, the DHT and local discovery and connect to us
+	listener, err := dl.Listen(fmt.Sprintf(":%d", listenPort), encryptionPolicy)
+	if err != nil {
+		log.Printf("Not accepting incoming connections: %v", err)
+	} else {
+		defer listener.Close()
+		listener.Add(d)
+		if socket != nil {
+			listener.Serve(socket)
+		}
 	}
 
-	// close pieces channel when all downloads are done
-	go func() {
-		wg.Wait()
-		close(piecesChan)
+	peers, source, announceErr := startAnnounce(ctx, torrent, torrentInfo, infoHash, announcer)
+	if announceErr != nil {
+		log.Printf("Failed to find peers: %v", announceErr)
+	}
+	// web seeds are enough to download from
+	if len(peers) < 1 && len(t.WebSeeds(torrent)) == 0 {
+		select {
+		case <-localPeers:
+		case <-ctx.Done():
+			stopAnnouncer(announcer)
+			return nil, fmt.Errorf("%w: %w", dl.ErrStopped, ctx.Err())
+		case <-time.After(localPeersTimeout):
+			stopAnnouncer(announcer)
+			if announceErr != nil {
+				return nil, fmt.Errorf("%w: %w", dl.ErrNoPeers, announceErr)
+			}
+			return nil, dl.ErrNoPeers
+		}
+	}
+	d.AddPeers(peerAddrs(peers), source)
+
+	// keep announcing at the interval the tracker asks for while we download, and tell
+	// it we left once we are done
+	announceCtx, stopAnnouncing := context.WithCancel(ctx)
+	go announcer.Run(announceCtx, func(newPeers []tracker.Peer) {
+		d.AddPeers(peerAddrs(newPeers), dl.SourceTracker)
+	})
+	defer func() {
+		stopAnnouncing()
+		stopAnnouncer(announcer)
 	}()
 
-	pieces := make([][]byte, numPieces)
-	for piece := range piecesChan {
-		pieces[piece.index] = piece.data
+	if err := d.Run(ctx); err != nil {
+		return nil, err
 	}
 
-	fileData := make([]byte, 0, fileLength)
-	for i := 0; i < numPieces; i++ {
-		fileData = append(fileData, pieces[i]...)
+	if len(options.pieces) == 0 {
+		if _, err := announcer.Complete(ctx); err != nil {
+			log.Printf("Failed to send completed announce: %v", err)
+		}
 	}
 
-	return fileData
+	return d, nil
 }
 
-func sendBlockRequest(conn net.Conn, pieceIndex, offset, blockSize int) error {
-	request := make([]byte, PAYLOAD_BYTES)
-	binary.BigEndian.PutUint32(request[LengthIndexStart:LengthIndexEnd], 13)
-	request[4] = REQUEST_ID
-	binary.BigEndian.PutUint32(request[PieceIndexStart:PieceIndexEnd], uint32(pieceIndex))
-	binary.BigEndian.PutUint32(request[OffsetIndexStart:OffsetIndexEnd], uint32(offset))
-	binary.BigEndian.PutUint32(request[BlocksizeIndexStart:BlocksizeIndexEnd], uint32(blockSize))
+// newDownload describes the torrent to the download engine
+func newDownload(metainfo map[string]interface{}, options downloadOptions, socket *utp.Socket) (*dl.Download, error) {
+	torrent, err := dl.FromMetainfo(metainfo)
+	if err != nil {
+		return nil, err
+	}
 
-	log.Printf("Sending request for piece index: %d, block offset: %d, block size: %d",
-		pieceIndex, offset, blockSize)
+	config := dl.DefaultConfig()
+	config.PeerID = clientPeerID
+	config.Port = listenPort
+	config.Pieces = options.pieces
+	config.FilePriorities = options.priorities
+	config.Storage = options.storage
+	config.Sequential = sequential
+	config.Encryption = encryptionPolicy
+	config.Transport = transport
+	config.UTP = socket
+	// new peers only come with the next announce, a command waiting for them looks hung
+	config.StallTimeout = stallTimeout
+
+	return dl.New(torrent, config), nil
+}
 
-	_, err := conn.Write(request)
-	return err
+func peerAddrs(peers []tracker.Peer) []netip.AddrPort {
+	addrs := make([]netip.AddrPort, 0, len(peers))
+	for _, p := range peers {
+		addrs = append(addrs, p.Addr)
+	}
+	return addrs
 }
 
-// Magnet links allows users to download files from peers without needing a torrent file
-// Unlike .torrent files, magnet links dont contain information like file length, piece lenghth and piece hashes
-// They only include the bare minimum neccesary to discover peers.
-// Clients can request the rest of the information from peers using the
-// metadata exchange protocol
-// Query params in a magnet link:
-//
-//	xt: urn:btih: followed by the 40 char hex-encoded info hash
-//	dn: name of the file to be downloaded
-//	tr: tracker URL
-//func handleMagnetLink(magnetLink string) {
-//	parsedMagnetLink := magnetlink.Parse(magnetLink)
-//}
+func handleMagnetParse(magnetLink string) (*magnetResult, error) {
+	link, err := magnetlink.Parse(magnetLink)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &magnetResult{
+		InfoHash:    hex.EncodeToString(link.InfoHash[:]),
+		Name:        link.Name,
+		TrackerURLs: append([]string{}, link.Trackers...),
+	}
+	for _, addr := range link.Peers {
+		r.Peers = append(r.Peers, addr.String())
+	}
+	return r, nil
+}
@@ -1,101 +1,338 @@
 package main
 
 import (
+	"context"
+	"encoding/hex"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
+	"log"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"strconv"
+	"syscall"
+
+	dl "github.com/nullxDEADBEEF/bittorrent/internal/download"
+	"github.com/nullxDEADBEEF/bittorrent/internal/mse"
+	"github.com/nullxDEADBEEF/bittorrent/internal/peer"
+	"github.com/nullxDEADBEEF/bittorrent/internal/tracker"
+)
+
+// exit codes let scripts tell why a command failed without parsing its output
+const (
+	exitFailure = 1
+	// the command line was invalid
+	exitUsage = 2
+	// no peer could be found or every peer failed
+	exitNoPeers = 3
+	// a tracker refused our request
+	exitTrackerFailure = 4
+	// a peer answered with a handshake for another torrent
+	exitHandshakeMismatch = 5
+	// the data downloaded did not match the piece hashes
+	exitCorruptData = 6
+	// interrupted by a signal, as shells report it
+	exitInterrupted = 130
 )
 
+// errUsage is wrapped by errors about the command line
+var errUsage = errors.New("invalid usage")
+
 func main() {
-	command := os.Args[1]
+	// interrupting stops the network operations in progress and leaves the swarms cleanly
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+
+	err := run(ctx, os.Args[1:])
+	// -h printed the usage it asked for
+	if err == nil || errors.Is(err, flag.ErrHelp) {
+		stop()
+		return
+	}
+	// stop cancels ctx too, whether we were interrupted has to be known before
+	code := exitCode(ctx, err)
+	stop()
+	printError(err, code)
+	os.Exit(code)
+}
+
+// exitCode maps an error to the exit code of the process. Corrupt data is reported
+// before the other causes, a download that ran out of peers because they sent bad pieces
+// failed because of the data
+func exitCode(ctx context.Context, err error) int {
+	switch {
+	case ctx.Err() != nil:
+		return exitInterrupted
+	case errors.Is(err, errUsage):
+		return exitUsage
+	case errors.Is(err, dl.ErrPieceHashMismatch):
+		return exitCorruptData
+	case errors.Is(err, peer.ErrHandshakeMismatch):
+		return exitHandshakeMismatch
+	case errors.Is(err, tracker.ErrTrackerFailure):
+		return exitTrackerFailure
+	case errors.Is(err, dl.ErrNoPeers):
+		return exitNoPeers
+	default:
+		return exitFailure
+	}
+}
 
-	// flags for commands
-	downloadPieceCmd := flag.NewFlagSet("download_piece", flag.ExitOnError)
-	downloadCmd := flag.NewFlagSet("download", flag.ExitOnError)
+// run runs the command of the command line, args not including the program name. Global
+// flags come before the command
+func run(ctx context.Context, args []string) error {
+	globalFlags := newFlagSet("bittorrent")
+	if err := parseFlags(globalFlags, args); err != nil {
+		return err
+	}
+	args = globalFlags.Args()
+
+	if len(args) == 0 {
+		return fmt.Errorf("%w: no command given", errUsage)
+	}
+	command, args := args[0], args[1:]
 
 	switch command {
 	case "decode":
-		fmt.Println(handleDecode(os.Args[2]))
+		decodeCmd := newFlagSet("decode")
+		if err := parseFlags(decodeCmd, args); err != nil {
+			return err
+		}
+		if decodeCmd.NArg() < 1 {
+			return fmt.Errorf("%w: decode <bencoded string>", errUsage)
+		}
+		// the decoded value is JSON already, with or without --json
+		decoded, err := handleDecode(decodeCmd.Arg(0))
+		if err != nil {
+			return err
+		}
+		fmt.Println(decoded)
 	case "info":
-		handleInfo(os.Args[2])
+		infoCmd := newFlagSet("info")
+		if err := parseFlags(infoCmd, args); err != nil {
+			return err
+		}
+		if infoCmd.NArg() < 1 {
+			return fmt.Errorf("%w: info <path to torrent file>", errUsage)
+		}
+		info, err := handleInfo(infoCmd.Arg(0))
+		if err != nil {
+			return err
+		}
+		return printResult(info)
 	case "peers":
-		peers := handlePeers(os.Args[2])
+		peersCmd := newFlagSet("peers")
+		if err := parseFlags(peersCmd, args); err != nil {
+			return err
+		}
+		if peersCmd.NArg() < 1 {
+			return fmt.Errorf("%w: peers <path to torrent file>", errUsage)
+		}
+		peers, err := handlePeers(ctx, peersCmd.Arg(0))
+		if err != nil {
+			return err
+		}
+		r := &peersResult{Peers: make([]peerAddr, 0, len(peers))}
 		for _, peer := range peers {
-			fmt.Println(peer)
+			r.Peers = append(r.Peers, peerAddr{IP: peer.Addr.Addr().String(), Port: peer.Addr.Port()})
+		}
+		return printResult(r)
+	case "scrape":
+		scrapeCmd := newFlagSet("scrape")
+		if err := parseFlags(scrapeCmd, args); err != nil {
+			return err
+		}
+		if scrapeCmd.NArg() < 1 {
+			return fmt.Errorf("%w: scrape <path to torrent file>", errUsage)
+		}
+		scrape, err := handleScrape(ctx, scrapeCmd.Arg(0))
+		if err != nil {
+			return err
 		}
+		return printResult(scrape)
 	case "handshake":
-		conn, peerID := handleHandshake(os.Args[2], os.Args[3])
-		fmt.Println("Peer ID: " + peerID)
+		handshakeCmd := newFlagSet("handshake")
+		encryption := handshakeCmd.String("encryption", "prefer", "peer connection encryption: prefer, require or disable")
+		transportName := handshakeCmd.String("transport", "race", "peer transport: tcp, utp or race")
+		if err := parseFlags(handshakeCmd, args); err != nil {
+			return err
+		}
+		if err := setNetworkOptions(*encryption, *transportName); err != nil {
+			return err
+		}
+		if handshakeCmd.NArg() < 2 {
+			return fmt.Errorf("%w: handshake <path to torrent file> <peer_ip>:<peer_port>", errUsage)
+		}
 
+		conn, err := handleHandshake(ctx, handshakeCmd.Arg(0), handshakeCmd.Arg(1))
+		if err != nil {
+			return err
+		}
 		defer conn.Close()
+		return printResult(&handshakeResult{
+			PeerID:     hex.EncodeToString(conn.Remote.PeerID[:]),
+			Client:     peer.IdentifyClient(conn.Remote.PeerID).String(),
+			Reserved:   hex.EncodeToString(conn.Remote.Reserved[:]),
+			Extensions: append([]string{}, conn.Remote.Extensions()...),
+			Encrypted:  conn.Encrypted,
+		})
 	case "download_piece":
+		downloadPieceCmd := newFlagSet("download_piece")
 		outputFile := downloadPieceCmd.String("o", "", "output file path")
-		downloadPieceCmd.Parse(os.Args[2:])
+		encryption := downloadPieceCmd.String("encryption", "prefer", "peer connection encryption: prefer, require or disable")
+		transportName := downloadPieceCmd.String("transport", "race", "peer transport: tcp, utp or race")
+		downloadPieceCmd.BoolVar(&quiet, "quiet", false, "show no progress and no logs, only errors")
+		if err := parseFlags(downloadPieceCmd, args); err != nil {
+			return err
+		}
+		if err := setNetworkOptions(*encryption, *transportName); err != nil {
+			return err
+		}
+		setQuiet()
 
 		if *outputFile == "" {
-			fmt.Println("Output file path is required")
 			downloadPieceCmd.PrintDefaults()
-			os.Exit(1)
+			return fmt.Errorf("%w: output file path is required", errUsage)
+		}
+		pieceIndex, err := strconv.Atoi(downloadPieceCmd.Arg(1))
+		if err != nil {
+			return fmt.Errorf("%w: invalid piece index: %w", errUsage, err)
 		}
 
-		file := createFile(*outputFile)
-		defer file.Close()
-
-		pieceIndex, err := strconv.Atoi(os.Args[5])
+		torrentPath := downloadPieceCmd.Arg(0)
+		pieceData, err := downloadPiece(ctx, torrentPath, pieceIndex)
 		if err != nil {
-			fmt.Println(err)
-			return
+			return err
 		}
 
-		torrentPath := os.Args[4]
-		pieceData := downloadPiece(torrentPath, pieceIndex)
-		file.Write(pieceData)
+		file, err := createFile(*outputFile)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		if _, err := file.Write(pieceData); err != nil {
+			return fmt.Errorf("failed to write piece: %w", err)
+		}
+		return printResult(&pieceResult{Piece: pieceIndex, Length: len(pieceData), Output: *outputFile})
 	case "download":
+		downloadCmd := newFlagSet("download")
 		outputFile := downloadCmd.String("o", "", "output file path")
-		downloadCmd.Parse(os.Args[2:])
+		encryption := downloadCmd.String("encryption", "prefer", "peer connection encryption: prefer, require or disable")
+		transportName := downloadCmd.String("transport", "race", "peer transport: tcp, utp or race")
+		files := downloadCmd.String("files", "", "files to download by index, e.g. 0,3-5 or 0:high,3-5:low, every file when empty")
+		downloadCmd.BoolVar(&sequential, "sequential", false, "download pieces in order")
+		downloadCmd.BoolVar(&quiet, "quiet", false, "show no progress and no logs, only errors")
+		if err := parseFlags(downloadCmd, args); err != nil {
+			return err
+		}
+		if err := setNetworkOptions(*encryption, *transportName); err != nil {
+			return err
+		}
+		setQuiet()
 
 		if *outputFile == "" {
-			fmt.Println("Output file path is required")
-			downloadPieceCmd.PrintDefaults()
-			os.Exit(1)
+			downloadCmd.PrintDefaults()
+			return fmt.Errorf("%w: output file path is required", errUsage)
 		}
 
-		file := createFile(*outputFile)
-		defer file.Close()
+		torrentPath := downloadCmd.Arg(0)
+		summary, err := download(ctx, torrentPath, *outputFile, *files)
+		if err != nil {
+			return err
+		}
+		return printResult(summary)
+	case "serve":
+		serveCmd := newFlagSet("serve")
+		addr := serveCmd.String("addr", ":8080", "address the HTTP server listens on")
+		dir := serveCmd.String("dir", ".", "directory the files are downloaded to")
+		encryption := serveCmd.String("encryption", "prefer", "peer connection encryption: prefer, require or disable")
+		transportName := serveCmd.String("transport", "race", "peer transport: tcp, utp or race")
+		if err := parseFlags(serveCmd, args); err != nil {
+			return err
+		}
+		if err := setNetworkOptions(*encryption, *transportName); err != nil {
+			return err
+		}
 
-		torrentPath := os.Args[4]
-		fileData := download(torrentPath)
-		file.Write(fileData)
+		if serveCmd.NArg() == 0 {
+			serveCmd.PrintDefaults()
+			return fmt.Errorf("%w: at least one torrent file is required", errUsage)
+		}
+
+		return handleServe(ctx, *addr, *dir, serveCmd.Args())
 	case "magnet_parse":
-		break
-		//magnetLink := os.Args[2]
-		//handleMagnetLink(magnetLink)
+		magnetCmd := newFlagSet("magnet_parse")
+		if err := parseFlags(magnetCmd, args); err != nil {
+			return err
+		}
+		if magnetCmd.NArg() < 1 {
+			return fmt.Errorf("%w: magnet_parse <magnet link>", errUsage)
+		}
+		link, err := handleMagnetParse(magnetCmd.Arg(0))
+		if err != nil {
+			return err
+		}
+		return printResult(link)
 	default:
-		fmt.Println("Unknown command: " + command)
-		os.Exit(1)
+		return fmt.Errorf("%w: unknown command %s", errUsage, command)
+	}
+
+	return nil
+}
+
+// newFlagSet returns the flag set of a command. --json is accepted among the flags of
+// every command as well as before the command
+func newFlagSet(command string) *flag.FlagSet {
+	flags := flag.NewFlagSet(command, flag.ContinueOnError)
+	flags.BoolVar(&jsonOutput, "json", jsonOutput, "print results and errors as JSON")
+	return flags
+}
+
+// parseFlags parses the flags of a command, the errors are usage errors. -h fails with
+// flag.ErrHelp once the usage is printed
+func parseFlags(flags *flag.FlagSet, args []string) error {
+	if err := flags.Parse(args); err != nil {
+		return fmt.Errorf("%w: %w", errUsage, err)
 	}
+	return nil
 }
 
-func createFile(outputFile string) *os.File {
+// setNetworkOptions sets the encryption policy and transport of peer connections
+func setNetworkOptions(encryption, transportName string) error {
+	policy, err := mse.ParsePolicy(encryption)
+	if err != nil {
+		return fmt.Errorf("%w: %w", errUsage, err)
+	}
+	encryptionPolicy = policy
 
+	t, err := peer.ParseTransport(transportName)
+	if err != nil {
+		return fmt.Errorf("%w: %w", errUsage, err)
+	}
+	transport = t
+
+	return nil
+}
+
+// setQuiet silences the logs when quiet is set, the progress view checks it on its own
+func setQuiet() {
+	if quiet {
+		log.SetOutput(io.Discard)
+	}
+}
+
+func createFile(outputFile string) (*os.File, error) {
 	// create directory if it doesnt exist
 	outputDir := filepath.Dir(outputFile)
-	if _, err := os.Stat(outputDir); os.IsNotExist(err) {
-		err := os.MkdirAll(outputDir, os.ModePerm)
-		if err != nil {
-			fmt.Println("Failed to create directory", err)
-			return nil
-		}
+	if err := os.MkdirAll(outputDir, os.ModePerm); err != nil {
+		return nil, fmt.Errorf("failed to create directory: %w", err)
 	}
 
-	// create file if it doesnt exist
 	file, err := os.Create(outputFile)
 	if err != nil {
-		fmt.Println("Failed to create output file", err)
-		return nil
+		return nil, fmt.Errorf("failed to create output file: %w", err)
 	}
 
-	return file
+	return file, nil
 }
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// jsonOutput makes commands print their result as a single JSON object on stdout, and
+// errors as one on stderr, instead of text. The objects are described in the README and
+// fields are only ever added to them
+var jsonOutput bool
+
+// result is what a command prints once it succeeded
+type result interface {
+	// printText prints the result for humans
+	printText(w io.Writer)
+}
+
+// printResult prints the result of a command on stdout, as JSON with --json
+func printResult(r result) error {
+	if !jsonOutput {
+		r.printText(os.Stdout)
+		return nil
+	}
+
+	if err := json.NewEncoder(os.Stdout).Encode(r); err != nil {
+		return fmt.Errorf("failed to encode output: %w", err)
+	}
+	return nil
+}
+
+// printError prints the error a command failed with on stderr, as JSON with --json
+func printError(err error, code int) {
+	if !jsonOutput {
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+
+	json.NewEncoder(os.Stderr).Encode(errorResult{Error: err.Error(), ExitCode: code})
+}
+
+type errorResult struct {
+	Error    string `json:"error"`
+	ExitCode int    `json:"exit_code"`
+}
+
+// infoResult describes a torrent file
+type infoResult struct {
+	TrackerURL  string   `json:"tracker_url"`
+	Name        string   `json:"name"`
+	Length      int      `json:"length"`
+	InfoHash    string   `json:"info_hash,omitempty"`
+	InfoHashV2  string   `json:"info_hash_v2,omitempty"`
+	PieceLength int      `json:"piece_length"`
+	PieceHashes []string `json:"piece_hashes,omitempty"`
+	// Files are listed for single file torrents too, named after the torrent
+	Files       []infoFile `json:"files"`
+	PiecesRoots []infoRoot `json:"pieces_roots,omitempty"`
+	multiFile   bool
+}
+
+type infoFile struct {
+	// Index is the index the download command selects the file with
+	Index  int    `json:"index"`
+	Path   string `json:"path"`
+	Length int    `json:"length"`
+}
+
+type infoRoot struct {
+	Path       string `json:"path"`
+	PiecesRoot string `json:"pieces_root"`
+}
+
+func (r *infoResult) printText(w io.Writer) {
+	fmt.Fprintf(w, "Tracker URL: %s\nLength: %d\n", r.TrackerURL, r.Length)
+	if r.InfoHash != "" {
+		fmt.Fprintf(w, "Info Hash: %s\n", r.InfoHash)
+	}
+	if r.InfoHashV2 != "" {
+		fmt.Fprintf(w, "Info Hash v2: %s\n", r.InfoHashV2)
+	}
+	fmt.Fprintf(w, "Piece Length: %d\n", r.PieceLength)
+
+	if len(r.PieceHashes) > 0 {
+		fmt.Fprintln(w, "Piece Hashes:")
+		for _, hash := range r.PieceHashes {
+			fmt.Fprintln(w, hash)
+		}
+	}
+	if r.multiFile {
+		fmt.Fprintln(w, "Files:")
+		for _, file := range r.Files {
+			fmt.Fprintf(w, "%d: %s (%d bytes)\n", file.Index, file.Path, file.Length)
+		}
+	}
+	if len(r.PiecesRoots) > 0 {
+		fmt.Fprintln(w, "Pieces Roots:")
+		for _, root := range r.PiecesRoots {
+			fmt.Fprintf(w, "%s %s\n", root.PiecesRoot, root.Path)
+		}
+	}
+}
+
+// peersResult lists the peers of a torrent
+type peersResult struct {
+	Peers []peerAddr `json:"peers"`
+}
+
+type peerAddr struct {
+	IP   string `json:"ip"`
+	Port uint16 `json:"port"`
+}
+
+func (r *peersResult) printText(w io.Writer) {
+	for _, peer := range r.Peers {
+		fmt.Fprintln(w, net.JoinHostPort(peer.IP, strconv.Itoa(int(peer.Port))))
+	}
+}
+
+// scrapeResult is what a tracker knows about the swarm of a torrent
+type scrapeResult struct {
+	TrackerURL string `json:"tracker_url"`
+	Complete   int    `json:"complete"`
+	Incomplete int    `json:"incomplete"`
+	Downloaded int    `json:"downloaded"`
+}
+
+func (r *scrapeResult) printText(w io.Writer) {
+	fmt.Fprintf(w, "Tracker URL: %s\nComplete: %d\nIncomplete: %d\nDownloaded: %d\n",
+		r.TrackerURL, r.Complete, r.Incomplete, r.Downloaded)
+}
+
+// handshakeResult describes a peer from its handshake
+type handshakeResult struct {
+	PeerID string `json:"peer_id"`
+	// Client is "unknown" when the peer id follows no known convention
+	Client string `json:"client"`
+	// Reserved are the reserved bytes in hex, Extensions the extensions they announce
+	Reserved   string   `json:"reserved"`
+	Extensions []string `json:"extensions"`
+	Encrypted  bool     `json:"encrypted"`
+}
+
+func (r *handshakeResult) printText(w io.Writer) {
+	fmt.Fprintf(w, "Peer ID: %s\nClient: %s\n", r.PeerID, r.Client)
+	if len(r.Extensions) > 0 {
+		fmt.Fprintf(w, "Extensions: %s\n", strings.Join(r.Extensions, ", "))
+	}
+}
+
+// pieceResult tells where a downloaded piece was written
+type pieceResult struct {
+	Piece  int    `json:"piece"`
+	Length int    `json:"length"`
+	Output string `json:"output"`
+}
+
+func (r *pieceResult) printText(w io.Writer) {
+	fmt.Fprintf(w, "Piece %d downloaded to %s\n", r.Piece, r.Output)
+}
+
+// downloadResult sums a completed download up, humans only get where it was saved as
+// the progress view told them the rest
+type downloadResult struct {
+	Name string `json:"name"`
+	// Output is the file of a single file torrent, the directory of a multi-file one
+	Output string `json:"output"`
+	// Length counts the files that were downloaded, the skipped ones are left out
+	Length          int64          `json:"length"`
+	DurationSeconds float64        `json:"duration_seconds"`
+	Files           []downloadFile `json:"files"`
+}
+
+type downloadFile struct {
+	Index    int    `json:"index"`
+	Path     string `json:"path"`
+	Length   int    `json:"length"`
+	Priority string `json:"priority"`
+}
+
+func (r *downloadResult) printText(w io.Writer) {
+	fmt.Fprintf(w, "Downloaded %s to %s\n", r.Name, r.Output)
+}
+
+// magnetResult is what a magnet link tells about a torrent
+type magnetResult struct {
+	InfoHash    string   `json:"info_hash"`
+	Name        string   `json:"name,omitempty"`
+	TrackerURLs []string `json:"tracker_urls"`
+	Peers       []string `json:"peers,omitempty"`
+}
+
+func (r *magnetResult) printText(w io.Writer) {
+	for _, trackerURL := range r.TrackerURLs {
+		fmt.Fprintf(w, "Tracker URL: %s\n", trackerURL)
+	}
+	fmt.Fprintf(w, "Info Hash: %s\n", r.InfoHash)
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	dl "github.com/nullxDEADBEEF/bittorrent/internal/download"
+)
+
+const (
+	// how often the progress view is redrawn on a terminal
+	progressRedrawInterval = 500 * time.Millisecond
+	// how often a progress line is printed when stdout is not a terminal
+	progressLineInterval = 10 * time.Second
+	// transfer rates are averaged over this long
+	progressRateWindow = 5 * time.Second
+	// at most this many files are listed, the ones still downloading first
+	progressMaxFiles = 10
+	// longer times left are shown as "∞", a download that slow is as good as stalled
+	progressMaxETA = 100 * 24 * time.Hour
+)
+
+// quiet hides the progress of downloads and the logs, errors are still printed
+var quiet bool
+
+// progress shows how a download is going on stdout. On a terminal the view is redrawn in
+// place, with log lines printed above it; otherwise a single line is printed every
+// progressLineInterval so logs of CI jobs stay readable
+type progress struct {
+	out  io.Writer
+	tty  bool
+	d    *dl.Download
+	stop chan struct{}
+	done chan struct{}
+
+	mu sync.Mutex
+	// lines is the height of the view drawn last, erased before drawing again
+	lines int
+	// samples are the transfer counters over the last progressRateWindow
+	samples []progressSample
+}
+
+type progressSample struct {
+	at         time.Time
+	downloaded int64
+	uploaded   int64
+}
+
+// newProgress returns the progress view of the download commands, nil when quiet or when
+// stdout is for JSON
+func newProgress() *progress {
+	if quiet || jsonOutput {
+		return nil
+	}
+	return &progress{out: os.Stdout, tty: isTerminal(os.Stdout)}
+}
+
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// start shows the progress of d until finish is called, it is meant for
+// downloadOptions.started
+func (p *progress) start(d *dl.Download) {
+	if p == nil {
+		return
+	}
+
+	p.d = d
+	p.sample()
+	p.stop = make(chan struct{})
+	p.done = make(chan struct{})
+	if p.tty {
+		// logs would tear the view apart, they are printed above it instead
+		log.SetOutput(p)
+	}
+
+	go func() {
+		defer close(p.done)
+
+		interval := progressLineInterval
+		if p.tty {
+			interval = progressRedrawInterval
+		}
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-p.stop:
+				return
+			case <-ticker.C:
+				p.draw()
+			}
+		}
+	}()
+}
+
+// finish draws the view a last time and leaves it on screen
+func (p *progress) finish() {
+	if p == nil || p.d == nil {
+		return
+	}
+
+	close(p.stop)
+	<-p.done
+	p.draw()
+	if p.tty {
+		log.SetOutput(os.Stderr)
+	}
+}
+
+// Write prints a log line above the view
+func (p *progress) Write(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.erase()
+	n, err := os.Stderr.Write(b)
+	p.render()
+	return n, err
+}
+
+func (p *progress) draw() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.sample()
+	if p.tty {
+		p.erase()
+	}
+	p.render()
+}
+
+// erase moves the cursor back to where the view started and clears it
+func (p *progress) erase() {
+	if p.lines > 0 {
+		fmt.Fprintf(p.out, "\x1b[%dA\x1b[J", p.lines)
+		p.lines = 0
+	}
+}
+
+func (p *progress) render() {
+	if p.samples == nil {
+		return
+	}
+
+	downloaded, left := p.d.Downloaded(), p.d.Left()
+	total := downloaded + left
+	downRate, upRate := p.rates()
+
+	eta := "-"
+	switch {
+	case left == 0:
+		eta = "done"
+	case downRate > 0:
+		eta = formatETA(float64(left) / downRate)
+	}
+
+	summary := fmt.Sprintf("%s %5.1f%% %s / %s  down %s/s  up %s/s  ETA %s  peers %d",
+		p.d.Name(), percent(downloaded, total), formatBytes(downloaded), formatBytes(total),
+		formatBytes(int64(downRate)), formatBytes(int64(upRate)), eta, p.d.Peers())
+	if !p.tty {
+		fmt.Fprintln(p.out, summary)
+		return
+	}
+
+	lines := append([]string{summary}, p.fileLines()...)
+	fmt.Fprintln(p.out, strings.Join(lines, "\n"))
+	p.lines = len(lines)
+}
+
+// fileLines describes the wanted files of a multi-file torrent, the ones still
+// downloading first
+func (p *progress) fileLines() []string {
+	files := p.d.Files()
+	if len(files) < 2 {
+		return nil
+	}
+
+	priorities := p.d.FilePriorities()
+	fileProgress := p.d.FileProgress()
+	var downloading, finished []string
+	for i, file := range files {
+		if file.Pad || priorities[i] == dl.PrioritySkip {
+			continue
+		}
+		line := fmt.Sprintf("  %5.1f%% %s", percent(fileProgress[i], int64(file.Length)), strings.Join(file.Path, "/"))
+		if fileProgress[i] < int64(file.Length) {
+			downloading = append(downloading, line)
+		} else {
+			finished = append(finished, line)
+		}
+	}
+
+	lines := append(downloading, finished...)
+	if len(lines) > progressMaxFiles {
+		more := len(lines) - progressMaxFiles
+		lines = append(lines[:progressMaxFiles], fmt.Sprintf("  and %d more files", more))
+	}
+	return lines
+}
+
+// sample records the transfer counters and forgets the ones older than the rate window
+func (p *progress) sample() {
+	now := time.Now()
+	p.samples = append(p.samples, progressSample{at: now, downloaded: p.d.Downloaded(), uploaded: p.d.Uploaded()})
+	for len(p.samples) > 2 && now.Sub(p.samples[1].at) >= progressRateWindow {
+		p.samples = p.samples[1:]
+	}
+}
+
+// rates returns the download and upload rates over the samples, in bytes per second
+func (p *progress) rates() (float64, float64) {
+	first, last := p.samples[0], p.samples[len(p.samples)-1]
+	elapsed := last.at.Sub(first.at).Seconds()
+	if elapsed <= 0 {
+		return 0, 0
+	}
+	return float64(last.downloaded-first.downloaded) / elapsed, float64(last.uploaded-first.uploaded) / elapsed
+}
+
+func percent(done, total int64) float64 {
+	if total == 0 {
+		return 100
+	}
+	return float64(done) * 100 / float64(total)
+}
+
+// formatETA formats the seconds a download has left, computed as floats as a slow rate
+// would overflow a Duration
+func formatETA(seconds float64) string {
+	if seconds > progressMaxETA.Seconds() {
+		return "∞"
+	}
+	return time.Duration(seconds * float64(time.Second)).Round(time.Second).String()
+}
+
+// formatBytes prints a size with a binary unit, as in "1.5 MiB"
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	value, prefix := float64(n)/unit, 0
+	for value >= unit && prefix < 4 {
+		value /= unit
+		prefix++
+	}
+	return fmt.Sprintf("%.1f %ciB", value, "KMGTP"[prefix])
+}
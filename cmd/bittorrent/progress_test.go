@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"math"
+	"testing"
+	"time"
+
+	dl "github.com/nullxDEADBEEF/bittorrent/internal/download"
+)
+
+func TestFormatETA(t *testing.T) {
+	tests := []struct {
+		seconds float64
+		want    string
+	}{
+		{0, "0s"},
+		{59.6, "1m0s"},
+		{4096, "1h8m16s"},
+		{progressMaxETA.Seconds(), "2400h0m0s"},
+		{progressMaxETA.Seconds() + 1, "∞"},
+		// more than a Duration holds
+		{1e12, "∞"},
+		{math.Inf(1), "∞"},
+	}
+	for _, test := range tests {
+		if got := formatETA(test.seconds); got != test.want {
+			t.Errorf("formatETA(%v) = %q, want %q", test.seconds, got, test.want)
+		}
+	}
+}
+
+func TestFormatBytes(t *testing.T) {
+	tests := []struct {
+		n    int64
+		want string
+	}{
+		{0, "0 B"},
+		{1023, "1023 B"},
+		{1024, "1.0 KiB"},
+		{1536, "1.5 KiB"},
+		{1 << 20, "1.0 MiB"},
+		{1 << 30, "1.0 GiB"},
+		{1 << 40, "1.0 TiB"},
+		{1 << 50, "1.0 PiB"},
+		// there is no unit past PiB
+		{1 << 60, "1024.0 PiB"},
+	}
+	for _, test := range tests {
+		if got := formatBytes(test.n); got != test.want {
+			t.Errorf("formatBytes(%d) = %q, want %q", test.n, got, test.want)
+		}
+	}
+}
+
+func TestPercent(t *testing.T) {
+	tests := []struct {
+		done, total int64
+		want        float64
+	}{
+		{0, 0, 100},
+		{0, 200, 0},
+		{50, 200, 25},
+		{200, 200, 100},
+	}
+	for _, test := range tests {
+		if got := percent(test.done, test.total); got != test.want {
+			t.Errorf("percent(%d, %d) = %v, want %v", test.done, test.total, got, test.want)
+		}
+	}
+}
+
+func TestProgressLine(t *testing.T) {
+	tests := []struct {
+		name   string
+		length int
+		rate   int64
+		want   string
+	}{
+		{"downloading", 4 << 20, 1024, "line   0.0% 0 B / 4.0 MiB  down 1.0 KiB/s  up 0 B/s  ETA 1h8m16s  peers 0\n"},
+		{"no rate", 4 << 20, 0, "line   0.0% 0 B / 4.0 MiB  down 0 B/s  up 0 B/s  ETA -  peers 0\n"},
+		{"too slow", 16 << 20, 1, "line   0.0% 0 B / 16.0 MiB  down 1 B/s  up 0 B/s  ETA ∞  peers 0\n"},
+		{"empty", 0, 0, "line 100.0% 0 B / 0 B  down 0 B/s  up 0 B/s  ETA done  peers 0\n"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			torrent := dl.Torrent{Name: "line", PieceLength: 1 << 20, Length: test.length}
+			for i := 0; i < (test.length+torrent.PieceLength-1)/torrent.PieceLength; i++ {
+				torrent.PieceHashes = append(torrent.PieceHashes, [20]byte{})
+			}
+
+			var out bytes.Buffer
+			now := time.Now()
+			p := &progress{
+				out: &out,
+				d:   dl.New(torrent, dl.DefaultConfig()),
+				samples: []progressSample{
+					{at: now.Add(-time.Second)},
+					{at: now, downloaded: test.rate},
+				},
+			}
+			p.render()
+
+			if out.String() != test.want {
+				t.Errorf("got %q, want %q", out.String(), test.want)
+			}
+			if p.lines != 0 {
+				t.Error("a progress line is erased like the terminal view")
+			}
+		})
+	}
+}
@@ -43,6 +43,10 @@ func (d *BencodeDecoder) Decode() (interface{}, error) {
 		return nil, fmt.Errorf("empty input data")
 	}
 
+	if *d.index >= len(d.data) {
+		return nil, fmt.Errorf("unexpected end of data")
+	}
+
 	dataType := d.data[*d.index]
 	var result interface{}
 	var err error
@@ -67,6 +71,12 @@ func (d *BencodeDecoder) Decode() (interface{}, error) {
 	return d.convertBytesToStringIfValid(result), nil
 }
 
+// Offset returns how many bytes of the data were decoded, which is where anything
+// following the decoded value starts
+func (d *BencodeDecoder) Offset() int {
+	return *d.index
+}
+
 // strings are encoded as <length>:<content>
 func (d *BencodeDecoder) decodeString() (interface{}, error) {
 	var firstColonIndex int
@@ -90,6 +100,10 @@ func (d *BencodeDecoder) decodeString() (interface{}, error) {
 		return nil, fmt.Errorf("invalid string length: %w", err)
 	}
 
+	if length < 0 {
+		return nil, fmt.Errorf("invalid string length: %d", length)
+	}
+
 	contentStart := firstColonIndex + 1
 	contentEnd := contentStart + length
 
@@ -200,6 +214,20 @@ func (d *BencodeDecoder) convertBytesToStringIfValid(value interface{}) interfac
 	return value
 }
 
+// Bytes returns a decoded byte string as bytes, nil if value is not a byte string. Byte
+// strings in dictionaries are decoded as strings when they happen to be valid UTF-8,
+// which binary values like hashes and compact peer lists sometimes are
+func Bytes(value interface{}) []byte {
+	switch v := value.(type) {
+	case []byte:
+		return v
+	case string:
+		return []byte(v)
+	default:
+		return nil
+	}
+}
+
 func (d *BencodeDecoder) sortDictionary(dictionary map[string]interface{}) map[string]interface{} {
 	sortedMap := make(map[string]interface{}, len(dictionary))
 	keys := make([]string, 0, len(dictionary))
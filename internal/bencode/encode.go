@@ -0,0 +1,95 @@
+package bencode
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+// Encode serializes a value into bencode, it is the counterpart of Decode and accepts
+// the same types Decode produces:
+//
+//	string, []byte          => <length>:<content>
+//	int, int64, uint16...   => i<number>e
+//	[]interface{}           => l<bencoded_elements>e
+//	map[string]interface{}  => d<key1><value1>...<keyN><valueN>e with keys sorted
+func Encode(value interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := encodeValue(&buf, value); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func encodeValue(buf *bytes.Buffer, value interface{}) error {
+	switch v := value.(type) {
+	case string:
+		encodeString(buf, v)
+	case []byte:
+		encodeString(buf, string(v))
+	case int:
+		encodeInteger(buf, int64(v))
+	case int64:
+		encodeInteger(buf, v)
+	case int32:
+		encodeInteger(buf, int64(v))
+	case uint16:
+		encodeInteger(buf, int64(v))
+	case uint32:
+		encodeInteger(buf, int64(v))
+	case bool:
+		// booleans are commonly sent as 0 / 1 integers, e.g. implied_port in the DHT
+		if v {
+			encodeInteger(buf, 1)
+		} else {
+			encodeInteger(buf, 0)
+		}
+	case []interface{}:
+		buf.WriteByte(typeList)
+		for _, element := range v {
+			if err := encodeValue(buf, element); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte(endMarker)
+	case []string:
+		buf.WriteByte(typeList)
+		for _, element := range v {
+			encodeString(buf, element)
+		}
+		buf.WriteByte(endMarker)
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		buf.WriteByte(typeDict)
+		for _, k := range keys {
+			encodeString(buf, k)
+			if err := encodeValue(buf, v[k]); err != nil {
+				return fmt.Errorf("error encoding value for key %q: %w", k, err)
+			}
+		}
+		buf.WriteByte(endMarker)
+	default:
+		return fmt.Errorf("cannot encode value of type %T", value)
+	}
+
+	return nil
+}
+
+func encodeString(buf *bytes.Buffer, s string) {
+	buf.WriteString(strconv.Itoa(len(s)))
+	buf.WriteByte(separator)
+	buf.WriteString(s)
+}
+
+func encodeInteger(buf *bytes.Buffer, i int64) {
+	buf.WriteByte(typeInt)
+	buf.WriteString(strconv.FormatInt(i, 10))
+	buf.WriteByte(endMarker)
+}
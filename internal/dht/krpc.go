@@ -0,0 +1,120 @@
+package dht
+
+import (
+	"fmt"
+
+	"github.com/nullxDEADBEEF/bittorrent/internal/bencode"
+)
+
+// KRPC is the RPC protocol of the DHT, every message is a single bencoded dictionary sent
+// in a UDP packet with keys
+//   - t: transaction ID chosen by the querying node and echoed in the response
+//   - y: message type, "q" for query, "r" for response and "e" for error
+//   - q: method name of a query (ping, find_node, get_peers, announce_peer)
+//   - a: arguments of a query
+//   - r: return values of a response
+//   - e: list of an error code and message
+const (
+	typeQuery    = "q"
+	typeResponse = "r"
+	typeError    = "e"
+
+	methodPing         = "ping"
+	methodFindNode     = "find_node"
+	methodGetPeers     = "get_peers"
+	methodAnnouncePeer = "announce_peer"
+)
+
+const (
+	errorGeneric       = 201
+	errorServer        = 202
+	errorProtocol      = 203
+	errorMethodUnknown = 204
+)
+
+type message struct {
+	TransactionID string
+	Type          string
+	Method        string
+	Args          map[string]interface{}
+	Response      map[string]interface{}
+	Error         *KRPCError
+}
+
+// KRPCError is an error message sent back by a remote node
+type KRPCError struct {
+	Code    int
+	Message string
+}
+
+func (e *KRPCError) Error() string {
+	return fmt.Sprintf("krpc error %d: %s", e.Code, e.Message)
+}
+
+func encodeMessage(msg message) ([]byte, error) {
+	dict := map[string]interface{}{
+		"t": msg.TransactionID,
+		"y": msg.Type,
+	}
+
+	switch msg.Type {
+	case typeQuery:
+		dict["q"] = msg.Method
+		dict["a"] = msg.Args
+	case typeResponse:
+		dict["r"] = msg.Response
+	case typeError:
+		dict["e"] = []interface{}{msg.Error.Code, msg.Error.Message}
+	}
+
+	return bencode.Encode(dict)
+}
+
+func decodeMessage(data []byte) (message, error) {
+	decoder := bencode.NewBencodeDecoder(data)
+	decoded, err := decoder.Decode()
+	if err != nil {
+		return message{}, err
+	}
+
+	dict, ok := decoded.(map[string]interface{})
+	if !ok {
+		return message{}, fmt.Errorf("expected dictionary, got %T", decoded)
+	}
+
+	msg := message{
+		TransactionID: string(bencode.Bytes(dict["t"])),
+		Type:          string(bencode.Bytes(dict["y"])),
+	}
+
+	switch msg.Type {
+	case typeQuery:
+		msg.Method = string(bencode.Bytes(dict["q"]))
+		msg.Args, ok = dict["a"].(map[string]interface{})
+		if !ok {
+			return message{}, fmt.Errorf("query without arguments")
+		}
+	case typeResponse:
+		msg.Response, ok = dict["r"].(map[string]interface{})
+		if !ok {
+			return message{}, fmt.Errorf("response without return values")
+		}
+	case typeError:
+		list, _ := dict["e"].([]interface{})
+		msg.Error = &KRPCError{Code: errorGeneric}
+		if len(list) > 0 {
+			msg.Error.Code, _ = list[0].(int)
+		}
+		if len(list) > 1 {
+			msg.Error.Message = string(bencode.Bytes(list[1]))
+		}
+	default:
+		return message{}, fmt.Errorf("unknown message type: %q", msg.Type)
+	}
+
+	return msg, nil
+}
+
+func nodeIDValue(dict map[string]interface{}, key string) (NodeID, error) {
+	return nodeIDFromBytes(bencode.Bytes(dict[key]))
+}
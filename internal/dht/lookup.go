@@ -0,0 +1,217 @@
+package dht
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"sync"
+
+	"github.com/nullxDEADBEEF/bittorrent/internal/bencode"
+)
+
+// number of queries a lookup keeps in flight at once
+const alpha = 3
+
+var ErrNoNodes = errors.New("routing table is empty, bootstrap first")
+
+// Bootstrap joins the DHT by looking up our own ID starting from the bootstrap nodes,
+// which fills the routing table with the nodes closest to us
+func (s *Server) Bootstrap() error {
+	for _, host := range s.config.BootstrapNodes {
+		udpAddr, err := net.ResolveUDPAddr("udp", host)
+		if err != nil {
+			log.Printf("Failed to resolve DHT bootstrap node %s: %v", host, err)
+			continue
+		}
+
+		addr := udpAddr.AddrPort()
+		addr = netip.AddrPortFrom(addr.Addr().Unmap(), addr.Port())
+		if _, err := s.Ping(addr); err != nil {
+			log.Printf("DHT bootstrap node %s did not respond: %v", host, err)
+		}
+	}
+
+	if s.table.Len() == 0 {
+		return ErrNoNodes
+	}
+
+	s.lookup(s.id, methodFindNode)
+	return nil
+}
+
+// GetPeers finds peers for an info hash by walking the DHT towards the nodes closest to it
+func (s *Server) GetPeers(infoHash [20]byte) ([]netip.AddrPort, error) {
+	result, err := s.lookup(infoHash, methodGetPeers)
+	if err != nil {
+		return nil, err
+	}
+	return result.peers, nil
+}
+
+// Announce tells the nodes closest to the info hash that we are a peer listening on
+// port. With impliedPort set the nodes use the source port of our UDP packets instead
+func (s *Server) Announce(infoHash [20]byte, port uint16, impliedPort bool) ([]netip.AddrPort, error) {
+	result, err := s.lookup(infoHash, methodGetPeers)
+	if err != nil {
+		return nil, err
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	announced := 0
+	for _, node := range result.closest {
+		token, ok := result.tokens[node.ID]
+		if !ok {
+			continue
+		}
+
+		wg.Add(1)
+		go func(node Node, token []byte) {
+			defer wg.Done()
+			_, err := s.query(node.Addr, methodAnnouncePeer, map[string]interface{}{
+				"info_hash":    infoHash[:],
+				"port":         port,
+				"implied_port": impliedPort,
+				"token":        token,
+			})
+			if err == nil {
+				mu.Lock()
+				announced++
+				mu.Unlock()
+			}
+		}(node, token)
+	}
+	wg.Wait()
+
+	if announced == 0 {
+		return result.peers, fmt.Errorf("no node accepted the announce")
+	}
+
+	return result.peers, nil
+}
+
+type lookupResult struct {
+	// closest are the K closest nodes that answered
+	closest []Node
+	// tokens received from get_peers responses, needed to announce
+	tokens map[NodeID][]byte
+	peers  []netip.AddrPort
+}
+
+// lookup is the iterative Kademlia lookup: query the alpha closest nodes we know, add the
+// nodes they return to the candidates and repeat with the closest ones not queried yet,
+// until the K closest candidates have all answered or failed
+func (s *Server) lookup(target NodeID, method string) (*lookupResult, error) {
+	candidates := s.table.Closest(target, K)
+	if len(candidates) == 0 {
+		return nil, ErrNoNodes
+	}
+
+	result := &lookupResult{tokens: make(map[NodeID][]byte)}
+	queried := make(map[netip.AddrPort]bool)
+	responded := make(map[NodeID]Node)
+	seenPeers := make(map[netip.AddrPort]bool)
+
+	var mu sync.Mutex
+	for {
+		batch := make([]Node, 0, alpha)
+		pending := 0
+		for _, node := range candidates {
+			if queried[node.Addr] {
+				continue
+			}
+			pending++
+			if len(batch) < alpha {
+				batch = append(batch, node)
+			}
+		}
+		if pending == 0 {
+			break
+		}
+
+		var wg sync.WaitGroup
+		for _, node := range batch {
+			queried[node.Addr] = true
+			wg.Add(1)
+			go func(node Node) {
+				defer wg.Done()
+
+				args := map[string]interface{}{"target": target[:]}
+				if method == methodGetPeers {
+					args = map[string]interface{}{"info_hash": target[:]}
+				}
+
+				resp, err := s.query(node.Addr, method, args)
+				if err != nil {
+					return
+				}
+
+				id, err := nodeIDValue(resp, "id")
+				if err != nil {
+					return
+				}
+				nodes, _ := decodeCompactNodes(bencode.Bytes(resp["nodes"]))
+
+				mu.Lock()
+				defer mu.Unlock()
+
+				node.ID = id
+				responded[id] = node
+				if token := bencode.Bytes(resp["token"]); token != nil {
+					result.tokens[id] = token
+				}
+				if values, ok := resp["values"].([]interface{}); ok {
+					for _, value := range values {
+						peer, err := decodeCompactPeer(bencode.Bytes(value))
+						if err == nil && !seenPeers[peer] {
+							seenPeers[peer] = true
+							result.peers = append(result.peers, peer)
+						}
+					}
+				}
+				candidates = append(candidates, nodes...)
+			}(node)
+		}
+		wg.Wait()
+
+		candidates = closestUnique(candidates, s.id, target, K, queried, responded)
+	}
+
+	for _, node := range responded {
+		result.closest = append(result.closest, node)
+	}
+	sortByDistance(result.closest, target)
+	if len(result.closest) > K {
+		result.closest = result.closest[:K]
+	}
+
+	return result, nil
+}
+
+// closestUnique deduplicates the candidates and keeps the count closest ones that have
+// not failed, nodes that were queried but did not answer and ourselves are dropped
+func closestUnique(candidates []Node, self, target NodeID, count int, queried map[netip.AddrPort]bool, responded map[NodeID]Node) []Node {
+	seen := make(map[NodeID]bool)
+	unique := make([]Node, 0, len(candidates))
+	for _, node := range candidates {
+		if seen[node.ID] || node.ID == self {
+			continue
+		}
+		if queried[node.Addr] {
+			if _, ok := responded[node.ID]; !ok {
+				continue
+			}
+		}
+		seen[node.ID] = true
+		unique = append(unique, node)
+	}
+
+	sortByDistance(unique, target)
+	if len(unique) > count {
+		unique = unique[:count]
+	}
+
+	return unique
+}
@@ -0,0 +1,130 @@
+package dht
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math/bits"
+	"net/netip"
+	"time"
+)
+
+const (
+	// compact node info is the 20 byte node ID followed by compact IPv4 peer info
+	compactNodeSize = 26
+	compactPeerSize = 6
+	// IPv6 peers can show up in get_peers values even though nodes are IPv4 only
+	compactPeer6Size = 18
+)
+
+// NodeID identifies a node in the DHT, it lives in the same 160 bit space as info hashes
+type NodeID [20]byte
+
+func RandomNodeID() NodeID {
+	var id NodeID
+	rand.Read(id[:])
+	return id
+}
+
+func (id NodeID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// Distance is the XOR metric used by Kademlia, smaller means closer
+func (id NodeID) Distance(other NodeID) NodeID {
+	var distance NodeID
+	for i := range id {
+		distance[i] = id[i] ^ other[i]
+	}
+	return distance
+}
+
+// Less reports whether id is a smaller number than other, used to compare distances
+func (id NodeID) Less(other NodeID) bool {
+	for i := range id {
+		if id[i] != other[i] {
+			return id[i] < other[i]
+		}
+	}
+	return false
+}
+
+// commonPrefixLength returns the number of leading bits id and other share
+func (id NodeID) commonPrefixLength(other NodeID) int {
+	for i := range id {
+		if x := id[i] ^ other[i]; x != 0 {
+			return i*8 + bits.LeadingZeros8(x)
+		}
+	}
+	return len(id) * 8
+}
+
+// Node is a contact in the routing table
+type Node struct {
+	ID       NodeID
+	Addr     netip.AddrPort
+	LastSeen time.Time
+	// Failures counts queries to the node that went unanswered since it last responded
+	Failures int
+}
+
+func nodeIDFromBytes(b []byte) (NodeID, error) {
+	var id NodeID
+	if len(b) != len(id) {
+		return id, fmt.Errorf("invalid node id length: %d", len(b))
+	}
+	copy(id[:], b)
+	return id, nil
+}
+
+func encodeCompactNodes(nodes []Node) []byte {
+	compact := make([]byte, 0, len(nodes)*compactNodeSize)
+	for _, node := range nodes {
+		if !node.Addr.Addr().Is4() {
+			continue
+		}
+		compact = append(compact, node.ID[:]...)
+		compact = append(compact, encodeCompactPeer(node.Addr)...)
+	}
+	return compact
+}
+
+func decodeCompactNodes(compact []byte) ([]Node, error) {
+	if len(compact)%compactNodeSize != 0 {
+		return nil, fmt.Errorf("invalid compact node info length: %d", len(compact))
+	}
+
+	nodes := make([]Node, 0, len(compact)/compactNodeSize)
+	for i := 0; i < len(compact); i += compactNodeSize {
+		var id NodeID
+		copy(id[:], compact[i:i+20])
+		addr, err := decodeCompactPeer(compact[i+20 : i+compactNodeSize])
+		if err != nil {
+			continue
+		}
+		nodes = append(nodes, Node{ID: id, Addr: addr})
+	}
+
+	return nodes, nil
+}
+
+func encodeCompactPeer(addr netip.AddrPort) []byte {
+	ip := addr.Addr().Unmap()
+	compact := ip.AsSlice()
+	return binary.BigEndian.AppendUint16(compact, addr.Port())
+}
+
+func decodeCompactPeer(compact []byte) (netip.AddrPort, error) {
+	if len(compact) != compactPeerSize && len(compact) != compactPeer6Size {
+		return netip.AddrPort{}, fmt.Errorf("invalid compact peer info length: %d", len(compact))
+	}
+
+	ip, _ := netip.AddrFromSlice(compact[:len(compact)-2])
+	port := binary.BigEndian.Uint16(compact[len(compact)-2:])
+	if ip.IsUnspecified() || port == 0 {
+		return netip.AddrPort{}, fmt.Errorf("invalid peer address %s:%d", ip, port)
+	}
+
+	return netip.AddrPortFrom(ip.Unmap(), port), nil
+}
@@ -0,0 +1,60 @@
+package dht
+
+import (
+	"net/netip"
+	"sync"
+	"time"
+)
+
+const (
+	// announced peers are forgotten if they do not announce again within this time
+	peerTTL = 30 * time.Minute
+	// maximum number of peers returned in a single get_peers response, keeps the
+	// response within a single UDP packet
+	maxPeersPerResponse = 50
+)
+
+// peerStore remembers the peers that announced themselves to us for each info hash
+type peerStore struct {
+	mu    sync.Mutex
+	peers map[[20]byte]map[netip.AddrPort]time.Time
+}
+
+func newPeerStore() *peerStore {
+	return &peerStore{peers: make(map[[20]byte]map[netip.AddrPort]time.Time)}
+}
+
+func (s *peerStore) Add(infoHash [20]byte, addr netip.AddrPort) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.peers[infoHash] == nil {
+		s.peers[infoHash] = make(map[netip.AddrPort]time.Time)
+	}
+	s.peers[infoHash][addr] = time.Now().Add(peerTTL)
+}
+
+// Get returns up to maxPeersPerResponse peers for the info hash, map iteration order
+// makes sure different queriers get different subsets
+func (s *peerStore) Get(infoHash [20]byte) []netip.AddrPort {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	peers := make([]netip.AddrPort, 0)
+	for addr, expires := range s.peers[infoHash] {
+		if now.After(expires) {
+			delete(s.peers[infoHash], addr)
+			continue
+		}
+		if len(peers) < maxPeersPerResponse {
+			peers = append(peers, addr)
+		}
+	}
+
+	if len(s.peers[infoHash]) == 0 {
+		delete(s.peers, infoHash)
+	}
+
+	return peers
+}
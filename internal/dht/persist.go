@@ -0,0 +1,102 @@
+package dht
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+)
+
+// the routing table is persisted as JSON along with our node ID, nodes only make sense
+// relative to the ID they were collected for
+type persistedState struct {
+	ID    string          `json:"id"`
+	Nodes []persistedNode `json:"nodes"`
+}
+
+type persistedNode struct {
+	ID   string `json:"id"`
+	Addr string `json:"addr"`
+}
+
+type state struct {
+	id    NodeID
+	nodes []Node
+}
+
+// loadState returns nil without an error when there is no state to load
+func loadState(path string) (*state, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var persisted persistedState
+	if err := json.Unmarshal(data, &persisted); err != nil {
+		return nil, fmt.Errorf("invalid state file: %w", err)
+	}
+
+	idBytes, err := hex.DecodeString(persisted.ID)
+	if err != nil {
+		return nil, fmt.Errorf("invalid node id in state file: %w", err)
+	}
+	id, err := nodeIDFromBytes(idBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	loaded := &state{id: id}
+	for _, node := range persisted.Nodes {
+		nodeIDBytes, err := hex.DecodeString(node.ID)
+		if err != nil {
+			continue
+		}
+		nodeID, err := nodeIDFromBytes(nodeIDBytes)
+		if err != nil {
+			continue
+		}
+		addr, err := netip.ParseAddrPort(node.Addr)
+		if err != nil {
+			continue
+		}
+		loaded.nodes = append(loaded.nodes, Node{ID: nodeID, Addr: addr})
+	}
+
+	return loaded, nil
+}
+
+func saveState(path string, id NodeID, nodes []Node) error {
+	persisted := persistedState{ID: id.String(), Nodes: make([]persistedNode, 0, len(nodes))}
+	for _, node := range nodes {
+		if node.Failures >= maxFailures {
+			continue
+		}
+		persisted.Nodes = append(persisted.Nodes, persistedNode{ID: node.ID.String(), Addr: node.Addr.String()})
+	}
+
+	data, err := json.MarshalIndent(persisted, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return err
+	}
+
+	// write to a temporary file first so a crash never leaves a truncated state behind
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
@@ -0,0 +1,146 @@
+package dht
+
+import (
+	"net/netip"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// K is the maximum number of nodes in a bucket and the number of nodes returned by
+	// find_node and get_peers
+	K = 8
+	// nodes that did not respond for this long are questionable and get pinged
+	questionableAfter = 15 * time.Minute
+	// nodes that failed to respond this many times in a row are replaced by new ones
+	maxFailures = 2
+)
+
+// RoutingTable keeps the nodes we know about. Kademlia splits the ID space in buckets by
+// distance to our own ID: bucket i holds the nodes whose IDs share exactly i leading bits
+// with ours, so we know many nodes close to us and only a few far away. Every bucket
+// holds at most K nodes, new nodes only replace nodes that stopped responding
+type RoutingTable struct {
+	self NodeID
+
+	mu      sync.Mutex
+	buckets [160][]*Node
+}
+
+func NewRoutingTable(self NodeID) *RoutingTable {
+	return &RoutingTable{self: self}
+}
+
+// Insert adds a node that was seen alive, or refreshes it if it is already known. It
+// reports whether the node is now in the table
+func (t *RoutingTable) Insert(id NodeID, addr netip.AddrPort) bool {
+	if id == t.self || !addr.IsValid() {
+		return false
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	bucket := t.bucketIndex(id)
+	for _, node := range t.buckets[bucket] {
+		if node.ID == id {
+			node.Addr = addr
+			node.LastSeen = time.Now()
+			node.Failures = 0
+			return true
+		}
+	}
+
+	newNode := &Node{ID: id, Addr: addr, LastSeen: time.Now()}
+	if len(t.buckets[bucket]) < K {
+		t.buckets[bucket] = append(t.buckets[bucket], newNode)
+		return true
+	}
+
+	for i, node := range t.buckets[bucket] {
+		if node.Failures >= maxFailures {
+			t.buckets[bucket][i] = newNode
+			return true
+		}
+	}
+
+	return false
+}
+
+// Failed records that a node did not answer a query
+func (t *RoutingTable) Failed(id NodeID) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, node := range t.buckets[t.bucketIndex(id)] {
+		if node.ID == id {
+			node.Failures++
+			return
+		}
+	}
+}
+
+// Closest returns up to count nodes sorted by distance to target, bad nodes are skipped
+func (t *RoutingTable) Closest(target NodeID, count int) []Node {
+	nodes := t.filter(func(node *Node) bool {
+		return node.Failures < maxFailures
+	})
+
+	sortByDistance(nodes, target)
+	if len(nodes) > count {
+		nodes = nodes[:count]
+	}
+
+	return nodes
+}
+
+// Questionable returns the nodes we have not heard from in a while
+func (t *RoutingTable) Questionable() []Node {
+	return t.filter(func(node *Node) bool {
+		return time.Since(node.LastSeen) > questionableAfter
+	})
+}
+
+// Nodes returns a copy of every node in the table
+func (t *RoutingTable) Nodes() []Node {
+	return t.filter(func(*Node) bool { return true })
+}
+
+func (t *RoutingTable) Len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	count := 0
+	for _, bucket := range t.buckets {
+		count += len(bucket)
+	}
+	return count
+}
+
+func (t *RoutingTable) filter(keep func(node *Node) bool) []Node {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	nodes := make([]Node, 0)
+	for _, bucket := range t.buckets {
+		for _, node := range bucket {
+			if keep(node) {
+				nodes = append(nodes, *node)
+			}
+		}
+	}
+
+	return nodes
+}
+
+func (t *RoutingTable) bucketIndex(id NodeID) int {
+	// our own ID never gets inserted, so the prefix length is at most 159
+	return min(t.self.commonPrefixLength(id), len(t.buckets)-1)
+}
+
+func sortByDistance(nodes []Node, target NodeID) {
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].ID.Distance(target).Less(nodes[j].ID.Distance(target))
+	})
+}
@@ -0,0 +1,396 @@
+package dht
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nullxDEADBEEF/bittorrent/internal/bencode"
+)
+
+const (
+	maxPacketSize       = 2048
+	maintenanceInterval = time.Minute
+)
+
+var (
+	ErrClosed  = errors.New("dht server closed")
+	ErrTimeout = errors.New("dht query timed out")
+)
+
+// DefaultBootstrapNodes are well known routers used to join the DHT
+var DefaultBootstrapNodes = []string{
+	"router.bittorrent.com:6881",
+	"dht.transmissionbt.com:6881",
+	"router.utorrent.com:6881",
+}
+
+type Config struct {
+	// Addr is the UDP address to listen on, e.g. ":6881"
+	Addr string
+	// NodeID is our ID in the DHT, a random one is used if it is zero and none was
+	// persisted in StateFile
+	NodeID NodeID
+	// BootstrapNodes are "host:port" addresses contacted when joining the DHT
+	BootstrapNodes []string
+	// StateFile, if set, is where the routing table is loaded from on start and saved
+	// to on Close so we do not have to bootstrap from scratch every time
+	StateFile string
+	// QueryTimeout is how long we wait for a node to answer a query
+	QueryTimeout time.Duration
+}
+
+func DefaultConfig() Config {
+	return Config{
+		Addr:           ":6881",
+		BootstrapNodes: DefaultBootstrapNodes,
+		QueryTimeout:   5 * time.Second,
+	}
+}
+
+// Server is a node of the mainline DHT (BEP 5). It answers queries from other nodes and
+// performs the iterative lookups needed to find peers for an info hash
+type Server struct {
+	config Config
+	id     NodeID
+	conn   net.PacketConn
+	table  *RoutingTable
+	tokens *tokenManager
+	peers  *peerStore
+
+	mu           sync.Mutex
+	transactions map[string]chan message
+	nextTID      uint16
+
+	// bootstrapping is set while maintain runs a bootstrap, so a slow one is not joined
+	// by another
+	bootstrapping atomic.Bool
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func NewServer(config Config) (*Server, error) {
+	if config.QueryTimeout == 0 {
+		config.QueryTimeout = DefaultConfig().QueryTimeout
+	}
+
+	state, err := loadState(config.StateFile)
+	if err != nil {
+		log.Printf("Failed to load DHT state: %v", err)
+	}
+
+	id := config.NodeID
+	if id == (NodeID{}) && state != nil {
+		id = state.id
+	}
+	if id == (NodeID{}) {
+		id = RandomNodeID()
+	}
+
+	conn, err := net.ListenPacket("udp", config.Addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen: %w", err)
+	}
+
+	s := &Server{
+		config:       config,
+		id:           id,
+		conn:         conn,
+		table:        NewRoutingTable(id),
+		tokens:       newTokenManager(),
+		peers:        newPeerStore(),
+		transactions: make(map[string]chan message),
+		closed:       make(chan struct{}),
+	}
+
+	if state != nil && state.id == id {
+		for _, node := range state.nodes {
+			s.table.Insert(node.ID, node.Addr)
+		}
+	}
+
+	go s.readLoop()
+	go s.maintain()
+
+	return s, nil
+}
+
+func (s *Server) ID() NodeID {
+	return s.id
+}
+
+func (s *Server) Addr() net.Addr {
+	return s.conn.LocalAddr()
+}
+
+// Nodes returns the contents of the routing table
+func (s *Server) Nodes() []Node {
+	return s.table.Nodes()
+}
+
+// AddNode inserts a known node in the routing table without contacting it
+func (s *Server) AddNode(id NodeID, addr netip.AddrPort) {
+	s.table.Insert(id, addr)
+}
+
+// Close stops the server and saves the routing table if a state file is configured
+func (s *Server) Close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		close(s.closed)
+		err = s.conn.Close()
+		if s.config.StateFile != "" {
+			if saveErr := saveState(s.config.StateFile, s.id, s.table.Nodes()); saveErr != nil {
+				err = saveErr
+			}
+		}
+	})
+	return err
+}
+
+func (s *Server) Ping(addr netip.AddrPort) (NodeID, error) {
+	resp, err := s.query(addr, methodPing, map[string]interface{}{})
+	if err != nil {
+		return NodeID{}, err
+	}
+	return nodeIDValue(resp, "id")
+}
+
+func (s *Server) FindNode(addr netip.AddrPort, target NodeID) ([]Node, error) {
+	resp, err := s.query(addr, methodFindNode, map[string]interface{}{"target": target[:]})
+	if err != nil {
+		return nil, err
+	}
+	return decodeCompactNodes(bencode.Bytes(resp["nodes"]))
+}
+
+// query sends a query to addr and waits for the response. Nodes that answer are added
+// to the routing table, nodes that do not are marked as failed
+func (s *Server) query(addr netip.AddrPort, method string, args map[string]interface{}) (map[string]interface{}, error) {
+	args["id"] = s.id[:]
+
+	tid, responses := s.newTransaction()
+	defer s.endTransaction(tid)
+
+	packet, err := encodeMessage(message{TransactionID: tid, Type: typeQuery, Method: method, Args: args})
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := s.conn.WriteTo(packet, net.UDPAddrFromAddrPort(addr)); err != nil {
+		return nil, err
+	}
+
+	timer := time.NewTimer(s.config.QueryTimeout)
+	defer timer.Stop()
+
+	select {
+	case msg := <-responses:
+		if msg.Error != nil {
+			return nil, msg.Error
+		}
+
+		id, err := nodeIDValue(msg.Response, "id")
+		if err != nil {
+			return nil, err
+		}
+		s.table.Insert(id, addr)
+
+		return msg.Response, nil
+	case <-timer.C:
+		s.markFailed(addr)
+		return nil, ErrTimeout
+	case <-s.closed:
+		return nil, ErrClosed
+	}
+}
+
+func (s *Server) newTransaction() (string, chan message) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.nextTID++
+	tid := string(binary.BigEndian.AppendUint16(nil, s.nextTID))
+	responses := make(chan message, 1)
+	s.transactions[tid] = responses
+
+	return tid, responses
+}
+
+func (s *Server) endTransaction(tid string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.transactions, tid)
+}
+
+func (s *Server) markFailed(addr netip.AddrPort) {
+	for _, node := range s.table.Nodes() {
+		if node.Addr == addr {
+			s.table.Failed(node.ID)
+		}
+	}
+}
+
+func (s *Server) readLoop() {
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, from, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			select {
+			case <-s.closed:
+				return
+			default:
+			}
+
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				continue
+			}
+			log.Printf("DHT read failed: %v", err)
+			return
+		}
+
+		udpAddr, ok := from.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+		addr := udpAddr.AddrPort()
+		addr = netip.AddrPortFrom(addr.Addr().Unmap(), addr.Port())
+
+		// decoded values point into the packet, so it must not share the read buffer
+		packet := make([]byte, n)
+		copy(packet, buf[:n])
+
+		msg, err := decodeMessage(packet)
+		if err != nil {
+			continue
+		}
+
+		switch msg.Type {
+		case typeQuery:
+			s.handleQuery(addr, msg)
+		case typeResponse, typeError:
+			s.mu.Lock()
+			responses, ok := s.transactions[msg.TransactionID]
+			s.mu.Unlock()
+			if ok {
+				select {
+				case responses <- msg:
+				default:
+				}
+			}
+		}
+	}
+}
+
+func (s *Server) handleQuery(addr netip.AddrPort, msg message) {
+	id, err := nodeIDValue(msg.Args, "id")
+	if err != nil {
+		s.sendError(addr, msg.TransactionID, errorProtocol, "invalid id")
+		return
+	}
+	s.table.Insert(id, addr)
+
+	response := map[string]interface{}{"id": s.id[:]}
+
+	switch msg.Method {
+	case methodPing:
+	case methodFindNode:
+		target, err := nodeIDValue(msg.Args, "target")
+		if err != nil {
+			s.sendError(addr, msg.TransactionID, errorProtocol, "invalid target")
+			return
+		}
+		response["nodes"] = encodeCompactNodes(s.table.Closest(target, K))
+	case methodGetPeers:
+		infoHash, err := nodeIDValue(msg.Args, "info_hash")
+		if err != nil {
+			s.sendError(addr, msg.TransactionID, errorProtocol, "invalid info_hash")
+			return
+		}
+		response["token"] = s.tokens.Token(addr.Addr())
+		response["nodes"] = encodeCompactNodes(s.table.Closest(infoHash, K))
+		if peers := s.peers.Get(infoHash); len(peers) > 0 {
+			values := make([]interface{}, 0, len(peers))
+			for _, peer := range peers {
+				values = append(values, encodeCompactPeer(peer))
+			}
+			response["values"] = values
+		}
+	case methodAnnouncePeer:
+		infoHash, err := nodeIDValue(msg.Args, "info_hash")
+		if err != nil {
+			s.sendError(addr, msg.TransactionID, errorProtocol, "invalid info_hash")
+			return
+		}
+		if !s.tokens.Valid(bencode.Bytes(msg.Args["token"]), addr.Addr()) {
+			s.sendError(addr, msg.TransactionID, errorProtocol, "bad token")
+			return
+		}
+
+		// with implied_port set the peer is reachable on the port it sent the query from,
+		// which is what peers behind NATs using uTP rely on
+		port := addr.Port()
+		if impliedPort, _ := msg.Args["implied_port"].(int); impliedPort == 0 {
+			announcedPort, _ := msg.Args["port"].(int)
+			if announcedPort <= 0 || announcedPort > 65535 {
+				s.sendError(addr, msg.TransactionID, errorProtocol, "invalid port")
+				return
+			}
+			port = uint16(announcedPort)
+		}
+		s.peers.Add(infoHash, netip.AddrPortFrom(addr.Addr(), port))
+	default:
+		s.sendError(addr, msg.TransactionID, errorMethodUnknown, "method unknown")
+		return
+	}
+
+	s.send(addr, message{TransactionID: msg.TransactionID, Type: typeResponse, Response: response})
+}
+
+func (s *Server) sendError(addr netip.AddrPort, tid string, code int, errorMessage string) {
+	s.send(addr, message{TransactionID: tid, Type: typeError, Error: &KRPCError{Code: code, Message: errorMessage}})
+}
+
+func (s *Server) send(addr netip.AddrPort, msg message) {
+	packet, err := encodeMessage(msg)
+	if err != nil {
+		log.Printf("Failed to encode DHT message: %v", err)
+		return
+	}
+	s.conn.WriteTo(packet, net.UDPAddrFromAddrPort(addr))
+}
+
+// maintain pings nodes we have not heard from in a while so nodes that left the DHT
+// are eventually replaced, and refreshes the table when it runs low on nodes
+func (s *Server) maintain() {
+	ticker := time.NewTicker(maintenanceInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.closed:
+			return
+		case <-ticker.C:
+		}
+
+		for _, node := range s.table.Questionable() {
+			go s.Ping(node.Addr)
+		}
+
+		if s.table.Len() < K && s.bootstrapping.CompareAndSwap(false, true) {
+			go func() {
+				defer s.bootstrapping.Store(false)
+				s.Bootstrap()
+			}()
+		}
+	}
+}
@@ -0,0 +1,205 @@
+package dht
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func newTestServer(t *testing.T, config Config) *Server {
+	t.Helper()
+
+	config.Addr = "127.0.0.1:0"
+	if config.QueryTimeout == 0 {
+		config.QueryTimeout = time.Second
+	}
+	s, err := NewServer(config)
+	if err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func serverAddr(s *Server) netip.AddrPort {
+	return s.Addr().(*net.UDPAddr).AddrPort()
+}
+
+// newTestNetwork starts n servers that joined the DHT through the first one
+func newTestNetwork(t *testing.T, n int) []*Server {
+	t.Helper()
+
+	router := newTestServer(t, Config{})
+	servers := []*Server{router}
+	for i := 1; i < n; i++ {
+		s := newTestServer(t, Config{BootstrapNodes: []string{serverAddr(router).String()}})
+		if err := s.Bootstrap(); err != nil {
+			t.Fatalf("server %d failed to bootstrap: %v", i, err)
+		}
+		servers = append(servers, s)
+	}
+	return servers
+}
+
+func hasNode(s *Server, id NodeID) bool {
+	return slices.ContainsFunc(s.Nodes(), func(node Node) bool { return node.ID == id })
+}
+
+func TestPing(t *testing.T) {
+	a := newTestServer(t, Config{})
+	b := newTestServer(t, Config{})
+
+	id, err := a.Ping(serverAddr(b))
+	if err != nil {
+		t.Fatalf("ping failed: %v", err)
+	}
+	if id != b.ID() {
+		t.Errorf("got id %v, want %v", id, b.ID())
+	}
+
+	// both ends learn about each other
+	if !hasNode(a, b.ID()) || !hasNode(b, a.ID()) {
+		t.Error("nodes are missing from the routing tables after a ping")
+	}
+}
+
+func TestPingTimeout(t *testing.T) {
+	a := newTestServer(t, Config{QueryTimeout: 100 * time.Millisecond})
+	b := newTestServer(t, Config{})
+	addr := serverAddr(b)
+	b.Close()
+
+	if _, err := a.Ping(addr); !errors.Is(err, ErrTimeout) {
+		t.Fatalf("got %v, want ErrTimeout", err)
+	}
+}
+
+func TestFindNode(t *testing.T) {
+	a := newTestServer(t, Config{})
+	b := newTestServer(t, Config{})
+	c := newTestServer(t, Config{})
+	b.AddNode(c.ID(), serverAddr(c))
+
+	nodes, err := a.FindNode(serverAddr(b), c.ID())
+	if err != nil {
+		t.Fatalf("find_node failed: %v", err)
+	}
+	if !slices.ContainsFunc(nodes, func(node Node) bool { return node.ID == c.ID() && node.Addr == serverAddr(c) }) {
+		t.Errorf("find_node returned %v, want %v at %v", nodes, c.ID(), serverAddr(c))
+	}
+}
+
+func TestBootstrapFillsRoutingTables(t *testing.T) {
+	servers := newTestNetwork(t, 5)
+
+	// the last server to join learned about the others from the lookup of its own id
+	last := servers[len(servers)-1]
+	for _, s := range servers[:len(servers)-1] {
+		if !hasNode(last, s.ID()) {
+			t.Errorf("server %v is missing from the routing table of the last one", s.ID())
+		}
+	}
+}
+
+func TestAnnounceAndGetPeers(t *testing.T) {
+	servers := newTestNetwork(t, 6)
+	infoHash := [20]byte{1, 2, 3}
+
+	if _, err := servers[1].Announce(infoHash, 6881, false); err != nil {
+		t.Fatalf("announce failed: %v", err)
+	}
+	// with implied_port the port we send from is used instead
+	if _, err := servers[2].Announce(infoHash, 1, true); err != nil {
+		t.Fatalf("announce with implied port failed: %v", err)
+	}
+
+	peers, err := servers[5].GetPeers(infoHash)
+	if err != nil {
+		t.Fatalf("get_peers failed: %v", err)
+	}
+
+	want := []netip.AddrPort{
+		netip.MustParseAddrPort("127.0.0.1:6881"),
+		serverAddr(servers[2]),
+	}
+	for _, peer := range want {
+		if !slices.Contains(peers, peer) {
+			t.Errorf("get_peers returned %v, want %v among them", peers, peer)
+		}
+	}
+
+	peers, err = servers[5].GetPeers([20]byte{4, 5, 6})
+	if err != nil {
+		t.Fatalf("get_peers for another info hash failed: %v", err)
+	}
+	if len(peers) != 0 {
+		t.Errorf("got peers %v for an info hash nobody announced", peers)
+	}
+}
+
+func TestAnnounceRejectsBadToken(t *testing.T) {
+	a := newTestServer(t, Config{})
+	b := newTestServer(t, Config{})
+	infoHash := [20]byte{1, 2, 3}
+
+	_, err := a.query(serverAddr(b), methodAnnouncePeer, map[string]interface{}{
+		"info_hash": infoHash[:],
+		"port":      6881,
+		"token":     []byte("not a token"),
+	})
+	var krpcErr *KRPCError
+	if !errors.As(err, &krpcErr) || krpcErr.Code != errorProtocol {
+		t.Fatalf("got %v, want a protocol error", err)
+	}
+
+	// a token handed to another address is no good either
+	token := b.tokens.Token(netip.MustParseAddr("10.0.0.1"))
+	_, err = a.query(serverAddr(b), methodAnnouncePeer, map[string]interface{}{
+		"info_hash": infoHash[:],
+		"port":      6881,
+		"token":     token,
+	})
+	if !errors.As(err, &krpcErr) || krpcErr.Code != errorProtocol {
+		t.Fatalf("got %v for the token of another address, want a protocol error", err)
+	}
+
+	if peers := b.peers.Get(infoHash); len(peers) != 0 {
+		t.Errorf("peers %v were stored despite bad tokens", peers)
+	}
+}
+
+func TestRoutingTableIsSaved(t *testing.T) {
+	stateFile := filepath.Join(t.TempDir(), "dht", "state.json")
+	a := newTestServer(t, Config{StateFile: stateFile})
+	b := newTestServer(t, Config{})
+	c := newTestServer(t, Config{})
+	if _, err := a.Ping(serverAddr(b)); err != nil {
+		t.Fatalf("ping failed: %v", err)
+	}
+	a.AddNode(c.ID(), serverAddr(c))
+
+	id := a.ID()
+	if err := a.Close(); err != nil {
+		t.Fatalf("failed to close: %v", err)
+	}
+
+	restarted := newTestServer(t, Config{StateFile: stateFile})
+	if restarted.ID() != id {
+		t.Errorf("restarted with id %v, want the saved %v", restarted.ID(), id)
+	}
+	for _, s := range []*Server{b, c} {
+		if !hasNode(restarted, s.ID()) {
+			t.Errorf("node %v was not restored", s.ID())
+		}
+	}
+
+	// the nodes only make sense for the id they were collected for
+	other := newTestServer(t, Config{StateFile: stateFile, NodeID: RandomNodeID()})
+	if len(other.Nodes()) != 0 {
+		t.Errorf("a server with another id loaded %d nodes", len(other.Nodes()))
+	}
+}
@@ -0,0 +1,72 @@
+package dht
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// tokens are handed out in get_peers responses and have to be presented in announce_peer
+// queries, which proves the announcing node owns the address it announces from. A token
+// is the SHA-1 of a secret and the querying IP, the secret changes every five minutes and
+// tokens made with the previous secret are still accepted
+const tokenSecretLifetime = 5 * time.Minute
+
+type tokenManager struct {
+	mu             sync.Mutex
+	secret         []byte
+	previousSecret []byte
+	rotated        time.Time
+}
+
+func newTokenManager() *tokenManager {
+	return &tokenManager{secret: randomSecret(), rotated: time.Now()}
+}
+
+func (m *tokenManager) Token(ip netip.Addr) []byte {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.rotate()
+	return tokenFor(m.secret, ip)
+}
+
+func (m *tokenManager) Valid(token []byte, ip netip.Addr) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.rotate()
+	for _, secret := range [][]byte{m.secret, m.previousSecret} {
+		if secret != nil && subtle.ConstantTimeCompare(token, tokenFor(secret, ip)) == 1 {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (m *tokenManager) rotate() {
+	if time.Since(m.rotated) < tokenSecretLifetime {
+		return
+	}
+
+	m.previousSecret = m.secret
+	m.secret = randomSecret()
+	m.rotated = time.Now()
+}
+
+func tokenFor(secret []byte, ip netip.Addr) []byte {
+	hash := sha1.New()
+	hash.Write(secret)
+	hash.Write(ip.Unmap().AsSlice())
+	return hash.Sum(nil)
+}
+
+func randomSecret() []byte {
+	secret := make([]byte, 20)
+	rand.Read(secret)
+	return secret
+}
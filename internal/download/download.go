@@ -0,0 +1,833 @@
+package download
+
+import (
+	"context"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nullxDEADBEEF/bittorrent/internal/merkle"
+	"github.com/nullxDEADBEEF/bittorrent/internal/mse"
+	"github.com/nullxDEADBEEF/bittorrent/internal/peer"
+	"github.com/nullxDEADBEEF/bittorrent/internal/ratelimit"
+	"github.com/nullxDEADBEEF/bittorrent/internal/utp"
+)
+
+var (
+	ErrStopped = errors.New("download stopped before completion")
+	// ErrNoPeers is returned by Run when the download stalled for StallTimeout
+	ErrNoPeers = errors.New("no peers to download from")
+	// ErrPieceHashMismatch is wrapped by the PieceHashError of a piece whose data does
+	// not match its hash
+	ErrPieceHashMismatch = errors.New("piece failed hash check")
+)
+
+// PieceHashError tells which piece failed its hash check
+type PieceHashError struct {
+	Index int
+}
+
+func (e *PieceHashError) Error() string {
+	return fmt.Sprintf("piece %d failed hash check", e.Index)
+}
+
+func (e *PieceHashError) Unwrap() error {
+	return ErrPieceHashMismatch
+}
+
+// Torrent holds what the download needs to know from the metainfo file
+type Torrent struct {
+	InfoHash    [20]byte
+	PieceHashes [][20]byte
+	PieceLength int
+	Length      int
+	// Name and Files describe the layout of the data, they are needed to find the pieces
+	// on web seeds. A torrent without files is a single file of Length bytes
+	Name  string
+	Files []File
+	// V2Pieces verify the pieces of v2 and hybrid torrents (BEP 52), pieces of hybrid
+	// torrents have to match both their v1 and v2 hashes. PieceLayers are the piece layers
+	// of the files, served to peers asking for them
+	V2Pieces    []V2Piece
+	PieceLayers map[merkle.Hash][]merkle.Hash
+	// WebSeeds are the URLs of HTTP servers hosting the files (BEP 19)
+	WebSeeds []string
+	// Private torrents (BEP 27) only get peers from their trackers, peer exchange is
+	// disabled for them
+	Private bool
+	// Metadata is the bencoded info dictionary, it is served to peers that joined the
+	// swarm from a magnet link (BEP 9) when set
+	Metadata []byte
+}
+
+// File is one of the files of a torrent, the pieces cover the files back to back
+type File struct {
+	// Path is relative to the directory named after the torrent, it is empty for the
+	// only file of a single file torrent
+	Path   []string
+	Length int
+	// Pad files align the next file on a piece boundary, they are zeros
+	Pad bool
+}
+
+// V2Piece is the merkle hash of a v2 piece, Length is the part of the piece belonging
+// to its file and Leaves the width of the subtree the hash is the root of
+type V2Piece struct {
+	Root   merkle.Hash
+	Length int
+	Leaves int
+}
+
+func (t *Torrent) NumPieces() int {
+	if len(t.PieceHashes) == 0 {
+		return len(t.V2Pieces)
+	}
+	return len(t.PieceHashes)
+}
+
+// zeroPadding clears the parts of a piece falling in pad files, whatever a peer sent
+// there they hash as zeros
+func (t *Torrent) zeroPadding(index int, data []byte) {
+	for _, r := range t.fileRanges(index*t.PieceLength, len(data)) {
+		if t.Files[r.file].Pad {
+			begin := int(r.offset) + t.fileOffset(r.file) - index*t.PieceLength
+			clear(data[begin : begin+r.length])
+		}
+	}
+}
+
+// fileOffset returns the offset of the first byte of a file in the torrent
+func (t *Torrent) fileOffset(file int) int {
+	offset := 0
+	for _, f := range t.Files[:file] {
+		offset += f.Length
+	}
+	return offset
+}
+
+// verify checks a piece against every hash we have for it
+func (t *Torrent) verify(index int, data []byte) bool {
+	if len(t.PieceHashes) > 0 && sha1.Sum(data) != t.PieceHashes[index] {
+		return false
+	}
+	if len(t.V2Pieces) > 0 {
+		piece := t.V2Pieces[index]
+		if piece.Length > len(data) || merkle.PieceHash(data[:piece.Length], piece.Leaves) != piece.Root {
+			return false
+		}
+	}
+	return true
+}
+
+// PieceSize returns the length of a piece, only the last one may be shorter
+func (t *Torrent) PieceSize(index int) int {
+	begin := index * t.PieceLength
+	return min(begin+t.PieceLength, t.Length) - begin
+}
+
+// Storage keeps the data of verified pieces at their offset in the torrent. WriteAt may
+// drop the parts of a piece falling in files SetSkip skipped, the download keeps such
+// pieces in memory and writes them again once their files are wanted
+type Storage interface {
+	io.ReaderAt
+	io.WriterAt
+	SetSkip(file int, skip bool)
+}
+
+type Config struct {
+	PeerID [20]byte
+	// Port is the TCP port we tell peers we listen on
+	Port uint16
+	// MaxConnections is the number of peers we talk to at once
+	MaxConnections int
+	// Pieces restricts the download to these piece indexes, every piece is downloaded
+	// when it is empty
+	Pieces []int
+	// FilePriorities are the initial priorities of the files, files without one are
+	// downloaded with PriorityNormal
+	FilePriorities []Priority
+	// Sequential downloads the pieces right after the first missing one before any other,
+	// Readahead of them, so the data becomes available from the start
+	Sequential bool
+	Readahead  int
+	// DialTimeout bounds connecting to a peer and HandshakeTimeout the handshakes that
+	// follow. A peer that leaves our block requests unanswered for RequestTimeout is
+	// dropped so its pieces go to other peers
+	DialTimeout      time.Duration
+	HandshakeTimeout time.Duration
+	RequestTimeout   time.Duration
+	// Encryption is the message stream encryption policy of outgoing connections
+	Encryption mse.Policy
+	// Transport decides whether peers are connected to over TCP, uTP or both, uTP needs
+	// the UTP socket to be set
+	Transport peer.Transport
+	UTP       *utp.Socket
+	// DownloadLimit and UploadLimit cap the rate of the pieces we receive and send, they
+	// are usually shared by every download of a client. Nil limiters do not limit
+	DownloadLimit *ratelimit.Limiter
+	UploadLimit   *ratelimit.Limiter
+	// Storage is where pieces are written as soon as they are verified, and read back
+	// from to serve peers and file readers. Without it every piece is kept in memory,
+	// which only suits downloads of a few pieces. Run fails when it can not be written to
+	Storage Storage
+	// OnPiece is called with every piece once it is verified and stored, before Done is
+	// closed when it is the last one. It is called from the connection that downloaded
+	// the piece
+	OnPiece func(index int, data []byte)
+	// OnEvent is called with the events of the download as they happen, from the
+	// goroutine that caused them, so it must return quickly
+	OnEvent func(Event)
+	// StallTimeout makes Run give up when no piece was verified for that long, rather
+	// than wait for peers that may never come. It returns the PieceHashError of the last
+	// piece that failed its hash check, as peers sending corrupt data stall the download
+	// too, or ErrNoPeers. Zero waits forever
+	StallTimeout time.Duration
+}
+
+func DefaultConfig() Config {
+	return Config{
+		Port:             6881,
+		MaxConnections:   5,
+		DialTimeout:      10 * time.Second,
+		HandshakeTimeout: 10 * time.Second,
+		RequestTimeout:   time.Minute,
+	}
+}
+
+// setTimeouts replaces the timeouts that are not set with the default ones
+func (c *Config) setTimeouts() {
+	defaults := DefaultConfig()
+	if c.DialTimeout <= 0 {
+		c.DialTimeout = defaults.DialTimeout
+	}
+	if c.HandshakeTimeout <= 0 {
+		c.HandshakeTimeout = defaults.HandshakeTimeout
+	}
+	if c.RequestTimeout <= 0 {
+		c.RequestTimeout = defaults.RequestTimeout
+	}
+}
+
+type pieceState int
+
+const (
+	pieceMissing pieceState = iota
+	pieceInProgress
+	pieceDone
+	// pieces that are not part of the download
+	pieceSkipped
+)
+
+// Download fetches the pieces of a single torrent from the peers in its pool. Every
+// connection runs in its own goroutine and asks the download for the next piece to fetch
+// from that peer, until every wanted piece is downloaded and verified
+type Download struct {
+	torrent Torrent
+	config  Config
+	pool    *pool
+
+	mu     sync.Mutex
+	states []pieceState
+	// pieces are the verified pieces kept in memory, every one of them without Storage,
+	// otherwise the ones storage dropped part of. skipped are the files storage was last
+	// told to skip, skipVersion counts the times that changed
+	pieces      [][]byte
+	skipped     []bool
+	skipVersion int
+	priorities  []Priority
+	// filePriorities are set by the user, pieceFilter restricts the download to some
+	// pieces when it is not nil
+	filePriorities []Priority
+	pieceFilter    []bool
+	// remaining counts the wanted pieces not downloaded yet, completed is set once it
+	// reached zero and done was closed
+	remaining int
+	completed bool
+	// readers are the open file readers with the pieces they are about to read, cursor is
+	// the first piece that may be missing in sequential mode. progress is closed and
+	// replaced whenever a piece is verified or the priorities change
+	readers  map[*FileReader]readerWindow
+	cursor   int
+	progress chan struct{}
+
+	// finished is closed when Run returns or its context is cancelled, it is nil while
+	// Run is not running. Incoming connections are only accepted while it is open and Run
+	// waits for them through inbound before returning
+	finished     <-chan struct{}
+	inbound      sync.WaitGroup
+	inboundCount int
+
+	downloaded atomic.Int64
+	uploaded   atomic.Int64
+	done       chan struct{}
+	// hashErr is the last piece that failed its hash check, lastVerified is when a
+	// piece last passed it, in unix nanoseconds
+	hashErr      error
+	lastVerified atomic.Int64
+	// failed is closed when the download can not go on, err tells why
+	failed chan struct{}
+	err    error
+}
+
+func New(torrent Torrent, config Config) *Download {
+	if config.MaxConnections <= 0 {
+		config.MaxConnections = DefaultConfig().MaxConnections
+	}
+	config.setTimeouts()
+
+	if len(torrent.Files) == 0 {
+		torrent.Files = []File{{Length: torrent.Length}}
+	}
+
+	d := &Download{
+		torrent:        torrent,
+		config:         config,
+		pool:           newPool(),
+		states:         make([]pieceState, torrent.NumPieces()),
+		pieces:         make([][]byte, torrent.NumPieces()),
+		priorities:     make([]Priority, torrent.NumPieces()),
+		filePriorities: make([]Priority, len(torrent.Files)),
+		readers:        make(map[*FileReader]readerWindow),
+		progress:       make(chan struct{}),
+		done:           make(chan struct{}),
+		failed:         make(chan struct{}),
+	}
+
+	for i := range d.filePriorities {
+		d.filePriorities[i] = PriorityNormal
+		if i < len(config.FilePriorities) {
+			d.filePriorities[i] = config.FilePriorities[i]
+		}
+	}
+
+	if len(config.Pieces) > 0 {
+		d.pieceFilter = make([]bool, len(d.states))
+		for _, index := range config.Pieces {
+			if index >= 0 && index < len(d.states) {
+				d.pieceFilter[index] = true
+			}
+		}
+	}
+
+	d.updatePriorities()
+
+	return d
+}
+
+// AddPeers adds peers to the pool of candidates to connect to
+func (d *Download) AddPeers(addrs []netip.AddrPort, source Source) {
+	for _, addr := range addrs {
+		d.pool.add(addr, source, 0)
+	}
+}
+
+// Run connects to peers and downloads until every wanted piece is verified or ctx is
+// cancelled, in which case ErrStopped is returned along with the error of ctx. Every
+// connection is closed by the time Run returns, so it can be called again later
+func (d *Download) Run(ctx context.Context) error {
+	// cancelled when Run returns so every connection winds down
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	finished := ctx.Done()
+	d.mu.Lock()
+	d.finished = finished
+	d.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for i := 0; i < d.config.MaxConnections; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				addr, ok := d.pool.next(finished)
+				if !ok {
+					return
+				}
+
+				err := d.runPeer(ctx, addr)
+				if errors.Is(err, peer.ErrSelfConnection) {
+					d.pool.ban(addr)
+					continue
+				}
+				// being cancelled is not the fault of the peer
+				failed := err != nil && !errors.Is(err, errPeerIdle) && ctx.Err() == nil
+				if failed {
+					log.Printf("Connection to %s (%s) ended: %v", addr, d.pool.client(addr), err)
+				}
+				d.pool.disconnected(addr, failed)
+			}
+		}()
+	}
+
+	for _, url := range d.torrent.WebSeeds {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			d.runWebSeed(ctx, url)
+		}()
+	}
+
+	var err error
+	select {
+	case <-d.done:
+	case <-d.failed:
+		d.mu.Lock()
+		err = d.err
+		d.mu.Unlock()
+	case <-finished:
+		err = fmt.Errorf("%w: %w", ErrStopped, ctx.Err())
+	case <-d.stalled(finished):
+		d.mu.Lock()
+		err = d.hashErr
+		d.mu.Unlock()
+		if err == nil {
+			err = ErrNoPeers
+		}
+	}
+
+	d.mu.Lock()
+	d.finished = nil
+	d.mu.Unlock()
+
+	cancel()
+	wg.Wait()
+	d.inbound.Wait()
+
+	return err
+}
+
+// stalled returns a channel closed once no piece was verified for StallTimeout, it is
+// never closed when there is no StallTimeout
+func (d *Download) stalled(finished <-chan struct{}) <-chan struct{} {
+	stalled := make(chan struct{})
+	if d.config.StallTimeout <= 0 {
+		return stalled
+	}
+
+	d.lastVerified.Store(time.Now().UnixNano())
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-finished:
+				return
+			case <-ticker.C:
+			}
+			// an idle download is not waiting for peers
+			if d.Idle() {
+				d.lastVerified.Store(time.Now().UnixNano())
+				continue
+			}
+			if time.Since(time.Unix(0, d.lastVerified.Load())) > d.config.StallTimeout {
+				close(stalled)
+				return
+			}
+		}
+	}()
+	return stalled
+}
+
+// accept runs the session of an incoming connection, it is refused when the download is
+// not running or has as many incoming connections as it has outgoing ones
+func (d *Download) accept(conn *peer.Conn) {
+	addr, err := netip.ParseAddrPort(conn.RemoteAddr().String())
+	if err != nil {
+		conn.Close()
+		return
+	}
+	addr = netip.AddrPortFrom(addr.Addr().Unmap(), addr.Port())
+
+	d.mu.Lock()
+	finished := d.finished
+	if finished == nil || d.inboundCount >= d.config.MaxConnections {
+		d.mu.Unlock()
+		conn.Close()
+		return
+	}
+	d.inboundCount++
+	d.inbound.Add(1)
+	d.mu.Unlock()
+
+	go func() {
+		defer func() {
+			d.mu.Lock()
+			d.inboundCount--
+			d.mu.Unlock()
+			d.inbound.Done()
+		}()
+
+		if !d.pool.accept(addr) {
+			conn.Close()
+			return
+		}
+
+		err := d.serve(conn, addr, finished)
+		if err != nil && !errors.Is(err, errPeerIdle) {
+			log.Printf("Connection from %s (%s) ended: %v", addr, d.pool.client(addr), err)
+		}
+		d.pool.disconnected(addr, err != nil && !errors.Is(err, errPeerIdle))
+	}()
+}
+
+// handshake returns the handshake we send to peers
+func (d *Download) handshake() *peer.Handshake {
+	h := &peer.Handshake{InfoHash: d.torrent.InfoHash, PeerID: d.config.PeerID}
+	h.SetExtensions()
+	h.SetFast()
+	if len(d.torrent.V2Pieces) > 0 {
+		h.SetV2()
+	}
+	return h
+}
+
+// Done is closed once every wanted piece has been downloaded and verified
+func (d *Download) Done() <-chan struct{} {
+	return d.done
+}
+
+func (d *Download) InfoHash() [20]byte {
+	return d.torrent.InfoHash
+}
+
+// Name is the suggested name of the file, or of the directory of a multi-file torrent
+func (d *Download) Name() string {
+	return d.torrent.Name
+}
+
+func (d *Download) NumPieces() int {
+	return d.torrent.NumPieces()
+}
+
+// Peers returns the number of peers we are connected to
+func (d *Download) Peers() int {
+	return len(d.pool.connectedPeers())
+}
+
+// PeerStats describes a peer we are connected to
+type PeerStats struct {
+	Addr   netip.AddrPort
+	Source Source
+	// Client is the software the peer runs, from its extended handshake or its peer id
+	Client peer.ClientInfo
+}
+
+// PeerStats returns the peers we are connected to, sorted by address
+func (d *Download) PeerStats() []PeerStats {
+	return d.pool.stats()
+}
+
+// Downloaded returns the number of bytes of verified pieces
+func (d *Download) Downloaded() int64 {
+	return d.downloaded.Load()
+}
+
+// Uploaded returns the number of bytes of piece data sent to peers
+func (d *Download) Uploaded() int64 {
+	return d.uploaded.Load()
+}
+
+// Left returns the number of bytes we still need to download
+func (d *Download) Left() int64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	left := int64(0)
+	for i, state := range d.states {
+		if state != pieceDone && d.priorities[i] != PrioritySkip {
+			left += int64(d.torrent.PieceSize(i))
+		}
+	}
+	return left
+}
+
+// FileProgress returns how many bytes of every file belong to verified pieces
+func (d *Download) FileProgress() []int64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	pieceLength := int64(d.torrent.PieceLength)
+	progress := make([]int64, len(d.torrent.Files))
+	for i, file := range d.torrent.Files {
+		begin := int64(d.torrent.fileOffset(i))
+		end := begin + int64(file.Length)
+		for index := begin / pieceLength; index*pieceLength < end; index++ {
+			if d.states[index] == pieceDone {
+				progress[i] += min(end, (index+1)*pieceLength) - max(begin, index*pieceLength)
+			}
+		}
+	}
+	return progress
+}
+
+// Piece returns the data of a verified piece, nil if it was not downloaded
+func (d *Download) Piece(index int) ([]byte, error) {
+	if index < 0 || index >= d.torrent.NumPieces() {
+		return nil, nil
+	}
+
+	data := make([]byte, d.torrent.PieceSize(index))
+	if ok, err := d.readPiece(index, 0, data); !ok {
+		return nil, err
+	}
+	return data, nil
+}
+
+// readPiece reads the part of a verified piece starting at begin into p, from memory or
+// from storage. It reports false when the piece was not downloaded
+func (d *Download) readPiece(index, begin int, p []byte) (bool, error) {
+	d.mu.Lock()
+	if index < 0 || index >= len(d.states) || d.states[index] != pieceDone || begin < 0 || begin+len(p) > d.torrent.PieceSize(index) {
+		d.mu.Unlock()
+		return false, nil
+	}
+	if data := d.pieces[index]; data != nil {
+		copy(p, data[begin:])
+		d.mu.Unlock()
+		return true, nil
+	}
+	d.mu.Unlock()
+
+	// pieces leave memory only once they are entirely in storage
+	if _, err := d.config.Storage.ReadAt(p, d.pieceOffset(index)+int64(begin)); err != nil {
+		return false, fmt.Errorf("failed to read piece %d: %w", index, err)
+	}
+	return true, nil
+}
+
+func (d *Download) pieceOffset(index int) int64 {
+	return int64(index) * int64(d.torrent.PieceLength)
+}
+
+// overlapsSkipped reports whether part of a piece falls in a skipped file, whose data
+// storage drops. It must be called with mu held
+func (d *Download) overlapsSkipped(index int) bool {
+	for _, r := range d.torrent.fileRanges(index*d.torrent.PieceLength, d.torrent.PieceSize(index)) {
+		if !d.torrent.Files[r.file].Pad && d.filePriorities[r.file] == PrioritySkip {
+			return true
+		}
+	}
+	return false
+}
+
+// syncSkipped tells storage which files are skipped and writes the pieces kept in memory
+// whose files are all wanted again. It must be called with mu held
+func (d *Download) syncSkipped() {
+	if d.config.Storage == nil {
+		return
+	}
+
+	// the storage is told about every file the first time, it may skip some of its own
+	synced := d.skipped != nil
+	if !synced {
+		d.skipped = make([]bool, len(d.filePriorities))
+	}
+	changed := false
+	for i, priority := range d.filePriorities {
+		skip := priority == PrioritySkip && !d.torrent.Files[i].Pad
+		if synced && d.skipped[i] == skip {
+			continue
+		}
+		d.config.Storage.SetSkip(i, skip)
+		d.skipped[i] = skip
+		changed = true
+	}
+	if !changed {
+		return
+	}
+	d.skipVersion++
+
+	for index, data := range d.pieces {
+		if data == nil || d.overlapsSkipped(index) {
+			continue
+		}
+		if _, err := d.config.Storage.WriteAt(data, d.pieceOffset(index)); err != nil {
+			d.fail(fmt.Errorf("failed to store piece %d: %w", index, err))
+			return
+		}
+		d.pieces[index] = nil
+	}
+}
+
+// fail stops the download for good, Run returns err. It must be called with mu held
+func (d *Download) fail(err error) {
+	if d.err == nil {
+		d.err = err
+		close(d.failed)
+	}
+}
+
+// Stop ends the download for good once nothing will download it anymore: Run returns
+// ErrStopped right away and reads waiting for pieces give up. Verified pieces can still
+// be read
+func (d *Download) Stop() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.fail(ErrStopped)
+}
+
+// notifyProgress wakes the readers waiting for pieces, it must be called with mu held
+func (d *Download) notifyProgress() {
+	close(d.progress)
+	d.progress = make(chan struct{})
+}
+
+// pickPiece returns a missing piece the peer has and marks it as in progress. Pieces
+// close to what readers are reading come first, then the ones of higher priority, among
+// pieces of the same priority the preferred ones are tried first
+func (d *Download) pickPiece(has func(index int) bool, preferred []int) (int, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if index, ok := d.pickUrgent(has); ok {
+		d.states[index] = pieceInProgress
+		return index, true
+	}
+
+	best, bestPriority := -1, PrioritySkip
+	for _, i := range preferred {
+		if i >= 0 && i < len(d.states) && d.states[i] == pieceMissing && d.priorities[i] > bestPriority && has(i) {
+			best, bestPriority = i, d.priorities[i]
+		}
+	}
+	for i, state := range d.states {
+		if bestPriority == PriorityHigh {
+			break
+		}
+		if state == pieceMissing && d.priorities[i] > bestPriority && has(i) {
+			best, bestPriority = i, d.priorities[i]
+		}
+	}
+
+	if best < 0 {
+		return 0, false
+	}
+	d.states[best] = pieceInProgress
+	return best, true
+}
+
+// hasPiece reports whether we downloaded and verified a piece
+func (d *Download) hasPiece(index int) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return index >= 0 && index < len(d.states) && d.states[index] == pieceDone
+}
+
+// bitfield returns the pieces we have along with their count
+func (d *Download) bitfield() (peer.Bitfield, int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	bitfield := peer.NewBitfield(len(d.states))
+	count := 0
+	for i, state := range d.states {
+		if state == pieceDone {
+			bitfield.SetPiece(i)
+			count++
+		}
+	}
+	return bitfield, count
+}
+
+// wants reports whether the peer has any piece we still need
+func (d *Download) wants(has func(index int) bool) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for i, state := range d.states {
+		if (state == pieceMissing || state == pieceInProgress) && has(i) {
+			return true
+		}
+	}
+	return false
+}
+
+// abandonPiece puts a piece that was in progress back in the missing pieces
+func (d *Download) abandonPiece(index int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.states[index] == pieceInProgress {
+		d.states[index] = pieceMissing
+		if d.priorities[index] == PrioritySkip {
+			d.states[index] = pieceSkipped
+			d.notifyProgress()
+		}
+	}
+}
+
+// finishPiece checks the hash of a downloaded piece and stores it, a PieceHashError is
+// returned when the piece is not valid
+func (d *Download) finishPiece(index int, data []byte) error {
+	d.torrent.zeroPadding(index, data)
+	if !d.torrent.verify(index, data) {
+		d.abandonPiece(index)
+		err := &PieceHashError{Index: index}
+		d.mu.Lock()
+		d.hashErr = err
+		d.mu.Unlock()
+		d.event(PieceFailedEvent{Index: index})
+		return err
+	}
+
+	d.mu.Lock()
+	if d.states[index] == pieceDone {
+		d.mu.Unlock()
+		return nil
+	}
+	keep, skipVersion := d.config.Storage == nil || d.overlapsSkipped(index), d.skipVersion
+	d.mu.Unlock()
+
+	if d.config.Storage != nil {
+		if _, err := d.config.Storage.WriteAt(data, d.pieceOffset(index)); err != nil {
+			err = fmt.Errorf("failed to store piece %d: %w", index, err)
+			d.abandonPiece(index)
+			d.mu.Lock()
+			d.fail(err)
+			d.mu.Unlock()
+			return err
+		}
+	}
+
+	if d.config.OnPiece != nil {
+		d.config.OnPiece(index, data)
+	}
+
+	d.mu.Lock()
+	if d.states[index] == pieceDone {
+		d.mu.Unlock()
+		return nil
+	}
+
+	d.states[index] = pieceDone
+	// a file skipped while the piece was written may have lost its part of it
+	if keep || skipVersion != d.skipVersion || d.overlapsSkipped(index) {
+		d.pieces[index] = data
+	}
+	d.lastVerified.Store(time.Now().UnixNano())
+	d.notifyProgress()
+	d.downloaded.Add(int64(len(data)))
+	if d.priorities[index] != PrioritySkip {
+		d.remaining--
+	}
+	completed := d.remaining == 0 && !d.completed
+	if completed {
+		d.completed = true
+		close(d.done)
+	}
+	d.mu.Unlock()
+
+	d.event(PieceVerifiedEvent{Index: index})
+	if completed {
+		d.event(CompletedEvent{})
+	}
+
+	return nil
+}
@@ -0,0 +1,153 @@
+package download
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/nullxDEADBEEF/bittorrent/internal/storage"
+)
+
+func newTestStorage(t *testing.T, torrent Torrent) *storage.Storage {
+	t.Helper()
+
+	files := make([]storage.File, 0, len(torrent.Files))
+	for _, file := range torrent.Files {
+		files = append(files, storage.File{Path: file.Path, Length: file.Length, Pad: file.Pad})
+	}
+	store, err := storage.New(t.TempDir(), files)
+	if err != nil {
+		t.Fatalf("failed to create storage: %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+// downloadPiece hands the right data of a piece to the download, as a peer would
+func downloadPiece(t *testing.T, d *Download, data []byte, index int) {
+	t.Helper()
+
+	begin := index * d.torrent.PieceLength
+	piece := append([]byte(nil), data[begin:begin+d.torrent.PieceSize(index)]...)
+	if err := d.finishPiece(index, piece); err != nil {
+		t.Fatalf("failed to finish piece %d: %v", index, err)
+	}
+}
+
+func TestPiecesAreStored(t *testing.T) {
+	// piece 1 straddles the skipped file, the download is not over while piece 3 is missing
+	torrent, data := testTorrent("stored", 1<<14, 20000, 30000, 15000)
+	store := newTestStorage(t, torrent)
+
+	config := DefaultConfig()
+	config.Storage = store
+	config.FilePriorities = []Priority{PriorityNormal, PrioritySkip, PriorityNormal}
+	d := New(torrent, config)
+
+	downloadPiece(t, d, data, 0)
+	downloadPiece(t, d, data, 1)
+
+	// only the pieces the storage could not take entirely stay in memory
+	for index, kept := range []bool{false, true} {
+		if (d.pieces[index] != nil) != kept {
+			t.Errorf("piece %d kept in memory: %v, want %v", index, !kept, kept)
+		}
+	}
+	if _, err := os.Stat(store.Path(1)); !os.IsNotExist(err) {
+		t.Errorf("the skipped file was created: %v", err)
+	}
+	for _, index := range []int{0, 1} {
+		piece, err := d.Piece(index)
+		if err != nil {
+			t.Fatalf("failed to read piece %d: %v", index, err)
+		}
+		begin := index * torrent.PieceLength
+		if !bytes.Equal(piece, data[begin:begin+torrent.PieceSize(index)]) {
+			t.Errorf("piece %d does not match", index)
+		}
+	}
+
+	// wanting the file again writes the pieces kept for it
+	if err := d.SetFilePriority(1, PriorityNormal); err != nil {
+		t.Fatalf("failed to restore the file: %v", err)
+	}
+	if d.pieces[1] != nil {
+		t.Error("the piece was kept in memory once its files were wanted")
+	}
+	downloadPiece(t, d, data, 2)
+	downloadPiece(t, d, data, 3)
+
+	got, err := os.ReadFile(store.Path(1))
+	if err != nil {
+		t.Fatalf("failed to read the restored file: %v", err)
+	}
+	if !bytes.Equal(got, fileData(torrent, data, 1)) {
+		t.Error("the restored file does not match")
+	}
+}
+
+// failingStorage fails every write
+type failingStorage struct{}
+
+var errDiskFull = errors.New("disk full")
+
+func (failingStorage) ReadAt(p []byte, off int64) (int, error)  { return 0, io.EOF }
+func (failingStorage) WriteAt(p []byte, off int64) (int, error) { return 0, errDiskFull }
+func (failingStorage) SetSkip(file int, skip bool)              {}
+
+func TestStorageFailureStopsDownload(t *testing.T) {
+	torrent, data := testTorrent("full", 1<<14, 40000)
+	config := DefaultConfig()
+	config.Storage = failingStorage{}
+	d := New(torrent, config)
+
+	index, _ := d.pickPiece(func(int) bool { return true }, nil)
+	begin := index * torrent.PieceLength
+	if err := d.finishPiece(index, data[begin:begin+torrent.PieceSize(index)]); !errors.Is(err, errDiskFull) {
+		t.Fatalf("got %v, want the storage error", err)
+	}
+	if d.hasPiece(index) {
+		t.Error("a piece that was not stored counts as downloaded")
+	}
+	if err := d.Run(context.Background()); !errors.Is(err, errDiskFull) {
+		t.Errorf("Run returned %v, want the storage error", err)
+	}
+}
+
+func TestSkippingEveryFileLeavesDownloadIdle(t *testing.T) {
+	torrent, data := testTorrent("idle", 1<<14, 20000, 30000)
+	d := New(torrent, DefaultConfig())
+	downloadPiece(t, d, data, 0)
+
+	for file := range torrent.Files {
+		if err := d.SetFilePriority(file, PrioritySkip); err != nil {
+			t.Fatalf("failed to skip file %d: %v", file, err)
+		}
+	}
+	if !d.Idle() {
+		t.Error("the download is not idle once every file is skipped")
+	}
+	select {
+	case <-d.Done():
+		t.Fatal("skipping every file completed the download")
+	default:
+	}
+
+	if err := d.SetFilePriority(1, PriorityNormal); err != nil {
+		t.Fatalf("failed to want the file again: %v", err)
+	}
+	if d.Idle() {
+		t.Error("the download stayed idle once a file was wanted again")
+	}
+	for index := 1; index < torrent.NumPieces(); index++ {
+		downloadPiece(t, d, data, index)
+	}
+	select {
+	case <-d.Done():
+	default:
+		t.Error("the download did not complete once the wanted file was downloaded")
+	}
+}
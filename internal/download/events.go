@@ -0,0 +1,58 @@
+package download
+
+import (
+	"net/netip"
+
+	"github.com/nullxDEADBEEF/bittorrent/internal/peer"
+)
+
+// Event is something that happened to a download, passed to Config.OnEvent. It is one
+// of PieceVerifiedEvent, PieceFailedEvent, PeerConnectedEvent, PeerDisconnectedEvent and
+// CompletedEvent
+type Event interface {
+	downloadEvent()
+}
+
+// PieceVerifiedEvent is sent when a piece passed its hash check and was stored
+type PieceVerifiedEvent struct {
+	Index int
+}
+
+// PieceFailedEvent is sent when a downloaded piece did not match its hash, it is
+// downloaded again
+type PieceFailedEvent struct {
+	Index int
+}
+
+// PeerConnectedEvent is sent once the handshake with a peer completed, in either
+// direction
+type PeerConnectedEvent struct {
+	Addr   netip.AddrPort
+	Source Source
+	// Client is what the peer id tells about the client, its extended handshake comes
+	// later and updates PeerStats
+	Client peer.ClientInfo
+}
+
+// PeerDisconnectedEvent is sent when the connection to a peer that sent
+// PeerConnectedEvent ended, Err tells why
+type PeerDisconnectedEvent struct {
+	Addr netip.AddrPort
+	Err  error
+}
+
+// CompletedEvent is sent once every wanted piece is verified, when Done is closed
+type CompletedEvent struct{}
+
+func (PieceVerifiedEvent) downloadEvent()    {}
+func (PieceFailedEvent) downloadEvent()      {}
+func (PeerConnectedEvent) downloadEvent()    {}
+func (PeerDisconnectedEvent) downloadEvent() {}
+func (CompletedEvent) downloadEvent()        {}
+
+// event passes an event to Config.OnEvent
+func (d *Download) event(e Event) {
+	if d.config.OnEvent != nil {
+		d.config.OnEvent(e)
+	}
+}
@@ -0,0 +1,115 @@
+package download
+
+import (
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/nullxDEADBEEF/bittorrent/internal/mse"
+	"github.com/nullxDEADBEEF/bittorrent/internal/peer"
+)
+
+// peers that connect to us have this long to complete the handshake
+const acceptTimeout = 10 * time.Second
+
+// Listener accepts incoming peer connections and hands them to the download of the
+// torrent they ask for. A single listener serves every download since they all share the
+// port we announce
+type Listener struct {
+	ln     net.Listener
+	policy mse.Policy
+
+	mu        sync.Mutex
+	downloads map[[20]byte]*Download
+}
+
+// Listen accepts connections on a TCP address, policy decides whether plaintext and
+// encrypted connections are accepted
+func Listen(addr string, policy mse.Policy) (*Listener, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &Listener{
+		ln:        ln,
+		policy:    policy,
+		downloads: make(map[[20]byte]*Download),
+	}
+	go l.serve(ln)
+
+	return l, nil
+}
+
+// Serve accepts connections from another listener as well, like a uTP socket. The
+// listener is not closed by Close and serving stops when it is closed
+func (l *Listener) Serve(ln net.Listener) {
+	go l.serve(ln)
+}
+
+func (l *Listener) Addr() net.Addr {
+	return l.ln.Addr()
+}
+
+// Add lets peers connect to us for the torrent of the download
+func (l *Listener) Add(d *Download) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.downloads[d.torrent.InfoHash] = d
+}
+
+func (l *Listener) Remove(d *Download) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	delete(l.downloads, d.torrent.InfoHash)
+}
+
+func (l *Listener) Close() error {
+	return l.ln.Close()
+}
+
+func (l *Listener) serve(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Printf("Failed to accept connection: %v", err)
+			continue
+		}
+
+		go l.handle(conn)
+	}
+}
+
+func (l *Listener) handle(conn net.Conn) {
+	l.mu.Lock()
+	infoHashes := make([][20]byte, 0, len(l.downloads))
+	for infoHash := range l.downloads {
+		infoHashes = append(infoHashes, infoHash)
+	}
+	l.mu.Unlock()
+
+	var d *Download
+	peerConn, err := peer.Accept(conn, l.policy, infoHashes, func(infoHash [20]byte) *peer.Handshake {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+
+		d = l.downloads[infoHash]
+		if d == nil {
+			return nil
+		}
+		return d.handshake()
+	}, acceptTimeout)
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	d.accept(peerConn)
+}
@@ -0,0 +1,376 @@
+package download
+
+import (
+	"context"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"log"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/nullxDEADBEEF/bittorrent/internal/bencode"
+	"github.com/nullxDEADBEEF/bittorrent/internal/merkle"
+	"github.com/nullxDEADBEEF/bittorrent/internal/peer"
+	t "github.com/nullxDEADBEEF/bittorrent/internal/torrent"
+)
+
+const (
+	// the extended message id we ask peers to use when sending us ut_metadata messages
+	metadataExtendedID = 2
+	// a peer that does not give us the whole info dictionary within this time is dropped
+	metadataTimeout = time.Minute
+	// the most hashes asked for in a single hash request
+	maxHashRequestLength = 512
+)
+
+var (
+	errNoMetadata    = errors.New("peer does not support the metadata extension")
+	errMetadataError = errors.New("peer sent invalid metadata")
+	errNoPieceLayers = errors.New("peer did not give the piece layers")
+)
+
+// Metadata fetches the info dictionary of a torrent from the peers in its pool (BEP 9), it
+// is what a magnet link is missing to start the download. Every connection downloads the
+// whole dictionary on its own, the first one matching the info hash wins. The info
+// dictionary of a v2 torrent does not hold the piece layers of its files, they are asked
+// from the same peer with hash requests
+type Metadata struct {
+	infoHash [20]byte
+	config   Config
+	pool     *pool
+
+	mu     sync.Mutex
+	info   []byte
+	layers map[merkle.Hash][]merkle.Hash
+	done   chan struct{}
+}
+
+func NewMetadata(infoHash [20]byte, config Config) *Metadata {
+	if config.MaxConnections <= 0 {
+		config.MaxConnections = DefaultConfig().MaxConnections
+	}
+	config.setTimeouts()
+
+	return &Metadata{
+		infoHash: infoHash,
+		config:   config,
+		pool:     newPool(),
+		done:     make(chan struct{}),
+	}
+}
+
+// AddPeers adds peers to the pool of candidates to ask for the metadata
+func (m *Metadata) AddPeers(addrs []netip.AddrPort, source Source) {
+	for _, addr := range addrs {
+		m.pool.add(addr, source, 0)
+	}
+}
+
+// Run asks peers for the info dictionary until one of them gives it to us or ctx is
+// cancelled, in which case ErrStopped is returned along with the error of ctx. The
+// dictionary is returned bencoded, as hashed into the info hash
+func (m *Metadata) Run(ctx context.Context) ([]byte, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	finished := ctx.Done()
+
+	var wg sync.WaitGroup
+	for i := 0; i < m.config.MaxConnections; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				addr, ok := m.pool.next(finished)
+				if !ok {
+					return
+				}
+
+				err := m.fetch(ctx, addr)
+				failed := err != nil && ctx.Err() == nil
+				if failed {
+					log.Printf("No metadata from %s: %v", addr, err)
+				}
+				m.pool.disconnected(addr, failed)
+			}
+		}()
+	}
+
+	var err error
+	select {
+	case <-m.done:
+	case <-finished:
+		err = fmt.Errorf("%w: %w", ErrStopped, ctx.Err())
+	}
+
+	cancel()
+	wg.Wait()
+
+	if err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.info, nil
+}
+
+// PieceLayers returns the piece layers fetched along with the info dictionary by the pieces
+// root of their file. They are missing for hybrid torrents when the peer could not give
+// them, the v1 hashes verify the pieces then
+func (m *Metadata) PieceLayers() map[merkle.Hash][]merkle.Hash {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.layers
+}
+
+// fetch downloads the info dictionary from a peer, one piece at a time
+func (m *Metadata) fetch(ctx context.Context, addr netip.AddrPort) error {
+	handshake := &peer.Handshake{InfoHash: m.infoHash, PeerID: m.config.PeerID}
+	handshake.SetExtensions()
+	handshake.SetV2()
+
+	conn, err := m.config.dialer().DialContext(ctx, addr.String(), handshake)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	m.pool.established(addr)
+
+	if !conn.SupportsExtensions() {
+		return errNoMetadata
+	}
+
+	// the connection is closed to unblock the reads when we are told to stop, or when the
+	// peer is too slow
+	timeout := time.NewTimer(metadataTimeout)
+	defer timeout.Stop()
+	quit := make(chan struct{})
+	defer close(quit)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-m.done:
+		case <-timeout.C:
+		case <-quit:
+			return
+		}
+		conn.Close()
+	}()
+
+	extended := &peer.ExtendedHandshake{
+		Extensions: map[string]int{peer.ExtensionMetadata: metadataExtendedID},
+		Port:       int(m.config.Port),
+		Client:     clientName,
+	}
+	msg, err := extended.Message()
+	if err != nil {
+		return err
+	}
+	if err := conn.WriteMessage(msg); err != nil {
+		return err
+	}
+
+	var info []byte
+	var received []bool
+	remoteID := 0
+	for {
+		msg, err := conn.ReadMessage()
+		if err != nil {
+			return err
+		}
+		if msg == nil || msg.ID != peer.MsgExtended {
+			continue
+		}
+
+		extendedID, payload, err := peer.ParseExtended(msg)
+		if err != nil {
+			return err
+		}
+
+		switch extendedID {
+		case peer.ExtendedHandshakeID:
+			remote, err := peer.ParseExtendedHandshake(payload)
+			if err != nil {
+				return err
+			}
+			remoteID = remote.Extensions[peer.ExtensionMetadata]
+			if remoteID == 0 || remote.MetadataSize <= 0 {
+				return errNoMetadata
+			}
+			if remote.MetadataSize > peer.MaxMetadataSize {
+				return fmt.Errorf("%w: metadata size %d", errMetadataError, remote.MetadataSize)
+			}
+			if info != nil {
+				continue
+			}
+
+			info = make([]byte, remote.MetadataSize)
+			received = make([]bool, peer.MetadataPieces(remote.MetadataSize))
+			for piece := range received {
+				request := &peer.MetadataMessage{Type: peer.MetadataRequest, Piece: piece}
+				payload, err := request.Encode()
+				if err != nil {
+					return err
+				}
+				if err := conn.WriteMessage(peer.NewExtendedMessage(byte(remoteID), payload)); err != nil {
+					return err
+				}
+			}
+		case metadataExtendedID:
+			if info == nil {
+				continue
+			}
+
+			data, err := peer.ParseMetadataMessage(payload)
+			if err != nil {
+				return err
+			}
+			switch data.Type {
+			case peer.MetadataReject:
+				return fmt.Errorf("peer rejected metadata piece %d", data.Piece)
+			case peer.MetadataData:
+			default:
+				continue
+			}
+
+			begin := data.Piece * peer.MetadataPieceSize
+			if data.Piece >= len(received) || data.TotalSize != len(info) || len(data.Data) != min(peer.MetadataPieceSize, len(info)-begin) {
+				return fmt.Errorf("%w: piece %d", errMetadataError, data.Piece)
+			}
+			copy(info[begin:], data.Data)
+			received[data.Piece] = true
+
+			if !allReceived(received) {
+				continue
+			}
+			if sha1.Sum(info) != m.infoHash {
+				return fmt.Errorf("%w: info hash mismatch", errMetadataError)
+			}
+			layers, err := fetchPieceLayers(conn, info)
+			if err != nil {
+				return err
+			}
+			m.finish(info, layers)
+			return nil
+		}
+	}
+}
+
+func (m *Metadata) finish(info []byte, layers map[merkle.Hash][]merkle.Hash) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.info == nil {
+		m.info = info
+		m.layers = layers
+		close(m.done)
+	}
+}
+
+// layerChunk is the part of a piece layer a hash request asks for
+type layerChunk struct {
+	root  merkle.Hash
+	index int
+}
+
+// fetchPieceLayers asks a peer for the piece layers of the files of a v2 info dictionary
+// larger than a piece, and checks them against the pieces root of their file. Hybrid
+// torrents do without them when the peer cannot give them
+func fetchPieceLayers(conn *peer.Conn, info []byte) (map[merkle.Hash][]merkle.Hash, error) {
+	decoded, err := bencode.NewBencodeDecoder(info).Decode()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", errMetadataError, err)
+	}
+	torrentInfo, ok := decoded.(map[string]interface{})
+	if !ok || !t.HasV2(torrentInfo) {
+		return nil, nil
+	}
+	// an invalid piece length is reported when the torrent is described
+	pieceLength, _ := torrentInfo["piece length"].(int)
+	if pieceLength < merkle.BlockSize || pieceLength&(pieceLength-1) != 0 {
+		return nil, nil
+	}
+	baseLayer := merkle.Log2(pieceLength / merkle.BlockSize)
+
+	// the layers are filled up to a power of two, as the peer pads them
+	layers := make(map[merkle.Hash][]merkle.Hash)
+	counts := make(map[merkle.Hash]int)
+	for _, file := range t.FileTree(torrentInfo) {
+		if file.Length > pieceLength {
+			counts[file.PiecesRoot] = (file.Length + pieceLength - 1) / pieceLength
+			layers[file.PiecesRoot] = make([]merkle.Hash, merkle.NextPowerOfTwo(counts[file.PiecesRoot]))
+		}
+	}
+	if len(layers) == 0 {
+		return nil, nil
+	}
+
+	noLayers := func() (map[merkle.Hash][]merkle.Hash, error) {
+		if t.HasV1(torrentInfo) {
+			return nil, nil
+		}
+		return nil, errNoPieceLayers
+	}
+	if !conn.SupportsV2() {
+		return noLayers()
+	}
+
+	pending := make(map[layerChunk]int)
+	for root, layer := range layers {
+		length := min(len(layer), maxHashRequestLength)
+		for index := 0; index < len(layer); index += length {
+			request := &peer.HashRequest{PiecesRoot: root, BaseLayer: baseLayer, Index: index, Length: length}
+			if err := conn.WriteMessage(peer.NewHashRequest(request)); err != nil {
+				return nil, err
+			}
+			pending[layerChunk{root: root, index: index}] = length
+		}
+	}
+
+	for len(pending) > 0 {
+		msg, err := conn.ReadMessage()
+		if err != nil {
+			return nil, err
+		}
+		if msg == nil {
+			continue
+		}
+
+		switch msg.ID {
+		case peer.MsgHashReject:
+			return noLayers()
+		case peer.MsgHashes:
+			request, hashes, err := peer.ParseHashes(msg)
+			if err != nil {
+				return nil, err
+			}
+			chunk := layerChunk{root: request.PiecesRoot, index: request.Index}
+			length, ok := pending[chunk]
+			if !ok || request.BaseLayer != baseLayer || request.Length != length || len(hashes) < length {
+				return nil, fmt.Errorf("%w: unexpected hashes", errMetadataError)
+			}
+			copy(layers[chunk.root][chunk.index:], hashes[:length])
+			delete(pending, chunk)
+		}
+	}
+
+	pad := merkle.ZeroHash(baseLayer)
+	for root, layer := range layers {
+		if merkle.Root(layer, len(layer), pad) != root {
+			return nil, fmt.Errorf("%w: piece layer does not match its pieces root", errMetadataError)
+		}
+		layers[root] = layer[:counts[root]]
+	}
+	return layers, nil
+}
+
+func allReceived(received []bool) bool {
+	for _, ok := range received {
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,182 @@
+package download
+
+import (
+	"context"
+	"crypto/sha1"
+	"math/rand"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/nullxDEADBEEF/bittorrent/internal/bencode"
+	"github.com/nullxDEADBEEF/bittorrent/internal/merkle"
+	"github.com/nullxDEADBEEF/bittorrent/internal/mse"
+	"github.com/nullxDEADBEEF/bittorrent/internal/peer"
+	tr "github.com/nullxDEADBEEF/bittorrent/internal/torrent"
+)
+
+// testHybridInfo returns the bencoded info dictionary of a single file hybrid torrent
+// along with the piece layer of its file
+func testHybridInfo(t *testing.T, data []byte, pieceLength int) ([]byte, []merkle.Hash) {
+	t.Helper()
+
+	var pieces []byte
+	var layer []merkle.Hash
+	for begin := 0; begin < len(data); begin += pieceLength {
+		piece := data[begin:min(begin+pieceLength, len(data))]
+		hash := sha1.Sum(piece)
+		pieces = append(pieces, hash[:]...)
+		layer = append(layer, merkle.PieceHash(piece, pieceLength/merkle.BlockSize))
+	}
+	root := merkle.Root(merkle.HashBlocks(data), merkle.LeafCount(len(data)), merkle.Hash{})
+
+	info, err := bencode.Encode(map[string]interface{}{
+		"name":         "hybrid",
+		"piece length": pieceLength,
+		"length":       len(data),
+		"pieces":       pieces,
+		"meta version": 2,
+		"file tree": map[string]interface{}{
+			"hybrid": map[string]interface{}{
+				"": map[string]interface{}{"length": len(data), "pieces root": root[:]},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("failed to encode info dictionary: %v", err)
+	}
+	return info, layer
+}
+
+// serveMetadata answers one connection with the info dictionary, and with the hashes of
+// the piece layer when v2 is set
+func serveMetadata(t *testing.T, info []byte, layer []merkle.Hash, pieceLength int, v2 bool) netip.AddrPort {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	infoHash := sha1.Sum(info)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		peerConn, err := peer.Accept(conn, mse.PolicyDisable, [][20]byte{infoHash}, func([20]byte) *peer.Handshake {
+			handshake := &peer.Handshake{InfoHash: infoHash, PeerID: [20]byte{'s', 'e', 'e', 'd'}}
+			handshake.SetExtensions()
+			if v2 {
+				handshake.SetV2()
+			}
+			return handshake
+		}, time.Second)
+		if err != nil {
+			return
+		}
+
+		extended := &peer.ExtendedHandshake{Extensions: map[string]int{peer.ExtensionMetadata: 1}, MetadataSize: len(info)}
+		msg, _ := extended.Message()
+		if peerConn.WriteMessage(msg) != nil {
+			return
+		}
+
+		pad := merkle.ZeroHash(merkle.Log2(pieceLength / merkle.BlockSize))
+		for {
+			msg, err := peerConn.ReadMessage()
+			if err != nil {
+				return
+			}
+			if msg == nil {
+				continue
+			}
+
+			switch msg.ID {
+			case peer.MsgExtended:
+				id, payload, err := peer.ParseExtended(msg)
+				if err != nil || id != 1 {
+					continue
+				}
+				request, err := peer.ParseMetadataMessage(payload)
+				if err != nil {
+					return
+				}
+				begin := request.Piece * peer.MetadataPieceSize
+				data := &peer.MetadataMessage{Type: peer.MetadataData, Piece: request.Piece, TotalSize: len(info), Data: info[begin:min(begin+peer.MetadataPieceSize, len(info))]}
+				payload, _ = data.Encode()
+				peerConn.WriteMessage(peer.NewExtendedMessage(metadataExtendedID, payload))
+			case peer.MsgHashRequest:
+				request, err := peer.ParseHashRequest(msg)
+				if err != nil {
+					return
+				}
+				hashes, _ := merkle.Proof(layer, pad, request.Index, request.Length, request.ProofLayers)
+				peerConn.WriteMessage(peer.NewHashes(request, hashes))
+			}
+		}
+	}()
+
+	return netip.MustParseAddrPort(listener.Addr().String())
+}
+
+func TestMetadataFetchesPieceLayers(t *testing.T) {
+	tests := []struct {
+		name       string
+		v2         bool
+		wantLayers bool
+	}{
+		{"v2 peer", true, true},
+		// without the piece layers a hybrid torrent is verified with its v1 hashes
+		{"v1 peer", false, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pieceLength := 2 * merkle.BlockSize
+			data := make([]byte, 5*pieceLength+1000)
+			rand.New(rand.NewSource(1)).Read(data)
+			info, layer := testHybridInfo(t, data, pieceLength)
+
+			config := DefaultConfig()
+			config.Encryption = mse.PolicyDisable
+			config.Transport = peer.TransportTCP
+			m := NewMetadata(sha1.Sum(info), config)
+			m.AddPeers([]netip.AddrPort{serveMetadata(t, info, layer, pieceLength, test.v2)}, SourceTracker)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			got, err := m.Run(ctx)
+			if err != nil {
+				t.Fatalf("failed to fetch metadata: %v", err)
+			}
+
+			decoded, err := bencode.NewBencodeDecoder(got).Decode()
+			if err != nil {
+				t.Fatalf("failed to decode info dictionary: %v", err)
+			}
+			metainfo := map[string]interface{}{"info": decoded}
+			if layers := m.PieceLayers(); len(layers) > 0 {
+				metainfo["piece layers"] = tr.EncodePieceLayers(layers)
+			}
+
+			// the magnet link becomes a torrent whose pieces can be verified
+			torrent, err := FromMetainfo(metainfo)
+			if err != nil {
+				t.Fatalf("failed to describe the torrent: %v", err)
+			}
+			if (len(torrent.V2Pieces) > 0) != test.wantLayers {
+				t.Errorf("got %d v2 pieces, want v2 hashes: %v", len(torrent.V2Pieces), test.wantLayers)
+			}
+			for index := 0; index < torrent.NumPieces(); index++ {
+				begin := index * pieceLength
+				if !torrent.verify(index, data[begin:begin+torrent.PieceSize(index)]) {
+					t.Errorf("piece %d does not verify", index)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,71 @@
+package download
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	t "github.com/nullxDEADBEEF/bittorrent/internal/torrent"
+)
+
+// FromMetainfo describes the torrent of a parsed metainfo file to the download. Torrents
+// from magnet links are described the same way once their info dictionary is wrapped in
+// a metainfo dictionary
+func FromMetainfo(metainfo map[string]interface{}) (Torrent, error) {
+	torrentInfo, ok := metainfo["info"].(map[string]interface{})
+	if !ok {
+		return Torrent{}, fmt.Errorf("metainfo has no info dictionary")
+	}
+	pieceLength, ok := torrentInfo["piece length"].(int)
+	if !ok || pieceLength <= 0 {
+		return Torrent{}, fmt.Errorf("info dictionary has no valid piece length")
+	}
+
+	infoHashBytes, err := hex.DecodeString(t.SwarmInfoHash(torrentInfo))
+	if err != nil {
+		return Torrent{}, err
+	}
+
+	torrent := Torrent{
+		PieceLength: pieceLength,
+		Length:      t.Length(torrentInfo),
+		Name:        t.Name(torrentInfo),
+		Private:     t.IsPrivate(torrentInfo),
+		WebSeeds:    t.WebSeeds(metainfo),
+		Metadata:    t.NewTorrentEncoder().EncodeTorrentInfo(torrentInfo),
+	}
+	for _, file := range t.Files(torrentInfo) {
+		torrent.Files = append(torrent.Files, File{Path: file.Path, Length: file.Length, Pad: file.Pad})
+	}
+	copy(torrent.InfoHash[:], infoHashBytes)
+
+	pieceHashes, _ := torrentInfo["pieces"].([]byte)
+	hashSizeInBytes := 20
+	for i := 0; i+hashSizeInBytes <= len(pieceHashes); i += hashSizeInBytes {
+		var hash [20]byte
+		copy(hash[:], pieceHashes[i:i+hashSizeInBytes])
+		torrent.PieceHashes = append(torrent.PieceHashes, hash)
+	}
+
+	if t.HasV2(torrentInfo) {
+		v2Pieces, err := t.V2Pieces(metainfo, torrentInfo)
+		// a hybrid torrent whose piece layers no peer gave us is verified with its v1
+		// hashes alone
+		if errors.Is(err, t.ErrMissingPieceLayer) && len(torrent.PieceHashes) > 0 {
+			return torrent, nil
+		}
+		if err != nil {
+			return Torrent{}, err
+		}
+		// the v1 and v2 pieces of a hybrid torrent are the same pieces
+		if len(torrent.PieceHashes) > 0 && len(v2Pieces) != len(torrent.PieceHashes) {
+			return Torrent{}, fmt.Errorf("hybrid torrent has %d v1 pieces and %d v2 pieces", len(torrent.PieceHashes), len(v2Pieces))
+		}
+		for _, piece := range v2Pieces {
+			torrent.V2Pieces = append(torrent.V2Pieces, V2Piece{Root: piece.Root, Length: piece.Length, Leaves: piece.Leaves})
+		}
+		torrent.PieceLayers = t.PieceLayers(metainfo)
+	}
+
+	return torrent, nil
+}
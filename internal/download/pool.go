@@ -0,0 +1,314 @@
+package download
+
+import (
+	"net/netip"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/nullxDEADBEEF/bittorrent/internal/peer"
+)
+
+// Source tells where we learned about a peer from
+type Source int
+
+const (
+	SourceTracker Source = iota
+	SourceDHT
+	SourcePEX
+	SourceLSD
+	// peers that connected to us
+	SourceIncoming
+)
+
+func (s Source) String() string {
+	switch s {
+	case SourceTracker:
+		return "tracker"
+	case SourceDHT:
+		return "dht"
+	case SourcePEX:
+		return "pex"
+	case SourceLSD:
+		return "lsd"
+	case SourceIncoming:
+		return "incoming"
+	default:
+		return "unknown"
+	}
+}
+
+const (
+	// peers we failed to connect to are retried after this delay, doubled on every failure
+	peerRetryDelay = 30 * time.Second
+	// after this many consecutive failures a peer is forgotten
+	maxPeerFailures = 4
+)
+
+type poolPeer struct {
+	addr   netip.AddrPort
+	source Source
+	// flags as defined by peer exchange, describing what we know about the peer. pex is
+	// set once peer exchange told us about the peer, only then does a missing flag tell
+	// that the peer lacks it
+	flags byte
+	pex   bool
+	// connected is set while we dial or talk to the peer, established once the
+	// handshake went through
+	connected   bool
+	established bool
+	// inbound peers connected to us, the port we know is not one we can connect to
+	inbound     bool
+	failures    int
+	nextAttempt time.Time
+	// client is the software the peer runs, known once connected
+	client peer.ClientInfo
+}
+
+// pool is the connection manager of a download. Every source of peers (trackers, DHT,
+// peer exchange, local discovery) adds the addresses it learns about, and the download
+// takes candidates out of it to connect to, making sure we never connect twice to the
+// same peer and that peers that keep failing are retried less and less
+type pool struct {
+	mu    sync.Mutex
+	peers map[netip.AddrPort]*poolPeer
+	// banned addresses are never added again, they turned out to be our own
+	banned map[netip.AddrPort]bool
+	// wake is signaled whenever new candidates may be available
+	wake chan struct{}
+}
+
+func newPool() *pool {
+	return &pool{
+		peers:  make(map[netip.AddrPort]*poolPeer),
+		banned: make(map[netip.AddrPort]bool),
+		wake:   make(chan struct{}, 1),
+	}
+}
+
+func (p *pool) add(addr netip.AddrPort, source Source, flags byte) {
+	if !addr.IsValid() || addr.Port() == 0 {
+		return
+	}
+	addr = netip.AddrPortFrom(addr.Addr().Unmap(), addr.Port())
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.banned[addr] {
+		return
+	}
+	if existing, ok := p.peers[addr]; ok {
+		existing.flags |= flags
+		existing.pex = existing.pex || source == SourcePEX
+		return
+	}
+	p.peers[addr] = &poolPeer{addr: addr, source: source, flags: flags, pex: source == SourcePEX}
+
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+// next returns a peer to connect to and marks it as connected, it blocks until one is
+// available or done is closed
+func (p *pool) next(done <-chan struct{}) (netip.AddrPort, bool) {
+	for {
+		addr, wait, ok := p.candidate()
+		if ok {
+			return addr, true
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-done:
+			timer.Stop()
+			return netip.AddrPort{}, false
+		case <-p.wake:
+			timer.Stop()
+		case <-timer.C:
+		}
+	}
+}
+
+// candidate returns the first peer that is ready to be connected to, or how long to wait
+// until one might be
+func (p *pool) candidate() (netip.AddrPort, time.Duration, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	wait := peerRetryDelay
+	for _, peer := range p.peers {
+		if peer.connected {
+			continue
+		}
+		if now.Before(peer.nextAttempt) {
+			wait = min(wait, peer.nextAttempt.Sub(now))
+			continue
+		}
+
+		peer.connected = true
+		return peer.addr, 0, true
+	}
+
+	return netip.AddrPort{}, wait, false
+}
+
+// disconnected returns a peer to the pool once its connection ended, failed tells
+// whether the connection ended because of an error
+func (p *pool) disconnected(addr netip.AddrPort, failed bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	peer, ok := p.peers[addr]
+	if !ok {
+		return
+	}
+
+	peer.connected = false
+	peer.established = false
+	if peer.inbound {
+		delete(p.peers, addr)
+		return
+	}
+	if !failed {
+		peer.failures = 0
+		peer.nextAttempt = time.Now().Add(peerRetryDelay)
+		return
+	}
+
+	peer.failures++
+	if peer.failures >= maxPeerFailures {
+		delete(p.peers, addr)
+		return
+	}
+	peer.nextAttempt = time.Now().Add(peerRetryDelay << (peer.failures - 1))
+}
+
+// ban forgets a peer for good
+func (p *pool) ban(addr netip.AddrPort) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	delete(p.peers, addr)
+	p.banned[addr] = true
+}
+
+// accept records an incoming connection, it returns false if we are already connected to
+// the peer
+func (p *pool) accept(addr netip.AddrPort) bool {
+	addr = netip.AddrPortFrom(addr.Addr().Unmap(), addr.Port())
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	peer, ok := p.peers[addr]
+	if ok && peer.connected {
+		return false
+	}
+	if !ok {
+		peer = &poolPeer{addr: addr, source: SourceIncoming, inbound: true}
+		p.peers[addr] = peer
+	}
+	peer.connected = true
+	peer.established = true
+	return true
+}
+
+// established marks a peer whose handshake completed
+func (p *pool) established(addr netip.AddrPort) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if peer, ok := p.peers[addr]; ok {
+		peer.established = true
+	}
+}
+
+// identify records the client of a peer, from its peer id or extended handshake
+func (p *pool) identify(addr netip.AddrPort, client peer.ClientInfo) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if peer, ok := p.peers[addr]; ok {
+		peer.client = client
+	}
+}
+
+// client returns the client of a peer, as far as we know it
+func (p *pool) client(addr netip.AddrPort) peer.ClientInfo {
+	return p.describe(addr).Client
+}
+
+// describe returns what we know about a peer
+func (p *pool) describe(addr netip.AddrPort) PeerStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if peer, ok := p.peers[addr]; ok {
+		return PeerStats{Addr: addr, Source: peer.source, Client: peer.client}
+	}
+	return PeerStats{Addr: addr}
+}
+
+func (p *pool) setFlags(addr netip.AddrPort, flags byte) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if peer, ok := p.peers[addr]; ok {
+		peer.flags |= flags
+	}
+}
+
+// pexFlags returns the flags of a peer, ok is false when peer exchange did not tell us
+// about it and a missing flag does not mean the peer lacks it
+func (p *pool) pexFlags(addr netip.AddrPort) (byte, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if peer, ok := p.peers[addr]; ok {
+		return peer.flags, peer.pex
+	}
+	return 0, false
+}
+
+// connectedPeers returns the peers we currently have an established connection to along
+// with their peer exchange flags
+func (p *pool) connectedPeers() map[netip.AddrPort]byte {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	connected := make(map[netip.AddrPort]byte)
+	for addr, peer := range p.peers {
+		if peer.established {
+			connected[addr] = peer.flags
+		}
+	}
+	return connected
+}
+
+// stats describes the peers we have an established connection to, sorted by address
+func (p *pool) stats() []PeerStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var stats []PeerStats
+	for _, peer := range p.peers {
+		if peer.established {
+			stats = append(stats, PeerStats{Addr: peer.addr, Source: peer.source, Client: peer.client})
+		}
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].Addr.Compare(stats[j].Addr) < 0
+	})
+	return stats
+}
+
+func (p *pool) len() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return len(p.peers)
+}
@@ -0,0 +1,165 @@
+package download
+
+import (
+	"errors"
+	"fmt"
+)
+
+var ErrCompleted = errors.New("download already completed")
+
+// Priority decides whether the pieces of a file are downloaded and in which order. Pieces
+// overlapping several files get the highest priority of them, pieces of higher priority
+// are always picked first
+type Priority int
+
+const (
+	PrioritySkip Priority = iota
+	PriorityLow
+	PriorityNormal
+	PriorityHigh
+)
+
+func (p Priority) String() string {
+	switch p {
+	case PrioritySkip:
+		return "skip"
+	case PriorityLow:
+		return "low"
+	case PriorityNormal:
+		return "normal"
+	case PriorityHigh:
+		return "high"
+	default:
+		return fmt.Sprintf("priority(%d)", int(p))
+	}
+}
+
+func ParsePriority(s string) (Priority, error) {
+	switch s {
+	case "skip":
+		return PrioritySkip, nil
+	case "low":
+		return PriorityLow, nil
+	case "normal":
+		return PriorityNormal, nil
+	case "high":
+		return PriorityHigh, nil
+	default:
+		return 0, fmt.Errorf("unknown priority %q, expected skip, low, normal or high", s)
+	}
+}
+
+// Files returns the files of the torrent
+func (d *Download) Files() []File {
+	return d.torrent.Files
+}
+
+// FilePriorities returns the priority of every file
+func (d *Download) FilePriorities() []Priority {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	priorities := make([]Priority, len(d.filePriorities))
+	copy(priorities, d.filePriorities)
+	return priorities
+}
+
+// SetFilePriority changes the priority of a file, it can be called while the download
+// runs. Pieces already being downloaded are finished even when their files are skipped.
+// Skipping every file left makes the download idle. Once every wanted piece is downloaded
+// the download is over and priorities can not be changed anymore
+func (d *Download) SetFilePriority(file int, priority Priority) error {
+	if priority < PrioritySkip || priority > PriorityHigh {
+		return fmt.Errorf("invalid priority %d", priority)
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if file < 0 || file >= len(d.filePriorities) {
+		return fmt.Errorf("file index %d out of range", file)
+	}
+	if d.completed {
+		return ErrCompleted
+	}
+
+	d.filePriorities[file] = priority
+	d.updatePriorities()
+	return nil
+}
+
+// updatePriorities derives the priority of every piece from the file priorities, skips or
+// restores the pieces whose files were skipped or restored, tells storage about them and
+// recounts the pieces left. It must be called with mu held
+func (d *Download) updatePriorities() {
+	for i := range d.priorities {
+		d.priorities[i] = PrioritySkip
+	}
+
+	offset := 0
+	for i, file := range d.torrent.Files {
+		begin := offset
+		offset += file.Length
+		if file.Pad || file.Length == 0 {
+			continue
+		}
+
+		first := begin / d.torrent.PieceLength
+		last := (begin + file.Length - 1) / d.torrent.PieceLength
+		for index := first; index <= last && index < len(d.priorities); index++ {
+			d.priorities[index] = max(d.priorities[index], d.filePriorities[i])
+		}
+	}
+
+	// pieces before the sequential cursor may have been restored
+	d.cursor = 0
+
+	d.remaining = 0
+	for i, priority := range d.priorities {
+		if d.pieceFilter != nil && !d.pieceFilter[i] {
+			d.priorities[i] = PrioritySkip
+			priority = PrioritySkip
+		}
+
+		switch {
+		case priority == PrioritySkip && d.states[i] == pieceMissing:
+			d.states[i] = pieceSkipped
+		case priority != PrioritySkip && d.states[i] == pieceSkipped:
+			d.states[i] = pieceMissing
+		}
+
+		if priority != PrioritySkip && d.states[i] != pieceDone {
+			d.remaining++
+		}
+	}
+
+	d.syncSkipped()
+	// readers waiting for pieces that were just skipped give up
+	d.notifyProgress()
+
+	// pieces left only because their files were skipped leave the download idle, it goes
+	// on once one of them is wanted again
+	if d.remaining == 0 && !d.completed && !d.hasSkippedPieces() {
+		d.completed = true
+		close(d.done)
+	}
+}
+
+// hasSkippedPieces reports whether a piece is missing because its files were skipped, it
+// must be called with mu held
+func (d *Download) hasSkippedPieces() bool {
+	for _, state := range d.states {
+		if state == pieceSkipped {
+			return true
+		}
+	}
+	return false
+}
+
+// Idle reports whether every piece left belongs to skipped files, the download then has
+// nothing to do but is not over. Wanting one of the files again resumes it
+func (d *Download) Idle() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.remaining == 0 && !d.completed
+}
@@ -0,0 +1,658 @@
+package download
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"slices"
+	"time"
+
+	"github.com/nullxDEADBEEF/bittorrent/internal/merkle"
+	"github.com/nullxDEADBEEF/bittorrent/internal/peer"
+)
+
+const (
+	// number of block requests we keep in flight on a connection
+	maxBacklog = 5
+	// connections that did not give us anything useful for this long are closed to make
+	// room for other peers
+	peerIdleTimeout = 2 * time.Minute
+	// the extended message id we ask peers to use when sending us ut_pex messages
+	pexExtendedID = 1
+	clientName    = "bittorrent"
+)
+
+var (
+	errPeerIdle       = errors.New("peer has nothing to offer")
+	errRequestTimeout = errors.New("peer did not answer our requests in time")
+	errFastMessage    = errors.New("fast extension message received without negotiating the extension")
+)
+
+type blockState int
+
+const (
+	blockMissing blockState = iota
+	blockRequested
+	blockReceived
+)
+
+// pieceProgress tracks the blocks of the piece being downloaded on a connection
+type pieceProgress struct {
+	index    int
+	buf      []byte
+	blocks   []blockState
+	backlog  int
+	received int
+	// waiting is when the outstanding requests were sent or last answered
+	waiting time.Time
+}
+
+func newPieceProgress(index, size int) *pieceProgress {
+	return &pieceProgress{
+		index:  index,
+		buf:    make([]byte, size),
+		blocks: make([]blockState, (size+peer.BlockSize-1)/peer.BlockSize),
+	}
+}
+
+// session is a single connection to a peer
+type session struct {
+	d        *Download
+	addr     netip.AddrPort
+	conn     *peer.Conn
+	bitfield peer.Bitfield
+	choked   bool
+	// fast is set when both sides support the fast extension
+	fast bool
+	// allowedFast are the pieces the peer lets us download while choked, ourAllowedFast
+	// the ones we let it download from us
+	allowedFast    map[int]bool
+	ourAllowedFast map[int]bool
+	// suggested are pieces the peer would like us to download first
+	suggested []int
+	// rejected are pieces the peer refused to give us while unchoked or from its allowed
+	// fast set, they are left for other peers
+	rejected map[int]bool
+	// remoteExtensions are the extended message ids the peer wants us to use
+	remoteExtensions map[string]int
+	pex              *peer.PEXState
+	piece            *pieceProgress
+	lastUseful       time.Time
+	// stop ends the session, it also interrupts rate limited waits
+	stop <-chan struct{}
+}
+
+// dialer returns the dialer of outgoing connections
+func (c *Config) dialer() *peer.Dialer {
+	return &peer.Dialer{
+		Encryption:       c.Encryption,
+		Transport:        c.Transport,
+		UTP:              c.UTP,
+		Timeout:          c.DialTimeout,
+		HandshakeTimeout: c.HandshakeTimeout,
+	}
+}
+
+// runPeer connects to a peer and downloads from it until the connection ends or ctx is
+// cancelled
+func (d *Download) runPeer(ctx context.Context, addr netip.AddrPort) error {
+	dialer := d.config.dialer()
+	// peer exchange tells whether the peer would rather be encrypted and speaks uTP
+	if flags, ok := d.pool.pexFlags(addr); ok {
+		dialer.PlaintextFirst = flags&peer.PEXPrefersEncryption == 0
+		dialer.TCPOnly = flags&peer.PEXSupportsUTP == 0
+	}
+
+	conn, err := dialer.DialContext(ctx, addr.String(), d.handshake())
+	if err != nil {
+		return err
+	}
+
+	d.pool.established(addr)
+	// we reached the peer with an outgoing connection, so others can too
+	d.pool.setFlags(addr, peer.PEXReachable)
+
+	return d.serve(conn, addr, ctx.Done())
+}
+
+// serve runs the session on a connection that completed the handshake, it closes the
+// connection when the session ends
+func (d *Download) serve(conn *peer.Conn, addr netip.AddrPort, stop <-chan struct{}) error {
+	defer conn.Close()
+
+	if _, ok := conn.RemoteAddr().(*net.UDPAddr); ok {
+		d.pool.setFlags(addr, peer.PEXSupportsUTP)
+	}
+	d.pool.identify(addr, peer.IdentifyClient(conn.Remote.PeerID))
+	described := d.pool.describe(addr)
+	d.event(PeerConnectedEvent{Addr: addr, Source: described.Source, Client: described.Client})
+
+	s := &session{
+		d:                d,
+		addr:             addr,
+		conn:             conn,
+		bitfield:         peer.NewBitfield(d.torrent.NumPieces()),
+		choked:           true,
+		fast:             conn.SupportsFast(),
+		allowedFast:      make(map[int]bool),
+		ourAllowedFast:   make(map[int]bool),
+		rejected:         make(map[int]bool),
+		remoteExtensions: make(map[string]int),
+		pex:              peer.NewPEXState(),
+		lastUseful:       time.Now(),
+		stop:             stop,
+	}
+	defer s.release()
+
+	err := s.run(stop)
+	d.event(PeerDisconnectedEvent{Addr: addr, Err: err})
+	return err
+}
+
+func (s *session) run(stop <-chan struct{}) error {
+	if err := s.sendBitfield(); err != nil {
+		return err
+	}
+
+	if s.conn.SupportsExtensions() {
+		if err := s.sendExtendedHandshake(); err != nil {
+			return err
+		}
+	}
+
+	if s.fast {
+		if err := s.sendAllowedFast(); err != nil {
+			return err
+		}
+	}
+
+	if err := s.conn.WriteMessage(&peer.Message{ID: peer.MsgInterested}); err != nil {
+		return err
+	}
+
+	// the reader goroutine hands messages over until the session returns
+	quit := make(chan struct{})
+	defer close(quit)
+
+	messages := make(chan *peer.Message)
+	readErr := make(chan error, 1)
+	go func() {
+		for {
+			msg, err := s.conn.ReadMessage()
+			if err != nil {
+				readErr <- err
+				return
+			}
+			select {
+			case messages <- msg:
+			case <-quit:
+				return
+			}
+		}
+	}()
+
+	pexTicker := time.NewTicker(peer.PEXInterval)
+	defer pexTicker.Stop()
+	tick := time.NewTicker(time.Second)
+	defer tick.Stop()
+
+	for {
+		if err := s.requestBlocks(); err != nil {
+			return err
+		}
+
+		select {
+		case <-stop:
+			return nil
+		case <-s.d.done:
+			return nil
+		case err := <-readErr:
+			return err
+		case msg := <-messages:
+			if err := s.handleMessage(msg); err != nil {
+				return err
+			}
+		case <-pexTicker.C:
+			if err := s.sendPEX(); err != nil {
+				return err
+			}
+		case <-tick.C:
+		}
+
+		if s.piece != nil && s.piece.received == len(s.piece.blocks) {
+			if err := s.finishPiece(); err != nil {
+				return err
+			}
+		}
+
+		if s.piece != nil && s.piece.backlog > 0 && time.Since(s.piece.waiting) > s.d.config.RequestTimeout {
+			return errRequestTimeout
+		}
+		if time.Since(s.lastUseful) > peerIdleTimeout {
+			return errPeerIdle
+		}
+	}
+}
+
+func (s *session) handleMessage(msg *peer.Message) error {
+	// keep-alive
+	if msg == nil {
+		return nil
+	}
+
+	switch msg.ID {
+	case peer.MsgSuggest, peer.MsgHaveAll, peer.MsgHaveNone, peer.MsgReject, peer.MsgAllowedFast:
+		if !s.fast {
+			return errFastMessage
+		}
+	}
+
+	switch msg.ID {
+	case peer.MsgChoke:
+		s.choked = true
+		// pending requests are dropped by the peer when it chokes us, with the fast
+		// extension it rejects them one by one instead
+		if s.piece != nil && !s.fast {
+			for i, state := range s.piece.blocks {
+				if state == blockRequested {
+					s.piece.blocks[i] = blockMissing
+				}
+			}
+			s.piece.backlog = 0
+		}
+	case peer.MsgUnchoke:
+		s.choked = false
+	case peer.MsgHave:
+		index, err := peer.ParseHave(msg)
+		if err != nil {
+			return err
+		}
+		s.bitfield.SetPiece(index)
+		s.updateSeedFlag()
+	case peer.MsgBitfield:
+		copy(s.bitfield, msg.Payload)
+		s.updateSeedFlag()
+	case peer.MsgHaveAll:
+		for i := 0; i < s.d.torrent.NumPieces(); i++ {
+			s.bitfield.SetPiece(i)
+		}
+		s.updateSeedFlag()
+	case peer.MsgHaveNone:
+	case peer.MsgSuggest:
+		index, err := peer.ParseSuggest(msg)
+		if err != nil {
+			return err
+		}
+		if index < s.d.torrent.NumPieces() && !slices.Contains(s.suggested, index) {
+			s.suggested = append(s.suggested, index)
+		}
+	case peer.MsgAllowedFast:
+		index, err := peer.ParseAllowedFast(msg)
+		if err != nil {
+			return err
+		}
+		if index < s.d.torrent.NumPieces() {
+			s.allowedFast[index] = true
+		}
+	case peer.MsgReject:
+		return s.handleReject(msg)
+	case peer.MsgRequest:
+		return s.handleRequest(msg)
+	case peer.MsgPiece:
+		return s.handlePiece(msg)
+	case peer.MsgExtended:
+		return s.handleExtended(msg)
+	case peer.MsgHashRequest:
+		return s.handleHashRequest(msg)
+	}
+
+	return nil
+}
+
+func (s *session) handlePiece(msg *peer.Message) error {
+	index, begin, block, err := peer.ParsePiece(msg)
+	if err != nil {
+		return err
+	}
+
+	if s.piece == nil || s.piece.index != index {
+		return nil
+	}
+
+	blockIndex := begin / peer.BlockSize
+	if begin%peer.BlockSize != 0 || blockIndex >= len(s.piece.blocks) || begin+len(block) > len(s.piece.buf) {
+		return fmt.Errorf("invalid block at offset %d of piece %d", begin, index)
+	}
+
+	if s.piece.blocks[blockIndex] == blockReceived {
+		return nil
+	}
+	if s.piece.blocks[blockIndex] == blockRequested {
+		s.piece.backlog--
+	}
+
+	copy(s.piece.buf[begin:], block)
+	s.piece.blocks[blockIndex] = blockReceived
+	s.piece.received++
+	s.piece.waiting = time.Now()
+	s.lastUseful = time.Now()
+
+	// holding off the next requests is what slows the peer down, the session notices
+	// stop on its own when the wait is cut short
+	s.d.config.DownloadLimit.Wait(len(block), s.stop)
+
+	return nil
+}
+
+// handleReject puts a block the peer refused back in the missing blocks. Blocks rejected
+// while we are choked are requested again once we get unchoked, but a peer that rejects
+// us while unchoking us will not give us the piece, so it is handed back right away for
+// other connections to download
+func (s *session) handleReject(msg *peer.Message) error {
+	index, begin, _, err := peer.ParseRequest(msg)
+	if err != nil {
+		return err
+	}
+
+	if s.piece == nil || s.piece.index != index || begin%peer.BlockSize != 0 {
+		return nil
+	}
+	blockIndex := begin / peer.BlockSize
+	if blockIndex >= len(s.piece.blocks) || s.piece.blocks[blockIndex] != blockRequested {
+		return nil
+	}
+
+	s.piece.blocks[blockIndex] = blockMissing
+	s.piece.backlog--
+
+	// the piece goes back to other peers whatever the reason, it is only asked from this
+	// peer again when choking was the reason and the piece is not one we may download
+	// while choked
+	if !s.choked || s.allowedFast[index] {
+		s.rejected[index] = true
+	}
+	s.release()
+
+	return nil
+}
+
+// handleRequest serves the pieces of our allowed fast set, we keep every peer choked so
+// any other request is rejected. Peers without the fast extension expect requests sent
+// while choked to be dropped silently
+func (s *session) handleRequest(msg *peer.Message) error {
+	index, begin, length, err := peer.ParseRequest(msg)
+	if err != nil {
+		return err
+	}
+	if !s.fast {
+		return nil
+	}
+
+	if s.ourAllowedFast[index] && length > 0 && length <= peer.BlockSize {
+		payload := make([]byte, 8+length)
+		ok, err := s.d.readPiece(index, begin, payload[8:])
+		if err != nil {
+			log.Printf("Failed to serve a block to %s: %v", s.addr, err)
+		}
+		if ok {
+			if err := s.d.config.UploadLimit.Wait(length, s.stop); err != nil {
+				return nil
+			}
+			binary.BigEndian.PutUint32(payload[0:4], uint32(index))
+			binary.BigEndian.PutUint32(payload[4:8], uint32(begin))
+			s.d.uploaded.Add(int64(length))
+			return s.conn.WriteMessage(&peer.Message{ID: peer.MsgPiece, Payload: payload})
+		}
+	}
+
+	return s.conn.WriteMessage(peer.NewReject(index, begin, length))
+}
+
+// handleHashRequest answers requests for hashes of the piece layers we have, with the
+// proof up to the pieces root. Requests for any other layer are rejected
+func (s *session) handleHashRequest(msg *peer.Message) error {
+	if !s.conn.SupportsV2() {
+		return nil
+	}
+
+	request, err := peer.ParseHashRequest(msg)
+	if err != nil {
+		return err
+	}
+
+	pieceLayer := merkle.Log2(s.d.torrent.PieceLength / merkle.BlockSize)
+	layer, ok := s.d.torrent.PieceLayers[request.PiecesRoot]
+	if ok && request.BaseLayer == pieceLayer {
+		pad := merkle.ZeroHash(pieceLayer)
+		if hashes, ok := merkle.Proof(layer, pad, request.Index, request.Length, request.ProofLayers); ok {
+			return s.conn.WriteMessage(peer.NewHashes(request, hashes))
+		}
+	}
+
+	return s.conn.WriteMessage(peer.NewHashReject(request))
+}
+
+// offers tells whether the peer has a piece and did not refuse to give it to us
+func (s *session) offers(index int) bool {
+	return s.bitfield.HasPiece(index) && !s.rejected[index]
+}
+
+// requestable tells whether we can ask the peer for blocks of a piece right now
+func (s *session) requestable(index int) bool {
+	return s.offers(index) && (!s.choked || s.allowedFast[index])
+}
+
+// requestBlocks picks a piece if we are not working on one and keeps the request
+// backlog full. While choked only pieces of the allowed fast set can be requested
+func (s *session) requestBlocks() error {
+	if s.choked && (s.piece == nil && len(s.allowedFast) == 0 || s.piece != nil && !s.allowedFast[s.piece.index]) {
+		return nil
+	}
+
+	if s.piece == nil {
+		index, ok := s.d.pickPiece(s.requestable, s.suggested)
+		if !ok {
+			if !s.choked && s.d.wants(s.offers) {
+				// the pieces we need from this peer are being downloaded elsewhere
+				s.lastUseful = time.Now()
+			}
+			return nil
+		}
+		s.piece = newPieceProgress(index, s.d.torrent.PieceSize(index))
+		s.lastUseful = time.Now()
+	}
+
+	for i, state := range s.piece.blocks {
+		if s.piece.backlog >= maxBacklog {
+			break
+		}
+		if state != blockMissing {
+			continue
+		}
+
+		begin := i * peer.BlockSize
+		length := min(peer.BlockSize, len(s.piece.buf)-begin)
+		if err := s.conn.WriteMessage(peer.NewRequest(s.piece.index, begin, length)); err != nil {
+			return err
+		}
+		if s.piece.backlog == 0 {
+			s.piece.waiting = time.Now()
+		}
+		s.piece.blocks[i] = blockRequested
+		s.piece.backlog++
+	}
+
+	return nil
+}
+
+func (s *session) finishPiece() error {
+	piece := s.piece
+	s.piece = nil
+
+	return s.d.finishPiece(piece.index, piece.buf)
+}
+
+// release gives the piece being downloaded back to the download when the connection ends
+func (s *session) release() {
+	if s.piece != nil {
+		s.d.abandonPiece(s.piece.index)
+		s.piece = nil
+	}
+}
+
+func (s *session) updateSeedFlag() {
+	if s.bitfield.Count(s.d.torrent.NumPieces()) == s.d.torrent.NumPieces() {
+		s.d.pool.setFlags(s.addr, peer.PEXSeed)
+	}
+}
+
+// sendBitfield tells the peer which pieces we have. With the fast extension one of
+// bitfield, have all or have none has to be sent, otherwise the bitfield may be left out
+// when we have nothing
+func (s *session) sendBitfield() error {
+	bitfield, count := s.d.bitfield()
+
+	switch {
+	case s.fast && count == 0:
+		return s.conn.WriteMessage(peer.NewHaveNone())
+	case s.fast && count == s.d.torrent.NumPieces():
+		return s.conn.WriteMessage(peer.NewHaveAll())
+	case count > 0:
+		return s.conn.WriteMessage(&peer.Message{ID: peer.MsgBitfield, Payload: bitfield})
+	}
+
+	return nil
+}
+
+// sendAllowedFast lets the peer download the pieces of its allowed fast set from us
+func (s *session) sendAllowedFast() error {
+	set := peer.AllowedFastSet(s.addr.Addr(), s.d.torrent.InfoHash, s.d.torrent.NumPieces(), peer.AllowedFastCount)
+	for _, index := range set {
+		if err := s.conn.WriteMessage(peer.NewAllowedFast(index)); err != nil {
+			return err
+		}
+		s.ourAllowedFast[index] = true
+	}
+	return nil
+}
+
+func (s *session) sendExtendedHandshake() error {
+	extensions := make(map[string]int)
+	if !s.d.torrent.Private {
+		extensions[peer.ExtensionPEX] = pexExtendedID
+	}
+	if len(s.d.torrent.Metadata) > 0 {
+		extensions[peer.ExtensionMetadata] = metadataExtendedID
+	}
+
+	handshake := &peer.ExtendedHandshake{
+		Extensions:   extensions,
+		Port:         int(s.d.config.Port),
+		Client:       clientName,
+		MetadataSize: len(s.d.torrent.Metadata),
+	}
+
+	msg, err := handshake.Message()
+	if err != nil {
+		return err
+	}
+
+	return s.conn.WriteMessage(msg)
+}
+
+func (s *session) handleExtended(msg *peer.Message) error {
+	extendedID, payload, err := peer.ParseExtended(msg)
+	if err != nil {
+		return err
+	}
+
+	switch extendedID {
+	case peer.ExtendedHandshakeID:
+		handshake, err := peer.ParseExtendedHandshake(payload)
+		if err != nil {
+			return err
+		}
+		s.remoteExtensions = handshake.Extensions
+		// the client names itself better than its peer id does
+		if handshake.Client != "" {
+			s.d.pool.identify(s.addr, peer.ParseClientVersion(handshake.Client))
+		}
+	case pexExtendedID:
+		if s.d.torrent.Private {
+			return nil
+		}
+
+		pex, err := peer.ParsePEX(payload)
+		if err != nil {
+			log.Printf("Invalid ut_pex message from %s: %v", s.addr, err)
+			return nil
+		}
+		for _, added := range pex.Added {
+			s.d.pool.add(added.Addr, SourcePEX, added.Flags)
+		}
+	case metadataExtendedID:
+		return s.handleMetadataRequest(payload)
+	}
+
+	return nil
+}
+
+// handleMetadataRequest sends the peer the piece of the info dictionary it asks for
+func (s *session) handleMetadataRequest(payload []byte) error {
+	remoteID, ok := s.remoteExtensions[peer.ExtensionMetadata]
+	if !ok || len(s.d.torrent.Metadata) == 0 {
+		return nil
+	}
+
+	request, err := peer.ParseMetadataMessage(payload)
+	if err != nil {
+		log.Printf("Invalid ut_metadata message from %s: %v", s.addr, err)
+		return nil
+	}
+	if request.Type != peer.MetadataRequest {
+		return nil
+	}
+
+	metadata := s.d.torrent.Metadata
+	response := &peer.MetadataMessage{Type: peer.MetadataReject, Piece: request.Piece}
+	if request.Piece < peer.MetadataPieces(len(metadata)) {
+		begin := request.Piece * peer.MetadataPieceSize
+		response.Type = peer.MetadataData
+		response.TotalSize = len(metadata)
+		response.Data = metadata[begin:min(begin+peer.MetadataPieceSize, len(metadata))]
+	}
+
+	msg, err := response.Encode()
+	if err != nil {
+		return err
+	}
+	return s.conn.WriteMessage(peer.NewExtendedMessage(byte(remoteID), msg))
+}
+
+// sendPEX tells the peer which peers we connected to and disconnected from since the
+// last message
+func (s *session) sendPEX() error {
+	remoteID, ok := s.remoteExtensions[peer.ExtensionPEX]
+	if !ok || s.d.torrent.Private {
+		return nil
+	}
+
+	connected := s.d.pool.connectedPeers()
+	delete(connected, s.addr)
+
+	delta, ok := s.pex.Delta(connected, time.Now())
+	if !ok {
+		return nil
+	}
+
+	payload, err := delta.Encode()
+	if err != nil {
+		return err
+	}
+
+	return s.conn.WriteMessage(peer.NewExtendedMessage(byte(remoteID), payload))
+}
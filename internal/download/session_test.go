@@ -0,0 +1,66 @@
+package download
+
+import (
+	"testing"
+
+	"github.com/nullxDEADBEEF/bittorrent/internal/peer"
+)
+
+// newTestSession is a session with the fast extension downloading a piece, with every
+// block of it requested
+func newTestSession(t *testing.T, d *Download) *session {
+	t.Helper()
+
+	index, ok := d.pickPiece(func(int) bool { return true }, nil)
+	if !ok {
+		t.Fatal("no piece to download")
+	}
+	s := &session{
+		d:           d,
+		fast:        true,
+		allowedFast: make(map[int]bool),
+		rejected:    make(map[int]bool),
+		piece:       newPieceProgress(index, d.torrent.PieceSize(index)),
+	}
+	for i := range s.piece.blocks {
+		s.piece.blocks[i] = blockRequested
+		s.piece.backlog++
+	}
+	return s
+}
+
+func TestRejectReleasesPiece(t *testing.T) {
+	tests := []struct {
+		name         string
+		choked       bool
+		allowedFast  bool
+		wantRejected bool
+	}{
+		{"unchoked", false, false, true},
+		{"choked", true, false, false},
+		{"choked allowed fast", true, true, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			torrent, _ := testTorrent("reject", 1<<15, 40000)
+			d := New(torrent, DefaultConfig())
+			s := newTestSession(t, d)
+			index := s.piece.index
+			s.choked = test.choked
+			s.allowedFast[index] = test.allowedFast
+
+			if err := s.handleReject(peer.NewReject(index, 0, peer.BlockSize)); err != nil {
+				t.Fatalf("failed to handle reject: %v", err)
+			}
+			if s.piece != nil {
+				t.Error("the rejected piece stayed with the session")
+			}
+			if got, ok := d.pickPiece(func(int) bool { return true }, nil); !ok || got != index {
+				t.Errorf("the rejected piece was not given back")
+			}
+			if s.rejected[index] != test.wantRejected {
+				t.Errorf("piece left for other peers: %v, want %v", s.rejected[index], test.wantRejected)
+			}
+		})
+	}
+}
@@ -0,0 +1,252 @@
+package download
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// DefaultReadahead is the number of pieces past the read position, or past the first
+// missing piece in sequential mode, that are downloaded before any other
+const DefaultReadahead = 8
+
+var (
+	ErrReaderClosed = errors.New("file reader closed")
+	// ErrPieceSkipped is returned by reads waiting for a piece whose files were all
+	// skipped since, it will not be downloaded
+	ErrPieceSkipped = errors.New("piece skipped")
+)
+
+// readerWindow is the span of pieces a reader is about to read
+type readerWindow struct {
+	first, last int
+}
+
+// FileReader reads a file of the torrent while it downloads. Reads block until the pieces
+// they need are verified, and the pieces right after the read position are downloaded
+// before any other so reading sequentially rarely has to wait
+type FileReader struct {
+	d *Download
+	// offset is where the file starts in the torrent
+	offset int64
+	length int64
+	pos    int64
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// OpenFile returns a reader for a file of the torrent. Files that were skipped are given
+// PriorityNormal so they get downloaded
+func (d *Download) OpenFile(index int) (*FileReader, error) {
+	if index < 0 || index >= len(d.torrent.Files) {
+		return nil, fmt.Errorf("file index %d out of range", index)
+	}
+	if d.torrent.Files[index].Pad {
+		return nil, fmt.Errorf("file %d is a pad file", index)
+	}
+
+	r := &FileReader{
+		d:      d,
+		offset: int64(d.torrent.fileOffset(index)),
+		length: int64(d.torrent.Files[index].Length),
+		closed: make(chan struct{}),
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.filePriorities[index] == PrioritySkip {
+		if d.completed && !d.fileDone(index) {
+			return nil, ErrCompleted
+		}
+		d.filePriorities[index] = PriorityNormal
+		d.updatePriorities()
+	}
+
+	d.readers[r] = r.window()
+	return r, nil
+}
+
+// fileDone reports whether every piece of a file is downloaded, it must be called with
+// mu held
+func (d *Download) fileDone(index int) bool {
+	file := d.torrent.Files[index]
+	if file.Length == 0 {
+		return true
+	}
+
+	begin := d.torrent.fileOffset(index)
+	for i := begin / d.torrent.PieceLength; i <= (begin+file.Length-1)/d.torrent.PieceLength; i++ {
+		if d.states[i] != pieceDone {
+			return false
+		}
+	}
+	return true
+}
+
+// window returns the pieces from the read position to the end of the readahead. Empty
+// files have no pieces, their window is empty
+func (r *FileReader) window() readerWindow {
+	if r.length == 0 {
+		return readerWindow{first: 0, last: -1}
+	}
+
+	pieceLength := int64(r.d.torrent.PieceLength)
+	pos := min(r.pos, r.length-1)
+
+	first := int((r.offset + pos) / pieceLength)
+	last := int((r.offset + r.length - 1) / pieceLength)
+	return readerWindow{first: first, last: min(first+r.d.readahead()-1, last)}
+}
+
+func (d *Download) readahead() int {
+	if d.config.Readahead > 0 {
+		return d.config.Readahead
+	}
+	return DefaultReadahead
+}
+
+// Read reads from the file, blocking until the piece at the read position is verified
+func (r *FileReader) Read(p []byte) (int, error) {
+	select {
+	case <-r.closed:
+		return 0, ErrReaderClosed
+	default:
+	}
+
+	if r.pos >= r.length {
+		return 0, io.EOF
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	pieceLength := int64(r.d.torrent.PieceLength)
+	offset := r.offset + r.pos
+	index := int(offset / pieceLength)
+
+	if err := r.d.waitPiece(index, r.closed); err != nil {
+		return 0, err
+	}
+
+	begin := offset - int64(index)*pieceLength
+	n := int(min(int64(len(p)), int64(r.d.torrent.PieceSize(index))-begin, r.length-r.pos))
+	if _, err := r.d.readPiece(index, int(begin), p[:n]); err != nil {
+		return 0, err
+	}
+	r.pos += int64(n)
+	r.d.moveReader(r)
+
+	return n, nil
+}
+
+// Seek sets the read position, which moves the pieces downloaded first along with it
+func (r *FileReader) Seek(offset int64, whence int) (int64, error) {
+	var pos int64
+	switch whence {
+	case io.SeekStart:
+		pos = offset
+	case io.SeekCurrent:
+		pos = r.pos + offset
+	case io.SeekEnd:
+		pos = r.length + offset
+	default:
+		return 0, fmt.Errorf("invalid whence %d", whence)
+	}
+	if pos < 0 {
+		return 0, fmt.Errorf("negative position %d", pos)
+	}
+
+	r.pos = pos
+	r.d.moveReader(r)
+	return pos, nil
+}
+
+// Close unblocks pending reads and stops prioritizing the pieces of the reader
+func (r *FileReader) Close() error {
+	r.closeOnce.Do(func() {
+		close(r.closed)
+
+		r.d.mu.Lock()
+		delete(r.d.readers, r)
+		r.d.mu.Unlock()
+	})
+	return nil
+}
+
+func (d *Download) moveReader(r *FileReader) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, ok := d.readers[r]; ok {
+		d.readers[r] = r.window()
+	}
+}
+
+// waitPiece returns once a piece is verified, or with an error once it will not be: the
+// reader was closed, the download failed or was stopped, or the piece was skipped
+func (d *Download) waitPiece(index int, closed <-chan struct{}) error {
+	for {
+		d.mu.Lock()
+		state, err := d.states[index], d.err
+		progress := d.progress
+		d.mu.Unlock()
+
+		switch {
+		case state == pieceDone:
+			return nil
+		case err != nil:
+			return err
+		case state == pieceSkipped:
+			return ErrPieceSkipped
+		}
+
+		select {
+		case <-progress:
+		case <-d.done:
+			// every wanted piece is verified, one still missing will not be
+			d.mu.Lock()
+			state = d.states[index]
+			d.mu.Unlock()
+			if state != pieceDone && state != pieceSkipped {
+				return ErrCompleted
+			}
+		case <-d.failed:
+		case <-closed:
+			return ErrReaderClosed
+		}
+	}
+}
+
+// pickUrgent returns the missing piece the peer has that is closest to the position of a
+// reader, or to the first missing piece in sequential mode. It must be called with mu held
+func (d *Download) pickUrgent(has func(index int) bool) (int, bool) {
+	best, bestDistance := -1, 0
+	for _, w := range d.readers {
+		for i := w.first; i <= w.last; i++ {
+			if d.states[i] == pieceMissing && has(i) && (best < 0 || i-w.first < bestDistance) {
+				best, bestDistance = i, i-w.first
+				break
+			}
+		}
+	}
+	if best >= 0 {
+		return best, true
+	}
+
+	if !d.config.Sequential {
+		return 0, false
+	}
+
+	for d.cursor < len(d.states) && (d.states[d.cursor] == pieceDone || d.states[d.cursor] == pieceSkipped) {
+		d.cursor++
+	}
+	for i := d.cursor; i < min(d.cursor+d.readahead(), len(d.states)); i++ {
+		if d.states[i] == pieceMissing && has(i) {
+			return i, true
+		}
+	}
+	return 0, false
+}
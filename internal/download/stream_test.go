@@ -0,0 +1,185 @@
+package download
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+// readAsync reads a file in the background, the result comes on the channel
+func readAsync(r io.Reader) <-chan error {
+	result := make(chan error, 1)
+	go func() {
+		_, err := io.ReadAll(r)
+		result <- err
+	}()
+	return result
+}
+
+func waitRead(t *testing.T, result <-chan error) error {
+	t.Helper()
+
+	select {
+	case err := <-result:
+		return err
+	case <-time.After(5 * time.Second):
+		t.Fatal("the read is still blocked")
+		return nil
+	}
+}
+
+func TestFileReaderReadsFromStorage(t *testing.T) {
+	torrent, data := testTorrent("read", 1<<14, 20000, 30000)
+	config := DefaultConfig()
+	config.Storage = newTestStorage(t, torrent)
+	d := New(torrent, config)
+
+	for index := 0; index < torrent.NumPieces(); index++ {
+		downloadPiece(t, d, data, index)
+	}
+
+	r, err := d.OpenFile(1)
+	if err != nil {
+		t.Fatalf("failed to open file: %v", err)
+	}
+	defer r.Close()
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("failed to read file: %v", err)
+	}
+	if !bytes.Equal(got, fileData(torrent, data, 1)) {
+		t.Error("the file read does not match")
+	}
+}
+
+func TestFileReaderWaitsForPieces(t *testing.T) {
+	torrent, data := testTorrent("wait", 1<<14, 40000)
+	d := New(torrent, DefaultConfig())
+
+	r, err := d.OpenFile(0)
+	if err != nil {
+		t.Fatalf("failed to open file: %v", err)
+	}
+	defer r.Close()
+
+	result := make(chan []byte, 1)
+	go func() {
+		got, _ := io.ReadAll(r)
+		result <- got
+	}()
+	for index := 0; index < torrent.NumPieces(); index++ {
+		downloadPiece(t, d, data, index)
+	}
+
+	select {
+	case got := <-result:
+		if !bytes.Equal(got, data) {
+			t.Error("the file read does not match")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the read is still blocked")
+	}
+}
+
+func TestFileReaderUnblocksWhenSkipped(t *testing.T) {
+	// the files do not share pieces
+	torrent, _ := testTorrent("skip", 1<<14, 1<<14, 1<<14)
+	d := New(torrent, DefaultConfig())
+
+	r, err := d.OpenFile(0)
+	if err != nil {
+		t.Fatalf("failed to open file: %v", err)
+	}
+	defer r.Close()
+
+	result := readAsync(r)
+	if err := d.SetFilePriority(0, PrioritySkip); err != nil {
+		t.Fatalf("failed to skip file: %v", err)
+	}
+	if err := waitRead(t, result); !errors.Is(err, ErrPieceSkipped) {
+		t.Errorf("got %v, want ErrPieceSkipped", err)
+	}
+}
+
+func TestFileReaderUnblocksWhenDownloadFails(t *testing.T) {
+	torrent, data := testTorrent("fail", 1<<14, 40000)
+	config := DefaultConfig()
+	config.Storage = failingStorage{}
+	d := New(torrent, config)
+
+	r, err := d.OpenFile(0)
+	if err != nil {
+		t.Fatalf("failed to open file: %v", err)
+	}
+	defer r.Close()
+
+	result := readAsync(r)
+	d.finishPiece(0, data[:torrent.PieceLength])
+	if err := waitRead(t, result); !errors.Is(err, errDiskFull) {
+		t.Errorf("got %v, want the storage error", err)
+	}
+}
+
+func TestFileReaderUnblocksWhenClosed(t *testing.T) {
+	torrent, _ := testTorrent("close", 1<<14, 40000)
+	d := New(torrent, DefaultConfig())
+
+	r, err := d.OpenFile(0)
+	if err != nil {
+		t.Fatalf("failed to open file: %v", err)
+	}
+
+	result := readAsync(r)
+	r.Close()
+	if err := waitRead(t, result); !errors.Is(err, ErrReaderClosed) {
+		t.Errorf("got %v, want ErrReaderClosed", err)
+	}
+}
+
+func TestFileReaderUnblocksWhenStopped(t *testing.T) {
+	torrent, data := testTorrent("stop", 1<<14, 40000)
+	d := New(torrent, DefaultConfig())
+	downloadPiece(t, d, data, 0)
+
+	r, err := d.OpenFile(0)
+	if err != nil {
+		t.Fatalf("failed to open file: %v", err)
+	}
+	defer r.Close()
+
+	result := readAsync(r)
+	d.Stop()
+	if err := waitRead(t, result); !errors.Is(err, ErrStopped) {
+		t.Errorf("got %v, want ErrStopped", err)
+	}
+
+	// what was downloaded can still be read
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		t.Fatalf("failed to seek: %v", err)
+	}
+	got := make([]byte, torrent.PieceLength)
+	if _, err := io.ReadFull(r, got); err != nil || !bytes.Equal(got, data[:torrent.PieceLength]) {
+		t.Errorf("failed to read the verified piece: %v", err)
+	}
+}
+
+func TestEmptyTrailingFile(t *testing.T) {
+	// the empty file starts right where the last piece ends
+	torrent, _ := testTorrent("empty", 1<<14, 1<<14, 0)
+	d := New(torrent, DefaultConfig())
+
+	r, err := d.OpenFile(1)
+	if err != nil {
+		t.Fatalf("failed to open file: %v", err)
+	}
+	defer r.Close()
+
+	if index, ok := d.pickPiece(func(int) bool { return true }, nil); !ok || index != 0 {
+		t.Errorf("picked %d and %v, want piece 0", index, ok)
+	}
+	if n, err := r.Read(make([]byte, 1)); n != 0 || err != io.EOF {
+		t.Errorf("got %d and %v, want io.EOF", n, err)
+	}
+}
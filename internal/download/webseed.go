@@ -0,0 +1,319 @@
+package download
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Web seeds (BEP 19) are HTTP servers hosting the files of a torrent. They are used like
+// peers that have every piece: a piece is fetched with range requests on the files it
+// spans and checked against its hash like any other
+const (
+	// failed requests are retried this many times before the seed is backed off
+	webSeedAttempts = 3
+	// delay between the attempts of a request
+	webSeedRetryDelay = time.Second
+	// seeds that fail are left alone for this long, doubled on every failure
+	webSeedBackoff = 30 * time.Second
+	// after this many consecutive failures a seed is not used anymore
+	maxWebSeedFailures = 5
+	// time allowed for a single range request, including reading the body
+	webSeedTimeout = time.Minute
+)
+
+var (
+	errWebSeedStatus = errors.New("unexpected HTTP status")
+	// errWebSeedRange is returned when a seed answers a range request with other bytes
+	// than the ones asked for
+	errWebSeedRange = errors.New("unexpected content range")
+)
+
+// webSeedError is a status the server answered with, along with the delay it asked us to
+// wait through Retry-After
+type webSeedError struct {
+	err        error
+	status     int
+	retryAfter time.Duration
+}
+
+// temporary reports whether asking again right away may work
+func (e *webSeedError) temporary() bool {
+	return e.status >= 500 && e.retryAfter == 0
+}
+
+func (e *webSeedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *webSeedError) Unwrap() error {
+	return e.err
+}
+
+// webSeed downloads pieces from a single HTTP server
+type webSeed struct {
+	d      *Download
+	url    string
+	client *http.Client
+	// retryDelay separates the attempts of a request, backoff is how long the seed is
+	// left alone after its first failure
+	retryDelay time.Duration
+	backoff    time.Duration
+	failures   int
+}
+
+// runWebSeed downloads pieces from a web seed until the download is done or ctx is
+// cancelled. Seeds that keep failing are retried less and less and eventually dropped
+func (d *Download) runWebSeed(ctx context.Context, rawURL string) {
+	if u, err := url.Parse(rawURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		log.Printf("Ignoring web seed %s: only HTTP(S) is supported", rawURL)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-d.done:
+		case <-ctx.Done():
+		}
+		cancel()
+	}()
+
+	w := &webSeed{
+		d:          d,
+		url:        rawURL,
+		client:     &http.Client{Timeout: webSeedTimeout},
+		retryDelay: webSeedRetryDelay,
+		backoff:    webSeedBackoff,
+	}
+	w.run(ctx)
+}
+
+// run downloads pieces until ctx is cancelled or the seed failed too many times in a row
+func (w *webSeed) run(ctx context.Context) {
+	d := w.d
+	for {
+		index, ok := d.pickPiece(func(int) bool { return true }, nil)
+		if !ok {
+			// every missing piece is being downloaded from someone, wait for one to be
+			// abandoned or for the download to end
+			if !sleepContext(ctx, w.retryDelay) {
+				return
+			}
+			continue
+		}
+
+		err := w.fetchPiece(ctx, index)
+		if err == nil {
+			w.failures = 0
+			continue
+		}
+		d.abandonPiece(index)
+		if ctx.Err() != nil {
+			return
+		}
+
+		w.failures++
+		if w.failures >= maxWebSeedFailures {
+			log.Printf("Giving up on web seed %s: %v", w.url, err)
+			return
+		}
+
+		delay := w.backoffDelay(err)
+		log.Printf("Web seed %s failed: %v, retrying in %s", w.url, err, delay)
+		if !sleepContext(ctx, delay) {
+			return
+		}
+	}
+}
+
+// backoffDelay is how long the seed is left alone after failing with err, the backoff
+// doubles with every failure in a row unless the seed asked for a longer wait
+func (w *webSeed) backoffDelay(err error) time.Duration {
+	delay := w.backoff << (w.failures - 1)
+	var seedErr *webSeedError
+	if errors.As(err, &seedErr) && seedErr.retryAfter > delay {
+		delay = seedErr.retryAfter
+	}
+	return delay
+}
+
+// fetchPiece downloads a piece from the seed and hands it to the download
+func (w *webSeed) fetchPiece(ctx context.Context, index int) error {
+	size := w.d.torrent.PieceSize(index)
+	data := make([]byte, 0, size)
+
+	begin := index * w.d.torrent.PieceLength
+	for _, r := range w.d.torrent.fileRanges(begin, size) {
+		// pad files are not hosted, they are zeros
+		if w.d.torrent.Files[r.file].Pad {
+			data = append(data, make([]byte, r.length)...)
+			continue
+		}
+		fileURL := w.fileURL(r.file)
+
+		var chunk []byte
+		var err error
+		for attempt := 0; attempt < webSeedAttempts; attempt++ {
+			if attempt > 0 && !sleepContext(ctx, w.retryDelay) {
+				return ctx.Err()
+			}
+
+			chunk, err = w.fetchRange(ctx, fileURL, r.offset, r.length)
+			var seedErr *webSeedError
+			if err == nil || ctx.Err() != nil || (errors.As(err, &seedErr) && !seedErr.temporary()) {
+				break
+			}
+		}
+		if err != nil {
+			return err
+		}
+		if err := w.d.config.DownloadLimit.Wait(len(chunk), ctx.Done()); err != nil {
+			return err
+		}
+
+		data = append(data, chunk...)
+	}
+
+	return w.d.finishPiece(index, data)
+}
+
+// fetchRange requests length bytes of a file from offset
+func (w *webSeed) fetchRange(ctx context.Context, fileURL string, offset int64, length int) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fileURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+int64(length)-1))
+	req.Header.Set("User-Agent", clientName)
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		if err := checkContentRange(resp.Header.Get("Content-Range"), offset, length); err != nil {
+			return nil, &webSeedError{err: fmt.Errorf("%w for %s", err, fileURL), status: resp.StatusCode}
+		}
+	case http.StatusOK:
+		// servers that ignore ranges send the whole file
+		if _, err := io.CopyN(io.Discard, resp.Body, offset); err != nil {
+			return nil, fmt.Errorf("failed to skip to offset %d: %w", offset, err)
+		}
+	default:
+		return nil, &webSeedError{
+			err:        fmt.Errorf("%w %s for %s", errWebSeedStatus, resp.Status, fileURL),
+			status:     resp.StatusCode,
+			retryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+		}
+	}
+
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(resp.Body, buf); err != nil {
+		return nil, fmt.Errorf("failed to read %d bytes at offset %d: %w", length, offset, err)
+	}
+
+	return buf, nil
+}
+
+// checkContentRange makes sure the Content-Range of a partial response, like
+// "bytes 0-99/1000", covers exactly the range that was requested
+func checkContentRange(value string, offset int64, length int) error {
+	var first, last int64
+	var total string
+	if _, err := fmt.Sscanf(value, "bytes %d-%d/%s", &first, &last, &total); err != nil {
+		return fmt.Errorf("%w %q", errWebSeedRange, value)
+	}
+	if first != offset || last != offset+int64(length)-1 {
+		return fmt.Errorf("%w %q, requested bytes %d-%d", errWebSeedRange, value, offset, offset+int64(length)-1)
+	}
+	return nil
+}
+
+// fileURL returns the URL of a file on the seed. The seed URL of a single file torrent is
+// the file itself, unless it ends with a slash, then the torrent name is appended. Files
+// of multi-file torrents are found under the torrent name
+func (w *webSeed) fileURL(file int) string {
+	t := &w.d.torrent
+	base := w.url
+
+	if len(t.Files) == 1 && len(t.Files[0].Path) == 0 {
+		if strings.HasSuffix(base, "/") {
+			base += url.PathEscape(t.Name)
+		}
+		return base
+	}
+
+	if !strings.HasSuffix(base, "/") {
+		base += "/"
+	}
+	elements := append([]string{t.Name}, t.Files[file].Path...)
+	for i, element := range elements {
+		elements[i] = url.PathEscape(element)
+	}
+	return base + strings.Join(elements, "/")
+}
+
+// fileRange is the part of a file covered by a span of the torrent
+type fileRange struct {
+	file   int
+	offset int64
+	length int
+}
+
+// fileRanges maps length bytes of the torrent starting at begin to the files they are in
+func (t *Torrent) fileRanges(begin, length int) []fileRange {
+	ranges := make([]fileRange, 0, 1)
+
+	start := 0
+	for i, file := range t.Files {
+		end := start + file.Length
+		// empty files have no bytes to fetch
+		if file.Length > 0 && begin < end && begin+length > start {
+			from := max(begin, start)
+			to := min(begin+length, end)
+			ranges = append(ranges, fileRange{file: i, offset: int64(from - start), length: to - from})
+		}
+		start = end
+	}
+
+	return ranges
+}
+
+// parseRetryAfter understands both forms of Retry-After, seconds and an HTTP date
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		return time.Until(date)
+	}
+	return 0
+}
+
+// sleepContext waits for the delay, it reports false when the context ended first
+func sleepContext(ctx context.Context, delay time.Duration) bool {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
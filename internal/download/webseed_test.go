@@ -0,0 +1,342 @@
+package download
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testTorrent describes random data laid out in files of the given lengths, a single
+// length makes a single file torrent
+func testTorrent(name string, pieceLength int, lengths ...int) (Torrent, []byte) {
+	torrent := Torrent{Name: name, PieceLength: pieceLength}
+	for i, length := range lengths {
+		torrent.Length += length
+		file := File{Length: length}
+		if len(lengths) > 1 {
+			file.Path = []string{"dir", fmt.Sprintf("file%d", i)}
+		}
+		torrent.Files = append(torrent.Files, file)
+	}
+
+	data := make([]byte, torrent.Length)
+	rand.New(rand.NewSource(int64(torrent.Length))).Read(data)
+	for begin := 0; begin < len(data); begin += pieceLength {
+		torrent.PieceHashes = append(torrent.PieceHashes, sha1.Sum(data[begin:min(begin+pieceLength, len(data))]))
+	}
+	return torrent, data
+}
+
+// fileData returns the part of data belonging to file i
+func fileData(torrent Torrent, data []byte, i int) []byte {
+	begin := torrent.fileOffset(i)
+	return data[begin : begin+torrent.Files[i].Length]
+}
+
+// testWebSeed serves the files of a torrent with range support, fail may answer a request
+// instead
+type testWebSeed struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	requests []string
+	fail     func(w http.ResponseWriter, r *http.Request) bool
+}
+
+func newTestWebSeed(t *testing.T, torrent Torrent, data []byte) *testWebSeed {
+	seed := &testWebSeed{}
+	files := make(map[string][]byte)
+	for i, file := range torrent.Files {
+		files["/"+strings.Join(append([]string{torrent.Name}, file.Path...), "/")] = fileData(torrent, data, i)
+	}
+
+	seed.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seed.mu.Lock()
+		seed.requests = append(seed.requests, r.URL.Path+" "+r.Header.Get("Range"))
+		fail := seed.fail
+		seed.mu.Unlock()
+
+		if fail != nil && fail(w, r) {
+			return
+		}
+		content, ok := files[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content))
+	}))
+	t.Cleanup(seed.Close)
+	return seed
+}
+
+func (s *testWebSeed) requestCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.requests)
+}
+
+func newTestWebSeedClient(d *Download, url string) *webSeed {
+	return &webSeed{
+		d:          d,
+		url:        url,
+		client:     http.DefaultClient,
+		retryDelay: 10 * time.Millisecond,
+		backoff:    10 * time.Millisecond,
+	}
+}
+
+func TestFileRanges(t *testing.T) {
+	torrent, _ := testTorrent("t", 100, 30, 0, 150, 20)
+
+	tests := []struct {
+		begin, length int
+		want          []fileRange
+	}{
+		{0, 100, []fileRange{{0, 0, 30}, {2, 0, 70}}},
+		{100, 100, []fileRange{{2, 70, 80}, {3, 0, 20}}},
+		{40, 10, []fileRange{{2, 10, 10}}},
+		{190, 10, []fileRange{{3, 10, 10}}},
+	}
+	for _, test := range tests {
+		got := torrent.fileRanges(test.begin, test.length)
+		if fmt.Sprint(got) != fmt.Sprint(test.want) {
+			t.Errorf("fileRanges(%d, %d) = %v, want %v", test.begin, test.length, got, test.want)
+		}
+	}
+}
+
+func TestWebSeedDownloadsMultiFileTorrent(t *testing.T) {
+	// pieces straddle the files, which end in the middle of blocks
+	torrent, data := testTorrent("multi", 1<<15, 20000, 0, 1, 50000, 12345)
+	seed := newTestWebSeed(t, torrent, data)
+	torrent.WebSeeds = []string{seed.URL + "/"}
+
+	d := New(torrent, DefaultConfig())
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := d.Run(ctx); err != nil {
+		t.Fatalf("download failed: %v", err)
+	}
+
+	for i := 0; i < torrent.NumPieces(); i++ {
+		begin := i * torrent.PieceLength
+		piece, err := d.Piece(i)
+		if err != nil {
+			t.Fatalf("failed to read piece %d: %v", i, err)
+		}
+		if want := data[begin : begin+torrent.PieceSize(i)]; !bytes.Equal(piece, want) {
+			t.Errorf("piece %d does not match", i)
+		}
+	}
+}
+
+func TestWebSeedSingleFileURL(t *testing.T) {
+	torrent, data := testTorrent("single.bin", 1<<14, 40000)
+	seed := newTestWebSeed(t, torrent, data)
+
+	d := New(torrent, DefaultConfig())
+	for _, url := range []string{seed.URL + "/single.bin", seed.URL + "/"} {
+		w := newTestWebSeedClient(d, url)
+		if got := w.fileURL(0); got != seed.URL+"/single.bin" {
+			t.Errorf("file url of seed %s is %s", url, got)
+		}
+	}
+
+	w := newTestWebSeedClient(d, seed.URL+"/single.bin")
+	index, _ := d.pickPiece(func(int) bool { return true }, nil)
+	if err := w.fetchPiece(context.Background(), index); err != nil {
+		t.Fatalf("failed to fetch piece: %v", err)
+	}
+	if !d.hasPiece(index) {
+		t.Errorf("piece %d was not verified", index)
+	}
+}
+
+func TestWebSeedRetriesTemporaryErrors(t *testing.T) {
+	torrent, data := testTorrent("retry", 1<<14, 40000)
+	seed := newTestWebSeed(t, torrent, data)
+	failures := 2
+	seed.fail = func(w http.ResponseWriter, r *http.Request) bool {
+		if failures == 0 {
+			return false
+		}
+		failures--
+		http.Error(w, "busy", http.StatusServiceUnavailable)
+		return true
+	}
+
+	d := New(torrent, DefaultConfig())
+	w := newTestWebSeedClient(d, seed.URL+"/")
+	index, _ := d.pickPiece(func(int) bool { return true }, nil)
+	if err := w.fetchPiece(context.Background(), index); err != nil {
+		t.Fatalf("failed to fetch piece after retries: %v", err)
+	}
+	if n := seed.requestCount(); n != 3 {
+		t.Errorf("got %d requests, want 3", n)
+	}
+}
+
+func TestWebSeedDoesNotRetryClientErrors(t *testing.T) {
+	torrent, data := testTorrent("missing", 1<<14, 40000)
+	seed := newTestWebSeed(t, torrent, data)
+	seed.fail = func(w http.ResponseWriter, r *http.Request) bool {
+		http.NotFound(w, r)
+		return true
+	}
+
+	d := New(torrent, DefaultConfig())
+	w := newTestWebSeedClient(d, seed.URL+"/")
+	err := w.fetchPiece(context.Background(), 0)
+	if !errors.Is(err, errWebSeedStatus) {
+		t.Fatalf("got %v, want errWebSeedStatus", err)
+	}
+	if n := seed.requestCount(); n != 1 {
+		t.Errorf("got %d requests, want 1", n)
+	}
+}
+
+func TestWebSeedRetryAfter(t *testing.T) {
+	torrent, data := testTorrent("later", 1<<14, 40000)
+	seed := newTestWebSeed(t, torrent, data)
+	seed.fail = func(w http.ResponseWriter, r *http.Request) bool {
+		w.Header().Set("Retry-After", "120")
+		http.Error(w, "slow down", http.StatusServiceUnavailable)
+		return true
+	}
+
+	d := New(torrent, DefaultConfig())
+	w := newTestWebSeedClient(d, seed.URL+"/")
+	err := w.fetchPiece(context.Background(), 0)
+
+	// a seed asking us to come back later is not asked again right away
+	if n := seed.requestCount(); n != 1 {
+		t.Errorf("got %d requests, want 1", n)
+	}
+	w.failures = 1
+	if delay := w.backoffDelay(err); delay != 120*time.Second {
+		t.Errorf("backed off for %v, want the 2 minutes of Retry-After", delay)
+	}
+}
+
+func TestWebSeedBackoff(t *testing.T) {
+	w := &webSeed{backoff: webSeedBackoff}
+	errShort := &webSeedError{err: errWebSeedStatus, status: 503, retryAfter: time.Second}
+
+	for failures, want := range []time.Duration{30 * time.Second, time.Minute, 2 * time.Minute, 4 * time.Minute} {
+		w.failures = failures + 1
+		if delay := w.backoffDelay(errors.New("failed")); delay != want {
+			t.Errorf("backed off for %v after %d failures, want %v", delay, w.failures, want)
+		}
+		// a shorter Retry-After does not cut the backoff short
+		if delay := w.backoffDelay(errShort); delay != want {
+			t.Errorf("backed off for %v with a short Retry-After, want %v", delay, want)
+		}
+	}
+}
+
+func TestWebSeedGivesUp(t *testing.T) {
+	torrent, data := testTorrent("broken", 1<<14, 40000)
+	seed := newTestWebSeed(t, torrent, data)
+	seed.fail = func(w http.ResponseWriter, r *http.Request) bool {
+		http.Error(w, "gone", http.StatusGone)
+		return true
+	}
+
+	d := New(torrent, DefaultConfig())
+	w := newTestWebSeedClient(d, seed.URL+"/")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	w.run(ctx)
+
+	if ctx.Err() != nil {
+		t.Fatal("the seed was not given up on")
+	}
+	if n := seed.requestCount(); n != maxWebSeedFailures {
+		t.Errorf("got %d requests, want %d", n, maxWebSeedFailures)
+	}
+	// the pieces go back to other peers
+	if index, ok := d.pickPiece(func(int) bool { return true }, nil); !ok || index != 0 {
+		t.Errorf("piece 0 was not given back")
+	}
+}
+
+func TestWebSeedRejectsWrongContentRange(t *testing.T) {
+	torrent, data := testTorrent("range", 1<<14, 40000)
+	seed := newTestWebSeed(t, torrent, data)
+	seed.fail = func(w http.ResponseWriter, r *http.Request) bool {
+		// the right length, from the wrong place
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes 1-%d/40000", torrent.PieceLength))
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write(data[1 : 1+torrent.PieceLength])
+		return true
+	}
+
+	d := New(torrent, DefaultConfig())
+	w := newTestWebSeedClient(d, seed.URL+"/")
+	if err := w.fetchPiece(context.Background(), 0); !errors.Is(err, errWebSeedRange) {
+		t.Fatalf("got %v, want errWebSeedRange", err)
+	}
+	if n := seed.requestCount(); n != 1 {
+		t.Errorf("got %d requests, want 1", n)
+	}
+}
+
+func TestWebSeedIgnoringRanges(t *testing.T) {
+	torrent, data := testTorrent("whole", 1<<14, 40000)
+	seed := newTestWebSeed(t, torrent, data)
+	seed.fail = func(w http.ResponseWriter, r *http.Request) bool {
+		w.Write(data)
+		return true
+	}
+
+	d := New(torrent, DefaultConfig())
+	w := newTestWebSeedClient(d, seed.URL+"/")
+	if err := w.fetchPiece(context.Background(), 2); err != nil {
+		t.Fatalf("failed to fetch piece from a 200 response: %v", err)
+	}
+}
+
+func TestCheckContentRange(t *testing.T) {
+	tests := []struct {
+		value string
+		ok    bool
+	}{
+		{"bytes 100-199/1000", true},
+		{"bytes 100-199/*", true},
+		{"bytes 100-198/1000", false},
+		{"bytes 0-99/1000", false},
+		{"", false},
+		{"items 100-199/1000", false},
+	}
+	for _, test := range tests {
+		err := checkContentRange(test.value, 100, 100)
+		if (err == nil) != test.ok {
+			t.Errorf("checkContentRange(%q) = %v", test.value, err)
+		}
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	if got := parseRetryAfter("90"); got != 90*time.Second {
+		t.Errorf("got %v for seconds", got)
+	}
+	date := time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)
+	if got := parseRetryAfter(date); got < 59*time.Minute || got > time.Hour {
+		t.Errorf("got %v for a date an hour from now", got)
+	}
+	for _, value := range []string{"", "soon", "-5"} {
+		if got := parseRetryAfter(value); got != 0 {
+			t.Errorf("got %v for %q", got, value)
+		}
+	}
+}
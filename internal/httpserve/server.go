@@ -0,0 +1,208 @@
+package httpserve
+
+import (
+	"encoding/hex"
+	"html/template"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nullxDEADBEEF/bittorrent/pkg/client"
+)
+
+// Server exposes the files of torrents over HTTP while they download:
+//
+//	/                        lists the torrents
+//	/<info hash>/            lists the files of a torrent
+//	/<info hash>/<path>      a file, with support for range requests
+//
+// Files are read through the streaming readers of the torrents, so a request only waits
+// for the pieces it needs and moves them to the front of the queue
+type Server struct {
+	mu       sync.Mutex
+	torrents map[string]*torrent
+	started  time.Time
+}
+
+type torrent struct {
+	InfoHash string
+	Name     string
+	t        *client.Torrent
+	// files maps the path of every file to its index in the files of the torrent
+	files map[string]int
+}
+
+type listedFile struct {
+	Path   string
+	Href   string
+	Length int64
+}
+
+func NewServer() *Server {
+	return &Server{
+		torrents: make(map[string]*torrent),
+		started:  time.Now(),
+	}
+}
+
+// Add serves the files of a torrent under its info hash, its info dictionary must be
+// known
+func (s *Server) Add(ct *client.Torrent) {
+	infoHash := ct.InfoHash()
+	t := &torrent{
+		InfoHash: hex.EncodeToString(infoHash[:]),
+		Name:     ct.Name(),
+		t:        ct,
+		files:    make(map[string]int),
+	}
+	for i, file := range ct.Files() {
+		t.files[file.Path] = i
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.torrents[t.InfoHash] = t
+}
+
+// Remove stops serving a torrent
+func (s *Server) Remove(infoHash [20]byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.torrents, hex.EncodeToString(infoHash[:]))
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	urlPath := strings.TrimPrefix(r.URL.Path, "/")
+	if urlPath == "" {
+		s.serveIndex(w)
+		return
+	}
+
+	infoHash, filePath, _ := strings.Cut(urlPath, "/")
+	s.mu.Lock()
+	t, ok := s.torrents[strings.ToLower(infoHash)]
+	s.mu.Unlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	if filePath == "" {
+		if !strings.HasSuffix(r.URL.Path, "/") {
+			http.Redirect(w, r, r.URL.Path+"/", http.StatusMovedPermanently)
+			return
+		}
+		s.serveTorrent(w, t)
+		return
+	}
+
+	index, ok := t.files[filePath]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	s.serveFile(w, r, t, index, filePath)
+}
+
+func (s *Server) serveFile(w http.ResponseWriter, r *http.Request, t *torrent, index int, filePath string) {
+	reader, err := t.t.OpenFile(index)
+	if err != nil {
+		log.Printf("Failed to open %s of %s: %v", filePath, t.InfoHash, err)
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	defer reader.Close()
+
+	// the content type is set from the extension, otherwise ServeContent would wait for
+	// the first piece to sniff it
+	contentType := mime.TypeByExtension(path.Ext(filePath))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", contentType)
+
+	// the reader blocks until the request goes away, closing it unblocks the read
+	go func() {
+		<-r.Context().Done()
+		reader.Close()
+	}()
+
+	http.ServeContent(w, r, path.Base(filePath), s.started, reader)
+}
+
+var indexTemplate = template.Must(template.New("index").Parse(`<!DOCTYPE html>
+<html><head><title>Torrents</title></head><body>
+<h1>Torrents</h1>
+<ul>
+{{range .}}<li><a href="/{{.InfoHash}}/">{{.Name}}</a> {{.InfoHash}}</li>
+{{end}}</ul>
+</body></html>
+`))
+
+var torrentTemplate = template.Must(template.New("torrent").Parse(`<!DOCTYPE html>
+<html><head><title>{{.Name}}</title></head><body>
+<h1>{{.Name}}</h1>
+<p><a href="/">All torrents</a></p>
+<ul>
+{{range .Files}}<li><a href="{{.Href}}">{{.Path}}</a> ({{.Length}} bytes)</li>
+{{end}}</ul>
+<h2>Peers</h2>
+<ul>
+{{range .Peers}}<li>{{.Addr}} {{.Client}} (from {{.Source}})</li>
+{{end}}</ul>
+</body></html>
+`))
+
+func (s *Server) serveIndex(w http.ResponseWriter) {
+	s.mu.Lock()
+	torrents := make([]*torrent, 0, len(s.torrents))
+	for _, t := range s.torrents {
+		torrents = append(torrents, t)
+	}
+	s.mu.Unlock()
+
+	sort.Slice(torrents, func(i, j int) bool { return torrents[i].Name < torrents[j].Name })
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := indexTemplate.Execute(w, torrents); err != nil {
+		log.Printf("Failed to render torrent list: %v", err)
+	}
+}
+
+func (s *Server) serveTorrent(w http.ResponseWriter, t *torrent) {
+	files := t.t.Files()
+	listing := struct {
+		Name  string
+		Files []listedFile
+		Peers []client.Peer
+	}{Name: t.Name, Peers: t.t.Peers()}
+
+	for filePath, index := range t.files {
+		segments := strings.Split(filePath, "/")
+		for i, segment := range segments {
+			segments[i] = url.PathEscape(segment)
+		}
+		listing.Files = append(listing.Files, listedFile{
+			Path:   filePath,
+			Href:   strings.Join(segments, "/"),
+			Length: files[index].Length,
+		})
+	}
+	sort.Slice(listing.Files, func(i, j int) bool { return listing.Files[i].Path < listing.Files[j].Path })
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := torrentTemplate.Execute(w, listing); err != nil {
+		log.Printf("Failed to render file list: %v", err)
+	}
+}
@@ -0,0 +1,337 @@
+package lsd
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Local Service Discovery (BEP 14) finds peers on the local network by multicasting
+// HTTP-like announces to a well known group:
+//
+//	BT-SEARCH * HTTP/1.1\r\n
+//	Host: 239.192.152.143:6771\r\n
+//	Port: <port we accept connections on>\r\n
+//	Infohash: <40 hex characters>\r\n
+//	cookie: <random value, used to ignore our own announces>\r\n
+//	\r\n
+//	\r\n
+//
+// The Infohash header may be repeated to announce several torrents at once. A peer is
+// reachable at the source address of the packet and the port of the Port header
+const (
+	DefaultAnnounceInterval = 5 * time.Minute
+	// announces for a single torrent are not sent more than once a minute
+	minAnnounceInterval = time.Minute
+	// announces have to fit in a single packet that is not fragmented
+	maxPacketSize = 1400
+)
+
+var (
+	IPv4Group = netip.MustParseAddrPort("239.192.152.143:6771")
+	IPv6Group = netip.MustParseAddrPort("[ff15::efc0:988f]:6771")
+)
+
+var ErrClosed = errors.New("local service discovery closed")
+
+type Config struct {
+	// Port is the port we accept peer connections on
+	Port uint16
+	// Interface is the network interface the multicast groups are joined on, the system
+	// picks one when it is nil
+	Interface *net.Interface
+	// AnnounceInterval is how often every torrent is announced
+	AnnounceInterval time.Duration
+}
+
+func DefaultConfig() Config {
+	return Config{
+		Port:             6881,
+		AnnounceInterval: DefaultAnnounceInterval,
+	}
+}
+
+// group is one multicast group we announce to and listen on. Announces are sent from
+// their own socket because the listening one does not loop multicast back to the host,
+// which would hide clients running on the same machine from each other
+type group struct {
+	addr   netip.AddrPort
+	listen *net.UDPConn
+	send   *net.UDPConn
+}
+
+type torrent struct {
+	onPeer       func(netip.AddrPort)
+	lastAnnounce time.Time
+}
+
+// Service announces the torrents added to it on the local network and reports the peers
+// other clients announce for them
+type Service struct {
+	config Config
+	cookie string
+	groups []*group
+
+	mu       sync.Mutex
+	torrents map[[20]byte]*torrent
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// NewService joins the IPv4 and IPv6 groups, it only fails if neither of them could be
+// joined
+func NewService(config Config) (*Service, error) {
+	if config.AnnounceInterval == 0 {
+		config.AnnounceInterval = DefaultConfig().AnnounceInterval
+	}
+
+	cookie := make([]byte, 8)
+	if _, err := rand.Read(cookie); err != nil {
+		return nil, err
+	}
+
+	s := &Service{
+		config:   config,
+		cookie:   hex.EncodeToString(cookie),
+		torrents: make(map[[20]byte]*torrent),
+		closed:   make(chan struct{}),
+	}
+
+	var errs []error
+	for _, addr := range []netip.AddrPort{IPv4Group, IPv6Group} {
+		g, err := joinGroup(addr, config.Interface)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		s.groups = append(s.groups, g)
+	}
+	if len(s.groups) == 0 {
+		return nil, fmt.Errorf("failed to join multicast groups: %w", errors.Join(errs...))
+	}
+	for _, err := range errs {
+		log.Printf("Local service discovery: %v", err)
+	}
+
+	for _, g := range s.groups {
+		go s.readLoop(g)
+	}
+	go s.announceLoop()
+
+	return s, nil
+}
+
+func joinGroup(addr netip.AddrPort, ifi *net.Interface) (*group, error) {
+	network := "udp4"
+	if addr.Addr().Is6() {
+		network = "udp6"
+	}
+
+	listen, err := net.ListenMulticastUDP(network, ifi, net.UDPAddrFromAddrPort(addr))
+	if err != nil {
+		return nil, fmt.Errorf("failed to join %s: %w", addr, err)
+	}
+
+	send, err := net.ListenUDP(network, nil)
+	if err != nil {
+		listen.Close()
+		return nil, fmt.Errorf("failed to open socket for %s: %w", addr, err)
+	}
+
+	return &group{addr: addr, listen: listen, send: send}, nil
+}
+
+// Add starts announcing a torrent, onPeer is called for every peer found for it
+func (s *Service) Add(infoHash [20]byte, onPeer func(netip.AddrPort)) {
+	s.mu.Lock()
+	s.torrents[infoHash] = &torrent{onPeer: onPeer}
+	s.mu.Unlock()
+
+	s.Announce(infoHash)
+}
+
+// Remove stops announcing a torrent and reporting its peers
+func (s *Service) Remove(infoHash [20]byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.torrents, infoHash)
+}
+
+// Announce announces a torrent right away, unless it was announced less than a minute ago
+func (s *Service) Announce(infoHash [20]byte) {
+	s.mu.Lock()
+	t, ok := s.torrents[infoHash]
+	if !ok || time.Since(t.lastAnnounce) < minAnnounceInterval {
+		s.mu.Unlock()
+		return
+	}
+	t.lastAnnounce = time.Now()
+	s.mu.Unlock()
+
+	s.send([][20]byte{infoHash})
+}
+
+func (s *Service) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.closed)
+		for _, g := range s.groups {
+			g.listen.Close()
+			g.send.Close()
+		}
+	})
+	return nil
+}
+
+func (s *Service) announceLoop() {
+	ticker := time.NewTicker(s.config.AnnounceInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.closed:
+			return
+		case <-ticker.C:
+		}
+
+		now := time.Now()
+		var infoHashes [][20]byte
+		s.mu.Lock()
+		for infoHash, t := range s.torrents {
+			if now.Sub(t.lastAnnounce) >= minAnnounceInterval {
+				t.lastAnnounce = now
+				infoHashes = append(infoHashes, infoHash)
+			}
+		}
+		s.mu.Unlock()
+
+		if len(infoHashes) > 0 {
+			s.send(infoHashes)
+		}
+	}
+}
+
+// send announces the info hashes to every group, splitting them over as many packets as
+// needed
+func (s *Service) send(infoHashes [][20]byte) {
+	for _, g := range s.groups {
+		for _, packet := range buildAnnounces(g.addr, s.config.Port, s.cookie, infoHashes) {
+			if _, err := g.send.WriteToUDPAddrPort(packet, g.addr); err != nil {
+				log.Printf("Failed to send local service discovery announce to %s: %v", g.addr, err)
+				break
+			}
+		}
+	}
+}
+
+func buildAnnounces(groupAddr netip.AddrPort, port uint16, cookie string, infoHashes [][20]byte) [][]byte {
+	header := fmt.Sprintf("BT-SEARCH * HTTP/1.1\r\nHost: %s\r\nPort: %d\r\n", groupAddr, port)
+	trailer := fmt.Sprintf("cookie: %s\r\n\r\n\r\n", cookie)
+
+	var packets [][]byte
+	var packet []byte
+	for _, infoHash := range infoHashes {
+		line := "Infohash: " + hex.EncodeToString(infoHash[:]) + "\r\n"
+		if packet != nil && len(packet)+len(line)+len(trailer) > maxPacketSize {
+			packets = append(packets, append(packet, trailer...))
+			packet = nil
+		}
+		if packet == nil {
+			packet = []byte(header)
+		}
+		packet = append(packet, line...)
+	}
+	if packet != nil {
+		packets = append(packets, append(packet, trailer...))
+	}
+
+	return packets
+}
+
+func (s *Service) readLoop(g *group) {
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, from, err := g.listen.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			select {
+			case <-s.closed:
+				return
+			default:
+			}
+			log.Printf("Failed to read local service discovery announce: %v", err)
+			continue
+		}
+
+		announce, err := parseAnnounce(buf[:n])
+		if err != nil || announce.cookie == s.cookie {
+			continue
+		}
+
+		addr := netip.AddrPortFrom(from.Addr().Unmap(), announce.port)
+		for _, infoHash := range announce.infoHashes {
+			s.mu.Lock()
+			t, ok := s.torrents[infoHash]
+			s.mu.Unlock()
+			if ok {
+				t.onPeer(addr)
+			}
+		}
+	}
+}
+
+type announce struct {
+	port       uint16
+	infoHashes [][20]byte
+	cookie     string
+}
+
+func parseAnnounce(packet []byte) (*announce, error) {
+	lines := strings.Split(strings.ReplaceAll(string(packet), "\r\n", "\n"), "\n")
+	if len(lines) == 0 || !strings.HasPrefix(lines[0], "BT-SEARCH * HTTP/") {
+		return nil, fmt.Errorf("not a BT-SEARCH announce")
+	}
+
+	a := &announce{}
+	for _, line := range lines[1:] {
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		value = strings.TrimSpace(value)
+
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "port":
+			port, err := strconv.ParseUint(value, 10, 16)
+			if err != nil || port == 0 {
+				return nil, fmt.Errorf("invalid port %q", value)
+			}
+			a.port = uint16(port)
+		case "infohash":
+			var infoHash [20]byte
+			if len(value) != 40 {
+				continue
+			}
+			if _, err := hex.Decode(infoHash[:], []byte(value)); err != nil {
+				continue
+			}
+			a.infoHashes = append(a.infoHashes, infoHash)
+		case "cookie":
+			a.cookie = value
+		}
+	}
+
+	if a.port == 0 {
+		return nil, fmt.Errorf("announce without port")
+	}
+
+	return a, nil
+}
@@ -0,0 +1,147 @@
+package lsd
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func newTestService(t *testing.T, port uint16) *Service {
+	t.Helper()
+
+	s, err := NewService(Config{Port: port})
+	if err != nil {
+		t.Skipf("multicast is not available: %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+// peerChannel returns an onPeer callback reporting on a channel
+func peerChannel() (chan netip.AddrPort, func(netip.AddrPort)) {
+	peers := make(chan netip.AddrPort, 16)
+	return peers, func(addr netip.AddrPort) {
+		select {
+		case peers <- addr:
+		default:
+		}
+	}
+}
+
+func waitPeer(t *testing.T, peers chan netip.AddrPort, port uint16) {
+	t.Helper()
+
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case addr := <-peers:
+			if addr.Port() == port {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("no announce with port %d was received", port)
+		}
+	}
+}
+
+// resetAnnounce lets a torrent be announced again right away
+func resetAnnounce(s *Service, infoHash [20]byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.torrents[infoHash].lastAnnounce = time.Time{}
+}
+
+func TestServicesFindEachOther(t *testing.T) {
+	infoHash := [20]byte{0xde, 0xad, 0xbe, 0xef}
+	a := newTestService(t, 10001)
+	b := newTestService(t, 10002)
+
+	aPeers, aOnPeer := peerChannel()
+	bPeers, bOnPeer := peerChannel()
+
+	// a announces before b knows the torrent, b's announce reaches a
+	a.Add(infoHash, aOnPeer)
+	b.Add(infoHash, bOnPeer)
+	waitPeer(t, aPeers, 10002)
+
+	resetAnnounce(a, infoHash)
+	a.Announce(infoHash)
+	waitPeer(t, bPeers, 10001)
+
+	// a never reports itself from its own announces
+	for len(aPeers) > 0 {
+		if addr := <-aPeers; addr.Port() == 10001 {
+			t.Errorf("a reported its own announce from %v", addr)
+		}
+	}
+}
+
+func TestServiceIgnoresOtherTorrents(t *testing.T) {
+	a := newTestService(t, 10003)
+	b := newTestService(t, 10004)
+
+	aPeers, aOnPeer := peerChannel()
+	_, bOnPeer := peerChannel()
+	a.Add([20]byte{1}, aOnPeer)
+	b.Add([20]byte{2}, bOnPeer)
+
+	select {
+	case addr := <-aPeers:
+		t.Errorf("got peer %v for a torrent b does not have", addr)
+	case <-time.After(500 * time.Millisecond):
+	}
+}
+
+func TestServiceRemove(t *testing.T) {
+	infoHash := [20]byte{3}
+	a := newTestService(t, 10005)
+	b := newTestService(t, 10006)
+
+	aPeers, aOnPeer := peerChannel()
+	_, bOnPeer := peerChannel()
+	a.Add(infoHash, aOnPeer)
+	a.Remove(infoHash)
+	b.Add(infoHash, bOnPeer)
+
+	select {
+	case addr := <-aPeers:
+		t.Errorf("got peer %v for a removed torrent", addr)
+	case <-time.After(500 * time.Millisecond):
+	}
+}
+
+func TestBuildAnnouncesSplitsPackets(t *testing.T) {
+	infoHashes := make([][20]byte, 100)
+	for i := range infoHashes {
+		infoHashes[i][0] = byte(i)
+	}
+
+	packets := buildAnnounces(IPv4Group, 6881, "cookie", infoHashes)
+	if len(packets) < 2 {
+		t.Fatalf("got %d packets, want the info hashes split", len(packets))
+	}
+
+	var parsed [][20]byte
+	for _, packet := range packets {
+		if len(packet) > maxPacketSize {
+			t.Errorf("packet of %d bytes is over the limit", len(packet))
+		}
+		a, err := parseAnnounce(packet)
+		if err != nil {
+			t.Fatalf("failed to parse announce: %v", err)
+		}
+		if a.port != 6881 || a.cookie != "cookie" {
+			t.Errorf("got port %d and cookie %q", a.port, a.cookie)
+		}
+		parsed = append(parsed, a.infoHashes...)
+	}
+
+	if len(parsed) != len(infoHashes) {
+		t.Fatalf("got %d info hashes back, want %d", len(parsed), len(infoHashes))
+	}
+	for i := range parsed {
+		if parsed[i] != infoHashes[i] {
+			t.Errorf("info hash %d is %x, want %x", i, parsed[i], infoHashes[i])
+		}
+	}
+}
@@ -1,5 +1,97 @@
 package magnetlink
 
-func Parse(magnetLink string) string {
-	return ""
+import (
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/netip"
+	"net/url"
+	"strings"
+)
+
+var ErrNotMagnet = errors.New("not a magnet link")
+
+// Magnet links allows users to download files from peers without needing a torrent file.
+// Unlike .torrent files, magnet links dont contain information like file length, piece
+// length and piece hashes, they only include the bare minimum neccesary to discover
+// peers (BEP 9). Clients request the rest of the information from peers using the
+// metadata exchange protocol. Query params in a magnet link:
+//
+//	xt: urn:btih: followed by the 40 char hex-encoded, or 32 char base32, info hash
+//	dn: name of the file to be downloaded
+//	tr: tracker URL, may be repeated
+//	x.pe: address of a peer, may be repeated
+type Link struct {
+	InfoHash [20]byte
+	Name     string
+	Trackers []string
+	Peers    []netip.AddrPort
+}
+
+func Parse(magnetLink string) (*Link, error) {
+	u, err := url.Parse(magnetLink)
+	if err != nil {
+		return nil, fmt.Errorf("invalid magnet link: %w", err)
+	}
+	if u.Scheme != "magnet" {
+		return nil, ErrNotMagnet
+	}
+
+	query := u.Query()
+	link := &Link{
+		Name:     query.Get("dn"),
+		Trackers: query["tr"],
+	}
+
+	found := false
+	for _, xt := range query["xt"] {
+		encoded, ok := strings.CutPrefix(xt, "urn:btih:")
+		if !ok {
+			continue
+		}
+		infoHash, err := decodeInfoHash(encoded)
+		if err != nil {
+			return nil, err
+		}
+		link.InfoHash = infoHash
+		found = true
+		break
+	}
+	if !found {
+		return nil, fmt.Errorf("magnet link has no urn:btih info hash")
+	}
+
+	for _, pe := range query["x.pe"] {
+		addr, err := netip.ParseAddrPort(pe)
+		if err != nil {
+			// peers may be given by host name, which we can not dial without resolving
+			continue
+		}
+		link.Peers = append(link.Peers, addr)
+	}
+
+	return link, nil
+}
+
+// decodeInfoHash accepts the hex encoding of the info hash as well as the older base32 one
+func decodeInfoHash(encoded string) ([20]byte, error) {
+	var infoHash [20]byte
+
+	var decoded []byte
+	var err error
+	switch len(encoded) {
+	case 40:
+		decoded, err = hex.DecodeString(encoded)
+	case 32:
+		decoded, err = base32.StdEncoding.DecodeString(strings.ToUpper(encoded))
+	default:
+		return infoHash, fmt.Errorf("invalid info hash length %d", len(encoded))
+	}
+	if err != nil {
+		return infoHash, fmt.Errorf("invalid info hash: %w", err)
+	}
+
+	copy(infoHash[:], decoded)
+	return infoHash, nil
 }
@@ -0,0 +1,125 @@
+package merkle
+
+import (
+	"crypto/sha256"
+	"math/bits"
+)
+
+// BitTorrent v2 (BEP 52) hashes every file on its own with a binary SHA-256 merkle tree.
+// The leaves are the hashes of the 16 KiB blocks of the file, the last block may be
+// shorter. The leaf layer is padded with zero hashes to a power of two and every node is
+// the hash of its two children concatenated. The root of the tree is the "pieces root"
+// of the file, and the layer whose nodes each cover one piece is the "piece layer"
+const BlockSize = 16 * 1024
+
+const HashSize = sha256.Size
+
+type Hash = [HashSize]byte
+
+// HashBlocks returns the leaf hashes of data
+func HashBlocks(data []byte) []Hash {
+	leaves := make([]Hash, 0, (len(data)+BlockSize-1)/BlockSize)
+	for begin := 0; begin < len(data); begin += BlockSize {
+		leaves = append(leaves, sha256.Sum256(data[begin:min(begin+BlockSize, len(data))]))
+	}
+	return leaves
+}
+
+// ZeroHash returns the root of a subtree of 2^height zero leaves, it pads layers above the
+// leaves
+func ZeroHash(height int) Hash {
+	var h Hash
+	for i := 0; i < height; i++ {
+		h = hashPair(h, h)
+	}
+	return h
+}
+
+// Root returns the root of the tree whose bottom layer is hashes, padded to width nodes
+// with pad. Width must be a power of two no smaller than the number of hashes
+func Root(hashes []Hash, width int, pad Hash) Hash {
+	layer := make([]Hash, width)
+	copy(layer, hashes)
+	for i := len(hashes); i < width; i++ {
+		layer[i] = pad
+	}
+
+	for len(layer) > 1 {
+		layer = parent(layer)
+	}
+
+	return layer[0]
+}
+
+// PieceHash returns the root of the subtree covering the data of a piece, whose leaf
+// layer is padded to leaves blocks
+func PieceHash(data []byte, leaves int) Hash {
+	return Root(HashBlocks(data), leaves, Hash{})
+}
+
+// LeafCount returns the width of the leaf layer of a file of the given length
+func LeafCount(length int) int {
+	return NextPowerOfTwo((length + BlockSize - 1) / BlockSize)
+}
+
+// NextPowerOfTwo returns the smallest power of two no smaller than n, and 1 for n <= 1
+func NextPowerOfTwo(n int) int {
+	if n <= 1 {
+		return 1
+	}
+	return 1 << bits.Len(uint(n-1))
+}
+
+// Log2 returns the base two logarithm of a power of two
+func Log2(n int) int {
+	return bits.TrailingZeros(uint(n))
+}
+
+// Proof returns the hashes of layer from index to index+length followed by the uncle
+// hashes proving them, starting with the sibling of the subtree they form and going up at
+// most proofLayers layers, the root excluded. The layer is padded with pad to a power of
+// two. Length must be a power of two and index a multiple of it, ok is false otherwise
+func Proof(layer []Hash, pad Hash, index, length, proofLayers int) ([]Hash, bool) {
+	width := NextPowerOfTwo(len(layer))
+	if length <= 0 || length&(length-1) != 0 || index < 0 || index%length != 0 || index+length > width {
+		return nil, false
+	}
+
+	nodes := make([]Hash, width)
+	copy(nodes, layer)
+	for i := len(layer); i < width; i++ {
+		nodes[i] = pad
+	}
+
+	hashes := make([]Hash, 0, length+proofLayers)
+	hashes = append(hashes, nodes[index:index+length]...)
+
+	// climb to the layer where the requested hashes are a single node
+	for n := length; n > 1; n /= 2 {
+		nodes = parent(nodes)
+		index /= 2
+	}
+
+	for i := 0; i < proofLayers && len(nodes) > 1; i++ {
+		hashes = append(hashes, nodes[index^1])
+		nodes = parent(nodes)
+		index /= 2
+	}
+
+	return hashes, true
+}
+
+func parent(layer []Hash) []Hash {
+	next := make([]Hash, len(layer)/2)
+	for i := range next {
+		next[i] = hashPair(layer[2*i], layer[2*i+1])
+	}
+	return next
+}
+
+func hashPair(left, right Hash) Hash {
+	var buf [2 * HashSize]byte
+	copy(buf[:HashSize], left[:])
+	copy(buf[HashSize:], right[:])
+	return sha256.Sum256(buf[:])
+}
@@ -0,0 +1,345 @@
+package mse
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rc4"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	mathrand "math/rand"
+	"net"
+)
+
+// Message stream encryption (MSE, also called protocol encryption or PE) hides the
+// BitTorrent handshake and the messages that follow from traffic shaping. Both sides
+// agree on a secret S with a Diffie-Hellman exchange, the info hash of the torrent
+// (SKEY) is used as a pre-shared key, and the stream is encrypted with RC4:
+//
+//  1. A->B: Ya, PadA
+//  2. B->A: Yb, PadB
+//  3. A->B: HASH('req1', S), HASH('req2', SKEY) xor HASH('req3', S),
+//     ENCRYPT(VC, crypto_provide, len(PadC), PadC, len(IA)), ENCRYPT(IA)
+//  4. B->A: ENCRYPT(VC, crypto_select, len(PadD), PadD), ENCRYPT2(payload stream)
+//  5. A->B: ENCRYPT2(payload stream)
+//
+// Pads are 0 to 512 random bytes, so the receiver of each step scans for something it
+// can compute itself to find where the pad ends: HASH('req1', S) for B and the encrypted
+// verification constant VC (8 zero bytes) for A. IA is the initial payload of A, usually
+// its BitTorrent handshake. ENCRYPT2 is RC4 if it was selected, plaintext otherwise
+type CryptoMethod uint32
+
+const (
+	CryptoPlaintext CryptoMethod = 0x01
+	CryptoRC4       CryptoMethod = 0x02
+)
+
+func (m CryptoMethod) String() string {
+	switch m {
+	case CryptoPlaintext:
+		return "plaintext"
+	case CryptoRC4:
+		return "rc4"
+	default:
+		return fmt.Sprintf("crypto(%#x)", uint32(m))
+	}
+}
+
+const (
+	keySize      = 96
+	maxPadLength = 512
+	// the first 1024 bytes of the RC4 keystream are discarded
+	rc4Discard = 1024
+)
+
+var (
+	// 768 bit safe prime, the generator is 2
+	prime     = mustParsePrime("FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD129024E088A67CC74020BBEA63B139B22514A08798E3404DDEF9519B3CD3A431B302B0A6DF25F14374FE1356D6D51C245E485B576625E7EC6F44C42E9A63A36210000000000090563")
+	generator = big.NewInt(2)
+
+	verificationConstant = make([]byte, 8)
+)
+
+var (
+	ErrNoCommonMethod = errors.New("no common crypto method")
+	ErrUnknownTorrent = errors.New("encrypted handshake for an unknown torrent")
+	ErrSyncFailed     = errors.New("failed to synchronize encrypted handshake")
+)
+
+func mustParsePrime(s string) *big.Int {
+	p, ok := new(big.Int).SetString(s, 16)
+	if !ok {
+		panic("invalid prime")
+	}
+	return p
+}
+
+// Conn is a connection that went through the encrypted handshake. Reads and writes are
+// transparently decrypted and encrypted when RC4 was selected
+type Conn struct {
+	net.Conn
+	Method CryptoMethod
+	r      io.Reader
+	w      io.Writer
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *Conn) Write(b []byte) (int, error) {
+	return c.w.Write(b)
+}
+
+type keyPair struct {
+	private *big.Int
+	public  []byte
+}
+
+func newKeyPair() (*keyPair, error) {
+	private := make([]byte, 20)
+	if _, err := rand.Read(private); err != nil {
+		return nil, err
+	}
+
+	x := new(big.Int).SetBytes(private)
+	y := new(big.Int).Exp(generator, x, prime)
+	return &keyPair{private: x, public: y.FillBytes(make([]byte, keySize))}, nil
+}
+
+// secret computes S from the public key of the other side
+func (k *keyPair) secret(public []byte) []byte {
+	y := new(big.Int).SetBytes(public)
+	return new(big.Int).Exp(y, k.private, prime).FillBytes(make([]byte, keySize))
+}
+
+func hash(parts ...[]byte) []byte {
+	h := sha1.New()
+	for _, part := range parts {
+		h.Write(part)
+	}
+	return h.Sum(nil)
+}
+
+func newCipher(key string, secret []byte, skey [20]byte) *rc4.Cipher {
+	c, _ := rc4.NewCipher(hash([]byte(key), secret, skey[:]))
+	discard := make([]byte, rc4Discard)
+	c.XORKeyStream(discard, discard)
+	return c
+}
+
+func randomPad() []byte {
+	pad := make([]byte, mathrand.Intn(maxPadLength+1))
+	rand.Read(pad)
+	return pad
+}
+
+// Initiate runs the encrypted handshake on an outgoing connection. provide are the crypto
+// methods we accept, the other side picks one of them. ia is sent encrypted along with
+// the handshake so it costs no extra round trip
+func Initiate(conn net.Conn, skey [20]byte, ia []byte, provide CryptoMethod) (*Conn, error) {
+	keys, err := newKeyPair()
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := conn.Write(append(keys.public, randomPad()...)); err != nil {
+		return nil, fmt.Errorf("failed to send public key: %w", err)
+	}
+
+	r := bufio.NewReader(conn)
+	remotePublic := make([]byte, keySize)
+	if _, err := io.ReadFull(r, remotePublic); err != nil {
+		return nil, fmt.Errorf("failed to read public key: %w", err)
+	}
+	secret := keys.secret(remotePublic)
+
+	encrypt := newCipher("keyA", secret, skey)
+	decrypt := newCipher("keyB", secret, skey)
+
+	var buf bytes.Buffer
+	buf.Write(hash([]byte("req1"), secret))
+	req2 := hash([]byte("req2"), skey[:])
+	req3 := hash([]byte("req3"), secret)
+	for i := range req2 {
+		buf.WriteByte(req2[i] ^ req3[i])
+	}
+
+	payload := make([]byte, 0, 16+len(ia))
+	payload = append(payload, verificationConstant...)
+	payload = binary.BigEndian.AppendUint32(payload, uint32(provide))
+	// no PadC, it is only there for future extensions
+	payload = binary.BigEndian.AppendUint16(payload, 0)
+	payload = binary.BigEndian.AppendUint16(payload, uint16(len(ia)))
+	payload = append(payload, ia...)
+	encrypt.XORKeyStream(payload, payload)
+	buf.Write(payload)
+
+	if _, err := conn.Write(buf.Bytes()); err != nil {
+		return nil, fmt.Errorf("failed to send crypto handshake: %w", err)
+	}
+
+	// the verification constant as B encrypts it marks the end of PadB
+	encryptedVC := make([]byte, len(verificationConstant))
+	decrypt.XORKeyStream(encryptedVC, verificationConstant)
+	if err := synchronize(r, encryptedVC, maxPadLength); err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, 6)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("failed to read crypto select: %w", err)
+	}
+	decrypt.XORKeyStream(header, header)
+
+	selected := CryptoMethod(binary.BigEndian.Uint32(header[0:4]))
+	if selected&provide == 0 || (selected != CryptoPlaintext && selected != CryptoRC4) {
+		return nil, fmt.Errorf("peer selected %v: %w", selected, ErrNoCommonMethod)
+	}
+
+	padLength := int(binary.BigEndian.Uint16(header[4:6]))
+	if padLength > maxPadLength {
+		return nil, fmt.Errorf("invalid pad length %d", padLength)
+	}
+	pad := make([]byte, padLength)
+	if _, err := io.ReadFull(r, pad); err != nil {
+		return nil, fmt.Errorf("failed to read pad: %w", err)
+	}
+	decrypt.XORKeyStream(pad, pad)
+
+	return newConn(conn, r, selected, encrypt, decrypt), nil
+}
+
+// Receive runs the encrypted handshake on an incoming connection whose first bytes were
+// not a plaintext BitTorrent handshake. infoHashes are the torrents we serve, the one the
+// peer asks for is returned along with the connection. allowed are the crypto methods we
+// accept, RC4 is picked when the peer provides it. The initial payload of the peer is
+// the first thing read from the returned connection
+func Receive(conn net.Conn, infoHashes [][20]byte, allowed CryptoMethod) (*Conn, [20]byte, error) {
+	var skey [20]byte
+
+	r := bufio.NewReader(conn)
+	remotePublic := make([]byte, keySize)
+	if _, err := io.ReadFull(r, remotePublic); err != nil {
+		return nil, skey, fmt.Errorf("failed to read public key: %w", err)
+	}
+
+	keys, err := newKeyPair()
+	if err != nil {
+		return nil, skey, err
+	}
+	if _, err := conn.Write(append(keys.public, randomPad()...)); err != nil {
+		return nil, skey, fmt.Errorf("failed to send public key: %w", err)
+	}
+	secret := keys.secret(remotePublic)
+
+	if err := synchronize(r, hash([]byte("req1"), secret), maxPadLength); err != nil {
+		return nil, skey, err
+	}
+
+	obfuscated := make([]byte, 20)
+	if _, err := io.ReadFull(r, obfuscated); err != nil {
+		return nil, skey, fmt.Errorf("failed to read torrent hash: %w", err)
+	}
+	req3 := hash([]byte("req3"), secret)
+	for i := range obfuscated {
+		obfuscated[i] ^= req3[i]
+	}
+
+	found := false
+	for _, infoHash := range infoHashes {
+		if bytes.Equal(hash([]byte("req2"), infoHash[:]), obfuscated) {
+			skey = infoHash
+			found = true
+			break
+		}
+	}
+	if !found {
+		return nil, skey, ErrUnknownTorrent
+	}
+
+	encrypt := newCipher("keyB", secret, skey)
+	decrypt := newCipher("keyA", secret, skey)
+
+	header := make([]byte, 14)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, skey, fmt.Errorf("failed to read crypto provide: %w", err)
+	}
+	decrypt.XORKeyStream(header, header)
+	if !bytes.Equal(header[0:8], verificationConstant) {
+		return nil, skey, ErrSyncFailed
+	}
+
+	provide := CryptoMethod(binary.BigEndian.Uint32(header[8:12]))
+	padLength := int(binary.BigEndian.Uint16(header[12:14]))
+	if padLength > maxPadLength {
+		return nil, skey, fmt.Errorf("invalid pad length %d", padLength)
+	}
+
+	rest := make([]byte, padLength+2)
+	if _, err := io.ReadFull(r, rest); err != nil {
+		return nil, skey, fmt.Errorf("failed to read pad: %w", err)
+	}
+	decrypt.XORKeyStream(rest, rest)
+
+	ia := make([]byte, binary.BigEndian.Uint16(rest[padLength:]))
+	if _, err := io.ReadFull(r, ia); err != nil {
+		return nil, skey, fmt.Errorf("failed to read initial payload: %w", err)
+	}
+	decrypt.XORKeyStream(ia, ia)
+
+	var selected CryptoMethod
+	switch {
+	case provide&allowed&CryptoRC4 != 0:
+		selected = CryptoRC4
+	case provide&allowed&CryptoPlaintext != 0:
+		selected = CryptoPlaintext
+	default:
+		return nil, skey, fmt.Errorf("peer provided %v: %w", provide, ErrNoCommonMethod)
+	}
+
+	response := make([]byte, 0, 14)
+	response = append(response, verificationConstant...)
+	response = binary.BigEndian.AppendUint32(response, uint32(selected))
+	response = binary.BigEndian.AppendUint16(response, 0)
+	encrypt.XORKeyStream(response, response)
+	if _, err := conn.Write(response); err != nil {
+		return nil, skey, fmt.Errorf("failed to send crypto select: %w", err)
+	}
+
+	c := newConn(conn, r, selected, encrypt, decrypt)
+	// IA was always encrypted, no matter the method selected for the rest of the stream
+	c.r = io.MultiReader(bytes.NewReader(ia), c.r)
+	return c, skey, nil
+}
+
+func newConn(conn net.Conn, r io.Reader, method CryptoMethod, encrypt, decrypt cipher.Stream) *Conn {
+	c := &Conn{Conn: conn, Method: method, r: r, w: conn}
+	if method == CryptoRC4 {
+		c.r = cipher.StreamReader{S: decrypt, R: r}
+		c.w = cipher.StreamWriter{S: encrypt, W: conn}
+	}
+	return c
+}
+
+// synchronize consumes the stream up to and including marker, which must appear within
+// the next maxSkip+len(marker) bytes
+func synchronize(r *bufio.Reader, marker []byte, maxSkip int) error {
+	window := make([]byte, 0, maxSkip+len(marker))
+	for len(window) < cap(window) {
+		b, err := r.ReadByte()
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrSyncFailed, err)
+		}
+		window = append(window, b)
+		if bytes.HasSuffix(window, marker) {
+			return nil
+		}
+	}
+	return ErrSyncFailed
+}
@@ -0,0 +1,54 @@
+package mse
+
+import "fmt"
+
+// Policy decides whether connections are encrypted
+type Policy int
+
+const (
+	// PolicyPrefer encrypts outgoing connections and falls back to plaintext when the
+	// peer does not support encryption, both kinds of incoming connections are accepted
+	PolicyPrefer Policy = iota
+	// PolicyRequire only allows RC4 encrypted connections
+	PolicyRequire
+	// PolicyDisable only allows plaintext connections
+	PolicyDisable
+)
+
+func (p Policy) String() string {
+	switch p {
+	case PolicyPrefer:
+		return "prefer"
+	case PolicyRequire:
+		return "require"
+	case PolicyDisable:
+		return "disable"
+	default:
+		return fmt.Sprintf("policy(%d)", int(p))
+	}
+}
+
+func ParsePolicy(s string) (Policy, error) {
+	switch s {
+	case "prefer":
+		return PolicyPrefer, nil
+	case "require":
+		return PolicyRequire, nil
+	case "disable":
+		return PolicyDisable, nil
+	default:
+		return 0, fmt.Errorf("unknown encryption policy %q, expected prefer, require or disable", s)
+	}
+}
+
+// Methods returns the crypto methods the policy accepts in an encrypted handshake
+func (p Policy) Methods() CryptoMethod {
+	switch p {
+	case PolicyRequire:
+		return CryptoRC4
+	case PolicyDisable:
+		return 0
+	default:
+		return CryptoRC4 | CryptoPlaintext
+	}
+}
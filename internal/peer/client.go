@@ -0,0 +1,184 @@
+package peer
+
+import (
+	"strconv"
+	"strings"
+)
+
+// ClientInfo is the software a peer runs, as far as its peer id or extended handshake
+// tell
+type ClientInfo struct {
+	Name    string
+	Version string
+}
+
+func (c ClientInfo) String() string {
+	switch {
+	case c.Name == "":
+		return "unknown"
+	case c.Version == "":
+		return c.Name
+	default:
+		return c.Name + " " + c.Version
+	}
+}
+
+// clients using Azureus style peer ids, "-" followed by two letters, four version
+// characters and "-"
+var azureusClients = map[string]string{
+	"AG": "Ares",
+	"AZ": "Vuze",
+	"BC": "BitComet",
+	"BI": "BiglyBT",
+	"BT": "BitTorrent",
+	"DE": "Deluge",
+	"FD": "Free Download Manager",
+	"FW": "FrostWire",
+	"KT": "KTorrent",
+	"LT": "libtorrent",
+	"lt": "rTorrent",
+	"NX": clientName,
+	"qB": "qBittorrent",
+	"SD": "Thunder",
+	"TL": "Tribler",
+	"TR": "Transmission",
+	"UM": "µTorrent Mac",
+	"UT": "µTorrent",
+	"UW": "µTorrent Web",
+	"WW": "WebTorrent",
+	"XL": "Xunlei",
+}
+
+// clients using Shadow style peer ids, a letter followed by up to five version
+// characters and dashes
+var shadowClients = map[byte]string{
+	'A': "ABC",
+	'O': "Osprey Permaseed",
+	'Q': "BTQueue",
+	'R': "Tribler",
+	'S': "Shadow's client",
+	'T': "BitTornado",
+	'U': "UPnP NAT BitTorrent",
+}
+
+// clientName is how we call ourselves in ClientInfo
+const clientName = "bittorrent"
+
+// IdentifyClient tells the client of a peer from its peer id, the zero ClientInfo is
+// returned for peer ids that follow no known convention
+func IdentifyClient(peerID [20]byte) ClientInfo {
+	if info, ok := identifyAzureus(peerID); ok {
+		return info
+	}
+	if info, ok := identifyMainline(peerID); ok {
+		return info
+	}
+	if info, ok := identifyShadow(peerID); ok {
+		return info
+	}
+	return ClientInfo{}
+}
+
+// identifyAzureus decodes peer ids like "-qB4520-", whose version characters are digits
+// or letters read as they are
+func identifyAzureus(peerID [20]byte) (ClientInfo, bool) {
+	if peerID[0] != '-' || peerID[7] != '-' {
+		return ClientInfo{}, false
+	}
+	name, ok := azureusClients[string(peerID[1:3])]
+	if !ok {
+		return ClientInfo{}, false
+	}
+
+	version := peerID[3:7]
+	for _, c := range version {
+		if !isAlphanumeric(c) {
+			return ClientInfo{Name: name}, true
+		}
+	}
+
+	// Transmission has two digit minor versions, "2940" is 2.94
+	if name == "Transmission" {
+		return ClientInfo{Name: name, Version: string(version[0]) + "." + string(version[1:3])}, true
+	}
+
+	parts := []string{string(version[0]), string(version[1]), string(version[2])}
+	if version[3] != '0' {
+		parts = append(parts, string(version[3]))
+	}
+	return ClientInfo{Name: name, Version: strings.Join(parts, ".")}, true
+}
+
+// identifyMainline decodes the peer ids of the original client, like "M7-4-3--"
+func identifyMainline(peerID [20]byte) (ClientInfo, bool) {
+	if peerID[0] != 'M' {
+		return ClientInfo{}, false
+	}
+
+	end := strings.Index(string(peerID[1:]), "--")
+	if end < 0 {
+		return ClientInfo{}, false
+	}
+	parts := strings.Split(string(peerID[1:1+end]), "-")
+	for _, part := range parts {
+		if _, err := strconv.Atoi(part); err != nil {
+			return ClientInfo{}, false
+		}
+	}
+	return ClientInfo{Name: "BitTorrent", Version: strings.Join(parts, ".")}, true
+}
+
+// identifyShadow decodes peer ids like "S58B-----", every version character being a
+// number in base 64 so "B" is 11, and dashes padding the version
+func identifyShadow(peerID [20]byte) (ClientInfo, bool) {
+	name, ok := shadowClients[peerID[0]]
+	if !ok {
+		return ClientInfo{}, false
+	}
+
+	var parts []string
+	i := 1
+	for ; i < 6 && peerID[i] != '-'; i++ {
+		n, ok := shadowDigit(peerID[i])
+		if !ok {
+			return ClientInfo{}, false
+		}
+		parts = append(parts, strconv.Itoa(n))
+	}
+	// the version is followed by dashes, which also tells these ids from random ones
+	if len(parts) == 0 || string(peerID[i:i+2]) != "--" {
+		return ClientInfo{}, false
+	}
+	return ClientInfo{Name: name, Version: strings.Join(parts, ".")}, true
+}
+
+func shadowDigit(c byte) (int, bool) {
+	switch {
+	case c >= '0' && c <= '9':
+		return int(c - '0'), true
+	case c >= 'A' && c <= 'Z':
+		return int(c-'A') + 10, true
+	case c >= 'a' && c <= 'z':
+		return int(c-'a') + 36, true
+	case c == '.':
+		return 62, true
+	default:
+		return 0, false
+	}
+}
+
+func isAlphanumeric(c byte) bool {
+	return c >= '0' && c <= '9' || c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z'
+}
+
+// ParseClientVersion reads the "v" field of an extended handshake, a client name
+// usually followed by a version, as in "qBittorrent/4.5.2" or "µTorrent 3.5.5"
+func ParseClientVersion(v string) ClientInfo {
+	v = strings.TrimSpace(v)
+	for i := 1; i < len(v)-1; i++ {
+		if (v[i] == '/' || v[i] == ' ') && v[i+1] >= '0' && v[i+1] <= '9' {
+			return ClientInfo{Name: strings.TrimSpace(v[:i]), Version: v[i+1:]}
+		}
+	}
+	return ClientInfo{Name: v}
+}
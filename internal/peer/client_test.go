@@ -0,0 +1,78 @@
+package peer
+
+import "testing"
+
+// testPeerID pads the start of a peer id with random looking characters
+func testPeerID(start string) [20]byte {
+	var peerID [20]byte
+	n := copy(peerID[:], start)
+	copy(peerID[n:], "k3Jx9QmZ0pLw7RtYv2Hs")
+	return peerID
+}
+
+func TestIdentifyClient(t *testing.T) {
+	tests := []struct {
+		name   string
+		peerID [20]byte
+		want   ClientInfo
+	}{
+		{"azureus", testPeerID("-qB4500-"), ClientInfo{"qBittorrent", "4.5.0"}},
+		{"azureus four part version", testPeerID("-UT355W-"), ClientInfo{"µTorrent", "3.5.5.W"}},
+		{"azureus transmission", testPeerID("-TR2940-"), ClientInfo{"Transmission", "2.94"}},
+		{"azureus ourselves", testPeerID(ClientPrefix), ClientInfo{clientName, "0.0.0.1"}},
+		{"azureus binary version", testPeerID("-LT\x01\x02\x03\x04-"), ClientInfo{Name: "libtorrent"}},
+		{"azureus unknown client", testPeerID("-ZZ1234-"), ClientInfo{}},
+		{"mainline", testPeerID("M7-4-3--"), ClientInfo{"BitTorrent", "7.4.3"}},
+		{"mainline without end", testPeerID("M7-4-3x"), ClientInfo{}},
+		{"shadow", testPeerID("S58B-----"), ClientInfo{"Shadow's client", "5.8.11"}},
+		{"shadow short version", testPeerID("T03I--"), ClientInfo{"BitTornado", "0.3.18"}},
+		{"shadow letter without dashes", testPeerID("T03IXYZ"), ClientInfo{}},
+		{"shadow letter without version", testPeerID("A--"), ClientInfo{}},
+		{"zeros", [20]byte{}, ClientInfo{}},
+		{"binary", [20]byte{0xff, 0xfe, 0x00, 0x2d, 0x80}, ClientInfo{}},
+		{"random", testPeerID(""), ClientInfo{}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := IdentifyClient(test.peerID); got != test.want {
+				t.Errorf("IdentifyClient(%q) = %+v, want %+v", test.peerID[:], got, test.want)
+			}
+		})
+	}
+}
+
+func TestParseClientVersion(t *testing.T) {
+	tests := []struct {
+		v    string
+		want ClientInfo
+	}{
+		{"qBittorrent/4.5.2", ClientInfo{"qBittorrent", "4.5.2"}},
+		{"µTorrent 3.5.5", ClientInfo{"µTorrent", "3.5.5"}},
+		{" Transmission 4.0.5 ", ClientInfo{"Transmission", "4.0.5"}},
+		{"libtorrent", ClientInfo{Name: "libtorrent"}},
+		{"Client v2", ClientInfo{Name: "Client v2"}},
+		{"1.0", ClientInfo{Name: "1.0"}},
+		{"", ClientInfo{}},
+	}
+	for _, test := range tests {
+		if got := ParseClientVersion(test.v); got != test.want {
+			t.Errorf("ParseClientVersion(%q) = %+v, want %+v", test.v, got, test.want)
+		}
+	}
+}
+
+func TestClientInfoString(t *testing.T) {
+	tests := []struct {
+		info ClientInfo
+		want string
+	}{
+		{ClientInfo{"qBittorrent", "4.5.0"}, "qBittorrent 4.5.0"},
+		{ClientInfo{Name: "libtorrent"}, "libtorrent"},
+		{ClientInfo{}, "unknown"},
+	}
+	for _, test := range tests {
+		if got := test.info.String(); got != test.want {
+			t.Errorf("got %q, want %q", got, test.want)
+		}
+	}
+}
@@ -0,0 +1,249 @@
+package peer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/nullxDEADBEEF/bittorrent/internal/mse"
+	"github.com/nullxDEADBEEF/bittorrent/internal/utp"
+)
+
+// Transport decides how connections to peers are made
+type Transport int
+
+const (
+	TransportTCP Transport = iota
+	TransportUTP
+	// TransportRace dials uTP and TCP at once, with a head start for uTP, and keeps the
+	// connection that is established first. Peers that speak uTP end up on it, so our
+	// transfers yield to other traffic, while the others are still reached over TCP
+	TransportRace
+)
+
+// uTP gets this long to connect before TCP is tried as well in a race
+const utpHeadStart = 500 * time.Millisecond
+
+func (t Transport) String() string {
+	switch t {
+	case TransportTCP:
+		return "tcp"
+	case TransportUTP:
+		return "utp"
+	case TransportRace:
+		return "race"
+	default:
+		return fmt.Sprintf("transport(%d)", int(t))
+	}
+}
+
+func ParseTransport(s string) (Transport, error) {
+	switch s {
+	case "tcp":
+		return TransportTCP, nil
+	case "utp":
+		return TransportUTP, nil
+	case "race":
+		return TransportRace, nil
+	default:
+		return 0, fmt.Errorf("unknown transport %q, expected tcp, utp or race", s)
+	}
+}
+
+// Dialer opens connections to peers and exchanges handshakes over them
+type Dialer struct {
+	Encryption mse.Policy
+	Transport  Transport
+	// UTP is the socket uTP connections are made from, TCP is used when it is nil
+	UTP *utp.Socket
+	// Timeout bounds connecting to the peer
+	Timeout time.Duration
+	// HandshakeTimeout bounds the handshakes once connected, Timeout is used when it is zero
+	HandshakeTimeout time.Duration
+	// PlaintextFirst tries a plaintext handshake before the encrypted one with
+	// PolicyPrefer, and TCPOnly dials TCP right away instead of racing uTP. They are set
+	// for peers that peer exchange told do not prefer encryption or do not speak uTP
+	PlaintextFirst bool
+	TCPOnly        bool
+}
+
+// Dial connects to a peer over TCP and exchanges handshakes
+func Dial(addr string, local *Handshake, policy mse.Policy, timeout time.Duration) (*Conn, error) {
+	d := &Dialer{Encryption: policy, Timeout: timeout}
+	return d.Dial(addr, local)
+}
+
+// Dial connects to a peer and exchanges handshakes. With PolicyPrefer the connection is
+// first attempted encrypted and dialed again in plaintext if the peer does not speak
+// message stream encryption, or the other way around with PlaintextFirst
+func (d *Dialer) Dial(addr string, local *Handshake) (*Conn, error) {
+	return d.DialContext(context.Background(), addr, local)
+}
+
+// DialContext is Dial giving up as soon as ctx is cancelled, whether connecting or in the
+// middle of the handshakes
+func (d *Dialer) DialContext(ctx context.Context, addr string, local *Handshake) (*Conn, error) {
+	first, fallback := d.Encryption, mse.PolicyDisable
+	if d.Encryption == mse.PolicyPrefer && d.PlaintextFirst {
+		first, fallback = mse.PolicyDisable, mse.PolicyPrefer
+	}
+	c, err := d.dial(ctx, addr, local, first)
+
+	var encryptionErr *encryptionError
+	var plaintextErr *plaintextError
+	if err != nil && ctx.Err() == nil && d.Encryption == mse.PolicyPrefer && (errors.As(err, &encryptionErr) || errors.As(err, &plaintextErr)) {
+		return d.dial(ctx, addr, local, fallback)
+	}
+
+	return c, err
+}
+
+// encryptionError marks failures of the encrypted handshake, as opposed to failures to
+// reach the peer at all
+type encryptionError struct {
+	err error
+}
+
+func (e *encryptionError) Error() string {
+	return "encrypted handshake failed: " + e.err.Error()
+}
+
+func (e *encryptionError) Unwrap() error {
+	return e.err
+}
+
+// plaintextError marks failures to exchange plaintext handshakes, which is what peers
+// requiring encryption make of them
+type plaintextError struct {
+	err error
+}
+
+func (e *plaintextError) Error() string {
+	return e.err.Error()
+}
+
+func (e *plaintextError) Unwrap() error {
+	return e.err
+}
+
+func (d *Dialer) dial(ctx context.Context, addr string, local *Handshake, policy mse.Policy) (*Conn, error) {
+	conn, err := d.dialTransport(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	// the handshakes only watch their deadline, closing the connection unblocks them
+	stop := context.AfterFunc(ctx, func() {
+		conn.Close()
+	})
+	defer stop()
+
+	handshakeTimeout := d.HandshakeTimeout
+	if handshakeTimeout <= 0 {
+		handshakeTimeout = d.Timeout
+	}
+	c, err := NewConn(conn, local, policy, handshakeTimeout)
+	if ctx.Err() != nil {
+		conn.Close()
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return c, nil
+}
+
+func (d *Dialer) dialTransport(ctx context.Context, addr string) (net.Conn, error) {
+	if d.UTP == nil {
+		return d.dialTCP(ctx, addr)
+	}
+
+	switch d.Transport {
+	case TransportUTP:
+		return d.dialUTP(ctx, addr)
+	case TransportRace:
+		if d.TCPOnly {
+			return d.dialTCP(ctx, addr)
+		}
+		return d.race(ctx, addr)
+	default:
+		return d.dialTCP(ctx, addr)
+	}
+}
+
+func (d *Dialer) dialTCP(ctx context.Context, addr string) (net.Conn, error) {
+	dialer := net.Dialer{Timeout: d.Timeout}
+	return dialer.DialContext(ctx, "tcp", addr)
+}
+
+func (d *Dialer) dialUTP(ctx context.Context, addr string) (net.Conn, error) {
+	if d.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.Timeout)
+		defer cancel()
+	}
+	return d.UTP.DialContext(ctx, addr)
+}
+
+// race dials uTP right away and TCP after the uTP head start, or as soon as uTP failed,
+// and returns the first connection established
+func (d *Dialer) race(ctx context.Context, addr string) (net.Conn, error) {
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	results := make(chan result, 2)
+	utpFailed := make(chan struct{})
+	// closed once a connection won, so TCP is not dialed for nothing
+	won := make(chan struct{})
+
+	go func() {
+		conn, err := d.dialUTP(ctx, addr)
+		if err != nil {
+			close(utpFailed)
+		}
+		results <- result{conn, err}
+	}()
+	go func() {
+		timer := time.NewTimer(utpHeadStart)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-utpFailed:
+		case <-won:
+			results <- result{}
+			return
+		case <-ctx.Done():
+			results <- result{err: ctx.Err()}
+			return
+		}
+		conn, err := d.dialTCP(ctx, addr)
+		results <- result{conn, err}
+	}()
+
+	var errs []error
+	for i := 0; i < 2; i++ {
+		r := <-results
+		if r.err != nil {
+			errs = append(errs, r.err)
+			continue
+		}
+
+		close(won)
+		// the loser is closed whenever it connects
+		if i == 0 {
+			go func() {
+				if other := <-results; other.conn != nil {
+					other.conn.Close()
+				}
+			}()
+		}
+		return r.conn, nil
+	}
+
+	return nil, errors.Join(errs...)
+}
@@ -0,0 +1,77 @@
+package peer
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nullxDEADBEEF/bittorrent/internal/mse"
+)
+
+// acceptPeers answers every connection with the given encryption policy, it returns the
+// address to dial and the number of connections accepted
+func acceptPeers(t *testing.T, policy mse.Policy, infoHash [20]byte) (string, *atomic.Int32) {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	accepted := &atomic.Int32{}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			accepted.Add(1)
+			go func() {
+				defer conn.Close()
+				c, err := Accept(conn, policy, [][20]byte{infoHash}, func([20]byte) *Handshake {
+					return &Handshake{InfoHash: infoHash, PeerID: [20]byte{'r', 'e', 'm', 'o', 't', 'e'}}
+				}, time.Second)
+				if err == nil {
+					c.Read(make([]byte, 1))
+				}
+			}()
+		}
+	}()
+
+	return listener.Addr().String(), accepted
+}
+
+func TestDialPlaintextFirst(t *testing.T) {
+	tests := []struct {
+		name          string
+		policy        mse.Policy
+		wantEncrypted bool
+		wantAccepted  int32
+	}{
+		{"plaintext peer", mse.PolicyDisable, false, 1},
+		// a peer requiring encryption refuses the plaintext handshake
+		{"encrypted peer", mse.PolicyRequire, true, 2},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			infoHash := [20]byte{'i', 'n', 'f', 'o'}
+			addr, accepted := acceptPeers(t, test.policy, infoHash)
+
+			d := &Dialer{Encryption: mse.PolicyPrefer, Timeout: time.Second, PlaintextFirst: true}
+			conn, err := d.Dial(addr, &Handshake{InfoHash: infoHash, PeerID: [20]byte{'l', 'o', 'c', 'a', 'l'}})
+			if err != nil {
+				t.Fatalf("failed to dial: %v", err)
+			}
+			defer conn.Close()
+
+			if conn.Encrypted != test.wantEncrypted {
+				t.Errorf("encrypted: %v, want %v", conn.Encrypted, test.wantEncrypted)
+			}
+			if got := accepted.Load(); got != test.wantAccepted {
+				t.Errorf("dialed %d times, want %d", got, test.wantAccepted)
+			}
+		})
+	}
+}
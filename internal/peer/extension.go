@@ -0,0 +1,112 @@
+package peer
+
+import (
+	"fmt"
+
+	"github.com/nullxDEADBEEF/bittorrent/internal/bencode"
+)
+
+// The extension protocol (BEP 10) multiplexes extensions over message id 20. The first
+// byte of the payload is the extended message id, 0 being the extended handshake. The
+// extended handshake is a bencoded dictionary whose "m" key maps the names of the
+// extensions a peer supports to the extended message id it wants to receive them with,
+// so every side picks its own ids and both have to be remembered
+const ExtendedHandshakeID = 0
+
+type ExtendedHandshake struct {
+	// Extensions maps extension names to extended message ids ("m")
+	Extensions map[string]int
+	// Port is the TCP port the peer listens on ("p")
+	Port int
+	// Client is the client name and version ("v")
+	Client string
+	// Reqq is the number of outstanding requests the peer allows ("reqq")
+	Reqq int
+	// MetadataSize is the size of the info dictionary of the torrent ("metadata_size"),
+	// peers that do not have it yet leave it out
+	MetadataSize int
+}
+
+// Message encodes the extended handshake as a peer message
+func (h *ExtendedHandshake) Message() (*Message, error) {
+	extensions := make(map[string]interface{}, len(h.Extensions))
+	for name, id := range h.Extensions {
+		extensions[name] = id
+	}
+
+	dict := map[string]interface{}{"m": extensions}
+	if h.Port != 0 {
+		dict["p"] = h.Port
+	}
+	if h.Client != "" {
+		dict["v"] = h.Client
+	}
+	if h.Reqq != 0 {
+		dict["reqq"] = h.Reqq
+	}
+	if h.MetadataSize != 0 {
+		dict["metadata_size"] = h.MetadataSize
+	}
+
+	payload, err := bencode.Encode(dict)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewExtendedMessage(ExtendedHandshakeID, payload), nil
+}
+
+func ParseExtendedHandshake(payload []byte) (*ExtendedHandshake, error) {
+	dict, err := decodeDict(payload)
+	if err != nil {
+		return nil, fmt.Errorf("invalid extended handshake: %w", err)
+	}
+
+	h := &ExtendedHandshake{Extensions: make(map[string]int)}
+	if extensions, ok := dict["m"].(map[string]interface{}); ok {
+		for name, rawID := range extensions {
+			// an id of 0 means the extension is disabled
+			if id, ok := rawID.(int); ok && id > 0 && id < 256 {
+				h.Extensions[name] = id
+			}
+		}
+	}
+	h.Port, _ = dict["p"].(int)
+	h.Client = string(bencode.Bytes(dict["v"]))
+	h.Reqq, _ = dict["reqq"].(int)
+	h.MetadataSize, _ = dict["metadata_size"].(int)
+
+	return h, nil
+}
+
+// NewExtendedMessage wraps the payload of an extension message, extendedID is the id
+// the receiving peer assigned to the extension in its extended handshake
+func NewExtendedMessage(extendedID byte, payload []byte) *Message {
+	buf := make([]byte, 0, len(payload)+1)
+	buf = append(buf, extendedID)
+	buf = append(buf, payload...)
+	return &Message{ID: MsgExtended, Payload: buf}
+}
+
+// ParseExtended splits an extended message into its extended id and payload
+func ParseExtended(msg *Message) (byte, []byte, error) {
+	if msg.ID != MsgExtended || len(msg.Payload) < 1 {
+		return 0, nil, fmt.Errorf("invalid extended message")
+	}
+	return msg.Payload[0], msg.Payload[1:], nil
+}
+
+func decodeDict(data []byte) (map[string]interface{}, error) {
+	decoder := bencode.NewBencodeDecoder(data)
+	decoded, err := decoder.Decode()
+	if err != nil {
+		return nil, err
+	}
+
+	dict, ok := decoded.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("expected dictionary, got %T", decoded)
+	}
+
+	return dict, nil
+}
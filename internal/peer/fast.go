@@ -0,0 +1,83 @@
+package peer
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"net/netip"
+	"slices"
+)
+
+// The fast extension (BEP 6) is enabled when both peers set its reserved bit. It adds
+//   - have all / have none: replace the bitfield when a peer has every piece or none
+//   - suggest piece: a piece the peer would like us to download, usually one it has cached
+//   - reject request: requests are no longer dropped silently, every request gets either
+//     the block or a reject, even when the peer chokes us
+//   - allowed fast: pieces the peer lets us download while we are choked, so peers that
+//     have nothing yet can get their first pieces without waiting for an unchoke
+//
+// With the extension the first message after the handshake must be one of bitfield,
+// have all or have none
+const AllowedFastCount = 10
+
+func NewHaveAll() *Message {
+	return &Message{ID: MsgHaveAll}
+}
+
+func NewHaveNone() *Message {
+	return &Message{ID: MsgHaveNone}
+}
+
+func NewSuggest(index int) *Message {
+	return newIndexMessage(MsgSuggest, index)
+}
+
+func ParseSuggest(msg *Message) (int, error) {
+	return parseIndexMessage(msg, MsgSuggest)
+}
+
+func NewAllowedFast(index int) *Message {
+	return newIndexMessage(MsgAllowedFast, index)
+}
+
+func ParseAllowedFast(msg *Message) (int, error) {
+	return parseIndexMessage(msg, MsgAllowedFast)
+}
+
+// NewReject answers a request we will not serve, it carries the same payload as the
+// request
+func NewReject(index, begin, length int) *Message {
+	msg := NewRequest(index, begin, length)
+	msg.ID = MsgReject
+	return msg
+}
+
+// AllowedFastSet generates the canonical allowed fast set of k pieces for a peer. It
+// only depends on the /24 network of the peer and the info hash so reconnecting, or
+// connecting from another address in the same network, does not get a peer new pieces
+// for free. The set is only defined for IPv4 peers
+func AllowedFastSet(ip netip.Addr, infoHash [20]byte, numPieces, k int) []int {
+	ip = ip.Unmap()
+	if !ip.Is4() || numPieces <= 0 {
+		return nil
+	}
+	k = min(k, numPieces)
+
+	addr := ip.As4()
+	x := make([]byte, 0, 24)
+	x = append(x, addr[0], addr[1], addr[2], 0)
+	x = append(x, infoHash[:]...)
+
+	set := make([]int, 0, k)
+	for len(set) < k {
+		hash := sha1.Sum(x)
+		x = hash[:]
+		for i := 0; i < 5 && len(set) < k; i++ {
+			index := int(binary.BigEndian.Uint32(x[i*4:i*4+4]) % uint32(numPieces))
+			if !slices.Contains(set, index) {
+				set = append(set, index)
+			}
+		}
+	}
+
+	return set
+}
@@ -0,0 +1,259 @@
+package peer
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/nullxDEADBEEF/bittorrent/internal/mse"
+)
+
+// the handshake is the first message sent on a connection, it is made of
+//   - length of the protocol string (1 byte), always 19
+//   - the protocol string "BitTorrent protocol" (19 bytes)
+//   - eight reserved bytes used to signal support for protocol extensions
+//   - the info hash of the torrent (20 bytes)
+//   - the peer id (20 bytes)
+const (
+	protocolString = "BitTorrent protocol"
+	HandshakeSize  = 49 + len(protocolString)
+)
+
+// reserved bits are numbered from the left, bit 0 being the high bit of the first byte
+const (
+	// extension protocol (BEP 10)
+	reservedExtensionByte = 5
+	reservedExtensionBit  = 0x10
+	// fast extension (BEP 6)
+	reservedFastByte = 7
+	reservedFastBit  = 0x04
+	// BitTorrent v2 (BEP 52)
+	reservedV2Byte = 7
+	reservedV2Bit  = 0x10
+)
+
+var (
+	// ErrHandshakeMismatch is returned when a peer answers with a handshake for another
+	// torrent than the one we asked for
+	ErrHandshakeMismatch = errors.New("handshake does not match the torrent")
+	// ErrInvalidHandshake is returned when a peer does not speak the BitTorrent protocol
+	ErrInvalidHandshake = errors.New("invalid handshake")
+	// ErrSelfConnection is returned when the peer answered with our own peer id, the
+	// address is one of ours and should not be connected to again
+	ErrSelfConnection = errors.New("connected to ourselves")
+)
+
+type Handshake struct {
+	Reserved [8]byte
+	InfoHash [20]byte
+	PeerID   [20]byte
+}
+
+func (h *Handshake) Serialize() []byte {
+	buf := make([]byte, 0, HandshakeSize)
+	buf = append(buf, byte(len(protocolString)))
+	buf = append(buf, protocolString...)
+	buf = append(buf, h.Reserved[:]...)
+	buf = append(buf, h.InfoHash[:]...)
+	buf = append(buf, h.PeerID[:]...)
+	return buf
+}
+
+// ReadHandshake reads a handshake, returning ErrInvalidHandshake if it is not one of the
+// BitTorrent protocol
+func ReadHandshake(r io.Reader) (*Handshake, error) {
+	buf := make([]byte, HandshakeSize)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, fmt.Errorf("failed to read handshake: %w", err)
+	}
+	if buf[0] != byte(len(protocolString)) || string(buf[1:1+len(protocolString)]) != protocolString {
+		return nil, fmt.Errorf("%w: unknown protocol %q", ErrInvalidHandshake, buf[1:1+len(protocolString)])
+	}
+
+	h := &Handshake{}
+	offset := 1 + len(protocolString)
+	copy(h.Reserved[:], buf[offset:offset+8])
+	copy(h.InfoHash[:], buf[offset+8:offset+28])
+	copy(h.PeerID[:], buf[offset+28:offset+48])
+	return h, nil
+}
+
+// Extensions returns the names of the extensions the reserved bits announce
+func (h *Handshake) Extensions() []string {
+	var extensions []string
+	if h.SupportsExtensions() {
+		extensions = append(extensions, "extension protocol")
+	}
+	if h.SupportsFast() {
+		extensions = append(extensions, "fast")
+	}
+	if h.SupportsV2() {
+		extensions = append(extensions, "v2")
+	}
+	return extensions
+}
+
+func (h *Handshake) SupportsExtensions() bool {
+	return h.Reserved[reservedExtensionByte]&reservedExtensionBit != 0
+}
+
+func (h *Handshake) SetExtensions() {
+	h.Reserved[reservedExtensionByte] |= reservedExtensionBit
+}
+
+func (h *Handshake) SupportsFast() bool {
+	return h.Reserved[reservedFastByte]&reservedFastBit != 0
+}
+
+func (h *Handshake) SetFast() {
+	h.Reserved[reservedFastByte] |= reservedFastBit
+}
+
+func (h *Handshake) SupportsV2() bool {
+	return h.Reserved[reservedV2Byte]&reservedV2Bit != 0
+}
+
+func (h *Handshake) SetV2() {
+	h.Reserved[reservedV2Byte] |= reservedV2Bit
+}
+
+// Conn is a connection to a peer that completed the handshake
+type Conn struct {
+	net.Conn
+	// Remote is the handshake the peer sent us
+	Remote *Handshake
+	// Local is the handshake we sent
+	Local *Handshake
+	// Encrypted is set when the stream is RC4 encrypted
+	Encrypted bool
+}
+
+// NewConn exchanges handshakes on an outgoing connection, encrypting it unless the policy
+// disables encryption
+func NewConn(conn net.Conn, local *Handshake, policy mse.Policy, timeout time.Duration) (*Conn, error) {
+	conn.SetDeadline(time.Now().Add(timeout))
+	defer conn.SetDeadline(time.Time{})
+
+	encrypted := false
+	if policy == mse.PolicyDisable {
+		if _, err := conn.Write(local.Serialize()); err != nil {
+			return nil, &plaintextError{fmt.Errorf("failed to send handshake: %w", err)}
+		}
+	} else {
+		// our handshake goes along with the encrypted handshake as initial payload
+		mseConn, err := mse.Initiate(conn, local.InfoHash, local.Serialize(), policy.Methods())
+		if err != nil {
+			return nil, &encryptionError{err}
+		}
+		conn = mseConn
+		encrypted = mseConn.Method == mse.CryptoRC4
+	}
+
+	remote, err := ReadHandshake(conn)
+	if err != nil {
+		if policy != mse.PolicyDisable {
+			return nil, &encryptionError{err}
+		}
+		return nil, &plaintextError{err}
+	}
+	if remote.InfoHash != local.InfoHash {
+		return nil, fmt.Errorf("%w: peer sent info hash %x", ErrHandshakeMismatch, remote.InfoHash)
+	}
+	if remote.PeerID == local.PeerID {
+		return nil, ErrSelfConnection
+	}
+
+	return &Conn{Conn: conn, Remote: remote, Local: local, Encrypted: encrypted}, nil
+}
+
+// Accept reads the handshake of an incoming connection, plaintext or encrypted depending
+// on what the peer sent first and what the policy allows. infoHashes are the torrents we
+// serve and local returns the handshake to answer with for one of them, nil if the
+// torrent is unknown
+func Accept(conn net.Conn, policy mse.Policy, infoHashes [][20]byte, local func(infoHash [20]byte) *Handshake, timeout time.Duration) (*Conn, error) {
+	conn.SetDeadline(time.Now().Add(timeout))
+	defer conn.SetDeadline(time.Time{})
+
+	buffered := &bufferedConn{Conn: conn, r: bufio.NewReader(conn)}
+	start, err := buffered.r.Peek(1 + len(protocolString))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read handshake: %w", err)
+	}
+
+	conn = buffered
+	encrypted := false
+	if start[0] == byte(len(protocolString)) && string(start[1:]) == protocolString {
+		if policy == mse.PolicyRequire {
+			return nil, fmt.Errorf("plaintext connection refused, encryption is required")
+		}
+	} else {
+		if policy == mse.PolicyDisable {
+			return nil, fmt.Errorf("encrypted connection refused, encryption is disabled")
+		}
+		mseConn, _, err := mse.Receive(buffered, infoHashes, policy.Methods())
+		if err != nil {
+			return nil, &encryptionError{err}
+		}
+		conn = mseConn
+		encrypted = mseConn.Method == mse.CryptoRC4
+	}
+
+	remote, err := ReadHandshake(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	handshake := local(remote.InfoHash)
+	if handshake == nil {
+		return nil, fmt.Errorf("%w: unknown info hash %x", ErrHandshakeMismatch, remote.InfoHash)
+	}
+	if _, err := conn.Write(handshake.Serialize()); err != nil {
+		return nil, fmt.Errorf("failed to send handshake: %w", err)
+	}
+	// we answer first so the dialing side, ourselves too, sees its own peer id
+	if remote.PeerID == handshake.PeerID {
+		return nil, ErrSelfConnection
+	}
+
+	return &Conn{Conn: conn, Remote: remote, Local: handshake, Encrypted: encrypted}, nil
+}
+
+// bufferedConn lets us peek at the first bytes of a connection without losing them
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *Conn) ReadMessage() (*Message, error) {
+	return ReadMessage(c.Conn)
+}
+
+func (c *Conn) WriteMessage(msg *Message) error {
+	_, err := c.Conn.Write(msg.Serialize())
+	return err
+}
+
+// SupportsExtensions reports whether both sides of the connection support the extension
+// protocol, only then may extended messages be sent
+func (c *Conn) SupportsExtensions() bool {
+	return c.Remote.SupportsExtensions() && c.Local.SupportsExtensions()
+}
+
+// SupportsFast reports whether the fast extension is enabled on the connection, which
+// requires both sides to set the bit
+func (c *Conn) SupportsFast() bool {
+	return c.Remote.SupportsFast() && c.Local.SupportsFast()
+}
+
+// SupportsV2 reports whether both sides speak BitTorrent v2, which allows the hash
+// messages to be exchanged
+func (c *Conn) SupportsV2() bool {
+	return c.Remote.SupportsV2() && c.Local.SupportsV2()
+}
@@ -0,0 +1,102 @@
+package peer
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/nullxDEADBEEF/bittorrent/internal/merkle"
+)
+
+// BitTorrent v2 peers exchange the layers of the file merkle trees with three messages,
+// which lets clients that joined from a magnet link get the piece layers, and verify
+// blocks on their own instead of whole pieces:
+//   - hash request: pieces root, base layer, index, length, proof layers
+//   - hashes: the same fields followed by the hashes of the base layer from index to
+//     index+length, then the uncle hashes proving them
+//   - hash reject: the fields of a request that will not be answered
+//
+// Layers are numbered from the leaves, which are layer 0. Length is a power of two of at
+// least 2 and index a multiple of it
+type HashRequest struct {
+	PiecesRoot  merkle.Hash
+	BaseLayer   int
+	Index       int
+	Length      int
+	ProofLayers int
+}
+
+const hashRequestSize = merkle.HashSize + 16
+
+func (r *HashRequest) payload() []byte {
+	payload := make([]byte, hashRequestSize)
+	copy(payload, r.PiecesRoot[:])
+	binary.BigEndian.PutUint32(payload[32:36], uint32(r.BaseLayer))
+	binary.BigEndian.PutUint32(payload[36:40], uint32(r.Index))
+	binary.BigEndian.PutUint32(payload[40:44], uint32(r.Length))
+	binary.BigEndian.PutUint32(payload[44:48], uint32(r.ProofLayers))
+	return payload
+}
+
+func parseHashRequest(payload []byte) (*HashRequest, error) {
+	if len(payload) < hashRequestSize {
+		return nil, fmt.Errorf("invalid hash request payload length: %d", len(payload))
+	}
+
+	r := &HashRequest{
+		BaseLayer:   int(binary.BigEndian.Uint32(payload[32:36])),
+		Index:       int(binary.BigEndian.Uint32(payload[36:40])),
+		Length:      int(binary.BigEndian.Uint32(payload[40:44])),
+		ProofLayers: int(binary.BigEndian.Uint32(payload[44:48])),
+	}
+	copy(r.PiecesRoot[:], payload)
+	return r, nil
+}
+
+func NewHashRequest(r *HashRequest) *Message {
+	return &Message{ID: MsgHashRequest, Payload: r.payload()}
+}
+
+// ParseHashRequest returns the request of a hash request or hash reject message
+func ParseHashRequest(msg *Message) (*HashRequest, error) {
+	if msg.ID != MsgHashRequest && msg.ID != MsgHashReject {
+		return nil, fmt.Errorf("invalid message %d", msg.ID)
+	}
+	return parseHashRequest(msg.Payload)
+}
+
+// NewHashReject answers a hash request we will not serve
+func NewHashReject(r *HashRequest) *Message {
+	return &Message{ID: MsgHashReject, Payload: r.payload()}
+}
+
+// NewHashes answers a hash request with the requested hashes and their proof
+func NewHashes(r *HashRequest, hashes []merkle.Hash) *Message {
+	payload := r.payload()
+	for _, h := range hashes {
+		payload = append(payload, h[:]...)
+	}
+	return &Message{ID: MsgHashes, Payload: payload}
+}
+
+// ParseHashes returns the request a hashes message answers and the hashes it carries
+func ParseHashes(msg *Message) (*HashRequest, []merkle.Hash, error) {
+	if msg.ID != MsgHashes {
+		return nil, nil, fmt.Errorf("invalid message %d", msg.ID)
+	}
+
+	r, err := parseHashRequest(msg.Payload)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	data := msg.Payload[hashRequestSize:]
+	if len(data)%merkle.HashSize != 0 {
+		return nil, nil, fmt.Errorf("invalid hashes length: %d", len(data))
+	}
+
+	hashes := make([]merkle.Hash, len(data)/merkle.HashSize)
+	for i := range hashes {
+		copy(hashes[i][:], data[i*merkle.HashSize:])
+	}
+	return r, hashes, nil
+}
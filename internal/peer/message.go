@@ -0,0 +1,212 @@
+package peer
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+/*
+peer messages consists of:
+- message length prefix (4 bytes)
+- message id (1 byte)
+- payload (variable size)
+
+a message with a length of 0 has no id nor payload and is a keep-alive
+
+// once the handshake is complete we need to exchange the following messages
+- wait for _bitfield_ message from peer to indicate which pieces it has
+  - message id for this type is 5
+  - payload is a bitfield with a bit set for every piece the peer has
+
+- send _interested_ message
+  - id for this message type is 2
+  - empty payload
+
+- wait till receiving _unchoke_ message
+  - id for this message type is 1
+  - empty payload
+
+// Break the pieces into blocks of 16 kiB (16 * 1024 bytes) and send _request_ message for each block
+  - id for this message type is 6
+  - payload consists of:
+  - index: zero-based index
+  - begin: zero-based byte offset within the piece
+    0 for first block, 2^14 for second, 2 * 2^14 for third.....
+  - length: the length of the block in bytes
+    this will be 2^14 for all blocks except the last one.
+    the last one will be 2^14 bytes or lower, this will be caculated using the piece length
+
+wait till receiving _piece_ message for each block requested
+  - id for this message type is 7
+  - payload consists of:
+    index: zero-based piece index
+    begin: zero-based byte offset within the piece
+    block: the data for the piece, usually 2^14 bytes long
+
+After combining blocks into pieces, we have to check the integrity of each piece
+by comparing the hash with the piece hash found in the torrent file
+*/
+
+type MessageID uint8
+
+const (
+	MsgChoke         MessageID = 0
+	MsgUnchoke       MessageID = 1
+	MsgInterested    MessageID = 2
+	MsgNotInterested MessageID = 3
+	MsgHave          MessageID = 4
+	MsgBitfield      MessageID = 5
+	MsgRequest       MessageID = 6
+	MsgPiece         MessageID = 7
+	MsgCancel        MessageID = 8
+	MsgPort          MessageID = 9
+	// fast extension (BEP 6)
+	MsgSuggest     MessageID = 13
+	MsgHaveAll     MessageID = 14
+	MsgHaveNone    MessageID = 15
+	MsgReject      MessageID = 16
+	MsgAllowedFast MessageID = 17
+	MsgExtended    MessageID = 20
+	// BitTorrent v2 (BEP 52)
+	MsgHashRequest MessageID = 21
+	MsgHashes      MessageID = 22
+	MsgHashReject  MessageID = 23
+)
+
+const (
+	// BlockSize is the size of the blocks pieces are requested in
+	BlockSize = 1 << 14
+	// messages bigger than this are refused, the biggest legitimate message is a piece
+	// message carrying a block, bitfields of huge torrents stay well below it too
+	maxMessageLength = 1 << 20
+)
+
+type Message struct {
+	ID      MessageID
+	Payload []byte
+}
+
+// Serialize encodes the message with its length prefix, a nil message is a keep-alive
+func (m *Message) Serialize() []byte {
+	if m == nil {
+		return make([]byte, 4)
+	}
+
+	length := uint32(len(m.Payload) + 1)
+	buf := make([]byte, 4+length)
+	binary.BigEndian.PutUint32(buf[0:4], length)
+	buf[4] = byte(m.ID)
+	copy(buf[5:], m.Payload)
+	return buf
+}
+
+// ReadMessage reads a single message, it returns a nil message for keep-alives
+func ReadMessage(r io.Reader) (*Message, error) {
+	lengthBuf := make([]byte, 4)
+	if _, err := io.ReadFull(r, lengthBuf); err != nil {
+		return nil, err
+	}
+
+	length := binary.BigEndian.Uint32(lengthBuf)
+	if length == 0 {
+		return nil, nil
+	}
+	if length > maxMessageLength {
+		return nil, fmt.Errorf("message too long: %d bytes", length)
+	}
+
+	messageBuf := make([]byte, length)
+	if _, err := io.ReadFull(r, messageBuf); err != nil {
+		return nil, err
+	}
+
+	return &Message{ID: MessageID(messageBuf[0]), Payload: messageBuf[1:]}, nil
+}
+
+func NewRequest(index, begin, length int) *Message {
+	payload := make([]byte, 12)
+	binary.BigEndian.PutUint32(payload[0:4], uint32(index))
+	binary.BigEndian.PutUint32(payload[4:8], uint32(begin))
+	binary.BigEndian.PutUint32(payload[8:12], uint32(length))
+	return &Message{ID: MsgRequest, Payload: payload}
+}
+
+func NewHave(index int) *Message {
+	return newIndexMessage(MsgHave, index)
+}
+
+// ParseHave returns the piece index of a have message
+func ParseHave(msg *Message) (int, error) {
+	return parseIndexMessage(msg, MsgHave)
+}
+
+// newIndexMessage builds a message whose payload is a single piece index
+func newIndexMessage(id MessageID, index int) *Message {
+	payload := make([]byte, 4)
+	binary.BigEndian.PutUint32(payload, uint32(index))
+	return &Message{ID: id, Payload: payload}
+}
+
+func parseIndexMessage(msg *Message, id MessageID) (int, error) {
+	if msg.ID != id || len(msg.Payload) != 4 {
+		return 0, fmt.Errorf("invalid message %d", id)
+	}
+	return int(binary.BigEndian.Uint32(msg.Payload)), nil
+}
+
+// ParseRequest returns the index, begin and length of a request, cancel or reject message
+func ParseRequest(msg *Message) (index, begin, length int, err error) {
+	if len(msg.Payload) != 12 {
+		return 0, 0, 0, fmt.Errorf("invalid request payload length: %d", len(msg.Payload))
+	}
+	index = int(binary.BigEndian.Uint32(msg.Payload[0:4]))
+	begin = int(binary.BigEndian.Uint32(msg.Payload[4:8]))
+	length = int(binary.BigEndian.Uint32(msg.Payload[8:12]))
+	return index, begin, length, nil
+}
+
+// ParsePiece returns the index, begin offset and data of a piece message
+func ParsePiece(msg *Message) (index, begin int, block []byte, err error) {
+	if msg.ID != MsgPiece || len(msg.Payload) < 8 {
+		return 0, 0, nil, fmt.Errorf("invalid piece message")
+	}
+	index = int(binary.BigEndian.Uint32(msg.Payload[0:4]))
+	begin = int(binary.BigEndian.Uint32(msg.Payload[4:8]))
+	return index, begin, msg.Payload[8:], nil
+}
+
+// Bitfield has a bit set for every piece a peer has, the high bit of the first byte
+// is piece 0
+type Bitfield []byte
+
+func NewBitfield(numPieces int) Bitfield {
+	return make(Bitfield, (numPieces+7)/8)
+}
+
+func (bf Bitfield) HasPiece(index int) bool {
+	byteIndex := index / 8
+	if index < 0 || byteIndex >= len(bf) {
+		return false
+	}
+	return bf[byteIndex]>>(7-index%8)&1 != 0
+}
+
+func (bf Bitfield) SetPiece(index int) {
+	byteIndex := index / 8
+	if index < 0 || byteIndex >= len(bf) {
+		return
+	}
+	bf[byteIndex] |= 1 << (7 - index%8)
+}
+
+// Count returns how many of the first numPieces pieces are set
+func (bf Bitfield) Count(numPieces int) int {
+	count := 0
+	for i := 0; i < numPieces; i++ {
+		if bf.HasPiece(i) {
+			count++
+		}
+	}
+	return count
+}
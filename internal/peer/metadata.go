@@ -0,0 +1,87 @@
+package peer
+
+import (
+	"fmt"
+
+	"github.com/nullxDEADBEEF/bittorrent/internal/bencode"
+)
+
+// The metadata extension (BEP 9) lets peers download the info dictionary of a torrent from
+// each other, which is all a magnet link is missing. The size of the info dictionary is
+// given by "metadata_size" in the extended handshake, it is split in pieces of 16 KiB and
+// every ut_metadata message is a bencoded dictionary with keys
+//   - msg_type: 0 for request, 1 for data and 2 for reject
+//   - piece: the index of the piece
+//   - total_size: the size of the info dictionary, only in data messages
+//
+// The data of a piece follows the dictionary of a data message
+const (
+	ExtensionMetadata = "ut_metadata"
+
+	MetadataPieceSize = 16 * 1024
+	// a peer announcing info dictionaries larger than this is not believed
+	MaxMetadataSize = 16 * 1024 * 1024
+)
+
+const (
+	MetadataRequest = 0
+	MetadataData    = 1
+	MetadataReject  = 2
+)
+
+type MetadataMessage struct {
+	Type      int
+	Piece     int
+	TotalSize int
+	Data      []byte
+}
+
+// Encode returns the payload of the ut_metadata message
+func (m *MetadataMessage) Encode() ([]byte, error) {
+	dict := map[string]interface{}{
+		"msg_type": m.Type,
+		"piece":    m.Piece,
+	}
+	if m.Type == MetadataData {
+		dict["total_size"] = m.TotalSize
+	}
+
+	payload, err := bencode.Encode(dict)
+	if err != nil {
+		return nil, err
+	}
+	return append(payload, m.Data...), nil
+}
+
+func ParseMetadataMessage(payload []byte) (*MetadataMessage, error) {
+	decoder := bencode.NewBencodeDecoder(payload)
+	decoded, err := decoder.Decode()
+	if err != nil {
+		return nil, fmt.Errorf("invalid ut_metadata message: %w", err)
+	}
+	dict, ok := decoded.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("invalid ut_metadata message: expected dictionary, got %T", decoded)
+	}
+
+	msgType, ok := dict["msg_type"].(int)
+	if !ok {
+		return nil, fmt.Errorf("invalid ut_metadata message: missing msg_type")
+	}
+	piece, ok := dict["piece"].(int)
+	if !ok || piece < 0 {
+		return nil, fmt.Errorf("invalid ut_metadata message: missing piece")
+	}
+
+	m := &MetadataMessage{Type: msgType, Piece: piece}
+	if msgType == MetadataData {
+		m.TotalSize, _ = dict["total_size"].(int)
+		m.Data = payload[decoder.Offset():]
+	}
+	return m, nil
+}
+
+// MetadataPieces returns the number of pieces an info dictionary of size bytes is split in
+func MetadataPieces(size int) int {
+	return (size + MetadataPieceSize - 1) / MetadataPieceSize
+}
@@ -0,0 +1,29 @@
+package peer
+
+import (
+	"crypto/rand"
+	"fmt"
+)
+
+// ClientPrefix starts our peer ids, in the Azureus style of a dash, a two letter client
+// code, four version digits and a dash, so other clients can tell what we are
+const ClientPrefix = "-NX0001-"
+
+// characters the random part of a peer id is made of, some clients display peer ids and
+// do not expect binary data
+const peerIDAlphabet = "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+
+// NewPeerID returns a peer id made of ClientPrefix and random characters. A client uses
+// the same one for a whole session, with trackers and every peer, so that peers and
+// trackers recognize it and connections to ourselves can be detected
+func NewPeerID() ([20]byte, error) {
+	var peerID [20]byte
+	n := copy(peerID[:], ClientPrefix)
+	if _, err := rand.Read(peerID[n:]); err != nil {
+		return [20]byte{}, fmt.Errorf("failed to generate peer id: %w", err)
+	}
+	for i := n; i < len(peerID); i++ {
+		peerID[i] = peerIDAlphabet[int(peerID[i])%len(peerIDAlphabet)]
+	}
+	return peerID, nil
+}
@@ -0,0 +1,177 @@
+package peer
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+	"time"
+
+	"github.com/nullxDEADBEEF/bittorrent/internal/bencode"
+)
+
+// Peer exchange (BEP 11) lets connected peers tell each other about the other peers they
+// are connected to. A ut_pex message is a bencoded dictionary with keys
+//   - added / added6: compact IPv4 / IPv6 addresses of peers we connected to
+//   - added.f / added6.f: one byte of flags for every added peer
+//   - dropped / dropped6: compact addresses of peers we disconnected from
+//
+// Messages only carry the difference with the previous one and are sent at most once a
+// minute on every connection
+const (
+	ExtensionPEX = "ut_pex"
+
+	PEXInterval = time.Minute
+	// a message must not add nor drop more than 50 peers
+	maxPEXPeers = 50
+)
+
+const (
+	PEXPrefersEncryption byte = 0x01
+	PEXSeed              byte = 0x02
+	PEXSupportsUTP       byte = 0x04
+	PEXHolepunch         byte = 0x08
+	PEXReachable         byte = 0x10
+)
+
+type PEXPeer struct {
+	Addr  netip.AddrPort
+	Flags byte
+}
+
+type PEXMessage struct {
+	Added   []PEXPeer
+	Dropped []netip.AddrPort
+}
+
+func (m *PEXMessage) Encode() ([]byte, error) {
+	var added, addedFlags, added6, added6Flags, dropped, dropped6 []byte
+
+	for _, p := range m.Added {
+		if p.Addr.Addr().Is4() {
+			added = appendCompactAddr(added, p.Addr)
+			addedFlags = append(addedFlags, p.Flags)
+		} else {
+			added6 = appendCompactAddr(added6, p.Addr)
+			added6Flags = append(added6Flags, p.Flags)
+		}
+	}
+	for _, addr := range m.Dropped {
+		if addr.Addr().Is4() {
+			dropped = appendCompactAddr(dropped, addr)
+		} else {
+			dropped6 = appendCompactAddr(dropped6, addr)
+		}
+	}
+
+	return bencode.Encode(map[string]interface{}{
+		"added":    added,
+		"added.f":  addedFlags,
+		"added6":   added6,
+		"added6.f": added6Flags,
+		"dropped":  dropped,
+		"dropped6": dropped6,
+	})
+}
+
+func ParsePEX(payload []byte) (*PEXMessage, error) {
+	dict, err := decodeDict(payload)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ut_pex message: %w", err)
+	}
+
+	m := &PEXMessage{}
+	for _, family := range []struct {
+		key  string
+		size int
+	}{{"added", 6}, {"added6", 18}} {
+		addrs, err := parseCompactAddrs(bencode.Bytes(dict[family.key]), family.size)
+		if err != nil {
+			return nil, err
+		}
+		flags := bencode.Bytes(dict[family.key+".f"])
+		for i, addr := range addrs {
+			p := PEXPeer{Addr: addr}
+			if i < len(flags) {
+				p.Flags = flags[i]
+			}
+			m.Added = append(m.Added, p)
+		}
+	}
+
+	for _, family := range []struct {
+		key  string
+		size int
+	}{{"dropped", 6}, {"dropped6", 18}} {
+		addrs, err := parseCompactAddrs(bencode.Bytes(dict[family.key]), family.size)
+		if err != nil {
+			return nil, err
+		}
+		m.Dropped = append(m.Dropped, addrs...)
+	}
+
+	return m, nil
+}
+
+// PEXState remembers what was sent on a single connection so only the differences are
+// sent next time
+type PEXState struct {
+	sent     map[netip.AddrPort]byte
+	lastSent time.Time
+}
+
+func NewPEXState() *PEXState {
+	return &PEXState{sent: make(map[netip.AddrPort]byte)}
+}
+
+// Delta compares the peers we are currently connected to with what we told the peer
+// last time. It returns false if it is too early to send another message or if nothing
+// changed, otherwise the returned message is considered sent
+func (s *PEXState) Delta(current map[netip.AddrPort]byte, now time.Time) (*PEXMessage, bool) {
+	if !s.lastSent.IsZero() && now.Sub(s.lastSent) < PEXInterval {
+		return nil, false
+	}
+
+	m := &PEXMessage{}
+	for addr, flags := range current {
+		if sentFlags, ok := s.sent[addr]; (!ok || sentFlags != flags) && len(m.Added) < maxPEXPeers {
+			m.Added = append(m.Added, PEXPeer{Addr: addr, Flags: flags})
+			s.sent[addr] = flags
+		}
+	}
+	for addr := range s.sent {
+		if _, ok := current[addr]; !ok && len(m.Dropped) < maxPEXPeers {
+			m.Dropped = append(m.Dropped, addr)
+			delete(s.sent, addr)
+		}
+	}
+
+	if len(m.Added) == 0 && len(m.Dropped) == 0 {
+		return nil, false
+	}
+
+	s.lastSent = now
+	return m, true
+}
+
+func appendCompactAddr(buf []byte, addr netip.AddrPort) []byte {
+	buf = append(buf, addr.Addr().AsSlice()...)
+	return binary.BigEndian.AppendUint16(buf, addr.Port())
+}
+
+func parseCompactAddrs(compact []byte, size int) ([]netip.AddrPort, error) {
+	if len(compact)%size != 0 {
+		return nil, fmt.Errorf("invalid compact address list length %d", len(compact))
+	}
+
+	addrs := make([]netip.AddrPort, 0, len(compact)/size)
+	for i := 0; i < len(compact); i += size {
+		ip, _ := netip.AddrFromSlice(compact[i : i+size-2])
+		port := binary.BigEndian.Uint16(compact[i+size-2 : i+size])
+		if ip.IsUnspecified() || port == 0 {
+			continue
+		}
+		addrs = append(addrs, netip.AddrPortFrom(ip.Unmap(), port))
+	}
+
+	return addrs, nil
+}
@@ -0,0 +1,88 @@
+package ratelimit
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+var ErrStopped = errors.New("rate limited wait stopped")
+
+// Limiter is a token bucket shared by every connection it limits. Tokens are bytes, they
+// accumulate at the rate up to a second worth of them, so short bursts go through at
+// full speed while the average stays under the rate. A nil Limiter does not limit
+type Limiter struct {
+	mu     sync.Mutex
+	rate   int
+	tokens float64
+	last   time.Time
+}
+
+// NewLimiter returns a limiter letting through rate bytes per second, a rate of 0 or less
+// does not limit
+func NewLimiter(rate int) *Limiter {
+	return &Limiter{rate: rate, tokens: float64(rate), last: time.Now()}
+}
+
+// SetRate changes the rate, waits in progress pick it up on their next check
+func (l *Limiter) SetRate(rate int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.refill(time.Now())
+	l.rate = rate
+	l.tokens = min(l.tokens, float64(rate))
+}
+
+func (l *Limiter) Rate() int {
+	if l == nil {
+		return 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.rate
+}
+
+// Wait takes n bytes worth of tokens, blocking until they are available or stop is closed.
+// Taking more than the bucket holds leaves it in debt, which later waits pay back
+func (l *Limiter) Wait(n int, stop <-chan struct{}) error {
+	if l == nil {
+		return nil
+	}
+
+	l.mu.Lock()
+	if l.rate <= 0 {
+		l.mu.Unlock()
+		return nil
+	}
+	now := time.Now()
+	l.refill(now)
+	l.tokens -= float64(n)
+	delay := time.Duration(0)
+	if l.tokens < 0 {
+		delay = time.Duration(-l.tokens / float64(l.rate) * float64(time.Second))
+	}
+	l.mu.Unlock()
+
+	if delay == 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-stop:
+		return ErrStopped
+	}
+}
+
+// refill adds the tokens accumulated since the last call, it must be called with mu held
+func (l *Limiter) refill(now time.Time) {
+	if l.rate > 0 {
+		l.tokens = min(l.tokens+now.Sub(l.last).Seconds()*float64(l.rate), float64(l.rate))
+	}
+	l.last = now
+}
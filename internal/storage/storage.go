@@ -0,0 +1,242 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+var ErrInvalidPath = errors.New("invalid file path")
+
+// File is a file of a torrent as stored on disk
+type File struct {
+	// Path is relative to the storage directory
+	Path   []string
+	Length int
+	// Pad files are never written, they read as zeros
+	Pad bool
+	// Skip files are not part of the download, they are neither written nor created
+	Skip       bool
+	Executable bool
+	// Symlink is the target of a symbolic link relative to the storage directory
+	Symlink []string
+}
+
+// Storage maps the byte offsets of a torrent to its files, which lie back to back in the
+// order they are listed. Files are created when first written to
+type Storage struct {
+	dir   string
+	files []File
+	// offsets[i] is the offset of the first byte of file i in the torrent
+	offsets []int64
+
+	mu      sync.Mutex
+	handles map[int]*os.File
+}
+
+// New prepares the storage of files under dir. Paths that would end up outside of dir
+// are refused
+func New(dir string, files []File) (*Storage, error) {
+	s := &Storage{
+		dir:     dir,
+		files:   files,
+		offsets: make([]int64, len(files)),
+		handles: make(map[int]*os.File),
+	}
+
+	offset := int64(0)
+	for i, file := range files {
+		if err := checkPath(file.Path); err != nil {
+			return nil, err
+		}
+		if file.Symlink != nil {
+			if err := checkPath(file.Symlink); err != nil {
+				return nil, err
+			}
+		}
+		s.offsets[i] = offset
+		offset += int64(file.Length)
+	}
+
+	return s, nil
+}
+
+// checkPath refuses empty paths and elements that are empty, "." or "..", or contain a
+// separator
+func checkPath(path []string) error {
+	if len(path) == 0 {
+		return ErrInvalidPath
+	}
+	for _, element := range path {
+		if element == "" || element == "." || element == ".." || filepath.Base(element) != element {
+			return fmt.Errorf("%w: %q", ErrInvalidPath, path)
+		}
+	}
+	return nil
+}
+
+// Path returns where file i is stored
+func (s *Storage) Path(i int) string {
+	return filepath.Join(append([]string{s.dir}, s.files[i].Path...)...)
+}
+
+// SetSkip changes whether a file is part of the download, for priorities changed while
+// the torrent downloads. Parts of a skipped file already written stay on disk
+func (s *Storage) SetSkip(i int, skip bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.files[i].Skip = skip
+}
+
+func (s *Storage) skipped(i int) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.files[i].Skip
+}
+
+// WriteAt writes data at an offset of the torrent, the parts falling in pad files, skipped
+// files or symbolic links are dropped
+func (s *Storage) WriteAt(p []byte, off int64) (int, error) {
+	err := s.span(p, off, func(i int, buf []byte, fileOff int64) error {
+		if s.files[i].Pad || s.skipped(i) || s.files[i].Symlink != nil {
+			return nil
+		}
+
+		f, err := s.open(i)
+		if err != nil {
+			return err
+		}
+		_, err = f.WriteAt(buf, fileOff)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// ReadAt reads data at an offset of the torrent, pad files read as zeros
+func (s *Storage) ReadAt(p []byte, off int64) (int, error) {
+	err := s.span(p, off, func(i int, buf []byte, fileOff int64) error {
+		if s.files[i].Pad || s.files[i].Symlink != nil {
+			clear(buf)
+			return nil
+		}
+
+		f, err := s.open(i)
+		if err != nil {
+			return err
+		}
+		_, err = f.ReadAt(buf, fileOff)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// span calls fn with the part of p falling in each file p overlaps
+func (s *Storage) span(p []byte, off int64, fn func(i int, buf []byte, fileOff int64) error) error {
+	end := off + int64(len(p))
+	for i, file := range s.files {
+		start := s.offsets[i]
+		fileEnd := start + int64(file.Length)
+		if fileEnd <= off || start >= end {
+			continue
+		}
+
+		from := max(off, start)
+		to := min(end, fileEnd)
+		if err := fn(i, p[from-off:to-off], from-start); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Storage) open(i int) (*os.File, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if f, ok := s.handles[i]; ok {
+		return f, nil
+	}
+
+	path := s.Path(i)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create directory: %w", err)
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file: %w", err)
+	}
+
+	s.handles[i] = f
+	return f, nil
+}
+
+// Finish creates the files that were never written to, like empty ones, sets their
+// executable bits and creates the symbolic links
+func (s *Storage) Finish() error {
+	for i, file := range s.files {
+		switch {
+		case file.Pad, s.skipped(i):
+		case file.Symlink != nil:
+			if err := s.symlink(i); err != nil {
+				return err
+			}
+		default:
+			f, err := s.open(i)
+			if err != nil {
+				return err
+			}
+			if err := f.Truncate(int64(file.Length)); err != nil {
+				return fmt.Errorf("failed to resize file: %w", err)
+			}
+			if file.Executable {
+				if err := f.Chmod(0o755); err != nil {
+					return fmt.Errorf("failed to make file executable: %w", err)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// symlink links file i to its target, the link is relative so the directory can be moved
+func (s *Storage) symlink(i int) error {
+	path := s.Path(i)
+	target := filepath.Join(append([]string{s.dir}, s.files[i].Symlink...)...)
+
+	relative, err := filepath.Rel(filepath.Dir(path), target)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+	os.Remove(path)
+	if err := os.Symlink(relative, path); err != nil {
+		return fmt.Errorf("failed to create symbolic link: %w", err)
+	}
+	return nil
+}
+
+// Close closes the files that were opened
+func (s *Storage) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var errs []error
+	for i, f := range s.handles {
+		errs = append(errs, f.Close())
+		delete(s.handles, i)
+	}
+	return errors.Join(errs...)
+}
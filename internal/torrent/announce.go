@@ -0,0 +1,79 @@
+package torrent
+
+import (
+	"net"
+	"strconv"
+
+	"github.com/nullxDEADBEEF/bittorrent/internal/bencode"
+)
+
+// AnnounceTiers returns the trackers of a torrent grouped in tiers. When the torrent has
+// an "announce-list" (BEP 12) it takes precedence and "announce" is ignored, otherwise
+// the single "announce" URL forms the only tier
+func AnnounceTiers(torrent map[string]interface{}) [][]string {
+	tiers := make([][]string, 0)
+
+	if announceList, ok := torrent["announce-list"].([]interface{}); ok {
+		for _, rawTier := range announceList {
+			list, ok := rawTier.([]interface{})
+			if !ok {
+				continue
+			}
+
+			tier := make([]string, 0, len(list))
+			for _, rawURL := range list {
+				if announceURL := string(bencode.Bytes(rawURL)); announceURL != "" {
+					tier = append(tier, announceURL)
+				}
+			}
+
+			if len(tier) > 0 {
+				tiers = append(tiers, tier)
+			}
+		}
+	}
+
+	if len(tiers) == 0 {
+		if announceURL := string(bencode.Bytes(torrent["announce"])); announceURL != "" {
+			tiers = append(tiers, []string{announceURL})
+		}
+	}
+
+	return tiers
+}
+
+// AnnounceURL returns the "announce" URL of a torrent, empty when it has none
+func AnnounceURL(torrent map[string]interface{}) string {
+	return string(bencode.Bytes(torrent["announce"]))
+}
+
+// DHTNodes returns the "nodes" of a trackerless torrent (BEP 5) as "host:port" addresses,
+// they are used to bootstrap the DHT
+func DHTNodes(torrent map[string]interface{}) []string {
+	nodes := make([]string, 0)
+
+	rawNodes, _ := torrent["nodes"].([]interface{})
+	for _, rawNode := range rawNodes {
+		pair, ok := rawNode.([]interface{})
+		if !ok || len(pair) != 2 {
+			continue
+		}
+
+		host := string(bencode.Bytes(pair[0]))
+		port, ok := pair[1].(int)
+		if host == "" || !ok {
+			continue
+		}
+
+		nodes = append(nodes, net.JoinHostPort(host, strconv.Itoa(port)))
+	}
+
+	return nodes
+}
+
+// IsPrivate reports whether the torrent is private (BEP 27), private torrents must only
+// get peers from their trackers and never from the DHT or peer exchange
+func IsPrivate(torrentInfo map[string]interface{}) bool {
+	private, _ := torrentInfo["private"].(int)
+	return private == 1
+}
@@ -0,0 +1,121 @@
+package torrent
+
+import "github.com/nullxDEADBEEF/bittorrent/internal/bencode"
+
+// File is one of the files of a torrent, the pieces cover the files back to back in the
+// order they are listed
+type File struct {
+	// Path is relative to the directory named after the torrent, it is empty for single
+	// file torrents whose only file is the torrent name itself
+	Path   []string
+	Length int
+	// Pad files only exist to align the next file on a piece boundary, they are zeros
+	Pad bool
+	// Executable and Hidden come from the file attributes (BEP 47)
+	Executable bool
+	Hidden     bool
+	// Symlink is the target of a symbolic link, relative to the torrent directory, the
+	// file has no data when it is set
+	Symlink []string
+}
+
+// file attributes (BEP 47) are a string of flag characters in "attr"
+const (
+	attrPad        = 'p'
+	attrExecutable = 'x'
+	attrHidden     = 'h'
+	attrSymlink    = 'l'
+)
+
+// setAttributes applies the "attr" and "symlink path" of a file dictionary, unknown
+// attributes are ignored
+func (f *File) setAttributes(dict map[string]interface{}) {
+	for _, attr := range string(bencode.Bytes(dict["attr"])) {
+		switch attr {
+		case attrPad:
+			f.Pad = true
+		case attrExecutable:
+			f.Executable = true
+		case attrHidden:
+			f.Hidden = true
+		case attrSymlink:
+			rawTarget, _ := dict["symlink path"].([]interface{})
+			target := make([]string, 0, len(rawTarget))
+			for _, element := range rawTarget {
+				target = append(target, string(bencode.Bytes(element)))
+			}
+			f.Symlink = target
+		}
+	}
+}
+
+// Name returns the suggested name of the file, or of the directory of a multi-file torrent
+func Name(torrentInfo map[string]interface{}) string {
+	return string(bencode.Bytes(torrentInfo["name"]))
+}
+
+// Files returns the files of a torrent. Single file torrents have a "length", multi-file
+// ones a "files" list with the length and path of each file and v2 only torrents a file
+// tree, whose files are aligned with pad files
+func Files(torrentInfo map[string]interface{}) []File {
+	if length, ok := torrentInfo["length"].(int); ok {
+		file := File{Length: length}
+		file.setAttributes(torrentInfo)
+		return []File{file}
+	}
+	if _, ok := torrentInfo["files"]; !ok && HasV2(torrentInfo) {
+		return v2Files(torrentInfo)
+	}
+
+	files := make([]File, 0)
+	rawFiles, _ := torrentInfo["files"].([]interface{})
+	for _, rawFile := range rawFiles {
+		dict, ok := rawFile.(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		length, _ := dict["length"].(int)
+		rawPath, _ := dict["path"].([]interface{})
+		path := make([]string, 0, len(rawPath))
+		for _, element := range rawPath {
+			path = append(path, string(bencode.Bytes(element)))
+		}
+
+		file := File{Path: path, Length: length}
+		file.setAttributes(dict)
+		files = append(files, file)
+	}
+
+	return files
+}
+
+// Length returns the total length of the files of a torrent
+func Length(torrentInfo map[string]interface{}) int {
+	length := 0
+	for _, file := range Files(torrentInfo) {
+		length += file.Length
+	}
+	return length
+}
+
+// WebSeeds returns the HTTP mirrors of a torrent (BEP 19), "url-list" is either a single
+// URL or a list of them
+func WebSeeds(torrent map[string]interface{}) []string {
+	urls := make([]string, 0)
+
+	switch v := torrent["url-list"].(type) {
+	case []interface{}:
+		for _, rawURL := range v {
+			if url := string(bencode.Bytes(rawURL)); url != "" {
+				urls = append(urls, url)
+			}
+		}
+	default:
+		if url := string(bencode.Bytes(v)); url != "" {
+			urls = append(urls, url)
+		}
+	}
+
+	return urls
+}
@@ -0,0 +1,236 @@
+package torrent
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/nullxDEADBEEF/bittorrent/internal/bencode"
+	"github.com/nullxDEADBEEF/bittorrent/internal/merkle"
+)
+
+// BitTorrent v2 (BEP 52) info dictionaries have "meta version" 2 and describe the files
+// in a "file tree" instead of "length" or "files":
+//
+//	file tree => {dir => {file name => {"" => {length, pieces root}}}}
+//
+// Files are sorted by path and every file starts on a piece boundary. Each file is hashed
+// with its own SHA-256 merkle tree whose root is its "pieces root", and the top level
+// "piece layers" dictionary maps the root of every file larger than a piece to the
+// concatenated hashes of its piece layer. The info hash is the SHA-256 of the info
+// dictionary, truncated to 20 bytes where a v1 info hash is expected.
+//
+// Hybrid torrents carry both the v1 and v2 keys, describing the same data: the v1 file
+// list contains pad files so that v1 pieces line up with v2 files
+type V2File struct {
+	File
+	PiecesRoot merkle.Hash
+}
+
+// ErrMissingPieceLayer is returned by V2Pieces when the torrent does not have the piece
+// layer of a file, which is the case for torrents from magnet links until a peer gave it
+var ErrMissingPieceLayer = errors.New("missing piece layer")
+
+// V2Piece is what is needed to verify a v2 piece
+type V2Piece struct {
+	// Root is the hash of the subtree of the file tree covering the piece
+	Root merkle.Hash
+	// Length is the number of bytes of the piece that belong to the file, the rest of the
+	// piece is padding up to the start of the next file
+	Length int
+	// Leaves is the width of the subtree in blocks
+	Leaves int
+}
+
+// MetaVersion returns the "meta version" of an info dictionary, 1 when it is missing
+func MetaVersion(torrentInfo map[string]interface{}) int {
+	if version, ok := torrentInfo["meta version"].(int); ok {
+		return version
+	}
+	return 1
+}
+
+// HasV1 reports whether the info dictionary has the v1 piece hashes
+func HasV1(torrentInfo map[string]interface{}) bool {
+	_, ok := torrentInfo["pieces"]
+	return ok
+}
+
+// HasV2 reports whether the info dictionary describes its files as a v2 file tree
+func HasV2(torrentInfo map[string]interface{}) bool {
+	_, ok := torrentInfo["file tree"].(map[string]interface{})
+	return ok && MetaVersion(torrentInfo) == 2
+}
+
+// IsHybrid reports whether the torrent can be downloaded both as v1 and v2
+func IsHybrid(torrentInfo map[string]interface{}) bool {
+	return HasV1(torrentInfo) && HasV2(torrentInfo)
+}
+
+func (e *TorrentEncoder) CalculateSHA256Hash(bencodedInfo []byte) string {
+	hash := sha256.Sum256(bencodedInfo)
+	return hex.EncodeToString(hash[:])
+}
+
+// SwarmInfoHash returns the hex encoded 20 byte info hash used with trackers, the DHT and
+// in handshakes. Torrents with v1 hashes keep using the v1 info hash, so hybrid torrents
+// reach every peer, v2 only torrents use their truncated v2 info hash
+func SwarmInfoHash(torrentInfo map[string]interface{}) string {
+	encoder := NewTorrentEncoder()
+	bencodedInfo := encoder.EncodeTorrentInfo(torrentInfo)
+
+	if !HasV1(torrentInfo) && HasV2(torrentInfo) {
+		return encoder.CalculateSHA256Hash(bencodedInfo)[:40]
+	}
+	return encoder.CalculateSHA1Hash(bencodedInfo)
+}
+
+// FileTree returns the files of a v2 file tree in order
+func FileTree(torrentInfo map[string]interface{}) []V2File {
+	files := make([]V2File, 0)
+
+	tree, _ := torrentInfo["file tree"].(map[string]interface{})
+	walkFileTree(tree, nil, &files)
+
+	return files
+}
+
+func walkFileTree(node map[string]interface{}, path []string, files *[]V2File) {
+	names := make([]string, 0, len(node))
+	for name := range node {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		child, ok := node[name].(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		// a file is a dictionary with a single empty key holding its properties
+		if name == "" {
+			length, _ := child["length"].(int)
+			file := V2File{File: File{Path: path, Length: length}}
+			file.setAttributes(child)
+			copy(file.PiecesRoot[:], string(bencode.Bytes(child["pieces root"])))
+			*files = append(*files, file)
+			continue
+		}
+
+		childPath := make([]string, len(path), len(path)+1)
+		copy(childPath, path)
+		walkFileTree(child, append(childPath, name), files)
+	}
+}
+
+// v2Files returns the files of a v2 only torrent with pad files so that every file starts
+// on a piece boundary
+func v2Files(torrentInfo map[string]interface{}) []File {
+	pieceLength, _ := torrentInfo["piece length"].(int)
+	tree := FileTree(torrentInfo)
+
+	// a single file named after the torrent is a single file torrent
+	if len(tree) == 1 && len(tree[0].Path) == 1 && tree[0].Path[0] == Name(torrentInfo) {
+		file := tree[0].File
+		file.Path = nil
+		return []File{file}
+	}
+
+	files := make([]File, 0, 2*len(tree))
+	for i, file := range tree {
+		files = append(files, file.File)
+		if i == len(tree)-1 || pieceLength <= 0 {
+			continue
+		}
+		if padding := (pieceLength - file.Length%pieceLength) % pieceLength; padding > 0 {
+			files = append(files, File{Path: []string{".pad", fmt.Sprint(padding)}, Length: padding, Pad: true})
+		}
+	}
+
+	return files
+}
+
+// PieceLayers returns the piece layers of a v2 torrent by the pieces root of their file
+func PieceLayers(torrent map[string]interface{}) map[merkle.Hash][]merkle.Hash {
+	layers := make(map[merkle.Hash][]merkle.Hash)
+
+	rawLayers, _ := torrent["piece layers"].(map[string]interface{})
+	for rawRoot, rawLayer := range rawLayers {
+		var root merkle.Hash
+		if len(rawRoot) != merkle.HashSize {
+			continue
+		}
+		copy(root[:], rawRoot)
+
+		data := string(bencode.Bytes(rawLayer))
+		layer := make([]merkle.Hash, len(data)/merkle.HashSize)
+		for i := range layer {
+			copy(layer[i][:], data[i*merkle.HashSize:])
+		}
+		layers[root] = layer
+	}
+
+	return layers
+}
+
+// EncodePieceLayers returns piece layers as the "piece layers" dictionary of a metainfo
+// file
+func EncodePieceLayers(layers map[merkle.Hash][]merkle.Hash) map[string]interface{} {
+	rawLayers := make(map[string]interface{}, len(layers))
+	for root, layer := range layers {
+		data := make([]byte, 0, len(layer)*merkle.HashSize)
+		for _, h := range layer {
+			data = append(data, h[:]...)
+		}
+		rawLayers[string(root[:])] = data
+	}
+	return rawLayers
+}
+
+// V2Pieces returns the hashes verifying the pieces of a v2 torrent, in the piece order of
+// the padded layout. Piece layers are checked against the pieces root of their file
+func V2Pieces(torrent map[string]interface{}, torrentInfo map[string]interface{}) ([]V2Piece, error) {
+	pieceLength, _ := torrentInfo["piece length"].(int)
+	if pieceLength < merkle.BlockSize || pieceLength&(pieceLength-1) != 0 {
+		return nil, fmt.Errorf("invalid v2 piece length %d", pieceLength)
+	}
+	pieceLeaves := pieceLength / merkle.BlockSize
+
+	layers := PieceLayers(torrent)
+	pieces := make([]V2Piece, 0)
+
+	for _, file := range FileTree(torrentInfo) {
+		if file.Length == 0 {
+			continue
+		}
+
+		if file.Length <= pieceLength {
+			pieces = append(pieces, V2Piece{Root: file.PiecesRoot, Length: file.Length, Leaves: merkle.LeafCount(file.Length)})
+			continue
+		}
+
+		layer, ok := layers[file.PiecesRoot]
+		if !ok {
+			return nil, fmt.Errorf("%w for %v", ErrMissingPieceLayer, file.Path)
+		}
+		count := (file.Length + pieceLength - 1) / pieceLength
+		if len(layer) != count {
+			return nil, fmt.Errorf("invalid piece layer for %v", file.Path)
+		}
+
+		pad := merkle.ZeroHash(merkle.Log2(pieceLeaves))
+		if merkle.Root(layer, merkle.NextPowerOfTwo(count), pad) != file.PiecesRoot {
+			return nil, fmt.Errorf("piece layer of %v does not match its pieces root", file.Path)
+		}
+
+		for i, root := range layer {
+			length := min(pieceLength, file.Length-i*pieceLength)
+			pieces = append(pieces, V2Piece{Root: root, Length: length, Leaves: pieceLeaves})
+		}
+	}
+
+	return pieces, nil
+}
@@ -0,0 +1,171 @@
+package tracker
+
+import (
+	"context"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+const (
+	// used when a tracker does not tell us how often to announce
+	defaultAnnounceInterval = 30 * time.Minute
+	// failed announces are retried after this delay, doubled on every consecutive failure
+	announceRetryDelay    = 30 * time.Second
+	maxAnnounceRetryDelay = 30 * time.Minute
+)
+
+// Stats are the transfer counters reported to trackers, in bytes
+type Stats struct {
+	Uploaded   int64
+	Downloaded int64
+	Left       int64
+}
+
+// Announcer drives the announce lifecycle of a single torrent: a "started" announce when
+// the transfer begins, regular announces at the interval requested by the tracker while
+// it runs, "completed" once all pieces are downloaded and "stopped" when we leave the swarm
+type Announcer struct {
+	trackers *TrackerList
+	request  AnnounceRequest
+	stats    func() Stats
+
+	mu          sync.Mutex
+	interval    time.Duration
+	minInterval time.Duration
+	lastAttempt time.Time
+	failures    int
+	onAnnounce  func(event Event, resp *AnnounceResponse, err error)
+}
+
+// NewAnnouncer creates an announcer for the torrent with the given info hash. stats is
+// called before every announce to get up to date transfer counters
+func NewAnnouncer(trackers *TrackerList, infoHash, peerID [20]byte, port uint16, stats func() Stats) *Announcer {
+	return &Announcer{
+		trackers: trackers,
+		request: AnnounceRequest{
+			InfoHash: infoHash,
+			PeerID:   peerID,
+			Port:     port,
+			Key:      randomUint32(),
+		},
+		stats:    stats,
+		interval: defaultAnnounceInterval,
+	}
+}
+
+func (a *Announcer) Start(ctx context.Context) (*AnnounceResponse, error) {
+	return a.announce(ctx, EventStarted)
+}
+
+func (a *Announcer) Complete(ctx context.Context) (*AnnounceResponse, error) {
+	return a.announce(ctx, EventCompleted)
+}
+
+// Stop tells the trackers we left the swarm. It is usually sent while shutting down, so
+// callers should pass a context that is not already cancelled, bounded by a short timeout
+func (a *Announcer) Stop(ctx context.Context) error {
+	_, err := a.announce(ctx, EventStopped)
+	return err
+}
+
+// Run sends regular announces until ctx is cancelled, every set of peers received is
+// passed to onPeers
+func (a *Announcer) Run(ctx context.Context, onPeers func(peers []Peer)) {
+	for {
+		timer := time.NewTimer(a.nextDelay())
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		resp, err := a.announce(ctx, EventNone)
+		if err == nil && onPeers != nil {
+			onPeers(resp.Peers)
+		}
+	}
+}
+
+// SetIPv6 makes every following announce include addr as an IPv6 address we can be
+// reached on
+func (a *Announcer) SetIPv6(addr netip.Addr) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.request.IPv6 = addr
+}
+
+// OnAnnounce sets a function told about the result of every announce that was not
+// cancelled, the regular announces of Run included
+func (a *Announcer) OnAnnounce(fn func(event Event, resp *AnnounceResponse, err error)) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.onAnnounce = fn
+}
+
+// Trackers returns the tracker list the announcer sends its announces to
+func (a *Announcer) Trackers() *TrackerList {
+	return a.trackers
+}
+
+func (a *Announcer) announce(ctx context.Context, event Event) (*AnnounceResponse, error) {
+	a.mu.Lock()
+	req := a.request
+	a.mu.Unlock()
+
+	req.Event = event
+	if a.stats != nil {
+		stats := a.stats()
+		req.Uploaded = stats.Uploaded
+		req.Downloaded = stats.Downloaded
+		req.Left = stats.Left
+	}
+
+	resp, err := a.trackers.Announce(ctx, req)
+	// a tracker may have answered just before the cancellation, which is still reported
+	// as one
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+
+	a.mu.Lock()
+	a.lastAttempt = time.Now()
+	if err != nil {
+		a.failures++
+	} else {
+		a.failures = 0
+		a.interval = defaultAnnounceInterval
+		if resp.Interval > 0 {
+			a.interval = resp.Interval
+		}
+		a.minInterval = resp.MinInterval
+	}
+	onAnnounce := a.onAnnounce
+	a.mu.Unlock()
+
+	if onAnnounce != nil {
+		onAnnounce(event, resp, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// nextDelay returns how long to wait before the next regular announce, honoring the
+// interval and min interval of the last response or backing off after failures
+func (a *Announcer) nextDelay() time.Duration {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	delay := max(a.interval, a.minInterval)
+	if a.failures > 0 {
+		delay = min(announceRetryDelay<<min(a.failures-1, 10), maxAnnounceRetryDelay)
+		delay = max(delay, a.minInterval)
+	}
+
+	return max(time.Until(a.lastAttempt.Add(delay)), 0)
+}
@@ -0,0 +1,54 @@
+package tracker
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestAnnounceCancelledAfterResponse(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	trackers := NewTrackerList([][]string{{"http://tracker.example/announce"}})
+	// the tracker answers, but the announce was cancelled meanwhile
+	trackers.AnnounceFunc = func(context.Context, string, AnnounceRequest) (*AnnounceResponse, error) {
+		cancel()
+		return &AnnounceResponse{}, nil
+	}
+
+	announced := false
+	a := NewAnnouncer(trackers, [20]byte{}, [20]byte{}, 6881, nil)
+	a.OnAnnounce(func(Event, *AnnounceResponse, error) { announced = true })
+
+	resp, err := a.Start(ctx)
+	if resp != nil || !errors.Is(err, context.Canceled) {
+		t.Fatalf("got %v and %v, want context.Canceled", resp, err)
+	}
+	if announced {
+		t.Error("a cancelled announce was reported")
+	}
+
+	// Run must not pass on the peers of a cancelled announce
+	a.Run(ctx, func([]Peer) { t.Error("peers of a cancelled announce were passed on") })
+}
+
+func TestAnnounceFailure(t *testing.T) {
+	trackers := NewTrackerList([][]string{{"http://tracker.example/announce"}})
+	trackers.AnnounceFunc = func(context.Context, string, AnnounceRequest) (*AnnounceResponse, error) {
+		return nil, &FailureError{Reason: "unregistered torrent"}
+	}
+
+	var reported error
+	a := NewAnnouncer(trackers, [20]byte{}, [20]byte{}, 6881, nil)
+	a.OnAnnounce(func(_ Event, _ *AnnounceResponse, err error) { reported = err })
+
+	resp, err := a.Start(context.Background())
+	var failure *FailureError
+	if resp != nil || !errors.As(err, &failure) {
+		t.Fatalf("got %v and %v, want a FailureError", resp, err)
+	}
+	if reported == nil {
+		t.Error("the failed announce was not reported")
+	}
+}
@@ -0,0 +1,124 @@
+package tracker
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/nullxDEADBEEF/bittorrent/internal/bencode"
+)
+
+// HTTP trackers are queried with a GET request on the announce URL, the parameters are
+// sent in the query string and the response is a bencoded dictionary with keys
+//   - failure reason: if present no other key is, the announce was refused
+//   - warning message: the announce went through but the tracker wants us to know something
+//   - interval: seconds to wait between regular announces
+//   - min interval: if present we must not re-announce more often than this
+//   - tracker id: to be sent back on the next announces
+//   - complete / incomplete: number of seeders / leechers
+//   - peers / peers6: the peer lists
+func announceHTTP(ctx context.Context, trackerURL *url.URL, req AnnounceRequest) (*AnnounceResponse, error) {
+	query := fmt.Sprintf("info_hash=%s&peer_id=%s&port=%d&uploaded=%d&downloaded=%d&left=%d&compact=1",
+		url.QueryEscape(string(req.InfoHash[:])),
+		url.QueryEscape(string(req.PeerID[:])),
+		req.Port,
+		req.Uploaded,
+		req.Downloaded,
+		req.Left)
+
+	if req.Event != EventNone {
+		query += "&event=" + req.Event.String()
+	}
+	if req.NumWant != 0 {
+		query += "&numwant=" + strconv.Itoa(int(req.NumWant))
+	}
+	if req.Key != 0 {
+		query += "&key=" + strconv.FormatUint(uint64(req.Key), 16)
+	}
+	if req.IPv6.IsValid() {
+		query += "&ipv6=" + url.QueryEscape(req.IPv6.String())
+	}
+	if req.TrackerID != "" {
+		query += "&trackerid=" + url.QueryEscape(req.TrackerID)
+	}
+
+	dict, err := getBencodedDict(ctx, trackerURL, query)
+	if err != nil {
+		return nil, err
+	}
+
+	if reason, ok := dict["failure reason"]; ok {
+		return nil, &FailureError{Reason: string(bencode.Bytes(reason))}
+	}
+
+	peers, err := parsePeers(dict)
+	if err != nil {
+		return nil, err
+	}
+
+	return &AnnounceResponse{
+		Interval:    secondsValue(dict["interval"]),
+		MinInterval: secondsValue(dict["min interval"]),
+		Seeders:     intValue(dict["complete"]),
+		Leechers:    intValue(dict["incomplete"]),
+		Peers:       peers,
+		Warning:     string(bencode.Bytes(dict["warning message"])),
+		TrackerID:   string(bencode.Bytes(dict["tracker id"])),
+	}, nil
+}
+
+// getBencodedDict sends a GET request with the given query appended to the URL and
+// decodes the bencoded dictionary in the response body
+func getBencodedDict(ctx context.Context, trackerURL *url.URL, query string) (map[string]interface{}, error) {
+	requestURL := *trackerURL
+	if requestURL.RawQuery != "" {
+		requestURL.RawQuery += "&" + query
+	} else {
+		requestURL.RawQuery = query
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodGet, requestURL.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK && len(body) == 0 {
+		return nil, fmt.Errorf("tracker responded with %s", resp.Status)
+	}
+
+	decoder := bencode.NewBencodeDecoder(body)
+	decoded, err := decoder.Decode()
+	if err != nil {
+		return nil, fmt.Errorf("invalid tracker response (%s): %w", resp.Status, err)
+	}
+
+	dict, ok := decoded.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("expected dictionary in tracker response, got %T", decoded)
+	}
+
+	return dict, nil
+}
+
+func intValue(value interface{}) int {
+	v, _ := value.(int)
+	return v
+}
+
+func secondsValue(value interface{}) time.Duration {
+	return time.Duration(intValue(value)) * time.Second
+}
@@ -0,0 +1,146 @@
+package tracker
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/netip"
+
+	"github.com/nullxDEADBEEF/bittorrent/internal/bencode"
+)
+
+const (
+	compactIPv4PeerSize = 6
+	compactIPv6PeerSize = 18
+)
+
+// Peer is a peer address handed out by a tracker
+type Peer struct {
+	Addr netip.AddrPort
+	// ID is only known when the tracker sent a non-compact peer list
+	ID []byte
+}
+
+func (p Peer) String() string {
+	return p.Addr.String()
+}
+
+// trackers send peers in one of three forms:
+//   - "peers" as a string of compact IPv4 entries (BEP 23)
+//   - "peers" as a list of dictionaries with "peer id", "ip" and "port" keys (BEP 3)
+//   - "peers6" as a string of compact IPv6 entries (BEP 7)
+func parsePeers(dict map[string]interface{}) ([]Peer, error) {
+	peers := make([]Peer, 0)
+
+	switch rawPeers := dict["peers"].(type) {
+	case nil:
+	case []interface{}:
+		peers = append(peers, parseDictionaryPeers(rawPeers)...)
+	default:
+		compactPeers, err := parseCompactPeers(bencode.Bytes(rawPeers), compactIPv4PeerSize)
+		if err != nil {
+			return nil, err
+		}
+		peers = append(peers, compactPeers...)
+	}
+
+	if rawPeers6, ok := dict["peers6"]; ok {
+		compactPeers, err := parseCompactPeers(bencode.Bytes(rawPeers6), compactIPv6PeerSize)
+		if err != nil {
+			return nil, err
+		}
+		peers = append(peers, compactPeers...)
+	}
+
+	return peers, nil
+}
+
+// compact peer lists are a concatenation of <ip><port> entries, where ip is 4 bytes for
+// IPv4 and 16 bytes for IPv6 and port is 2 bytes, all in network byte order
+func parseCompactPeers(peersBytes []byte, entrySize int) ([]Peer, error) {
+	if len(peersBytes)%entrySize != 0 {
+		return nil, fmt.Errorf("invalid compact peer list: length %d is not a multiple of %d", len(peersBytes), entrySize)
+	}
+
+	peers := make([]Peer, 0, len(peersBytes)/entrySize)
+	ipSize := entrySize - 2
+	for i := 0; i < len(peersBytes); i += entrySize {
+		ip, _ := netip.AddrFromSlice(peersBytes[i : i+ipSize])
+		port := binary.BigEndian.Uint16(peersBytes[i+ipSize : i+entrySize])
+		if peer, ok := newPeer(ip, port, nil); ok {
+			peers = append(peers, peer)
+		}
+	}
+
+	return peers, nil
+}
+
+// entries whose ip is not an address literal (the spec also allows DNS names) or that
+// are otherwise malformed are skipped rather than failing the whole list
+func parseDictionaryPeers(rawPeers []interface{}) []Peer {
+	peers := make([]Peer, 0, len(rawPeers))
+	for _, rawPeer := range rawPeers {
+		peerDict, ok := rawPeer.(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		ip, err := netip.ParseAddr(string(bencode.Bytes(peerDict["ip"])))
+		if err != nil {
+			continue
+		}
+
+		port := intValue(peerDict["port"])
+		if port <= 0 || port > 65535 {
+			continue
+		}
+
+		peerID := bencode.Bytes(peerDict["peer id"])
+		if len(peerID) != 20 {
+			peerID = nil
+		}
+
+		if peer, ok := newPeer(ip, uint16(port), peerID); ok {
+			peers = append(peers, peer)
+		}
+	}
+
+	return peers
+}
+
+func newPeer(ip netip.Addr, port uint16, peerID []byte) (Peer, bool) {
+	// IPv4 addresses sent as IPv4-mapped IPv6 addresses are turned back into plain IPv4
+	ip = ip.Unmap()
+	if !ip.IsValid() || ip.IsUnspecified() || ip.IsMulticast() || port == 0 {
+		return Peer{}, false
+	}
+
+	return Peer{Addr: netip.AddrPortFrom(ip, port), ID: peerID}, true
+}
+
+// LocalIPv6 returns a global unicast IPv6 address of this machine, if it has one, so it
+// can be announced to trackers along with the address they see us connecting from
+func LocalIPv6() (netip.Addr, bool) {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return netip.Addr{}, false
+	}
+
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+
+		ip, ok := netip.AddrFromSlice(ipNet.IP)
+		if !ok || ip.Is4() || ip.Is4In6() {
+			continue
+		}
+
+		if ip.IsGlobalUnicast() && !ip.IsPrivate() {
+			return ip, true
+		}
+	}
+
+	return netip.Addr{}, false
+}
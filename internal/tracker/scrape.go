@@ -0,0 +1,129 @@
+package tracker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/nullxDEADBEEF/bittorrent/internal/bencode"
+)
+
+// ErrScrapeNotSupported is returned for HTTP trackers whose announce URL does not follow
+// the scrape convention
+var ErrScrapeNotSupported = errors.New("tracker does not support scrape")
+
+// how many info hashes we put in a single HTTP scrape request, keeps the URL reasonably short
+const httpMaxScrapeHashes = 50
+
+// ScrapeURL derives the scrape URL of an HTTP tracker from its announce URL. By convention
+// the last path component has to start with "announce", which is replaced by "scrape":
+//
+//	http://example.com/announce          -> http://example.com/scrape
+//	http://example.com/x/announce.php?a  -> http://example.com/x/scrape.php?a
+//	http://example.com/a                 -> scrape not supported
+func ScrapeURL(announceURL string) (string, error) {
+	trackerURL, err := url.Parse(announceURL)
+	if err != nil {
+		return "", fmt.Errorf("invalid announce URL: %w", err)
+	}
+
+	slash := strings.LastIndex(trackerURL.Path, "/")
+	lastComponent := trackerURL.Path[slash+1:]
+	if !strings.HasPrefix(lastComponent, "announce") {
+		return "", ErrScrapeNotSupported
+	}
+
+	trackerURL.Path = trackerURL.Path[:slash+1] + "scrape" + strings.TrimPrefix(lastComponent, "announce")
+	return trackerURL.String(), nil
+}
+
+// Scrape asks a tracker for the swarm statistics of the given info hashes, batching them
+// in as few requests as possible. The protocol is selected by the scheme of the announce URL
+func Scrape(ctx context.Context, announceURL string, infoHashes [][20]byte) ([]ScrapeResult, error) {
+	trackerURL, err := url.Parse(announceURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid announce URL: %w", err)
+	}
+
+	switch trackerURL.Scheme {
+	case "http", "https":
+		return scrapeHTTP(ctx, announceURL, infoHashes)
+	case "udp":
+		return DefaultUDPClient.Scrape(ctx, trackerURL, infoHashes)
+	default:
+		return nil, fmt.Errorf("unsupported tracker scheme: %q", trackerURL.Scheme)
+	}
+}
+
+// HTTP scrape responses are a bencoded dictionary whose "files" key maps every raw info
+// hash to a dictionary with complete, incomplete and downloaded counts
+func scrapeHTTP(ctx context.Context, announceURL string, infoHashes [][20]byte) ([]ScrapeResult, error) {
+	scrapeURL, err := ScrapeURL(announceURL)
+	if err != nil {
+		return nil, err
+	}
+
+	trackerURL, err := url.Parse(scrapeURL)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]ScrapeResult, 0, len(infoHashes))
+	for start := 0; start < len(infoHashes); start += httpMaxScrapeHashes {
+		batch := infoHashes[start:min(start+httpMaxScrapeHashes, len(infoHashes))]
+
+		params := make([]string, 0, len(batch))
+		for _, infoHash := range batch {
+			params = append(params, "info_hash="+url.QueryEscape(string(infoHash[:])))
+		}
+
+		dict, err := getBencodedDict(ctx, trackerURL, strings.Join(params, "&"))
+		if err != nil {
+			return nil, err
+		}
+
+		if reason, ok := dict["failure reason"]; ok {
+			return nil, &FailureError{Reason: string(bencode.Bytes(reason))}
+		}
+
+		files, _ := dict["files"].(map[string]interface{})
+		for _, infoHash := range batch {
+			file, _ := files[string(infoHash[:])].(map[string]interface{})
+			results = append(results, ScrapeResult{
+				InfoHash:   infoHash,
+				Complete:   intValue(file["complete"]),
+				Incomplete: intValue(file["incomplete"]),
+				Downloaded: intValue(file["downloaded"]),
+			})
+		}
+	}
+
+	return results, nil
+}
+
+// Scrape walks the tiers like Announce and returns the statistics of the first tracker
+// that answers, along with its URL
+func (l *TrackerList) Scrape(ctx context.Context, infoHashes [][20]byte) (string, []ScrapeResult, error) {
+	lastErr := ErrNoTrackers
+
+	for _, tier := range l.snapshot() {
+		for _, announceURL := range tier {
+			trackerCtx, cancel := context.WithTimeout(ctx, l.timeout())
+			results, err := Scrape(trackerCtx, announceURL, infoHashes)
+			cancel()
+			if ctx.Err() != nil {
+				return "", nil, ctx.Err()
+			}
+			if err != nil {
+				lastErr = fmt.Errorf("%s: %w", announceURL, err)
+				continue
+			}
+
+			return announceURL, results, nil
+		}
+	}
+
+	return "", nil, lastErr
+}
@@ -0,0 +1,188 @@
+package tracker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// ErrNoTrackers is returned when announcing on a list that does not contain any tracker
+var ErrNoTrackers = errors.New("no trackers to announce to")
+
+// DefaultTimeout bounds a single announce or scrape when the list has no Timeout, a
+// tracker that does not answer in time is skipped for the next one
+const DefaultTimeout = 30 * time.Second
+
+// TrackerStatus describes the outcome of the last announce sent to a tracker
+type TrackerStatus struct {
+	URL          string
+	Tier         int
+	LastAnnounce time.Time
+	// LastError is empty when the last announce succeeded
+	LastError string
+	// Warning is the last warning message the tracker sent along with a response
+	Warning  string
+	Seeders  int
+	Leechers int
+	Peers    int
+	// NextAnnounce is the earliest time the tracker allows us to announce again
+	NextAnnounce time.Time
+
+	trackerID string
+}
+
+func (s TrackerStatus) Working() bool {
+	return !s.LastAnnounce.IsZero() && s.LastError == ""
+}
+
+// TrackerList implements the multitracker metadata extension (BEP 12). Trackers are
+// grouped in tiers that are tried in order, trackers within a tier are shuffled once and
+// a tracker that answers is moved to the front of its tier so it is tried first next time.
+// Only when every tracker of a tier fails do we fall back to the next tier
+type TrackerList struct {
+	// AnnounceFunc sends a single announce, it defaults to Announce
+	AnnounceFunc func(ctx context.Context, announceURL string, req AnnounceRequest) (*AnnounceResponse, error)
+	// Timeout bounds every announce and scrape sent to a single tracker, DefaultTimeout
+	// is used when it is zero
+	Timeout time.Duration
+
+	mu     sync.Mutex
+	tiers  [][]string
+	status map[string]*TrackerStatus
+}
+
+func NewTrackerList(tiers [][]string) *TrackerList {
+	list := &TrackerList{
+		AnnounceFunc: Announce,
+		tiers:        make([][]string, 0, len(tiers)),
+		status:       make(map[string]*TrackerStatus),
+	}
+
+	for i, tier := range tiers {
+		shuffled := make([]string, 0, len(tier))
+		for _, announceURL := range tier {
+			if _, seen := list.status[announceURL]; seen {
+				continue
+			}
+			shuffled = append(shuffled, announceURL)
+			list.status[announceURL] = &TrackerStatus{URL: announceURL, Tier: i}
+		}
+		rand.Shuffle(len(shuffled), func(a, b int) {
+			shuffled[a], shuffled[b] = shuffled[b], shuffled[a]
+		})
+		list.tiers = append(list.tiers, shuffled)
+	}
+
+	return list
+}
+
+// Announce walks the tiers until one tracker answers and returns its response. The error
+// of every failed tracker is recorded in its status and the last one is returned if no
+// tracker answered at all. Cancelling ctx stops the walk and returns its error
+func (l *TrackerList) Announce(ctx context.Context, req AnnounceRequest) (*AnnounceResponse, error) {
+	lastErr := ErrNoTrackers
+
+	for tierIndex, tier := range l.snapshot() {
+		for _, announceURL := range tier {
+			req.TrackerID = l.trackerID(announceURL)
+			trackerCtx, cancel := context.WithTimeout(ctx, l.timeout())
+			resp, err := l.AnnounceFunc(trackerCtx, announceURL, req)
+			cancel()
+			if ctx.Err() != nil {
+				// the tracker did nothing wrong, leave its status alone
+				return nil, ctx.Err()
+			}
+			l.record(announceURL, resp, err)
+			if err != nil {
+				lastErr = fmt.Errorf("%s: %w", announceURL, err)
+				continue
+			}
+
+			l.promote(tierIndex, announceURL)
+			return resp, nil
+		}
+	}
+
+	return nil, lastErr
+}
+
+// Status returns the status of every tracker in the order they will be tried
+func (l *TrackerList) Status() []TrackerStatus {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	statuses := make([]TrackerStatus, 0, len(l.status))
+	for _, tier := range l.tiers {
+		for _, announceURL := range tier {
+			statuses = append(statuses, *l.status[announceURL])
+		}
+	}
+
+	return statuses
+}
+
+func (l *TrackerList) timeout() time.Duration {
+	if l.Timeout <= 0 {
+		return DefaultTimeout
+	}
+	return l.Timeout
+}
+
+func (l *TrackerList) snapshot() [][]string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	tiers := make([][]string, len(l.tiers))
+	for i, tier := range l.tiers {
+		tiers[i] = append([]string(nil), tier...)
+	}
+
+	return tiers
+}
+
+func (l *TrackerList) record(announceURL string, resp *AnnounceResponse, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	status := l.status[announceURL]
+	status.LastAnnounce = time.Now()
+	if err != nil {
+		status.LastError = err.Error()
+		return
+	}
+
+	status.LastError = ""
+	status.Warning = resp.Warning
+	status.Seeders = resp.Seeders
+	status.Leechers = resp.Leechers
+	status.Peers = len(resp.Peers)
+	status.NextAnnounce = status.LastAnnounce.Add(resp.MinInterval)
+	if resp.TrackerID != "" {
+		status.trackerID = resp.TrackerID
+	}
+}
+
+func (l *TrackerList) trackerID(announceURL string) string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.status[announceURL].trackerID
+}
+
+// promote moves a tracker that answered to the front of its tier
+func (l *TrackerList) promote(tierIndex int, announceURL string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	tier := l.tiers[tierIndex]
+	for i, candidate := range tier {
+		if candidate == announceURL {
+			copy(tier[1:i+1], tier[:i])
+			tier[0] = announceURL
+			return
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package tracker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"net/url"
+	"time"
+)
+
+// Event tells the tracker why an announce is being sent. The numeric values match the
+// ones used on the wire by the UDP tracker protocol (BEP 15)
+type Event int
+
+const (
+	EventNone Event = iota
+	EventCompleted
+	EventStarted
+	EventStopped
+)
+
+func (e Event) String() string {
+	switch e {
+	case EventCompleted:
+		return "completed"
+	case EventStarted:
+		return "started"
+	case EventStopped:
+		return "stopped"
+	default:
+		return ""
+	}
+}
+
+// AnnounceRequest holds everything a tracker needs to know about us and our transfer
+type AnnounceRequest struct {
+	InfoHash   [20]byte
+	PeerID     [20]byte
+	Port       uint16
+	Uploaded   int64
+	Downloaded int64
+	Left       int64
+	Event      Event
+	// NumWant is the number of peers we would like to receive, -1 lets the tracker decide
+	NumWant int32
+	Key     uint32
+	// IPv6, when valid, is announced as an additional address we can be reached on (BEP 7)
+	IPv6 netip.Addr
+	// TrackerID is the "tracker id" a tracker sent in an earlier response, it has to be
+	// echoed back on subsequent announces to the same tracker
+	TrackerID string
+}
+
+// AnnounceResponse is what the tracker sends back after an announce
+type AnnounceResponse struct {
+	// Interval is how long we should wait before announcing again
+	Interval time.Duration
+	// MinInterval, when set, is the shortest allowed time between announces
+	MinInterval time.Duration
+	Leechers    int
+	Seeders     int
+	Peers       []Peer
+	// Warning is a message the tracker wants us to see even though the announce succeeded
+	Warning   string
+	TrackerID string
+}
+
+// ErrTrackerFailure is wrapped by the FailureError of a tracker that refused a request
+var ErrTrackerFailure = errors.New("tracker failure")
+
+// FailureError is returned when a tracker refuses a request, Reason is the human readable
+// message sent by the tracker
+type FailureError struct {
+	Reason string
+}
+
+func (e *FailureError) Error() string {
+	return "tracker failure: " + e.Reason
+}
+
+func (e *FailureError) Unwrap() error {
+	return ErrTrackerFailure
+}
+
+// ScrapeResult holds swarm statistics for a single info hash
+type ScrapeResult struct {
+	InfoHash   [20]byte
+	Complete   int
+	Incomplete int
+	Downloaded int
+}
+
+// Announce sends an announce to a single tracker, the protocol is selected by the scheme
+// of the announce URL. Cancelling ctx aborts the announce
+func Announce(ctx context.Context, announceURL string, req AnnounceRequest) (*AnnounceResponse, error) {
+	trackerURL, err := url.Parse(announceURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid announce URL: %w", err)
+	}
+
+	switch trackerURL.Scheme {
+	case "http", "https":
+		return announceHTTP(ctx, trackerURL, req)
+	case "udp":
+		return DefaultUDPClient.Announce(ctx, trackerURL, req)
+	default:
+		return nil, fmt.Errorf("unsupported tracker scheme: %q", trackerURL.Scheme)
+	}
+}
@@ -0,0 +1,336 @@
+package tracker
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// UDP trackers (BEP 15) avoid the overhead of HTTP by exchanging small binary packets.
+// Every exchange starts with a connect request that hands us a connection ID, which is
+// then echoed in announce and scrape requests to prove we are not spoofing our address.
+//
+// All integers are big endian, packets look like this:
+//
+//	connect request:   protocol_id(8) action(4) transaction_id(4)
+//	connect response:  action(4) transaction_id(4) connection_id(8)
+//	announce request:  connection_id(8) action(4) transaction_id(4) info_hash(20) peer_id(20)
+//	                   downloaded(8) left(8) uploaded(8) event(4) ip(4) key(4) num_want(4) port(2)
+//	announce response: action(4) transaction_id(4) interval(4) leechers(4) seeders(4) <peers>
+//	scrape request:    connection_id(8) action(4) transaction_id(4) info_hash(20)...
+//	scrape response:   action(4) transaction_id(4) (seeders(4) completed(4) leechers(4))...
+//	error response:    action(4) transaction_id(4) message
+const (
+	udpProtocolID uint64 = 0x41727101980
+
+	actionConnect  uint32 = 0
+	actionAnnounce uint32 = 1
+	actionScrape   uint32 = 2
+	actionError    uint32 = 3
+)
+
+const (
+	udpHeaderSize           = 16
+	udpResponseHeaderSize   = 8
+	udpAnnounceRequestSize  = 98
+	udpAnnounceResponseSize = 20
+	udpScrapeEntrySize      = 12
+	udpMaxPacketSize        = 2048
+
+	// a connection ID may be used until one minute after it was received
+	udpConnectionIDTTL = time.Minute
+	// a single scrape request can carry at most 74 info hashes
+	udpMaxScrapeHashes = 74
+)
+
+var errUDPTimeout = errors.New("udp tracker request timed out")
+
+// DefaultUDPClient is shared by callers that do not need their own client so that
+// connection IDs are reused across announces to the same tracker
+var DefaultUDPClient = NewUDPClient()
+
+type UDPClient struct {
+	// BaseTimeout is how long we wait for the first response, every retransmission
+	// doubles it (15 * 2^n seconds in the spec)
+	BaseTimeout time.Duration
+	// MaxRetransmits bounds n in the backoff above, the spec stops at 8 (3840 seconds)
+	MaxRetransmits int
+
+	key         uint32
+	mu          sync.Mutex
+	connections map[string]udpConnection
+}
+
+type udpConnection struct {
+	id       uint64
+	obtained time.Time
+}
+
+func NewUDPClient() *UDPClient {
+	return &UDPClient{
+		BaseTimeout:    15 * time.Second,
+		MaxRetransmits: 8,
+		key:            randomUint32(),
+		connections:    make(map[string]udpConnection),
+	}
+}
+
+func (c *UDPClient) Announce(ctx context.Context, trackerURL *url.URL, req AnnounceRequest) (*AnnounceResponse, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "udp", trackerURL.Host)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial tracker: %w", err)
+	}
+	defer conn.Close()
+
+	key := req.Key
+	if key == 0 {
+		key = c.key
+	}
+
+	numWant := req.NumWant
+	if numWant == 0 {
+		numWant = -1
+	}
+
+	body := make([]byte, udpAnnounceRequestSize-udpHeaderSize)
+	copy(body[0:20], req.InfoHash[:])
+	copy(body[20:40], req.PeerID[:])
+	binary.BigEndian.PutUint64(body[40:48], uint64(req.Downloaded))
+	binary.BigEndian.PutUint64(body[48:56], uint64(req.Left))
+	binary.BigEndian.PutUint64(body[56:64], uint64(req.Uploaded))
+	binary.BigEndian.PutUint32(body[64:68], uint32(req.Event))
+	// ip is left as 0 so the tracker uses the source address of the packet
+	binary.BigEndian.PutUint32(body[72:76], key)
+	binary.BigEndian.PutUint32(body[76:80], uint32(numWant))
+	binary.BigEndian.PutUint16(body[80:82], req.Port)
+
+	resp, err := c.roundTrip(ctx, conn, trackerURL.Host, actionAnnounce, body)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(resp) < udpAnnounceResponseSize-udpResponseHeaderSize {
+		return nil, fmt.Errorf("announce response too short: %d bytes", len(resp))
+	}
+
+	// the size of peer entries depends on the address family we talk to the tracker over
+	peerSize := compactIPv4PeerSize
+	if addr, ok := conn.RemoteAddr().(*net.UDPAddr); ok && addr.IP.To4() == nil {
+		peerSize = compactIPv6PeerSize
+	}
+
+	peers, err := parseCompactPeers(resp[12:], peerSize)
+	if err != nil {
+		return nil, err
+	}
+
+	return &AnnounceResponse{
+		Interval: time.Duration(binary.BigEndian.Uint32(resp[0:4])) * time.Second,
+		Leechers: int(binary.BigEndian.Uint32(resp[4:8])),
+		Seeders:  int(binary.BigEndian.Uint32(resp[8:12])),
+		Peers:    peers,
+	}, nil
+}
+
+func (c *UDPClient) Scrape(ctx context.Context, trackerURL *url.URL, infoHashes [][20]byte) ([]ScrapeResult, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "udp", trackerURL.Host)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial tracker: %w", err)
+	}
+	defer conn.Close()
+
+	results := make([]ScrapeResult, 0, len(infoHashes))
+	for start := 0; start < len(infoHashes); start += udpMaxScrapeHashes {
+		end := min(start+udpMaxScrapeHashes, len(infoHashes))
+		batch := infoHashes[start:end]
+
+		body := make([]byte, 0, len(batch)*20)
+		for _, infoHash := range batch {
+			body = append(body, infoHash[:]...)
+		}
+
+		resp, err := c.roundTrip(ctx, conn, trackerURL.Host, actionScrape, body)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(resp) < len(batch)*udpScrapeEntrySize {
+			return nil, fmt.Errorf("scrape response too short: %d bytes for %d info hashes", len(resp), len(batch))
+		}
+
+		for i, infoHash := range batch {
+			entry := resp[i*udpScrapeEntrySize:]
+			results = append(results, ScrapeResult{
+				InfoHash:   infoHash,
+				Complete:   int(binary.BigEndian.Uint32(entry[0:4])),
+				Downloaded: int(binary.BigEndian.Uint32(entry[4:8])),
+				Incomplete: int(binary.BigEndian.Uint32(entry[8:12])),
+			})
+		}
+	}
+
+	return results, nil
+}
+
+// roundTrip sends a request with the given action, connecting first if we have no valid
+// connection ID for the tracker, and retransmits with exponential backoff on timeouts.
+// It returns the response payload after the action and transaction ID, or the error of ctx
+// as soon as it is cancelled
+func (c *UDPClient) roundTrip(ctx context.Context, conn net.Conn, host string, action uint32, body []byte) ([]byte, error) {
+	// reads only time out on their deadline, cancelling ctx moves it to now
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetReadDeadline(time.Now())
+	})
+	defer stop()
+
+	for n := 0; n <= c.MaxRetransmits; n++ {
+		timeout := c.BaseTimeout << n
+
+		connectionID, ok := c.cachedConnectionID(host)
+		if !ok {
+			var err error
+			connectionID, err = c.connect(ctx, conn, timeout)
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			if errors.Is(err, errUDPTimeout) {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			c.storeConnectionID(host, connectionID)
+		}
+
+		transactionID := randomUint32()
+		packet := make([]byte, udpHeaderSize, udpHeaderSize+len(body))
+		binary.BigEndian.PutUint64(packet[0:8], connectionID)
+		binary.BigEndian.PutUint32(packet[8:12], action)
+		binary.BigEndian.PutUint32(packet[12:16], transactionID)
+		packet = append(packet, body...)
+
+		resp, err := c.exchange(ctx, conn, packet, action, transactionID, timeout)
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if errors.Is(err, errUDPTimeout) {
+			continue
+		}
+		if err != nil {
+			// the tracker may have rejected our connection ID, get a fresh one next time
+			c.forgetConnectionID(host)
+			return nil, err
+		}
+
+		return resp, nil
+	}
+
+	return nil, fmt.Errorf("tracker did not respond after %d retransmissions: %w", c.MaxRetransmits, errUDPTimeout)
+}
+
+func (c *UDPClient) connect(ctx context.Context, conn net.Conn, timeout time.Duration) (uint64, error) {
+	transactionID := randomUint32()
+	packet := make([]byte, udpHeaderSize)
+	binary.BigEndian.PutUint64(packet[0:8], udpProtocolID)
+	binary.BigEndian.PutUint32(packet[8:12], actionConnect)
+	binary.BigEndian.PutUint32(packet[12:16], transactionID)
+
+	resp, err := c.exchange(ctx, conn, packet, actionConnect, transactionID, timeout)
+	if err != nil {
+		return 0, err
+	}
+
+	if len(resp) < 8 {
+		return 0, fmt.Errorf("connect response too short: %d bytes", len(resp))
+	}
+
+	return binary.BigEndian.Uint64(resp[0:8]), nil
+}
+
+// exchange writes a packet and waits for the response carrying the same transaction ID,
+// packets belonging to other transactions (e.g. late answers to earlier attempts) are dropped.
+// The wait never outlasts the deadline of ctx
+func (c *UDPClient) exchange(ctx context.Context, conn net.Conn, packet []byte, action, transactionID uint32, timeout time.Duration) ([]byte, error) {
+	if _, err := conn.Write(packet); err != nil {
+		return nil, fmt.Errorf("failed to send request: %w", err)
+	}
+
+	deadline := time.Now().Add(timeout)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+	if err := conn.SetReadDeadline(deadline); err != nil {
+		return nil, err
+	}
+	// a cancellation that came before the deadline was set would be overwritten by it
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+
+	buf := make([]byte, udpMaxPacketSize)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				return nil, errUDPTimeout
+			}
+			return nil, fmt.Errorf("failed to read response: %w", err)
+		}
+
+		if n < udpResponseHeaderSize || binary.BigEndian.Uint32(buf[4:8]) != transactionID {
+			continue
+		}
+
+		switch respAction := binary.BigEndian.Uint32(buf[0:4]); respAction {
+		case action:
+			resp := make([]byte, n-udpResponseHeaderSize)
+			copy(resp, buf[udpResponseHeaderSize:n])
+			return resp, nil
+		case actionError:
+			return nil, &FailureError{Reason: string(buf[udpResponseHeaderSize:n])}
+		default:
+			return nil, fmt.Errorf("unexpected action in response: %d", respAction)
+		}
+	}
+}
+
+func (c *UDPClient) cachedConnectionID(host string) (uint64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	connection, ok := c.connections[host]
+	if !ok || time.Since(connection.obtained) >= udpConnectionIDTTL {
+		return 0, false
+	}
+
+	return connection.id, true
+}
+
+func (c *UDPClient) storeConnectionID(host string, id uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.connections[host] = udpConnection{id: id, obtained: time.Now()}
+}
+
+func (c *UDPClient) forgetConnectionID(host string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.connections, host)
+}
+
+func randomUint32() uint32 {
+	buf := make([]byte, 4)
+	rand.Read(buf)
+	return binary.BigEndian.Uint32(buf)
+}
@@ -0,0 +1,343 @@
+package tracker
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/netip"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeUDPTracker answers BEP 15 requests on loopback
+type fakeUDPTracker struct {
+	t    *testing.T
+	conn *net.UDPConn
+	// peers are returned by announces, packed for the address family of the tracker
+	peers []netip.AddrPort
+
+	mu sync.Mutex
+	// drop is how many of the next packets are ignored, to make the client retransmit
+	drop     int
+	connects int
+	// connectionIDs are the connection ids announces and scrapes came with
+	connectionIDs []uint64
+	nextID        uint64
+	issued        map[uint64]bool
+}
+
+func newFakeUDPTracker(t *testing.T, network, addr string, peers ...netip.AddrPort) *fakeUDPTracker {
+	t.Helper()
+
+	udpAddr, err := net.ResolveUDPAddr(network, addr)
+	if err != nil {
+		t.Skipf("no %s loopback: %v", network, err)
+	}
+	conn, err := net.ListenUDP(network, udpAddr)
+	if err != nil {
+		t.Skipf("no %s loopback: %v", network, err)
+	}
+
+	f := &fakeUDPTracker{t: t, conn: conn, peers: peers, nextID: 0x1000, issued: make(map[uint64]bool)}
+	t.Cleanup(func() { conn.Close() })
+	go f.serve()
+	return f
+}
+
+func (f *fakeUDPTracker) url() *url.URL {
+	return &url.URL{Scheme: "udp", Host: f.conn.LocalAddr().String()}
+}
+
+func (f *fakeUDPTracker) serve() {
+	buf := make([]byte, udpMaxPacketSize)
+	for {
+		n, from, err := f.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		if resp := f.handle(buf[:n]); resp != nil {
+			f.conn.WriteToUDP(resp, from)
+		}
+	}
+}
+
+func (f *fakeUDPTracker) handle(packet []byte) []byte {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.drop > 0 {
+		f.drop--
+		return nil
+	}
+	if len(packet) < udpHeaderSize {
+		return nil
+	}
+
+	connectionID := binary.BigEndian.Uint64(packet[0:8])
+	action := binary.BigEndian.Uint32(packet[8:12])
+	transactionID := binary.BigEndian.Uint32(packet[12:16])
+
+	resp := binary.BigEndian.AppendUint32(nil, action)
+	resp = binary.BigEndian.AppendUint32(resp, transactionID)
+
+	if action == actionConnect {
+		if connectionID != udpProtocolID {
+			return nil
+		}
+		f.connects++
+		f.nextID++
+		f.issued[f.nextID] = true
+		return binary.BigEndian.AppendUint64(resp, f.nextID)
+	}
+
+	f.connectionIDs = append(f.connectionIDs, connectionID)
+	if !f.issued[connectionID] {
+		resp = binary.BigEndian.AppendUint32(nil, actionError)
+		resp = binary.BigEndian.AppendUint32(resp, transactionID)
+		return append(resp, "unknown connection id"...)
+	}
+
+	switch action {
+	case actionAnnounce:
+		resp = binary.BigEndian.AppendUint32(resp, 1800)
+		resp = binary.BigEndian.AppendUint32(resp, 3)
+		resp = binary.BigEndian.AppendUint32(resp, 7)
+		for _, peer := range f.peers {
+			resp = append(resp, peer.Addr().AsSlice()...)
+			resp = binary.BigEndian.AppendUint16(resp, peer.Port())
+		}
+	case actionScrape:
+		hashes := (len(packet) - udpHeaderSize) / 20
+		for i := 0; i < hashes; i++ {
+			// seeders, completed and leechers tell the info hashes apart
+			resp = binary.BigEndian.AppendUint32(resp, uint32(i+1))
+			resp = binary.BigEndian.AppendUint32(resp, uint32(i+100))
+			resp = binary.BigEndian.AppendUint32(resp, uint32(i+10))
+		}
+	}
+	return resp
+}
+
+// dropNext makes the tracker ignore the next n packets
+func (f *fakeUDPTracker) dropNext(n int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.drop = n
+}
+
+func (f *fakeUDPTracker) stats() (int, []uint64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.connects, append([]uint64(nil), f.connectionIDs...)
+}
+
+func testUDPClient() *UDPClient {
+	c := NewUDPClient()
+	c.BaseTimeout = 50 * time.Millisecond
+	c.MaxRetransmits = 3
+	return c
+}
+
+func testContext(t *testing.T) context.Context {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	t.Cleanup(cancel)
+	return ctx
+}
+
+func TestUDPAnnounce(t *testing.T) {
+	f := newFakeUDPTracker(t, "udp4", "127.0.0.1:0",
+		netip.MustParseAddrPort("10.0.0.1:6881"),
+		netip.MustParseAddrPort("192.168.1.2:51413"),
+	)
+
+	resp, err := testUDPClient().Announce(testContext(t), f.url(), AnnounceRequest{Port: 6881, Left: 100})
+	if err != nil {
+		t.Fatalf("announce failed: %v", err)
+	}
+
+	if resp.Interval != 1800*time.Second || resp.Leechers != 3 || resp.Seeders != 7 {
+		t.Errorf("got interval %v, %d leechers and %d seeders", resp.Interval, resp.Leechers, resp.Seeders)
+	}
+	if len(resp.Peers) != len(f.peers) {
+		t.Fatalf("got %d peers, want %d", len(resp.Peers), len(f.peers))
+	}
+	for i, peer := range resp.Peers {
+		if peer.Addr != f.peers[i] {
+			t.Errorf("peer %d is %v, want %v", i, peer.Addr, f.peers[i])
+		}
+	}
+}
+
+func TestUDPAnnounceIPv6Peers(t *testing.T) {
+	f := newFakeUDPTracker(t, "udp6", "[::1]:0",
+		netip.MustParseAddrPort("[2001:db8::1]:6881"),
+		netip.MustParseAddrPort("[fe80::2]:51413"),
+	)
+
+	resp, err := testUDPClient().Announce(testContext(t), f.url(), AnnounceRequest{Port: 6881})
+	if err != nil {
+		t.Fatalf("announce failed: %v", err)
+	}
+
+	if len(resp.Peers) != len(f.peers) {
+		t.Fatalf("got %d peers, want %d", len(resp.Peers), len(f.peers))
+	}
+	for i, peer := range resp.Peers {
+		if peer.Addr != f.peers[i] {
+			t.Errorf("peer %d is %v, want %v", i, peer.Addr, f.peers[i])
+		}
+	}
+}
+
+func TestUDPScrape(t *testing.T) {
+	f := newFakeUDPTracker(t, "udp4", "127.0.0.1:0")
+
+	// more hashes than fit in one request
+	hashes := make([][20]byte, udpMaxScrapeHashes+3)
+	for i := range hashes {
+		hashes[i][0] = byte(i)
+	}
+
+	results, err := testUDPClient().Scrape(testContext(t), f.url(), hashes)
+	if err != nil {
+		t.Fatalf("scrape failed: %v", err)
+	}
+	if len(results) != len(hashes) {
+		t.Fatalf("got %d results, want %d", len(results), len(hashes))
+	}
+
+	// the fake numbers entries within each request
+	last := results[udpMaxScrapeHashes+1]
+	if last.InfoHash != hashes[udpMaxScrapeHashes+1] || last.Complete != 2 || last.Downloaded != 101 || last.Incomplete != 11 {
+		t.Errorf("unexpected result in second batch: %+v", last)
+	}
+
+	if connects, _ := f.stats(); connects != 1 {
+		t.Errorf("connected %d times, want once for both batches", connects)
+	}
+}
+
+func TestUDPConnectionIDReuse(t *testing.T) {
+	f := newFakeUDPTracker(t, "udp4", "127.0.0.1:0")
+	c := testUDPClient()
+	ctx := testContext(t)
+
+	for i := 0; i < 3; i++ {
+		if _, err := c.Announce(ctx, f.url(), AnnounceRequest{}); err != nil {
+			t.Fatalf("announce %d failed: %v", i, err)
+		}
+	}
+
+	connects, ids := f.stats()
+	if connects != 1 {
+		t.Errorf("connected %d times, want 1", connects)
+	}
+	for _, id := range ids {
+		if id != ids[0] {
+			t.Errorf("announces used connection ids %v, want the same one", ids)
+			break
+		}
+	}
+}
+
+func TestUDPConnectionIDExpiry(t *testing.T) {
+	f := newFakeUDPTracker(t, "udp4", "127.0.0.1:0")
+	c := testUDPClient()
+	ctx := testContext(t)
+
+	if _, err := c.Announce(ctx, f.url(), AnnounceRequest{}); err != nil {
+		t.Fatalf("first announce failed: %v", err)
+	}
+
+	// age the connection id past its lifetime
+	host := f.url().Host
+	c.mu.Lock()
+	connection := c.connections[host]
+	connection.obtained = time.Now().Add(-udpConnectionIDTTL)
+	c.connections[host] = connection
+	c.mu.Unlock()
+
+	if _, err := c.Announce(ctx, f.url(), AnnounceRequest{}); err != nil {
+		t.Fatalf("second announce failed: %v", err)
+	}
+
+	connects, ids := f.stats()
+	if connects != 2 {
+		t.Errorf("connected %d times, want 2", connects)
+	}
+	if len(ids) != 2 || ids[0] == ids[1] {
+		t.Errorf("announces used connection ids %v, want two different ones", ids)
+	}
+}
+
+func TestUDPRejectedConnectionIDIsForgotten(t *testing.T) {
+	f := newFakeUDPTracker(t, "udp4", "127.0.0.1:0")
+	c := testUDPClient()
+	c.storeConnectionID(f.url().Host, 42)
+
+	_, err := c.Announce(testContext(t), f.url(), AnnounceRequest{})
+	var failure *FailureError
+	if !errors.As(err, &failure) {
+		t.Fatalf("got %v, want a FailureError", err)
+	}
+
+	if _, ok := c.cachedConnectionID(f.url().Host); ok {
+		t.Error("rejected connection id is still cached")
+	}
+}
+
+func TestUDPRetransmitsOnTimeout(t *testing.T) {
+	f := newFakeUDPTracker(t, "udp4", "127.0.0.1:0")
+	// lose the first connect, then the first announce of the second round
+	f.dropNext(1)
+	c := testUDPClient()
+
+	if _, err := c.Announce(testContext(t), f.url(), AnnounceRequest{}); err != nil {
+		t.Fatalf("announce failed: %v", err)
+	}
+
+	f.dropNext(1)
+	if _, err := c.Announce(testContext(t), f.url(), AnnounceRequest{}); err != nil {
+		t.Fatalf("announce after a lost request failed: %v", err)
+	}
+
+	connects, ids := f.stats()
+	if connects != 1 || len(ids) != 2 {
+		t.Errorf("got %d connects and %d announces, want 1 and 2", connects, len(ids))
+	}
+}
+
+func TestUDPGivesUpAfterRetransmissions(t *testing.T) {
+	f := newFakeUDPTracker(t, "udp4", "127.0.0.1:0")
+	f.dropNext(1 << 30)
+	c := testUDPClient()
+	c.MaxRetransmits = 2
+
+	start := time.Now()
+	_, err := c.Announce(testContext(t), f.url(), AnnounceRequest{})
+	if !errors.Is(err, errUDPTimeout) {
+		t.Fatalf("got %v, want a timeout", err)
+	}
+
+	// 50ms, 100ms and 200ms
+	if elapsed := time.Since(start); elapsed < 350*time.Millisecond {
+		t.Errorf("gave up after %v, the timeouts should double", elapsed)
+	}
+}
+
+func TestUDPAnnounceCancelled(t *testing.T) {
+	f := newFakeUDPTracker(t, "udp4", "127.0.0.1:0")
+	f.dropNext(1 << 30)
+	c := NewUDPClient()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	_, err := c.Announce(ctx, f.url(), AnnounceRequest{})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("got %v, want context.Canceled", err)
+	}
+}
@@ -0,0 +1,748 @@
+package utp
+
+import (
+	"io"
+	"math/rand"
+	"net"
+	"net/netip"
+	"os"
+	"sync"
+	"time"
+)
+
+// Congestion control follows LEDBAT: every packet carries the time it was sent and the
+// difference between the send and receive times of the last packet the sender got, so
+// each ack tells us the one way delay of our packets. The lowest delay seen in the last
+// two minutes is taken as the base delay of the path, anything above it is queuing. The
+// window grows while the queuing delay stays below a 100ms target and shrinks when it
+// goes above, which makes uTP back off as soon as other traffic fills the buffers of the
+// link instead of competing with it like TCP does
+const (
+	maxPayload = 1400 - headerSize
+	// the congestion window never goes below two packets
+	minWindow = 2 * maxPayload
+	maxWindow = 1 << 20
+	// how much the congestion window can grow in one round trip when there is no delay
+	maxWindowIncreasePerRTT = 3000
+	targetDelay             = 100 * time.Millisecond
+
+	// bytes we buffer for the peer to send us, advertised as our window, and bytes
+	// written but not sent yet
+	receiveBufferSize = 1 << 20
+	sendBufferSize    = 256 << 10
+	// packets received ahead of a missing one that we are willing to hold on to
+	maxOutOfOrder = 1024
+	// selective acks cover at most this many packets past the missing one
+	maxSelectiveAckBits = 256
+
+	initialRTO        = time.Second
+	minRTO            = 500 * time.Millisecond
+	maxRTO            = 60 * time.Second
+	maxRetransmits    = 8
+	maxSynRetransmits = 3
+	keepAliveInterval = 29 * time.Second
+	idleTimeout       = 2 * keepAliveInterval
+	// duplicate acks and selectively acked packets after a missing one before it is
+	// considered lost
+	duplicateAckThreshold = 3
+)
+
+type connState int
+
+const (
+	stateSynSent connState = iota
+	stateConnected
+	stateClosed
+)
+
+type outPacket struct {
+	typ           packetType
+	seq           uint16
+	payload       []byte
+	sentAt        time.Time
+	transmissions int
+}
+
+// Conn is a uTP connection, it implements net.Conn
+type Conn struct {
+	socket *Socket
+	remote netip.AddrPort
+	// the connection ids we receive and send with
+	recvID uint16
+	sendID uint16
+
+	mu    sync.Mutex
+	state connState
+	// seq is the sequence number of the next packet we send, ack the last one we
+	// received in order
+	seq uint16
+	ack uint16
+
+	// sending side
+	sendBuf       []byte
+	inflight      []*outPacket
+	inflightBytes int
+	cwnd          float64
+	slowStart     bool
+	peerWindow    int
+	lastAck       uint16
+	duplicateAcks int
+	lastLoss      time.Time
+	rtt           time.Duration
+	rttVar        time.Duration
+	rto           time.Duration
+	delays        delayHistory
+	// replyMicro is the difference between the send time of the last packet we got
+	// and the time we received it, echoed in every packet we send
+	replyMicro uint32
+	lastSend   time.Time
+	lastRecv   time.Time
+
+	// receiving side
+	recvBuf    []byte
+	outOfOrder map[uint16][]byte
+	gotFin     bool
+	finSeq     uint16
+
+	closing bool
+	finSent bool
+	err     error
+
+	readDeadline  time.Time
+	writeDeadline time.Time
+
+	readable  chan struct{}
+	writable  chan struct{}
+	connected chan struct{}
+	done      chan struct{}
+}
+
+func newConn(s *Socket, remote netip.AddrPort, recvID, sendID uint16) *Conn {
+	now := time.Now()
+	return &Conn{
+		socket:     s,
+		remote:     remote,
+		recvID:     recvID,
+		sendID:     sendID,
+		cwnd:       minWindow,
+		slowStart:  true,
+		peerWindow: maxPayload,
+		rto:        initialRTO,
+		lastSend:   now,
+		lastRecv:   now,
+		outOfOrder: make(map[uint16][]byte),
+		readable:   make(chan struct{}, 1),
+		writable:   make(chan struct{}, 1),
+		connected:  make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+}
+
+// connect sends the SYN of an outgoing connection
+func (c *Conn) connect() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.state = stateSynSent
+	c.seq = 1
+	syn := &outPacket{typ: stSyn, seq: c.seq}
+	c.seq++
+	c.inflight = append(c.inflight, syn)
+	c.transmit(syn)
+}
+
+// acceptSyn answers the SYN of an incoming connection
+func (c *Conn) acceptSyn(h *header) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.state = stateConnected
+	c.seq = uint16(rand.Intn(1 << 16))
+	c.ack = h.seq
+	c.lastAck = c.seq - 1
+	c.replyMicro = nowMicros() - h.timestamp
+	close(c.connected)
+	c.sendState()
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	for {
+		c.mu.Lock()
+		if len(c.recvBuf) > 0 {
+			wasFull := len(c.recvBuf) > receiveBufferSize-maxPayload
+			n := copy(b, c.recvBuf)
+			c.recvBuf = c.recvBuf[n:]
+			if len(c.recvBuf) == 0 {
+				c.recvBuf = nil
+			}
+			// the peer stopped sending because our window was full, tell it there is
+			// room again
+			if wasFull && c.state == stateConnected {
+				c.sendState()
+			}
+			c.mu.Unlock()
+			return n, nil
+		}
+		if c.gotFin && !seqLess(c.ack, c.finSeq) {
+			c.mu.Unlock()
+			return 0, io.EOF
+		}
+		if c.closing {
+			c.mu.Unlock()
+			return 0, net.ErrClosed
+		}
+		if c.err != nil {
+			err := c.err
+			c.mu.Unlock()
+			return 0, err
+		}
+		deadline := c.readDeadline
+		c.mu.Unlock()
+
+		if err := c.wait(c.readable, deadline); err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (c *Conn) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) > 0 {
+		c.mu.Lock()
+		if c.closing {
+			c.mu.Unlock()
+			return written, net.ErrClosed
+		}
+		if c.err != nil {
+			err := c.err
+			c.mu.Unlock()
+			return written, err
+		}
+
+		if space := sendBufferSize - len(c.sendBuf); space > 0 {
+			n := min(space, len(b))
+			c.sendBuf = append(c.sendBuf, b[:n]...)
+			b = b[n:]
+			written += n
+			c.flush()
+			c.mu.Unlock()
+			continue
+		}
+		deadline := c.writeDeadline
+		c.mu.Unlock()
+
+		if err := c.wait(c.writable, deadline); err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// Close sends what is left in the send buffer followed by a FIN, without waiting for the
+// peer to acknowledge it
+func (c *Conn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closing {
+		return nil
+	}
+	c.closing = true
+	notify(c.readable)
+	notify(c.writable)
+
+	if c.err != nil || c.state != stateConnected {
+		c.terminate(nil)
+		return nil
+	}
+
+	c.flush()
+	c.checkFinished()
+	return nil
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	return c.socket.Addr()
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return net.UDPAddrFromAddrPort(c.remote)
+}
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline = t
+	c.mu.Unlock()
+	notify(c.readable)
+	return nil
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.writeDeadline = t
+	c.mu.Unlock()
+	notify(c.writable)
+	return nil
+}
+
+// wait blocks until ch is signaled, the connection ends or the deadline passes
+func (c *Conn) wait(ch chan struct{}, deadline time.Time) error {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return os.ErrDeadlineExceeded
+		}
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case <-ch:
+	case <-c.done:
+	case <-timeout:
+		return os.ErrDeadlineExceeded
+	}
+	return nil
+}
+
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+func (c *Conn) terminalError() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.err != nil {
+		return c.err
+	}
+	return ErrClosed
+}
+
+// reset tells the peer the connection is gone and ends it
+func (c *Conn) reset(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.state == stateClosed {
+		return
+	}
+	h := c.header(stReset, c.seq)
+	c.socket.send(c.remote, h.marshal(nil))
+	c.terminate(err)
+}
+
+// terminate ends the connection and removes it from the socket
+func (c *Conn) terminate(err error) {
+	if c.state == stateClosed {
+		return
+	}
+	c.state = stateClosed
+	if err != nil && c.err == nil {
+		c.err = err
+	}
+	close(c.done)
+	notify(c.readable)
+	notify(c.writable)
+	c.socket.remove(c)
+}
+
+// checkFinished ends a closing connection once everything we sent was acknowledged
+func (c *Conn) checkFinished() {
+	if c.closing && c.finSent && len(c.inflight) == 0 {
+		c.terminate(nil)
+	}
+}
+
+func (c *Conn) header(typ packetType, seq uint16) *header {
+	window := receiveBufferSize - len(c.recvBuf)
+	for _, payload := range c.outOfOrder {
+		window -= len(payload)
+	}
+
+	connID := c.sendID
+	if typ == stSyn {
+		connID = c.recvID
+	}
+
+	return &header{
+		typ:           typ,
+		connID:        connID,
+		timestamp:     nowMicros(),
+		timestampDiff: c.replyMicro,
+		wndSize:       uint32(max(window, 0)),
+		seq:           seq,
+		ack:           c.ack,
+	}
+}
+
+func (c *Conn) transmit(p *outPacket) {
+	p.sentAt = time.Now()
+	p.transmissions++
+	c.lastSend = p.sentAt
+	c.socket.send(c.remote, c.header(p.typ, p.seq).marshal(p.payload))
+}
+
+// sendState acknowledges what we received, with a selective ack when packets are
+// missing
+func (c *Conn) sendState() {
+	h := c.header(stState, c.seq)
+	if len(c.outOfOrder) > 0 {
+		h.sack = c.selectiveAck()
+	}
+	c.lastSend = time.Now()
+	c.socket.send(c.remote, h.marshal(nil))
+}
+
+func (c *Conn) selectiveAck() []byte {
+	bits := 0
+	for seq := range c.outOfOrder {
+		if offset := int(seq - c.ack - 2); offset < maxSelectiveAckBits {
+			bits = max(bits, offset+1)
+		}
+	}
+	// the bitmask is a multiple of 32 bits
+	sack := make([]byte, (bits+31)/32*4)
+	for seq := range c.outOfOrder {
+		if offset := int(seq - c.ack - 2); offset < len(sack)*8 {
+			sack[offset/8] |= 1 << (offset % 8)
+		}
+	}
+	return sack
+}
+
+func (c *Conn) window() int {
+	return min(int(c.cwnd), c.peerWindow)
+}
+
+// flush turns the send buffer into packets as far as the window allows, followed by a FIN
+// once the connection is closing and everything was sent
+func (c *Conn) flush() {
+	if c.state != stateConnected {
+		return
+	}
+
+	for len(c.sendBuf) > 0 {
+		n := min(len(c.sendBuf), maxPayload)
+		// a packet is always allowed when nothing is in flight so a closed window gets
+		// probed
+		if len(c.inflight) > 0 && c.inflightBytes+n > c.window() {
+			break
+		}
+
+		payload := make([]byte, n)
+		copy(payload, c.sendBuf)
+		c.sendBuf = c.sendBuf[n:]
+
+		p := &outPacket{typ: stData, seq: c.seq, payload: payload}
+		c.seq++
+		c.inflight = append(c.inflight, p)
+		c.inflightBytes += n
+		c.transmit(p)
+	}
+	if len(c.sendBuf) == 0 {
+		c.sendBuf = nil
+	}
+
+	if c.closing && len(c.sendBuf) == 0 && !c.finSent {
+		fin := &outPacket{typ: stFin, seq: c.seq}
+		c.seq++
+		c.inflight = append(c.inflight, fin)
+		c.finSent = true
+		c.transmit(fin)
+	}
+
+	if len(c.sendBuf) < sendBufferSize {
+		notify(c.writable)
+	}
+}
+
+func (c *Conn) handlePacket(h *header, payload []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.state == stateClosed {
+		return
+	}
+
+	now := time.Now()
+	c.lastRecv = now
+	c.replyMicro = nowMicros() - h.timestamp
+
+	switch h.typ {
+	case stReset:
+		c.terminate(ErrReset)
+		return
+	case stSyn:
+		c.sendState()
+		return
+	}
+
+	if c.state == stateSynSent {
+		// the first packet of the peer tells us where its sequence numbers start
+		c.ack = h.seq - 1
+		c.state = stateConnected
+		close(c.connected)
+	}
+
+	c.peerWindow = int(h.wndSize)
+	c.handleAck(h, now)
+
+	if h.typ == stData || h.typ == stFin {
+		c.receive(h, payload)
+	}
+
+	c.flush()
+	c.checkFinished()
+}
+
+// handleAck removes acknowledged packets from the ones in flight, updates the round trip
+// time and congestion window and resends packets that look lost
+func (c *Conn) handleAck(h *header, now time.Time) {
+	acked := 0
+	progress := false
+	var rttSample time.Duration
+
+	for len(c.inflight) > 0 && !seqLess(h.ack, c.inflight[0].seq) {
+		p := c.inflight[0]
+		c.inflight = c.inflight[1:]
+		acked += len(p.payload)
+		progress = true
+		// only packets sent once give a meaningful round trip time
+		if p.transmissions == 1 {
+			rttSample = now.Sub(p.sentAt)
+		}
+	}
+
+	if h.sack != nil {
+		remaining := c.inflight[:0]
+		for _, p := range c.inflight {
+			if selectivelyAcked(h, p.seq) {
+				acked += len(p.payload)
+				if p.transmissions == 1 {
+					rttSample = now.Sub(p.sentAt)
+				}
+				continue
+			}
+			remaining = append(remaining, p)
+		}
+		c.inflight = remaining
+	}
+
+	c.inflightBytes = 0
+	for _, p := range c.inflight {
+		c.inflightBytes += len(p.payload)
+	}
+
+	if rttSample > 0 {
+		c.updateRTT(rttSample)
+	} else if progress && c.rtt > 0 {
+		// the peer is getting our packets again, forget the timeout backoff
+		c.rto = min(max(c.rtt+4*c.rttVar, minRTO), maxRTO)
+	}
+
+	if acked > 0 && h.timestampDiff != 0 {
+		c.updateWindow(acked, h.timestampDiff, now)
+	}
+
+	// acks that do not move past a packet in flight mean it did not arrive while later
+	// ones did
+	if h.ack != c.lastAck {
+		c.duplicateAcks = 0
+	} else if h.typ == stState && len(c.inflight) > 0 {
+		c.duplicateAcks++
+	}
+	c.lastAck = h.ack
+
+	// packets followed by enough selectively acked ones were lost, without selective
+	// acks the packet right after the acked one is lost once enough acks repeat
+	if h.sack != nil {
+		for _, p := range c.inflight {
+			if countAckedAfter(h, p.seq) < duplicateAckThreshold {
+				break
+			}
+			// leave it a round trip to arrive before sending it yet again
+			if now.Sub(p.sentAt) > c.rtt {
+				c.lost(now)
+				c.transmit(p)
+			}
+		}
+	} else if c.duplicateAcks == duplicateAckThreshold && len(c.inflight) > 0 {
+		if p := c.inflight[0]; p.seq == h.ack+1 {
+			c.lost(now)
+			c.transmit(p)
+		}
+	}
+
+	if acked > 0 {
+		notify(c.writable)
+	}
+}
+
+// selectivelyAcked tells whether the selective ack of a packet covers seq
+func selectivelyAcked(h *header, seq uint16) bool {
+	offset := int(seq - h.ack - 2)
+	return offset < len(h.sack)*8 && h.sack[offset/8]&(1<<(offset%8)) != 0
+}
+
+// countAckedAfter counts the packets past seq the selective ack covers
+func countAckedAfter(h *header, seq uint16) int {
+	count := 0
+	for offset := 0; offset < len(h.sack)*8; offset++ {
+		if h.sack[offset/8]&(1<<(offset%8)) != 0 && seqLess(seq, h.ack+2+uint16(offset)) {
+			count++
+		}
+	}
+	return count
+}
+
+func (c *Conn) updateRTT(sample time.Duration) {
+	if c.rtt == 0 {
+		c.rtt = sample
+		c.rttVar = sample / 2
+	} else {
+		diff := c.rtt - sample
+		if diff < 0 {
+			diff = -diff
+		}
+		c.rttVar += (diff - c.rttVar) / 4
+		c.rtt += (sample - c.rtt) / 8
+	}
+	c.rto = min(max(c.rtt+4*c.rttVar, minRTO), maxRTO)
+}
+
+// updateWindow applies LEDBAT to the congestion window for bytes that were acknowledged
+// by a packet reporting the delay of our packets
+func (c *Conn) updateWindow(acked int, delaySample uint32, now time.Time) {
+	c.delays.add(delaySample, now)
+	queuing := time.Duration(delaySample-c.delays.base()) * time.Microsecond
+
+	if c.slowStart && queuing < targetDelay/2 {
+		c.cwnd += float64(acked)
+	} else {
+		c.slowStart = false
+		offTarget := float64(targetDelay-queuing) / float64(targetDelay)
+		windowFactor := float64(min(float64(acked), c.cwnd)) / max(c.cwnd, float64(acked))
+		c.cwnd += maxWindowIncreasePerRTT * offTarget * windowFactor
+	}
+	c.cwnd = min(max(c.cwnd, minWindow), maxWindow)
+}
+
+// lost halves the window, at most once per round trip since a burst of losses is a
+// single congestion event
+func (c *Conn) lost(now time.Time) {
+	c.slowStart = false
+	if now.Sub(c.lastLoss) < c.rtt {
+		return
+	}
+	c.lastLoss = now
+	c.cwnd = max(c.cwnd/2, minWindow)
+}
+
+func (c *Conn) receive(h *header, payload []byte) {
+	if h.typ == stFin && !c.gotFin {
+		c.gotFin = true
+		c.finSeq = h.seq
+	}
+
+	switch {
+	case h.seq == c.ack+1:
+		c.recvBuf = append(c.recvBuf, payload...)
+		c.ack++
+		for {
+			next, ok := c.outOfOrder[c.ack+1]
+			if !ok {
+				break
+			}
+			delete(c.outOfOrder, c.ack+1)
+			c.recvBuf = append(c.recvBuf, next...)
+			c.ack++
+		}
+		notify(c.readable)
+	case seqLess(c.ack+1, h.seq) && seqLess(h.seq, c.ack+1+maxOutOfOrder):
+		if _, ok := c.outOfOrder[h.seq]; !ok {
+			c.outOfOrder[h.seq] = payload
+		}
+	}
+
+	c.sendState()
+}
+
+func (c *Conn) tick(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.state == stateClosed {
+		return
+	}
+
+	if len(c.inflight) > 0 {
+		p := c.inflight[0]
+		if now.Sub(p.sentAt) > c.rto {
+			limit := maxRetransmits
+			if p.typ == stSyn {
+				limit = maxSynRetransmits
+			}
+			if p.transmissions > limit {
+				c.terminate(ErrTimeout)
+				return
+			}
+
+			// a timeout means the path is congested, start again from the smallest window
+			c.slowStart = false
+			c.cwnd = minWindow
+			c.rto = min(c.rto*2, maxRTO)
+			c.transmit(p)
+		}
+	}
+
+	if c.state == stateConnected {
+		if now.Sub(c.lastRecv) > idleTimeout {
+			c.terminate(ErrTimeout)
+			return
+		}
+		if now.Sub(c.lastSend) > keepAliveInterval {
+			c.sendState()
+		}
+	}
+
+	c.flush()
+	c.checkFinished()
+}
+
+// delayHistory keeps the lowest delay seen over the last two minutes in one minute
+// buckets, so the base delay follows route changes
+type delayHistory struct {
+	buckets [2]uint32
+	started time.Time
+	valid   bool
+}
+
+func (h *delayHistory) add(sample uint32, now time.Time) {
+	if !h.valid {
+		h.buckets = [2]uint32{sample, sample}
+		h.started = now
+		h.valid = true
+		return
+	}
+	if now.Sub(h.started) > time.Minute {
+		h.buckets[0] = h.buckets[1]
+		h.buckets[1] = sample
+		h.started = now
+	}
+	h.buckets[1] = min(h.buckets[1], sample)
+}
+
+func (h *delayHistory) base() uint32 {
+	return min(h.buckets[0], h.buckets[1])
+}
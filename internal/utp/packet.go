@@ -0,0 +1,124 @@
+package utp
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// uTP (BEP 29) is a reliable, ordered stream protocol on top of UDP. Every packet starts
+// with a 20 byte header:
+//
+//	0       4       8               16              24              32
+//	+-------+-------+---------------+---------------+---------------+
+//	| type  | ver   | extension     | connection_id                 |
+//	+-------+-------+---------------+---------------+---------------+
+//	| timestamp_microseconds                                        |
+//	+---------------+---------------+---------------+---------------+
+//	| timestamp_difference_microseconds                             |
+//	+---------------+---------------+---------------+---------------+
+//	| wnd_size                                                      |
+//	+---------------+---------------+---------------+---------------+
+//	| seq_nr                        | ack_nr                        |
+//	+---------------+---------------+---------------+---------------+
+//
+// followed by a linked list of extensions (the extension byte gives the type of the
+// first one, every extension starts with the type of the next one and its length) and
+// the payload. Sequence numbers count packets, not bytes, and wrap around at 2^16
+type packetType uint8
+
+const (
+	stData  packetType = 0
+	stFin   packetType = 1
+	stState packetType = 2
+	stReset packetType = 3
+	stSyn   packetType = 4
+)
+
+const (
+	protocolVersion = 1
+	headerSize      = 20
+	// the selective ack extension is a bitmask of the packets received past ack_nr + 1
+	extensionSelectiveAck = 1
+)
+
+type header struct {
+	typ           packetType
+	connID        uint16
+	timestamp     uint32
+	timestampDiff uint32
+	wndSize       uint32
+	seq           uint16
+	ack           uint16
+	// selective ack bitmask, bit i is set when packet ack+2+i was received
+	sack []byte
+}
+
+func (h *header) marshal(payload []byte) []byte {
+	size := headerSize + len(payload)
+	if h.sack != nil {
+		size += 2 + len(h.sack)
+	}
+
+	buf := make([]byte, headerSize, size)
+	buf[0] = byte(h.typ)<<4 | protocolVersion
+	binary.BigEndian.PutUint16(buf[2:4], h.connID)
+	binary.BigEndian.PutUint32(buf[4:8], h.timestamp)
+	binary.BigEndian.PutUint32(buf[8:12], h.timestampDiff)
+	binary.BigEndian.PutUint32(buf[12:16], h.wndSize)
+	binary.BigEndian.PutUint16(buf[16:18], h.seq)
+	binary.BigEndian.PutUint16(buf[18:20], h.ack)
+
+	if h.sack != nil {
+		buf[1] = extensionSelectiveAck
+		buf = append(buf, 0, byte(len(h.sack)))
+		buf = append(buf, h.sack...)
+	}
+
+	return append(buf, payload...)
+}
+
+func parsePacket(b []byte) (*header, []byte, error) {
+	if len(b) < headerSize {
+		return nil, nil, fmt.Errorf("packet too short: %d bytes", len(b))
+	}
+	if b[0]&0x0f != protocolVersion {
+		return nil, nil, fmt.Errorf("unsupported version %d", b[0]&0x0f)
+	}
+
+	h := &header{
+		typ:           packetType(b[0] >> 4),
+		connID:        binary.BigEndian.Uint16(b[2:4]),
+		timestamp:     binary.BigEndian.Uint32(b[4:8]),
+		timestampDiff: binary.BigEndian.Uint32(b[8:12]),
+		wndSize:       binary.BigEndian.Uint32(b[12:16]),
+		seq:           binary.BigEndian.Uint16(b[16:18]),
+		ack:           binary.BigEndian.Uint16(b[18:20]),
+	}
+	if h.typ > stSyn {
+		return nil, nil, fmt.Errorf("unknown packet type %d", h.typ)
+	}
+
+	extension := b[1]
+	offset := headerSize
+	for extension != 0 {
+		if offset+2 > len(b) {
+			return nil, nil, fmt.Errorf("truncated extension")
+		}
+		next, length := b[offset], int(b[offset+1])
+		if offset+2+length > len(b) {
+			return nil, nil, fmt.Errorf("truncated extension")
+		}
+		if extension == extensionSelectiveAck {
+			h.sack = b[offset+2 : offset+2+length]
+		}
+		extension = next
+		offset += 2 + length
+	}
+
+	return h, b[offset:], nil
+}
+
+// seqLess compares sequence numbers, taking wrap around into account
+func seqLess(a, b uint16) bool {
+	return int16(a-b) < 0
+}
@@ -0,0 +1,298 @@
+package utp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+const (
+	maxPacketSize = 1500
+	// connections are checked for retransmissions and keep-alives this often
+	tickInterval = 50 * time.Millisecond
+	// incoming connections waiting for Accept, more are reset
+	acceptBacklog = 32
+	// size of the kernel buffers of the UDP socket
+	socketBufferSize = 4 << 20
+)
+
+var (
+	ErrClosed  = errors.New("utp: socket closed")
+	ErrReset   = errors.New("utp: connection reset by peer")
+	ErrTimeout = errors.New("utp: connection timed out")
+)
+
+type connKey struct {
+	addr netip.AddrPort
+	// the connection id the peer puts in the packets it sends us
+	id uint16
+}
+
+// Socket multiplexes uTP connections over a single UDP socket. It implements
+// net.Listener so incoming connections can be served like TCP ones
+type Socket struct {
+	conn *net.UDPConn
+
+	mu    sync.Mutex
+	conns map[connKey]*Conn
+
+	accept    chan *Conn
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// Listen opens a UDP socket for uTP connections, e.g. ":6881"
+func Listen(addr string) (*Socket, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen: %w", err)
+	}
+
+	// bursts of packets from fast connections would otherwise overflow the default
+	// buffers and be lost
+	conn.SetReadBuffer(socketBufferSize)
+	conn.SetWriteBuffer(socketBufferSize)
+
+	s := &Socket{
+		conn:   conn,
+		conns:  make(map[connKey]*Conn),
+		accept: make(chan *Conn, acceptBacklog),
+		closed: make(chan struct{}),
+	}
+
+	go s.readLoop()
+	go s.tickLoop()
+
+	return s, nil
+}
+
+func (s *Socket) Addr() net.Addr {
+	return s.conn.LocalAddr()
+}
+
+// Accept waits for the next incoming connection
+func (s *Socket) Accept() (net.Conn, error) {
+	select {
+	case c := <-s.accept:
+		return c, nil
+	case <-s.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close resets every connection and closes the UDP socket
+func (s *Socket) Close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		close(s.closed)
+
+		s.mu.Lock()
+		conns := make([]*Conn, 0, len(s.conns))
+		for _, c := range s.conns {
+			conns = append(conns, c)
+		}
+		s.mu.Unlock()
+
+		for _, c := range conns {
+			c.reset(ErrClosed)
+		}
+
+		err = s.conn.Close()
+	})
+	return err
+}
+
+// DialTimeout opens a connection to a "host:port" address
+func (s *Socket) DialTimeout(addr string, timeout time.Duration) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return s.DialContext(ctx, addr)
+}
+
+// DialContext opens a connection to a "host:port" address, giving up when ctx is done
+func (s *Socket) DialContext(ctx context.Context, addr string) (net.Conn, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	remote := unmap(udpAddr.AddrPort())
+
+	s.mu.Lock()
+	select {
+	case <-s.closed:
+		s.mu.Unlock()
+		return nil, ErrClosed
+	default:
+	}
+
+	// we receive on recvID and send on recvID+1, the peer does the opposite
+	var recvID uint16
+	for {
+		recvID = uint16(rand.Intn(1 << 16))
+		if _, ok := s.conns[connKey{remote, recvID}]; !ok {
+			break
+		}
+	}
+	c := newConn(s, remote, recvID, recvID+1)
+	s.conns[connKey{remote, recvID}] = c
+	s.mu.Unlock()
+
+	c.connect()
+
+	select {
+	case <-c.connected:
+		return c, nil
+	case <-c.done:
+		return nil, fmt.Errorf("failed to connect to %s: %w", addr, c.terminalError())
+	case <-ctx.Done():
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			c.reset(ErrTimeout)
+			return nil, fmt.Errorf("failed to connect to %s: %w", addr, ErrTimeout)
+		}
+		c.reset(ctx.Err())
+		return nil, fmt.Errorf("failed to connect to %s: %w", addr, ctx.Err())
+	}
+}
+
+func (s *Socket) send(addr netip.AddrPort, packet []byte) {
+	if _, err := s.conn.WriteToUDPAddrPort(packet, addr); err != nil {
+		select {
+		case <-s.closed:
+		default:
+			log.Printf("Failed to send uTP packet to %s: %v", addr, err)
+		}
+	}
+}
+
+func (s *Socket) remove(c *Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := connKey{c.remote, c.recvID}
+	if s.conns[key] == c {
+		delete(s.conns, key)
+	}
+}
+
+func (s *Socket) readLoop() {
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, from, err := s.conn.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			select {
+			case <-s.closed:
+				return
+			default:
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+
+		// the payload is handed over to the connection, which may keep it
+		packet := make([]byte, n)
+		copy(packet, buf[:n])
+
+		h, payload, err := parsePacket(packet)
+		if err != nil {
+			continue
+		}
+		s.handlePacket(unmap(from), h, payload)
+	}
+}
+
+func (s *Socket) handlePacket(from netip.AddrPort, h *header, payload []byte) {
+	if h.typ == stSyn {
+		s.handleSyn(from, h)
+		return
+	}
+
+	s.mu.Lock()
+	c, ok := s.conns[connKey{from, h.connID}]
+	s.mu.Unlock()
+
+	if !ok {
+		if h.typ != stReset {
+			reset := &header{typ: stReset, connID: h.connID, timestamp: nowMicros(), seq: uint16(rand.Intn(1 << 16)), ack: h.seq}
+			s.send(from, reset.marshal(nil))
+		}
+		return
+	}
+
+	c.handlePacket(h, payload)
+}
+
+// handleSyn sets up an incoming connection, the peer sends on the id of the SYN and
+// receives on the next one
+func (s *Socket) handleSyn(from netip.AddrPort, h *header) {
+	key := connKey{from, h.connID + 1}
+
+	s.mu.Lock()
+	if c, ok := s.conns[key]; ok {
+		s.mu.Unlock()
+		// our answer to the SYN got lost
+		c.handlePacket(h, nil)
+		return
+	}
+	select {
+	case <-s.closed:
+		s.mu.Unlock()
+		return
+	default:
+	}
+
+	c := newConn(s, from, h.connID+1, h.connID)
+	s.conns[key] = c
+	s.mu.Unlock()
+
+	c.acceptSyn(h)
+
+	select {
+	case s.accept <- c:
+	default:
+		c.reset(fmt.Errorf("utp: accept backlog full"))
+	}
+}
+
+func (s *Socket) tickLoop() {
+	ticker := time.NewTicker(tickInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.closed:
+			return
+		case now := <-ticker.C:
+			s.mu.Lock()
+			conns := make([]*Conn, 0, len(s.conns))
+			for _, c := range s.conns {
+				conns = append(conns, c)
+			}
+			s.mu.Unlock()
+
+			for _, c := range conns {
+				c.tick(now)
+			}
+		}
+	}
+}
+
+func unmap(addr netip.AddrPort) netip.AddrPort {
+	return netip.AddrPortFrom(addr.Addr().Unmap(), addr.Port())
+}
+
+func nowMicros() uint32 {
+	return uint32(time.Now().UnixMicro())
+}
@@ -0,0 +1,406 @@
+// Package client runs any number of torrents in one BitTorrent client. The client owns
+// what torrents share: the port peers connect to, the DHT node, local service discovery,
+// the rate limiters and the peer id. Torrents are added from metainfo files or magnet
+// links and controlled through the Torrent handles returned
+package client
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/nullxDEADBEEF/bittorrent/internal/bencode"
+	"github.com/nullxDEADBEEF/bittorrent/internal/dht"
+	dl "github.com/nullxDEADBEEF/bittorrent/internal/download"
+	"github.com/nullxDEADBEEF/bittorrent/internal/lsd"
+	magnetlink "github.com/nullxDEADBEEF/bittorrent/internal/manget_link"
+	"github.com/nullxDEADBEEF/bittorrent/internal/mse"
+	"github.com/nullxDEADBEEF/bittorrent/internal/peer"
+	"github.com/nullxDEADBEEF/bittorrent/internal/ratelimit"
+	"github.com/nullxDEADBEEF/bittorrent/internal/tracker"
+	"github.com/nullxDEADBEEF/bittorrent/internal/utp"
+)
+
+// a DHT bootstrap that failed, for lack of network or reachable nodes, is tried again
+// after this delay, doubled up to maxDHTRetryDelay on every failure
+const (
+	dhtRetryDelay    = 30 * time.Second
+	maxDHTRetryDelay = 10 * time.Minute
+)
+
+var (
+	ErrClosed        = errors.New("client closed")
+	ErrTorrentExists = errors.New("torrent already added")
+)
+
+// EncryptionPolicy decides whether peer connections are encrypted
+type EncryptionPolicy = mse.Policy
+
+const (
+	EncryptionPrefer  = mse.PolicyPrefer
+	EncryptionRequire = mse.PolicyRequire
+	EncryptionDisable = mse.PolicyDisable
+)
+
+// Transport decides whether peers are connected to over TCP, uTP or both
+type Transport = peer.Transport
+
+const (
+	TransportTCP  = peer.TransportTCP
+	TransportUTP  = peer.TransportUTP
+	TransportRace = peer.TransportRace
+)
+
+type Config struct {
+	// DataDir is where the files of the torrents are written, single file torrents as
+	// DataDir/<name> and multi-file torrents under DataDir/<name>/
+	DataDir string
+	// ListenPort is the TCP and uTP port peers connect to, the DHT uses it as well when
+	// it is free
+	ListenPort uint16
+	// PeerID identifies the client to trackers and peers, a random one starting with our
+	// client code is used when it is zero
+	PeerID [20]byte
+	// MaxConnections is the number of peers every torrent talks to at once
+	MaxConnections int
+	Encryption     EncryptionPolicy
+	Transport      Transport
+	// DownloadRateLimit and UploadRateLimit are in bytes per second for all torrents
+	// together, 0 does not limit
+	DownloadRateLimit int
+	UploadRateLimit   int
+	// DisableDHT and DisableLSD turn off the DHT (BEP 5) and local service discovery
+	// (BEP 14), private torrents never use them
+	DisableDHT bool
+	DisableLSD bool
+	// DHTStateFile keeps the routing table between runs when set
+	DHTStateFile string
+	// DialTimeout bounds connecting to a peer, HandshakeTimeout the handshakes that
+	// follow and RequestTimeout how long a peer may leave our requests unanswered before
+	// it is dropped. TrackerTimeout bounds every announce to a single tracker. The
+	// defaults are used for the ones that are zero
+	DialTimeout      time.Duration
+	HandshakeTimeout time.Duration
+	RequestTimeout   time.Duration
+	TrackerTimeout   time.Duration
+}
+
+func DefaultConfig() Config {
+	downloadConfig := dl.DefaultConfig()
+	config := Config{
+		DataDir:          ".",
+		ListenPort:       6881,
+		MaxConnections:   downloadConfig.MaxConnections,
+		Encryption:       EncryptionPrefer,
+		Transport:        TransportRace,
+		DialTimeout:      downloadConfig.DialTimeout,
+		HandshakeTimeout: downloadConfig.HandshakeTimeout,
+		RequestTimeout:   downloadConfig.RequestTimeout,
+		TrackerTimeout:   tracker.DefaultTimeout,
+	}
+	if cacheDir, err := os.UserCacheDir(); err == nil {
+		config.DHTStateFile = filepath.Join(cacheDir, "bittorrent", "dht.json")
+	}
+	return config
+}
+
+type Client struct {
+	config   Config
+	peerID   [20]byte
+	listener *dl.Listener
+	socket   *utp.Socket
+	dht      *dht.Server
+	// dhtReady is closed once the DHT node bootstrapped, lookups wait for it
+	dhtReady chan struct{}
+	lsd      *lsd.Service
+
+	downloadLimit *ratelimit.Limiter
+	uploadLimit   *ratelimit.Limiter
+
+	mu       sync.Mutex
+	torrents map[[20]byte]*Torrent
+	closed   bool
+	// closing is closed by Close, it stops the background work of the client
+	closing chan struct{}
+
+	// subs are the event subscriptions, subsEnded is set once the client is closed
+	subsMu    sync.Mutex
+	subs      map[*Subscription]bool
+	subsEnded bool
+}
+
+// NewClient starts listening for peers. Failing to listen on the TCP port is an error,
+// uTP, the DHT and local service discovery are disabled when they can not be started
+func NewClient(config Config) (*Client, error) {
+	if config.MaxConnections <= 0 {
+		config.MaxConnections = dl.DefaultConfig().MaxConnections
+	}
+
+	c := &Client{
+		config:        config,
+		peerID:        config.PeerID,
+		dhtReady:      make(chan struct{}),
+		closing:       make(chan struct{}),
+		downloadLimit: ratelimit.NewLimiter(config.DownloadRateLimit),
+		uploadLimit:   ratelimit.NewLimiter(config.UploadRateLimit),
+		torrents:      make(map[[20]byte]*Torrent),
+		subs:          make(map[*Subscription]bool),
+	}
+	if c.peerID == ([20]byte{}) {
+		peerID, err := peer.NewPeerID()
+		if err != nil {
+			return nil, err
+		}
+		c.peerID = peerID
+	}
+
+	addr := fmt.Sprintf(":%d", config.ListenPort)
+	listener, err := dl.Listen(addr, config.Encryption)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen for peers: %w", err)
+	}
+	c.listener = listener
+
+	if config.Transport != TransportTCP {
+		socket, err := utp.Listen(addr)
+		if err != nil {
+			log.Printf("uTP disabled: %v", err)
+		} else {
+			c.socket = socket
+			listener.Serve(socket)
+		}
+	}
+
+	if !config.DisableDHT {
+		c.startDHT(addr)
+	}
+
+	if !config.DisableLSD {
+		lsdConfig := lsd.DefaultConfig()
+		lsdConfig.Port = config.ListenPort
+		service, err := lsd.NewService(lsdConfig)
+		if err != nil {
+			log.Printf("Local service discovery disabled: %v", err)
+		} else {
+			c.lsd = service
+		}
+	}
+
+	return c, nil
+}
+
+// startDHT joins the DHT in the background, torrents added in the meantime look up their
+// peers once it bootstrapped. Bootstraps that fail are tried again until the client is
+// closed
+func (c *Client) startDHT(addr string) {
+	config := dht.DefaultConfig()
+	config.Addr = addr
+	config.StateFile = c.config.DHTStateFile
+
+	server, err := dht.NewServer(config)
+	if err != nil {
+		// the port is taken by uTP or another client, any port will do
+		config.Addr = ":0"
+		server, err = dht.NewServer(config)
+		if err != nil {
+			log.Printf("DHT disabled: %v", err)
+			return
+		}
+	}
+	c.dht = server
+
+	go func() {
+		for delay := dhtRetryDelay; ; delay = min(2*delay, maxDHTRetryDelay) {
+			err := server.Bootstrap()
+			if err == nil {
+				close(c.dhtReady)
+				return
+			}
+			log.Printf("DHT bootstrap failed: %v, retrying in %s", err, delay)
+
+			timer := time.NewTimer(delay)
+			select {
+			case <-timer.C:
+			case <-c.closing:
+				timer.Stop()
+				return
+			}
+		}
+	}()
+}
+
+// PeerID returns the peer id the client uses for every torrent
+func (c *Client) PeerID() [20]byte {
+	return c.peerID
+}
+
+// SetRateLimits changes the download and upload rate limits in bytes per second, 0 does
+// not limit
+func (c *Client) SetRateLimits(download, upload int) {
+	c.downloadLimit.SetRate(download)
+	c.uploadLimit.SetRate(upload)
+}
+
+// AddTorrentFile adds the torrent of a metainfo file and starts downloading it
+func (c *Client) AddTorrentFile(path string) (*Torrent, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read torrent file: %w", err)
+	}
+	return c.AddTorrent(data)
+}
+
+// AddTorrent adds the torrent of a bencoded metainfo file and starts downloading it
+func (c *Client) AddTorrent(metainfo []byte) (*Torrent, error) {
+	decoded, err := bencode.NewBencodeDecoder(metainfo).Decode()
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode torrent: %w", err)
+	}
+	dict, ok := decoded.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("expected dictionary, got %T", decoded)
+	}
+
+	torrent, err := dl.FromMetainfo(dict)
+	if err != nil {
+		return nil, err
+	}
+
+	t := newTorrent(c, torrent.InfoHash, torrent.Name)
+	if err := t.setMetainfo(dict, torrent); err != nil {
+		return nil, err
+	}
+	if err := c.add(t); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// AddMagnet adds the torrent of a magnet link, its info dictionary is downloaded from
+// peers before the files are
+func (c *Client) AddMagnet(uri string) (*Torrent, error) {
+	link, err := magnetlink.Parse(uri)
+	if err != nil {
+		return nil, err
+	}
+
+	t := newTorrent(c, link.InfoHash, link.Name)
+	for _, tracker := range link.Trackers {
+		t.trackers = append(t.trackers, []string{tracker})
+	}
+	t.addPeers(link.Peers, dl.SourceTracker)
+
+	if err := c.add(t); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (c *Client) add(t *Torrent) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return ErrClosed
+	}
+	if _, ok := c.torrents[t.infoHash]; ok {
+		return ErrTorrentExists
+	}
+	c.torrents[t.infoHash] = t
+
+	go t.run()
+	return nil
+}
+
+// Torrents returns the torrents of the client
+func (c *Client) Torrents() []*Torrent {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	torrents := make([]*Torrent, 0, len(c.torrents))
+	for _, t := range c.torrents {
+		torrents = append(torrents, t)
+	}
+	return torrents
+}
+
+// Torrent returns the torrent with an info hash
+func (c *Client) Torrent(infoHash [20]byte) (*Torrent, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	t, ok := c.torrents[infoHash]
+	return t, ok
+}
+
+// Remove stops a torrent and removes it from the client, the files downloaded so far are
+// left on disk
+func (c *Client) Remove(t *Torrent) {
+	c.mu.Lock()
+	if c.torrents[t.infoHash] == t {
+		delete(c.torrents, t.infoHash)
+	}
+	c.mu.Unlock()
+
+	t.remove()
+}
+
+// Close removes every torrent and stops listening
+func (c *Client) Close() error {
+	c.mu.Lock()
+	if !c.closed {
+		close(c.closing)
+	}
+	c.closed = true
+	torrents := make([]*Torrent, 0, len(c.torrents))
+	for _, t := range c.torrents {
+		torrents = append(torrents, t)
+	}
+	c.mu.Unlock()
+
+	for _, t := range torrents {
+		c.Remove(t)
+	}
+	c.endSubscriptions(nil)
+
+	errs := []error{c.listener.Close()}
+	if c.socket != nil {
+		errs = append(errs, c.socket.Close())
+	}
+	if c.dht != nil {
+		errs = append(errs, c.dht.Close())
+	}
+	if c.lsd != nil {
+		errs = append(errs, c.lsd.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// downloadConfig is the configuration every download of the client shares
+func (c *Client) downloadConfig() dl.Config {
+	config := dl.DefaultConfig()
+	config.PeerID = c.peerID
+	config.Port = c.config.ListenPort
+	config.MaxConnections = c.config.MaxConnections
+	config.Encryption = c.config.Encryption
+	config.Transport = c.config.Transport
+	config.UTP = c.socket
+	config.DownloadLimit = c.downloadLimit
+	config.UploadLimit = c.uploadLimit
+	// zero timeouts are replaced with the defaults by the download
+	config.DialTimeout = c.config.DialTimeout
+	config.HandshakeTimeout = c.config.HandshakeTimeout
+	config.RequestTimeout = c.config.RequestTimeout
+	return config
+}
+
+func (c *Client) trackerTimeout() time.Duration {
+	if c.config.TrackerTimeout <= 0 {
+		return tracker.DefaultTimeout
+	}
+	return c.config.TrackerTimeout
+}
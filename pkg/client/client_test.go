@@ -0,0 +1,92 @@
+package client
+
+import (
+	"crypto/sha1"
+	"errors"
+	"net/netip"
+	"testing"
+
+	"github.com/nullxDEADBEEF/bittorrent/internal/bencode"
+	dl "github.com/nullxDEADBEEF/bittorrent/internal/download"
+)
+
+// newTestClient runs a client on random ports without the DHT and local discovery
+func newTestClient(t *testing.T) *Client {
+	t.Helper()
+
+	config := DefaultConfig()
+	config.DataDir = t.TempDir()
+	config.ListenPort = 0
+	config.Transport = TransportTCP
+	config.DisableDHT = true
+	config.DisableLSD = true
+	config.DHTStateFile = ""
+	c, err := NewClient(config)
+	if err != nil {
+		t.Fatalf("failed to start client: %v", err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+// testMetainfo is a single file torrent without trackers
+func testMetainfo(t *testing.T, name string, private bool) []byte {
+	t.Helper()
+
+	data := make([]byte, 1000)
+	hash := sha1.Sum(data)
+	info := map[string]interface{}{
+		"name":         name,
+		"length":       len(data),
+		"piece length": 1 << 14,
+		"pieces":       hash[:],
+	}
+	if private {
+		info["private"] = 1
+	}
+	metainfo, err := bencode.Encode(map[string]interface{}{"info": info})
+	if err != nil {
+		t.Fatalf("failed to encode metainfo: %v", err)
+	}
+	return metainfo
+}
+
+func TestAddTorrentErrors(t *testing.T) {
+	c := newTestClient(t)
+	metainfo := testMetainfo(t, "twice", false)
+
+	if _, err := c.AddTorrent(metainfo); err != nil {
+		t.Fatalf("failed to add torrent: %v", err)
+	}
+	if torrent, err := c.AddTorrent(metainfo); torrent != nil || !errors.Is(err, ErrTorrentExists) {
+		t.Errorf("got %v and %v, want ErrTorrentExists and no torrent", torrent, err)
+	}
+
+	c.Close()
+	if torrent, err := c.AddTorrent(testMetainfo(t, "closed", false)); torrent != nil || !errors.Is(err, ErrClosed) {
+		t.Errorf("got %v and %v, want ErrClosed and no torrent", torrent, err)
+	}
+}
+
+func TestPrivateTorrentIgnoresPublicPeers(t *testing.T) {
+	c := newTestClient(t)
+	torrent, err := c.AddTorrent(testMetainfo(t, "private", true))
+	if err != nil {
+		t.Fatalf("failed to add torrent: %v", err)
+	}
+
+	public := netip.MustParseAddrPort("192.0.2.1:6881")
+	tracked := netip.MustParseAddrPort("192.0.2.2:6881")
+	torrent.addPeers([]netip.AddrPort{public}, dl.SourceDHT)
+	torrent.addPeers([]netip.AddrPort{public}, dl.SourceLSD)
+	torrent.addPeers([]netip.AddrPort{tracked}, dl.SourceTracker)
+
+	torrent.mu.Lock()
+	defer torrent.mu.Unlock()
+	if _, ok := torrent.peers[public]; ok {
+		t.Error("a private torrent took peers from the DHT or local discovery")
+	}
+	if _, ok := torrent.peers[tracked]; !ok {
+		t.Error("a private torrent did not take the peers of its trackers")
+	}
+}
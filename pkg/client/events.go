@@ -0,0 +1,266 @@
+package client
+
+import (
+	"net/netip"
+	"sync"
+
+	dl "github.com/nullxDEADBEEF/bittorrent/internal/download"
+	"github.com/nullxDEADBEEF/bittorrent/internal/tracker"
+)
+
+// Event is something that happened to a torrent, received from a Subscription. It is one
+// of PieceVerified, PieceFailed, PeerConnected, PeerDisconnected, TrackerAnnounced,
+// StateChanged and Completed
+type Event interface {
+	// Torrent is the torrent the event happened to
+	Torrent() *Torrent
+}
+
+type torrentEvent struct {
+	t *Torrent
+}
+
+func (e torrentEvent) Torrent() *Torrent {
+	return e.t
+}
+
+// PieceVerified is sent when a piece passed its hash check
+type PieceVerified struct {
+	torrentEvent
+	Index int
+}
+
+// PieceFailed is sent when a downloaded piece did not match its hash, it is downloaded
+// again
+type PieceFailed struct {
+	torrentEvent
+	Index int
+}
+
+// PeerConnected is sent once the handshake with a peer completed
+type PeerConnected struct {
+	torrentEvent
+	Peer Peer
+}
+
+// PeerDisconnected is sent when the connection to a peer ended, Err tells why
+type PeerDisconnected struct {
+	torrentEvent
+	Addr netip.AddrPort
+	Err  error
+}
+
+// TrackerAnnounced is sent after every announce of the torrent to its trackers
+type TrackerAnnounced struct {
+	torrentEvent
+	// Event is "started", "completed", "stopped" or empty for regular announces
+	Event string
+	// Peers is the number of peers the trackers returned
+	Peers int
+	// Warning is the warning message of the tracker, if any
+	Warning string
+	// Err is set when no tracker answered
+	Err error
+}
+
+// StateChanged is sent when the State of the torrent changes
+type StateChanged struct {
+	torrentEvent
+	State State
+}
+
+// Completed is sent once every file of the torrent is downloaded and written
+type Completed struct {
+	torrentEvent
+}
+
+// Subscription receives the events of a client or of one of its torrents. Events are
+// queued for every subscription, so a subscriber that falls behind never slows the
+// torrents down, it only delays its own events
+type Subscription struct {
+	c *Client
+	// torrent restricts the subscription to the events of a torrent, nil receives them all
+	torrent *Torrent
+	events  chan Event
+
+	mu    sync.Mutex
+	queue []Event
+	// wake is signaled when events are queued or the subscription ends
+	wake chan struct{}
+	// closed drops the events still queued, finished delivers them first
+	closed   bool
+	finished bool
+}
+
+// Subscribe returns a subscription to the events of every torrent of the client. It
+// ends when the client is closed
+func (c *Client) Subscribe() *Subscription {
+	return c.subscribe(nil)
+}
+
+// Subscribe returns a subscription to the events of the torrent. It ends once the
+// torrent completed, failed or was removed, after its last StateChanged event
+func (t *Torrent) Subscribe() *Subscription {
+	return t.c.subscribe(t)
+}
+
+func (c *Client) subscribe(t *Torrent) *Subscription {
+	s := &Subscription{
+		c:       c,
+		torrent: t,
+		events:  make(chan Event),
+		wake:    make(chan struct{}, 1),
+	}
+
+	c.subsMu.Lock()
+	defer c.subsMu.Unlock()
+
+	// subscribing to what already ended gets a closed channel
+	if c.subsEnded || (t != nil && t.subsEnded) {
+		s.finished = true
+		close(s.events)
+		return s
+	}
+	c.subs[s] = true
+
+	go s.deliver()
+	return s
+}
+
+// Events returns the channel events are received on, it is closed when the subscription
+// ends
+func (s *Subscription) Events() <-chan Event {
+	return s.events
+}
+
+// Close ends the subscription, the events not received yet are dropped
+func (s *Subscription) Close() {
+	s.c.subsMu.Lock()
+	delete(s.c.subs, s)
+	s.c.subsMu.Unlock()
+
+	s.mu.Lock()
+	s.closed = true
+	s.queue = nil
+	s.mu.Unlock()
+	s.signal()
+}
+
+// finish ends the subscription once the events queued so far are delivered
+func (s *Subscription) finish() {
+	s.mu.Lock()
+	s.finished = true
+	s.mu.Unlock()
+	s.signal()
+}
+
+func (s *Subscription) push(e Event) {
+	s.mu.Lock()
+	if s.closed || s.finished {
+		s.mu.Unlock()
+		return
+	}
+	s.queue = append(s.queue, e)
+	s.mu.Unlock()
+	s.signal()
+}
+
+func (s *Subscription) signal() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// deliver sends the queued events on the channel of the subscription until it ends
+func (s *Subscription) deliver() {
+	defer close(s.events)
+
+	for {
+		s.mu.Lock()
+		if s.closed || (s.finished && len(s.queue) == 0) {
+			s.mu.Unlock()
+			return
+		}
+		if len(s.queue) == 0 {
+			s.mu.Unlock()
+			<-s.wake
+			continue
+		}
+		e := s.queue[0]
+		s.queue[0] = nil
+		s.queue = s.queue[1:]
+		s.mu.Unlock()
+
+		select {
+		case s.events <- e:
+		case <-s.wake:
+			// put it back, the subscription may have been closed
+			s.mu.Lock()
+			if !s.closed {
+				s.queue = append([]Event{e}, s.queue...)
+			}
+			s.mu.Unlock()
+		}
+	}
+}
+
+// publish queues an event for the subscriptions interested in it, it never blocks
+func (c *Client) publish(e Event) {
+	c.subsMu.Lock()
+	defer c.subsMu.Unlock()
+
+	for s := range c.subs {
+		if s.torrent == nil || s.torrent == e.Torrent() {
+			s.push(e)
+		}
+	}
+}
+
+// endSubscriptions finishes the subscriptions to a torrent, or every subscription when t
+// is nil
+func (c *Client) endSubscriptions(t *Torrent) {
+	c.subsMu.Lock()
+	defer c.subsMu.Unlock()
+
+	// subscriptions made from now on end right away
+	if t == nil {
+		c.subsEnded = true
+	} else {
+		t.subsEnded = true
+	}
+	for s := range c.subs {
+		if t == nil || s.torrent == t {
+			delete(c.subs, s)
+			s.finish()
+		}
+	}
+}
+
+// downloadEvent turns an event of the download engine into one of the torrent
+func (t *Torrent) downloadEvent(e dl.Event) {
+	base := torrentEvent{t}
+	switch e := e.(type) {
+	case dl.PieceVerifiedEvent:
+		t.c.publish(PieceVerified{base, e.Index})
+	case dl.PieceFailedEvent:
+		t.c.publish(PieceFailed{base, e.Index})
+	case dl.PeerConnectedEvent:
+		t.c.publish(PeerConnected{base, Peer{Addr: e.Addr, Source: e.Source.String(), Client: e.Client.String()}})
+	case dl.PeerDisconnectedEvent:
+		t.c.publish(PeerDisconnected{base, e.Addr, e.Err})
+	}
+}
+
+// announced turns the result of an announce into an event
+func (t *Torrent) announced(event tracker.Event, resp *tracker.AnnounceResponse, err error) {
+	announced := TrackerAnnounced{torrentEvent: torrentEvent{t}, Err: err}
+	if event != tracker.EventNone {
+		announced.Event = event.String()
+	}
+	if resp != nil {
+		announced.Peers = len(resp.Peers)
+		announced.Warning = resp.Warning
+	}
+	t.c.publish(announced)
+}
@@ -0,0 +1,71 @@
+package client
+
+import (
+	"testing"
+	"time"
+)
+
+// drain receives the events of a subscription until its channel is closed
+func drain(t *testing.T, s *Subscription) []Event {
+	t.Helper()
+
+	var events []Event
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case e, ok := <-s.Events():
+			if !ok {
+				return events
+			}
+			events = append(events, e)
+		case <-timeout:
+			t.Fatal("the subscription did not end")
+			return nil
+		}
+	}
+}
+
+func TestSubscribeAfterEnd(t *testing.T) {
+	c := newTestClient(t)
+	torrent := newTorrent(c, [20]byte{1}, "ended")
+
+	// between the end of the subscriptions and Done, as a torrent that just stopped
+	c.endSubscriptions(torrent)
+	s := torrent.Subscribe()
+	select {
+	case _, ok := <-s.Events():
+		if ok {
+			t.Error("got an event after the subscriptions ended")
+		}
+	default:
+		t.Error("the subscription was not ended right away")
+	}
+	s.Close()
+
+	c.Close()
+	select {
+	case _, ok := <-c.Subscribe().Events():
+		if ok {
+			t.Error("got an event from a closed client")
+		}
+	default:
+		t.Error("the subscription to a closed client was not ended right away")
+	}
+}
+
+func TestSubscriptionEndsWithTorrent(t *testing.T) {
+	c := newTestClient(t)
+	torrent := newTorrent(c, [20]byte{2}, "ending")
+	s := torrent.Subscribe()
+
+	c.publish(StateChanged{torrentEvent{torrent}, StateStopped})
+	c.endSubscriptions(torrent)
+
+	events := drain(t, s)
+	if len(events) != 1 {
+		t.Fatalf("got %d events, want the last StateChanged", len(events))
+	}
+	if e, ok := events[0].(StateChanged); !ok || e.State != StateStopped {
+		t.Errorf("got %#v, want StateChanged", events[0])
+	}
+}
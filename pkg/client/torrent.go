@@ -0,0 +1,752 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/netip"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nullxDEADBEEF/bittorrent/internal/bencode"
+	dl "github.com/nullxDEADBEEF/bittorrent/internal/download"
+	"github.com/nullxDEADBEEF/bittorrent/internal/storage"
+	"github.com/nullxDEADBEEF/bittorrent/internal/torrent"
+	"github.com/nullxDEADBEEF/bittorrent/internal/tracker"
+)
+
+// how often the DHT is asked for more peers while a torrent runs
+const dhtInterval = 15 * time.Minute
+
+var (
+	ErrRemoved = errors.New("torrent removed")
+	ErrNoInfo  = errors.New("torrent info not downloaded yet")
+)
+
+// Priority decides whether the pieces of a file are downloaded and in which order
+type Priority = dl.Priority
+
+const (
+	PrioritySkip   = dl.PrioritySkip
+	PriorityLow    = dl.PriorityLow
+	PriorityNormal = dl.PriorityNormal
+	PriorityHigh   = dl.PriorityHigh
+)
+
+type State int
+
+const (
+	// StateMetadata torrents added from a magnet link are downloading their info
+	// dictionary from peers
+	StateMetadata State = iota
+	StateDownloading
+	// StateIdle torrents have every file left skipped, wanting one of them again resumes
+	// the download
+	StateIdle
+	StatePaused
+	StateCompleted
+	// StateStopped torrents were removed or failed, Err tells which
+	StateStopped
+)
+
+func (s State) String() string {
+	switch s {
+	case StateMetadata:
+		return "metadata"
+	case StateDownloading:
+		return "downloading"
+	case StateIdle:
+		return "idle"
+	case StatePaused:
+		return "paused"
+	case StateCompleted:
+		return "completed"
+	case StateStopped:
+		return "stopped"
+	default:
+		return fmt.Sprintf("state(%d)", int(s))
+	}
+}
+
+type Stats struct {
+	State State
+	// Length is the size of the torrent, it is 0 until the info dictionary is known
+	Length     int64
+	Downloaded int64
+	// Uploaded is the piece data sent to peers since the torrent was added
+	Uploaded int64
+	Left     int64
+	// Peers is the number of peers we are connected to
+	Peers int
+}
+
+// Peer is a peer a torrent is connected to
+type Peer struct {
+	Addr netip.AddrPort
+	// Source tells where we learned about the peer: tracker, dht, pex, lsd or incoming
+	Source string
+	// Client is the name and version of the software the peer runs, "unknown" when
+	// neither its peer id nor its extended handshake tell
+	Client string
+}
+
+// File is a file of the torrent, pad files are left out
+type File struct {
+	// Path is slash separated and relative to the directory of the torrent, the only
+	// file of a single file torrent is named after the torrent
+	Path     string
+	Length   int64
+	Priority Priority
+}
+
+// Torrent is a torrent of the client. It downloads from the moment it is added until it
+// completes, fails or is removed, which closes Done
+type Torrent struct {
+	c        *Client
+	infoHash [20]byte
+	trackers [][]string
+
+	mu       sync.Mutex
+	name     string
+	private  bool
+	desc     dl.Torrent
+	download *dl.Download
+	metadata *dl.Metadata
+	store    *storage.Storage
+	// files are the indexes of the download files we list, pad files are left out.
+	// priorities are the priorities of the download files until the download starts
+	files      []int
+	priorities []Priority
+	// peers are every peer we learned about, handed to the download once it starts
+	peers map[netip.AddrPort]dl.Source
+	// stopRun cancels the running download on pause, wake is closed and replaced on
+	// resume
+	paused    bool
+	stopRun   context.CancelFunc
+	wake      chan struct{}
+	completed bool
+	err       error
+	// state is the state last reported with StateChanged
+	state State
+	// subsEnded is set once the subscriptions to the torrent ended, it is guarded by the
+	// subsMu of the client
+	subsEnded bool
+
+	gotInfo chan struct{}
+	// ctx is cancelled when the torrent is removed or stopped running, every run derives
+	// from it
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func newTorrent(c *Client, infoHash [20]byte, name string) *Torrent {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Torrent{
+		c:        c,
+		infoHash: infoHash,
+		name:     name,
+		peers:    make(map[netip.AddrPort]dl.Source),
+		wake:     make(chan struct{}),
+		gotInfo:  make(chan struct{}),
+		ctx:      ctx,
+		cancel:   cancel,
+		done:     make(chan struct{}),
+	}
+}
+
+func (t *Torrent) InfoHash() [20]byte {
+	return t.infoHash
+}
+
+// Name returns the name of the torrent, torrents from magnet links without a display
+// name have none until their info dictionary is downloaded
+func (t *Torrent) Name() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.name
+}
+
+// GotInfo is closed once the info dictionary is known, right away for torrents added
+// from metainfo files
+func (t *Torrent) GotInfo() <-chan struct{} {
+	return t.gotInfo
+}
+
+// Done is closed once the torrent completed, failed or was removed
+func (t *Torrent) Done() <-chan struct{} {
+	return t.done
+}
+
+// Err returns why the torrent stopped, it is nil while it runs and once it completed
+func (t *Torrent) Err() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.err
+}
+
+func (t *Torrent) Stats() Stats {
+	t.mu.Lock()
+	d := t.download
+	stats := Stats{Length: int64(t.desc.Length), State: t.currentState()}
+	t.mu.Unlock()
+
+	if d != nil {
+		stats.Downloaded = d.Downloaded()
+		stats.Uploaded = d.Uploaded()
+		stats.Left = d.Left()
+		stats.Peers = d.Peers()
+	}
+	return stats
+}
+
+// currentState tells what the torrent is doing, t.mu must be held
+func (t *Torrent) currentState() State {
+	switch {
+	case t.completed:
+		return StateCompleted
+	case t.err != nil:
+		return StateStopped
+	case t.paused:
+		return StatePaused
+	case t.download == nil:
+		return StateMetadata
+	case t.download.Idle():
+		return StateIdle
+	default:
+		return StateDownloading
+	}
+}
+
+// stateChanged sends StateChanged if the state changed since it was last sent
+func (t *Torrent) stateChanged() {
+	t.mu.Lock()
+	state := t.currentState()
+	changed := state != t.state
+	t.state = state
+	t.mu.Unlock()
+
+	if changed {
+		t.c.publish(StateChanged{torrentEvent{t}, state})
+	}
+}
+
+// Peers returns the peers the torrent is connected to, sorted by address
+func (t *Torrent) Peers() []Peer {
+	t.mu.Lock()
+	d := t.download
+	t.mu.Unlock()
+	if d == nil {
+		return nil
+	}
+
+	var peers []Peer
+	for _, stats := range d.PeerStats() {
+		peers = append(peers, Peer{Addr: stats.Addr, Source: stats.Source.String(), Client: stats.Client.String()})
+	}
+	return peers
+}
+
+// Files returns the files of the torrent, nil until the info dictionary is known
+func (t *Torrent) Files() []File {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	priorities := t.priorities
+	if t.download != nil {
+		priorities = t.download.FilePriorities()
+	}
+
+	files := make([]File, 0, len(t.files))
+	for _, index := range t.files {
+		file := t.desc.Files[index]
+		path := t.name
+		if len(file.Path) > 0 {
+			path = strings.Join(file.Path, "/")
+		}
+		files = append(files, File{Path: path, Length: int64(file.Length), Priority: priorities[index]})
+	}
+	return files
+}
+
+// SetFilePriority changes the priority of a file of Files, skipped files are not created
+func (t *Torrent) SetFilePriority(file int, priority Priority) error {
+	t.mu.Lock()
+	if t.files == nil {
+		t.mu.Unlock()
+		return ErrNoInfo
+	}
+	if file < 0 || file >= len(t.files) {
+		t.mu.Unlock()
+		return fmt.Errorf("file index %d out of range", file)
+	}
+	index := t.files[file]
+
+	if t.download != nil {
+		if err := t.download.SetFilePriority(index, priority); err != nil {
+			t.mu.Unlock()
+			return err
+		}
+	}
+	t.priorities[index] = priority
+	t.mu.Unlock()
+
+	// skipping every file left makes the torrent idle
+	t.stateChanged()
+	return nil
+}
+
+// OpenFile returns a reader for a file of Files, reads block until the pieces they need
+// are downloaded and the pieces being read are downloaded first. Skipped files get
+// PriorityNormal
+func (t *Torrent) OpenFile(file int) (io.ReadSeekCloser, error) {
+	t.mu.Lock()
+	if t.download == nil {
+		t.mu.Unlock()
+		return nil, ErrNoInfo
+	}
+	if file < 0 || file >= len(t.files) {
+		t.mu.Unlock()
+		return nil, fmt.Errorf("file index %d out of range", file)
+	}
+	r, err := t.download.OpenFile(t.files[file])
+	t.mu.Unlock()
+
+	if err != nil {
+		return nil, err
+	}
+
+	// opening a skipped file resumes an idle torrent
+	t.stateChanged()
+	return r, nil
+}
+
+// Pause disconnects from every peer until Resume is called, trackers and the DHT keep
+// being announced to
+func (t *Torrent) Pause() {
+	t.mu.Lock()
+	if t.paused {
+		t.mu.Unlock()
+		return
+	}
+	t.paused = true
+	if t.stopRun != nil {
+		t.stopRun()
+		t.stopRun = nil
+	}
+	t.mu.Unlock()
+
+	t.stateChanged()
+}
+
+func (t *Torrent) Resume() {
+	t.mu.Lock()
+	if !t.paused {
+		t.mu.Unlock()
+		return
+	}
+	t.paused = false
+	close(t.wake)
+	t.wake = make(chan struct{})
+	t.mu.Unlock()
+
+	t.stateChanged()
+}
+
+// remove stops the torrent and waits for it to leave the swarm
+func (t *Torrent) remove() {
+	t.cancel()
+	<-t.done
+}
+
+// setMetainfo lays out the files of the torrent in the data directory
+func (t *Torrent) setMetainfo(metainfo map[string]interface{}, desc dl.Torrent) error {
+	info := metainfo["info"].(map[string]interface{})
+	files := torrent.Files(info)
+
+	dir := filepath.Join(t.c.config.DataDir, desc.Name)
+	if len(files) == 1 && len(files[0].Path) == 0 {
+		dir = t.c.config.DataDir
+		files[0].Path = []string{desc.Name}
+	}
+
+	storageFiles := make([]storage.File, 0, len(files))
+	for _, file := range files {
+		storageFiles = append(storageFiles, storage.File{
+			Path:       file.Path,
+			Length:     file.Length,
+			Pad:        file.Pad,
+			Executable: file.Executable,
+			Symlink:    file.Symlink,
+		})
+	}
+	store, err := storage.New(dir, storageFiles)
+	if err != nil {
+		return err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.name = desc.Name
+	t.private = desc.Private
+	t.desc = desc
+	t.store = store
+	t.files = []int{}
+	t.priorities = make([]Priority, len(files))
+	for i, file := range files {
+		t.priorities[i] = PriorityNormal
+		if !file.Pad {
+			t.files = append(t.files, i)
+		}
+	}
+	if t.trackers == nil {
+		t.trackers = torrent.AnnounceTiers(metainfo)
+	}
+	close(t.gotInfo)
+
+	return nil
+}
+
+// run takes the torrent through its life: fetching the info dictionary of a magnet link,
+// downloading the files and leaving the swarm
+func (t *Torrent) run() {
+	discoverCtx, stopDiscovery := context.WithCancel(t.ctx)
+	discovered := make(chan struct{})
+	go func() {
+		t.discover(discoverCtx)
+		close(discovered)
+	}()
+
+	err := t.fetch()
+
+	stopDiscovery()
+	<-discovered
+
+	t.mu.Lock()
+	if err == nil {
+		t.completed = true
+	} else {
+		t.err = err
+	}
+	d, store := t.download, t.store
+	t.mu.Unlock()
+
+	// readers of the files stop waiting for pieces nothing downloads anymore
+	if d != nil {
+		d.Stop()
+	}
+
+	if store != nil {
+		store.Close()
+	}
+	if err == nil {
+		t.c.publish(Completed{torrentEvent{t}})
+	}
+	t.stateChanged()
+	t.c.endSubscriptions(t)
+	t.cancel()
+	close(t.done)
+}
+
+func (t *Torrent) fetch() error {
+	select {
+	case <-t.gotInfo:
+	default:
+		if err := t.fetchMetadata(); err != nil {
+			return err
+		}
+	}
+
+	t.mu.Lock()
+	config := t.c.downloadConfig()
+	config.FilePriorities = t.priorities
+	// the download tells the storage which files it skips
+	config.Storage = t.store
+	config.OnEvent = t.downloadEvent
+	d := dl.New(t.desc, config)
+	t.download = d
+	t.metadata = nil
+	for addr, source := range t.peers {
+		// the info dictionary of a magnet link may have just told the torrent is private
+		if !t.private || privateSource(source) {
+			d.AddPeers([]netip.AddrPort{addr}, source)
+		}
+	}
+	t.mu.Unlock()
+	t.stateChanged()
+
+	t.c.listener.Add(d)
+	defer t.c.listener.Remove(d)
+
+	for {
+		ctx, ok := t.waitRunnable()
+		if !ok {
+			return ErrRemoved
+		}
+
+		err := d.Run(ctx)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, dl.ErrStopped) {
+			return err
+		}
+	}
+
+	return t.store.Finish()
+}
+
+// fetchMetadata downloads the info dictionary of a torrent added from a magnet link
+func (t *Torrent) fetchMetadata() error {
+	m := dl.NewMetadata(t.infoHash, t.c.downloadConfig())
+
+	t.mu.Lock()
+	t.metadata = m
+	for addr, source := range t.peers {
+		m.AddPeers([]netip.AddrPort{addr}, source)
+	}
+	t.mu.Unlock()
+
+	for {
+		ctx, ok := t.waitRunnable()
+		if !ok {
+			return ErrRemoved
+		}
+
+		info, err := m.Run(ctx)
+		if errors.Is(err, dl.ErrStopped) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		decoded, err := bencode.NewBencodeDecoder(info).Decode()
+		if err != nil {
+			return fmt.Errorf("failed to decode info dictionary: %w", err)
+		}
+		metainfo := map[string]interface{}{"info": decoded}
+		if layers := m.PieceLayers(); len(layers) > 0 {
+			metainfo["piece layers"] = torrent.EncodePieceLayers(layers)
+		}
+
+		desc, err := dl.FromMetainfo(metainfo)
+		if err != nil {
+			return err
+		}
+		if desc.InfoHash != t.infoHash {
+			return fmt.Errorf("info dictionary does not match the info hash of the magnet link")
+		}
+		desc.Metadata = info
+
+		return t.setMetainfo(metainfo, desc)
+	}
+}
+
+// waitRunnable blocks while the torrent is paused, it returns the context of the next
+// run, cancelled on pause and removal, or false once the torrent is removed
+func (t *Torrent) waitRunnable() (context.Context, bool) {
+	for {
+		t.mu.Lock()
+		if t.ctx.Err() != nil {
+			t.mu.Unlock()
+			return nil, false
+		}
+		if !t.paused {
+			if t.stopRun != nil {
+				t.stopRun()
+			}
+			ctx, stopRun := context.WithCancel(t.ctx)
+			t.stopRun = stopRun
+			t.mu.Unlock()
+			return ctx, true
+		}
+		wake := t.wake
+		t.mu.Unlock()
+
+		select {
+		case <-wake:
+		case <-t.ctx.Done():
+			return nil, false
+		}
+	}
+}
+
+// addPeers hands peers to the metadata download or the download, whichever runs
+func (t *Torrent) addPeers(addrs []netip.AddrPort, source dl.Source) {
+	t.mu.Lock()
+	// a lookup may still answer once a magnet link turned out to be private
+	if t.private && !privateSource(source) {
+		t.mu.Unlock()
+		return
+	}
+	for _, addr := range addrs {
+		t.peers[addr] = source
+	}
+	d, m := t.download, t.metadata
+	t.mu.Unlock()
+
+	switch {
+	case d != nil:
+		d.AddPeers(addrs, source)
+	case m != nil:
+		m.AddPeers(addrs, source)
+	}
+}
+
+// discover finds peers from the trackers, the DHT and the local network until ctx is
+// cancelled, private torrents only use their trackers. Torrents of magnet links use the
+// DHT and the local network until their info dictionary tells they are private
+func (t *Torrent) discover(ctx context.Context) {
+	t.mu.Lock()
+	trackers, private := t.trackers, t.private
+	t.mu.Unlock()
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	if len(trackers) > 0 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			t.announce(ctx, trackers)
+		}()
+	}
+
+	if private || (t.c.dht == nil && t.c.lsd == nil) {
+		<-ctx.Done()
+		return
+	}
+
+	publicCtx, stopPublic := context.WithCancel(ctx)
+	defer stopPublic()
+	go func() {
+		select {
+		case <-t.gotInfo:
+			if t.isPrivate() {
+				stopPublic()
+			}
+		case <-publicCtx.Done():
+		}
+	}()
+
+	if t.c.dht != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			t.lookupDHT(publicCtx)
+		}()
+	}
+
+	if t.c.lsd != nil {
+		t.c.lsd.Add(t.infoHash, func(addr netip.AddrPort) {
+			t.addPeers([]netip.AddrPort{addr}, dl.SourceLSD)
+		})
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-publicCtx.Done()
+			t.c.lsd.Remove(t.infoHash)
+		}()
+	}
+
+	<-ctx.Done()
+}
+
+func (t *Torrent) isPrivate() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.private
+}
+
+// privateSource reports whether private torrents (BEP 27) may use the peers of a source,
+// only their trackers and the peers connecting to us are allowed
+func privateSource(source dl.Source) bool {
+	return source == dl.SourceTracker || source == dl.SourceIncoming
+}
+
+// announce runs the announce lifecycle on the trackers of the torrent until ctx is
+// cancelled, the last announces are sent after that with a timeout of their own
+func (t *Torrent) announce(ctx context.Context, tiers [][]string) {
+	trackers := tracker.NewTrackerList(tiers)
+	trackers.Timeout = t.c.config.TrackerTimeout
+	announcer := tracker.NewAnnouncer(trackers, t.infoHash, t.c.peerID, t.c.config.ListenPort, t.trackerStats)
+	announcer.OnAnnounce(t.announced)
+	if addr, ok := tracker.LocalIPv6(); ok {
+		announcer.SetIPv6(addr)
+	}
+
+	resp, err := announcer.Start(ctx)
+	if err != nil {
+		log.Printf("Failed to announce %s: %v", t.Name(), err)
+	} else {
+		if resp.Warning != "" {
+			log.Printf("Tracker warning: %s", resp.Warning)
+		}
+		t.addPeers(peerAddrs(resp.Peers), dl.SourceTracker)
+	}
+
+	announcer.Run(ctx, func(peers []tracker.Peer) {
+		t.addPeers(peerAddrs(peers), dl.SourceTracker)
+	})
+
+	leaveCtx, cancel := context.WithTimeout(context.Background(), t.c.trackerTimeout())
+	defer cancel()
+	if stats := t.Stats(); stats.Length > 0 && stats.Left == 0 {
+		if _, err := announcer.Complete(leaveCtx); err != nil {
+			log.Printf("Failed to send completed announce: %v", err)
+		}
+	}
+	if err := announcer.Stop(leaveCtx); err != nil {
+		log.Printf("Failed to send stopped announce: %v", err)
+	}
+}
+
+// trackerStats reports our transfer counters to the trackers. Until the size of the
+// torrent is known a byte is reported left so trackers do not take us for a seed
+func (t *Torrent) trackerStats() tracker.Stats {
+	stats := t.Stats()
+	if stats.Length == 0 {
+		return tracker.Stats{Left: 1}
+	}
+	return tracker.Stats{Uploaded: stats.Uploaded, Downloaded: stats.Downloaded, Left: stats.Left}
+}
+
+// lookupDHT announces the torrent on the DHT and collects its peers, again every
+// dhtInterval
+func (t *Torrent) lookupDHT(ctx context.Context) {
+	select {
+	case <-t.c.dhtReady:
+	case <-ctx.Done():
+		return
+	}
+
+	for {
+		addrs, err := t.c.dht.Announce(t.infoHash, t.c.config.ListenPort, false)
+		if err != nil {
+			log.Printf("DHT lookup failed: %v", err)
+		} else {
+			t.addPeers(addrs, dl.SourceDHT)
+		}
+
+		timer := time.NewTimer(dhtInterval)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		}
+	}
+}
+
+func peerAddrs(peers []tracker.Peer) []netip.AddrPort {
+	addrs := make([]netip.AddrPort, 0, len(peers))
+	for _, p := range peers {
+		addrs = append(addrs, p.Addr)
+	}
+	return addrs
+}